@@ -0,0 +1,308 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	swaggerFiles "github.com/swaggo/files"
+	ginSwagger "github.com/swaggo/gin-swagger"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/backup"
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/domains"
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/feed"
+	"golang-multi-tenant/internal/jobs"
+	"golang-multi-tenant/internal/mail"
+	"golang-multi-tenant/internal/metrics"
+	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/ratelimit"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/storage"
+	"golang-multi-tenant/internal/transfer"
+	"golang-multi-tenant/internal/usage"
+	"golang-multi-tenant/internal/webhook"
+	"golang-multi-tenant/internal/worker"
+)
+
+// Server holds the configuration and dependencies shared by the handlers
+type Server struct {
+	cfg         *config.Config
+	tenants     repository.TenantStore
+	users       repository.UserRepository
+	invitations repository.InvitationRepository
+	domains     repository.DomainRepository
+	posts       repository.PostRepository
+	identities  repository.IdentityRepository
+	audit       repository.AuditRepository
+	plans       repository.PlanRepository
+	usage       repository.UsageRepository
+	webhooks    repository.WebhookRepository
+	jobs        repository.JobRepository
+	snapshots   repository.SnapshotRepository
+	tokens      *middleware.TokenService
+	resolver    *middleware.TenantResolver
+	verifier    *domains.Verifier
+	mailer      mail.Sender
+	metrics     *metrics.Metrics
+	limiter     *ratelimit.Limiter
+	meter       *usage.Meter
+	billing     *billing.Service
+	dispatcher  *webhook.Dispatcher
+	bus         *events.Bus
+	relay       *events.Relay
+	feed        *feed.Hub
+	archives    storage.Storage
+	runner      *jobs.Runner
+	transfer    *transfer.Service
+	backup      *backup.Service
+}
+
+// NewServer creates the handlers for the configuration, storing data through
+// the given repositories
+func NewServer(cfg *config.Config, repos repository.Repositories) *Server {
+	m := metrics.New(repos.Tenants, cfg.Metrics.MaxTenantLabels)
+	bus := events.NewBus()
+	archives := storage.New(cfg.Storage)
+	billingService := billing.NewService(billing.NewProvider(cfg.Billing), repos.Billing)
+	s := &Server{
+		cfg:         cfg,
+		tenants:     repos.Tenants,
+		users:       repos.Users,
+		invitations: repos.Invitations,
+		domains:     repos.Domains,
+		posts:       repos.Posts,
+		identities:  repos.Identities,
+		audit:       repos.Audit,
+		plans:       repos.Plans,
+		usage:       repos.Usage,
+		webhooks:    repos.Webhooks,
+		jobs:        repos.Jobs,
+		snapshots:   repos.Snapshots,
+		tokens:      middleware.NewTokenService(cfg.JWT),
+		resolver:    middleware.NewTenantResolver(cfg.Tenant, repos.Tenants),
+		verifier:    domains.NewVerifier(cfg.Domains),
+		mailer:      mail.NewSender(cfg.Mail),
+		metrics:     m,
+		limiter:     ratelimit.New(cfg.RateLimit, newRateLimitStore(cfg.RateLimit, repos.Tenants), m),
+		meter:       usage.NewMeter(repos.Usage, repos.Plans),
+		billing:     billingService,
+		dispatcher:  webhook.NewDispatcher(cfg.Webhooks, repos.Tenants, repos.Webhooks),
+		bus:         bus,
+		relay:       events.NewRelay(repos.Tenants, repos.Outbox, bus, time.Duration(cfg.Events.RetentionHours)*time.Hour),
+		feed:        feed.NewHub(repos.Outbox),
+		archives:    archives,
+		runner:      jobs.NewRunner(repos.Jobs, archives, time.Duration(cfg.Jobs.RetentionHours)*time.Hour),
+		transfer:    transfer.NewService(repos, archives, billingService),
+		backup:      backup.NewService(cfg.Backup, repos, archives, billingService),
+	}
+	s.dispatcher.Subscribe(bus)
+	s.transfer.Register(s.runner)
+	s.backup.Register(s.runner)
+	return s
+}
+
+// StartWorkers starts the server's background workers in g
+func (s *Server) StartWorkers(g *worker.Group) {
+	interval := time.Duration(s.cfg.Usage.FlushIntervalSeconds) * time.Second
+	g.Go("usage-meter", func(ctx context.Context) {
+		s.meter.Run(ctx, interval)
+	})
+
+	if s.cfg.Billing.Provider != "none" {
+		interval := time.Duration(s.cfg.Billing.ReportIntervalSeconds) * time.Second
+		g.Go("billing-usage", func(ctx context.Context) {
+			s.billing.Run(ctx, interval)
+		})
+	}
+
+	relayInterval := time.Duration(s.cfg.Events.PollIntervalSeconds) * time.Second
+	g.Go("event-relay", func(ctx context.Context) {
+		s.relay.Run(ctx, relayInterval)
+	})
+
+	pollInterval := time.Duration(s.cfg.Webhooks.PollIntervalSeconds) * time.Second
+	g.Go("webhook-dispatcher", func(ctx context.Context) {
+		s.dispatcher.Run(ctx, pollInterval)
+	})
+
+	jobsInterval := time.Duration(s.cfg.Jobs.PollIntervalSeconds) * time.Second
+	g.Go("job-runner", func(ctx context.Context) {
+		s.runner.Run(ctx, jobsInterval)
+	})
+
+	g.Go("snapshot-retention", func(ctx context.Context) {
+		s.backup.Run(ctx)
+	})
+}
+
+// newRateLimitStore creates the configured rate limit backend, nil if rate
+// limiting is disabled
+func newRateLimitStore(cfg config.RateLimitConfig, tenants repository.TenantStore) ratelimit.Store {
+	switch cfg.Backend {
+	case "memory":
+		return ratelimit.NewMemoryStore()
+	case "postgres":
+		return ratelimit.NewPostgresStore(tenants.MainDB())
+	default:
+		return nil
+	}
+}
+
+// Router creates the Gin engine serving the API
+func (s *Server) Router() *gin.Engine {
+	r := gin.New()
+	r.Use(otelgin.Middleware(s.cfg.Tracing.ServiceName))
+	r.Use(middleware.RequestID())
+	r.Use(middleware.AccessLog())
+	r.Use(middleware.Recovery())
+	r.Use(s.metrics.Middleware())
+	r.Use(audit.Middleware(s.audit))
+
+	// Configure CORS
+	corsConfig := cors.DefaultConfig()
+	corsConfig.AllowOrigins = []string{"*"} // Allow all origins not recommended for production
+	corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
+	corsConfig.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization", middleware.TenantHeader, middleware.AdminKeyHeader, middleware.RequestIDHeader, "traceparent", "tracestate"}
+	corsConfig.ExposeHeaders = []string{middleware.RequestIDHeader, ratelimit.LimitHeader, ratelimit.RemainingHeader, ratelimit.ResetHeader, ratelimit.RetryAfterHeader}
+	corsConfig.AllowCredentials = true
+	r.Use(cors.New(corsConfig))
+
+	// Swagger endpoint
+	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+
+	// Health checks and platform administration don't belong to a tenant
+	r.GET("/healthz", s.Healthz)
+	r.GET("/readyz", s.Readyz)
+	r.GET("/metrics", gin.WrapH(s.metrics.Handler()))
+	r.POST("/billing/webhook", s.BillingWebhook)
+
+	platformAdmin := r.Group("/admin")
+	platformAdmin.Use(middleware.RequireAdminKey(s.cfg.Admin.APIKey), s.limiter.APIKey(middleware.AdminKeyHeader))
+	{
+		platformAdmin.GET("/tenants/:id/health", s.TenantHealth)
+		platformAdmin.GET("/audit", s.GetPlatformAuditEvents)
+		platformAdmin.GET("/audit/verify", s.VerifyPlatformAuditLog)
+		platformAdmin.GET("/plans", s.GetPlans)
+		platformAdmin.PUT("/plans/:name", s.UpdatePlan)
+		platformAdmin.PUT("/tenants/:id/plan", s.AssignTenantPlan)
+		platformAdmin.PUT("/tenants/:id/template", s.SetTenantTemplate)
+		platformAdmin.GET("/tenants/:id/usage", s.GetTenantUsage)
+		platformAdmin.POST("/tenants/:id/export", s.ExportTenant)
+		platformAdmin.GET("/tenants/:id/exports/:job_id", s.GetExport)
+		platformAdmin.GET("/tenants/:id/exports/:job_id/archive", s.DownloadExport)
+		platformAdmin.POST("/tenants/import", s.ImportTenant)
+		platformAdmin.GET("/tenants/imports/:job_id", s.GetImport)
+		platformAdmin.POST("/tenants/:id/snapshots", s.CreateSnapshot)
+		platformAdmin.GET("/tenants/:id/snapshots", s.GetSnapshots)
+		platformAdmin.GET("/tenants/:id/snapshots/:snapshot_id", s.GetSnapshot)
+		platformAdmin.DELETE("/tenants/:id/snapshots/:snapshot_id", s.DeleteSnapshot)
+		platformAdmin.POST("/tenants/:id/snapshots/:snapshot_id/restore", s.RestoreSnapshot)
+		platformAdmin.GET("/jobs/:job_id", s.GetJob)
+	}
+
+	// Resolve tenant from custom domain, subdomain, X-Tenant header or /t/:slug path prefix
+	r.Use(s.resolver.Middleware())
+	r.Use(s.resolver.RequireActiveTenant())
+	r.Use(s.limiter.Tenant())
+	r.Use(s.meter.Middleware())
+
+	// Platform routes
+	r.POST("/tenants", s.CreateTenant)
+
+	// Tenant routes, optionally also served under the /t/:slug path prefix
+	s.registerTenantRoutes(&r.RouterGroup)
+	if s.resolver.StrategyEnabled(middleware.TenantStrategyPath) {
+		s.registerTenantRoutes(r.Group("/t/:slug"))
+	}
+
+	return r
+}
+
+// registerTenantRoutes registers the routes that operate within a tenant
+func (s *Server) registerTenantRoutes(rg *gin.RouterGroup) {
+	// Public routes
+	rg.POST("/register", s.Register)
+	rg.POST("/login", s.Login)
+	rg.POST("/invitations/:token/accept", s.AcceptInvitation)
+	rg.POST("/verify-email", s.VerifyEmail)
+
+	// Protected routes
+	protected := rg.Group("/")
+	protected.Use(middleware.AuthMiddleware(s.tokens, s.users, s.metrics), s.resolver.RequireActiveTenant(), s.limiter.Tenant(), s.meter.Middleware(), s.limiter.User())
+	{
+		protected.GET("/me", s.Me)
+		protected.PATCH("/me", s.UpdateMe)
+		protected.POST("/me/password", s.ChangePassword)
+		protected.POST("/me/email-verification", s.RequestEmailVerification)
+		protected.GET("/me/tenants", s.GetMyTenants)
+		protected.POST("/token/switch-tenant", s.SwitchTenant)
+		protected.GET("/users/:id", s.GetUser)
+
+		// Post routes
+		protected.POST("/posts", s.CreatePost)
+		protected.GET("/posts", s.GetPosts)
+		protected.GET("/posts/:id", s.GetPost)
+		protected.PUT("/posts/:id", s.UpdatePost)
+		protected.DELETE("/posts/:id", s.DeletePost)
+	}
+
+	// Streaming routes, also authenticated by a token in the query string as
+	// EventSource and browser WebSockets can't send headers
+	streaming := rg.Group("/")
+	streaming.Use(middleware.QueryToken(), middleware.AuthMiddleware(s.tokens, s.users, s.metrics), s.resolver.RequireActiveTenant(), s.limiter.Tenant(), s.meter.Middleware(), s.limiter.User())
+	{
+		streaming.GET("/posts/stream", s.StreamPosts)
+		streaming.GET("/posts/ws", s.PostsWebSocket)
+	}
+
+	// Tenant admin routes
+	admin := protected.Group("/")
+	admin.Use(middleware.RequireRole(models.RoleAdmin))
+	{
+		// User management routes
+		admin.GET("/users", s.GetUsers)
+		admin.PATCH("/users/:id", s.UpdateUser)
+		admin.DELETE("/users/:id", s.DeleteUser)
+
+		// Invitation routes
+		admin.POST("/invitations", s.CreateInvitation)
+		admin.GET("/invitations", s.GetInvitations)
+		admin.DELETE("/invitations/:id", s.DeleteInvitation)
+
+		// Tenant settings routes
+		admin.GET("/settings", s.GetSettings)
+		admin.PATCH("/settings", s.UpdateSettings)
+
+		// Custom domain routes
+		admin.POST("/domains", s.CreateDomain)
+		admin.GET("/domains", s.GetDomains)
+		admin.POST("/domains/:id/verify", s.VerifyDomain)
+		admin.DELETE("/domains/:id", s.DeleteDomain)
+
+		// Audit log routes
+		admin.GET("/audit", s.GetAuditEvents)
+		admin.GET("/audit/verify", s.VerifyAuditLog)
+
+		// Usage routes
+		admin.GET("/tenants/:id/usage", s.GetTenantUsage)
+
+		// Export routes
+		admin.POST("/tenants/:id/export", s.ExportTenant)
+		admin.GET("/tenants/:id/exports/:job_id", s.GetExport)
+		admin.GET("/tenants/:id/exports/:job_id/archive", s.DownloadExport)
+
+		// Webhook routes
+		admin.POST("/webhooks", s.CreateWebhook)
+		admin.GET("/webhooks", s.GetWebhooks)
+		admin.DELETE("/webhooks/:id", s.DeleteWebhook)
+		admin.GET("/webhooks/:id/deliveries", s.GetWebhookDeliveries)
+		admin.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", s.RedeliverWebhook)
+	}
+}
@@ -0,0 +1,3022 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/websocket"
+
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/billingtest"
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/domains"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/ratelimit"
+	"golang-multi-tenant/internal/repository/memory"
+	"golang-multi-tenant/internal/tracing"
+	"golang-multi-tenant/internal/transfer"
+	"golang-multi-tenant/internal/webhook"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Cheap hashes keep the suite fast
+	models.InitPasswordHasher(config.PasswordConfig{HashAlgorithm: models.AlgorithmBcrypt, BcryptCost: bcrypt.MinCost})
+	models.RegisterValidators()
+
+	os.Exit(m.Run())
+}
+
+// testServer is an API server backed by the memory store
+type testServer struct {
+	t      *testing.T
+	store  *memory.Store
+	server *Server
+	router http.Handler
+	mail   *mailRecorder
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerWithConfig(t, nil)
+}
+
+// newTestServerWithConfig creates a test server after letting configure
+// change the test configuration
+func newTestServerWithConfig(t *testing.T, configure func(cfg *config.Config)) *testServer {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.JWT.SecretKey = "test-secret-key"
+	cfg.Tenant.BaseDomain = "example.com"
+	cfg.Admin.APIKey = "test-admin-key"
+	cfg.Storage.Dir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+
+	store := memory.New()
+	server := NewServer(cfg, store.Repositories())
+	mail := &mailRecorder{}
+	server.mailer = mail
+	return &testServer{
+		t:      t,
+		store:  store,
+		server: server,
+		router: server.Router(),
+		mail:   mail,
+	}
+}
+
+// mailRecorder records the emails sent by the test server
+type mailRecorder struct {
+	mu   sync.Mutex
+	sent []sentMail
+}
+
+type sentMail struct {
+	to, subject, body string
+}
+
+func (m *mailRecorder) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, sentMail{to, subject, body})
+	return nil
+}
+
+// token returns the token of the last email sent to the address, empty if
+// none was sent
+func (m *mailRecorder) token(to string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].to != to {
+			continue
+		}
+		_, after, ok := strings.Cut(m.sent[i].body, "with the token ")
+		if !ok {
+			return ""
+		}
+		token, _, _ := strings.Cut(after, "\n")
+		return token
+	}
+	return ""
+}
+
+// request sends a request and decodes the JSON response into out, if not nil.
+// headers are given as name, value pairs.
+func (ts *testServer) request(method, path string, body interface{}, out interface{}, headers ...string) int {
+	ts.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i] == "Host" {
+			req.Host = headers[i+1]
+			continue
+		}
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			ts.t.Fatalf("%s %s: decoding response %q: %v", method, path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+// createTenant creates a tenant and fails the test if that isn't possible
+func (ts *testServer) createTenant(name, slug string) models.Tenant {
+	ts.t.Helper()
+
+	var tenant models.Tenant
+	if code := ts.request(http.MethodPost, "/tenants", gin.H{"name": name, "slug": slug}, &tenant); code != http.StatusCreated {
+		ts.t.Fatalf("creating tenant %s: status %d", slug, code)
+	}
+	return tenant
+}
+
+// register registers a user in the tenant and returns their token
+func (ts *testServer) register(slug, email, password string) string {
+	ts.t.Helper()
+
+	var resp struct{ Token string }
+	code := ts.request(http.MethodPost, "/register", gin.H{"email": email, "password": password}, &resp, middleware.TenantHeader, slug)
+	if code != http.StatusCreated {
+		ts.t.Fatalf("registering %s in %s: status %d", email, slug, code)
+	}
+	return resp.Token
+}
+
+// verifyEmail verifies the email of a user of the tenant with the token
+// emailed to them, linking them to the global identity with that email
+func (ts *testServer) verifyEmail(slug, email string) {
+	ts.t.Helper()
+
+	token := ts.mail.token(email)
+	code := ts.request(http.MethodPost, "/verify-email", gin.H{"token": token}, nil, middleware.TenantHeader, slug)
+	if code != http.StatusOK {
+		ts.t.Fatalf("verifying %s in %s: status %d", email, slug, code)
+	}
+}
+
+// login signs a user in to the tenant and returns their token
+func (ts *testServer) login(slug, email, password string) string {
+	ts.t.Helper()
+
+	var resp struct{ Token string }
+	code := ts.request(http.MethodPost, "/login", gin.H{"email": email, "password": password}, &resp, middleware.TenantHeader, slug)
+	if code != http.StatusOK {
+		ts.t.Fatalf("signing %s in to %s: status %d", email, slug, code)
+	}
+	return resp.Token
+}
+
+func bearer(token string) string {
+	return "Bearer " + token
+}
+
+func TestCreateTenant(t *testing.T) {
+	ts := newTestServer(t)
+
+	var tenant models.Tenant
+	code := ts.request(http.MethodPost, "/tenants", gin.H{"name": "Acme Corp"}, &tenant)
+	if code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+	}
+	if tenant.ID == 0 || tenant.Name != "Acme Corp" || tenant.Slug != "acme-corp" {
+		t.Errorf("tenant = %+v, want Acme Corp with the derived slug acme-corp", tenant)
+	}
+
+	tests := []struct {
+		name string
+		body gin.H
+		want int
+	}{
+		{"duplicate name", gin.H{"name": "Acme Corp", "slug": "other"}, http.StatusConflict},
+		{"duplicate slug", gin.H{"name": "Other", "slug": "acme-corp"}, http.StatusConflict},
+		{"invalid slug", gin.H{"name": "Other", "slug": "Not A Slug"}, http.StatusBadRequest},
+		{"missing name", gin.H{"slug": "other"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(http.MethodPost, "/tenants", tt.body, nil); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+
+	// The first user becomes the tenant admin, later ones are members
+	ts.register("acme", "admin@acme.com", "password123")
+	ts.register("acme", "member@acme.com", "password123")
+
+	for email, role := range map[string]string{"admin@acme.com": models.RoleAdmin, "member@acme.com": models.RoleMember} {
+		user, err := ts.store.UserByEmail(context.Background(), tenant.ID, email)
+		if err != nil {
+			t.Fatalf("looking up %s: %v", email, err)
+		}
+		if user.Role != role {
+			t.Errorf("role of %s = %q, want %q", email, user.Role, role)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		body    gin.H
+		headers []string
+		want    int
+	}{
+		{"existing user", gin.H{"email": "admin@acme.com", "password": "password123"}, []string{middleware.TenantHeader, "acme"}, http.StatusConflict},
+		{"weak password", gin.H{"email": "new@acme.com", "password": "short"}, []string{middleware.TenantHeader, "acme"}, http.StatusBadRequest},
+		{"invalid email", gin.H{"email": "not-an-email", "password": "password123"}, []string{middleware.TenantHeader, "acme"}, http.StatusBadRequest},
+		{"no tenant", gin.H{"email": "new@acme.com", "password": "password123"}, nil, http.StatusBadRequest},
+		{"unknown tenant", gin.H{"email": "new@acme.com", "password": "password123"}, []string{middleware.TenantHeader, "unknown"}, http.StatusNotFound},
+		{"unknown tenant ID", gin.H{"tenant_id": 42, "email": "new@acme.com", "password": "password123"}, nil, http.StatusBadRequest},
+		{"mismatched tenant ID", gin.H{"tenant_id": 42, "email": "new@acme.com", "password": "password123"}, []string{middleware.TenantHeader, "acme"}, http.StatusBadRequest},
+		{"body tenant ID only", gin.H{"tenant_id": tenant.ID, "email": "legacy@acme.com", "password": "password123"}, nil, http.StatusBadRequest},
+		{"matching tenant ID", gin.H{"tenant_id": tenant.ID, "email": "legacy@acme.com", "password": "password123"}, []string{middleware.TenantHeader, "acme"}, http.StatusCreated},
+		{"subdomain", gin.H{"email": "sub@acme.com", "password": "password123"}, []string{"Host", "acme.example.com"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(http.MethodPost, "/register", tt.body, nil, tt.headers...); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	t.Run("password policy message", func(t *testing.T) {
+		var resp struct{ Error string }
+		body := gin.H{"email": "new@acme.com", "password": "abcdefghij"}
+		if code := ts.request(http.MethodPost, "/register", body, &resp, middleware.TenantHeader, "acme"); code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", code, http.StatusBadRequest)
+		}
+		if want := models.DefaultPasswordPolicy.Check("abcdefghij").Error(); resp.Error != want {
+			t.Errorf("error = %q, want %q", resp.Error, want)
+		}
+	})
+
+	t.Run("path prefix", func(t *testing.T) {
+		body := gin.H{"email": "path@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/t/acme/register", body, nil); code != http.StatusCreated {
+			t.Errorf("status = %d, want %d", code, http.StatusCreated)
+		}
+	})
+
+	t.Run("invite only", func(t *testing.T) {
+		settings := &models.TenantSettings{RegistrationMode: models.RegistrationInviteOnly}
+		if err := ts.store.UpdateTenantSettings(context.Background(), tenant.ID, settings); err != nil {
+			t.Fatal(err)
+		}
+		body := gin.H{"email": "late@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/register", body, nil, middleware.TenantHeader, "acme"); code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("domain restricted", func(t *testing.T) {
+		settings := &models.TenantSettings{RegistrationMode: models.RegistrationDomainRestricted, AllowedEmailDomains: []string{"acme.com"}}
+		if err := ts.store.UpdateTenantSettings(context.Background(), tenant.ID, settings); err != nil {
+			t.Fatal(err)
+		}
+		register := func(email string) (int, string) {
+			var resp struct{ Token string }
+			code := ts.request(http.MethodPost, "/register", gin.H{"email": email, "password": "password123"}, &resp, middleware.TenantHeader, "acme")
+			return code, resp.Token
+		}
+		login := func(email string) int {
+			return ts.request(http.MethodPost, "/login", gin.H{"email": email, "password": "password123"}, nil, middleware.TenantHeader, "acme")
+		}
+
+		if code, _ := register("mallory@example.com"); code != http.StatusForbidden {
+			t.Errorf("other domain: status = %d, want %d", code, http.StatusForbidden)
+		}
+
+		// Users of approved domains can't sign in until they verify their email
+		if code, token := register("carol@acme.com"); code != http.StatusCreated || token != "" {
+			t.Fatalf("approved domain: status = %d, token = %q, want %d without a token", code, token, http.StatusCreated)
+		}
+		if code := login("carol@acme.com"); code != http.StatusForbidden {
+			t.Errorf("login before verifying: status = %d, want %d", code, http.StatusForbidden)
+		}
+		ts.verifyEmail("acme", "carol@acme.com")
+		if code := login("carol@acme.com"); code != http.StatusOK {
+			t.Errorf("login after verifying: status = %d, want %d", code, http.StatusOK)
+		}
+
+		// Knowing the password of the global account with the email proves it
+		ts.createTenant("Globex", "globex")
+		ts.register("globex", "dave@acme.com", "password123")
+		ts.verifyEmail("globex", "dave@acme.com")
+		if code, token := register("dave@acme.com"); code != http.StatusCreated || token == "" {
+			t.Errorf("global account's password: status = %d, token = %q, want %d with a token", code, token, http.StatusCreated)
+		}
+
+		// Users the admin deactivates in the meantime stay deactivated
+		register("erin@acme.com")
+		erin, err := ts.store.UserByEmail(context.Background(), tenant.ID, "erin@acme.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.login("acme", "admin@acme.com", "password123"))}
+		if code := ts.request(http.MethodPatch, fmt.Sprintf("/users/%d", erin.ID), gin.H{"active": false}, nil, admin...); code != http.StatusOK {
+			t.Fatalf("deactivating: status = %d, want %d", code, http.StatusOK)
+		}
+		if code := ts.request(http.MethodPost, "/verify-email", gin.H{"token": ts.mail.token("erin@acme.com")}, nil, middleware.TenantHeader, "acme"); code != http.StatusNotFound {
+			t.Errorf("verifying after deactivation: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := login("erin@acme.com"); code != http.StatusForbidden {
+			t.Errorf("login of the deactivated user: status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestLogin(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+	ts.register("acme", "user@acme.com", "password123")
+
+	var resp struct{ Token string }
+	code := ts.request(http.MethodPost, "/login", gin.H{"email": "user@acme.com", "password": "password123"}, &resp, middleware.TenantHeader, "acme")
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if resp.Token == "" {
+		t.Fatal("no token in the login response")
+	}
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     int
+	}{
+		{"wrong password", "user@acme.com", "wrong-password", http.StatusUnauthorized},
+		{"unknown user", "nobody@acme.com", "password123", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := gin.H{"email": tt.email, "password": tt.password}
+			if code := ts.request(http.MethodPost, "/login", body, nil, middleware.TenantHeader, "acme"); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	t.Run("deactivated", func(t *testing.T) {
+		user, err := ts.store.UserByEmail(context.Background(), tenant.ID, "user@acme.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.store.SetUserActive(tenant.ID, user.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		defer ts.store.SetUserActive(tenant.ID, user.ID, true)
+
+		body := gin.H{"email": "user@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/login", body, nil, middleware.TenantHeader, "acme"); code != http.StatusForbidden {
+			t.Errorf("login status = %d, want %d", code, http.StatusForbidden)
+		}
+		// Tokens issued before the deactivation stop working too
+		if code := ts.request(http.MethodGet, "/me", nil, nil, "Authorization", bearer(resp.Token)); code != http.StatusUnauthorized {
+			t.Errorf("/me status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestMe(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+	token := ts.register("acme", "user@acme.com", "password123")
+
+	var me struct {
+		UserID   int    `json:"user_id"`
+		TenantID int    `json:"tenant_id"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}
+	if code := ts.request(http.MethodGet, "/me", nil, &me, "Authorization", bearer(token)); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if me.UserID != 1 || me.TenantID != tenant.ID || me.Email != "user@acme.com" || me.Role != models.RoleAdmin {
+		t.Errorf("me = %+v, want the tenant's admin user@acme.com", me)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+	}{
+		{"no token", ""},
+		{"malformed token", bearer("not-a-token")},
+		{"token signed with another key", bearer(forgeToken(t, me.UserID, me.TenantID, me.Email))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(http.MethodGet, "/me", nil, nil, "Authorization", tt.authorization); code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestInvitations(t *testing.T) {
+	ts := newTestServer(t)
+	acme := ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	admin := []string{"Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	member := []string{"Authorization", bearer(ts.register("acme", "member@acme.com", "password123"))}
+
+	invite := func(email string) models.Invitation {
+		t.Helper()
+		var inv models.Invitation
+		body := gin.H{"email": email, "role": models.RoleAdmin}
+		if code := ts.request(http.MethodPost, "/invitations", body, &inv, admin...); code != http.StatusCreated {
+			t.Fatalf("inviting %s: status = %d, want %d", email, code, http.StatusCreated)
+		}
+		return inv
+	}
+	accept := func(slug, token string) int {
+		return ts.request(http.MethodPost, "/invitations/"+token+"/accept", gin.H{"password": "password123"}, nil, middleware.TenantHeader, slug)
+	}
+	pending := func() []models.Invitation {
+		t.Helper()
+		var invitations []models.Invitation
+		if code := ts.request(http.MethodGet, "/invitations", nil, &invitations, admin...); code != http.StatusOK {
+			t.Fatalf("listing invitations: status = %d, want %d", code, http.StatusOK)
+		}
+		return invitations
+	}
+
+	bob := invite("bob@acme.com")
+	if bob.Token == "" || ts.mail.token("bob@acme.com") != bob.Token {
+		t.Errorf("invitation token %q isn't the one emailed to the invitee", bob.Token)
+	}
+	if p := pending(); len(p) != 1 || p[0].Email != "bob@acme.com" || p[0].Token != "" {
+		t.Errorf("pending invitations = %+v, want Bob's without its token", p)
+	}
+	if code := ts.request(http.MethodPost, "/invitations", gin.H{"email": "carol@acme.com"}, nil, member...); code != http.StatusForbidden {
+		t.Errorf("member inviting: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := ts.request(http.MethodPost, "/invitations", gin.H{"email": "member@acme.com"}, nil, admin...); code != http.StatusConflict {
+		t.Errorf("inviting an existing user: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	t.Run("invitations are single-use", func(t *testing.T) {
+		if code := accept("globex", bob.Token); code != http.StatusNotFound {
+			t.Errorf("accepting in another tenant: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := accept("acme", "not-a-token"); code != http.StatusNotFound {
+			t.Errorf("accepting an unknown token: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := accept("acme", bob.Token); code != http.StatusCreated {
+			t.Fatalf("accepting: status = %d, want %d", code, http.StatusCreated)
+		}
+		user, err := ts.store.UserByEmail(context.Background(), acme.ID, "bob@acme.com")
+		if err != nil || user.Role != models.RoleAdmin {
+			t.Errorf("invitee = %+v, %v, want an admin", user, err)
+		}
+		if code := accept("acme", bob.Token); code != http.StatusNotFound {
+			t.Errorf("accepting again: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if p := pending(); len(p) != 0 {
+			t.Errorf("pending invitations = %+v, want none", p)
+		}
+	})
+
+	t.Run("invitations expire", func(t *testing.T) {
+		carol := invite("carol@acme.com")
+		if err := ts.store.ExpireInvitation(acme.ID, carol.ID); err != nil {
+			t.Fatal(err)
+		}
+		if code := accept("acme", carol.Token); code != http.StatusNotFound {
+			t.Errorf("accepting an expired invitation: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if p := pending(); len(p) != 0 {
+			t.Errorf("pending invitations = %+v, want the expired one left out", p)
+		}
+	})
+
+	t.Run("invitations can be revoked", func(t *testing.T) {
+		dave := invite("dave@acme.com")
+		path := fmt.Sprintf("/invitations/%d", dave.ID)
+		if code := ts.request(http.MethodDelete, path, nil, nil, admin...); code != http.StatusNoContent {
+			t.Fatalf("revoking: status = %d, want %d", code, http.StatusNoContent)
+		}
+		if code := ts.request(http.MethodDelete, path, nil, nil, admin...); code != http.StatusNotFound {
+			t.Errorf("revoking again: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := accept("acme", dave.Token); code != http.StatusNotFound {
+			t.Errorf("accepting a revoked invitation: status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
+
+// txtRecords is a TXT resolver serving fixed records
+type txtRecords map[string][]string
+
+func (r txtRecords) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r[name], nil
+}
+
+func TestCustomDomains(t *testing.T) {
+	// The HTTP challenge stub serves the tokens published so far
+	var mu sync.Mutex
+	published := map[string]bool{}
+	challenges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.URL.Path, domains.HTTPChallengePath)
+		mu.Lock()
+		defer mu.Unlock()
+		if !published[r.Host+"/"+token] {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, token)
+	}))
+	defer challenges.Close()
+
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Domains.ChallengeHTTPAddr = challenges.Listener.Addr().String()
+	})
+	records := txtRecords{}
+	ts.server.verifier.Resolver = records
+
+	ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	acme := []string{"Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	globex := []string{"Authorization", bearer(ts.register("globex", "admin@globex.com", "password123"))}
+
+	addDomain := func(auth []string, domain, method string) models.TenantDomain {
+		t.Helper()
+		var d models.TenantDomain
+		code := ts.request(http.MethodPost, "/domains", gin.H{"domain": domain, "verification_method": method}, &d, auth...)
+		if code != http.StatusCreated || d.Challenge == nil || d.Challenge.Value == "" {
+			t.Fatalf("adding %s: status = %d, domain = %+v, want it with its challenge", domain, code, d)
+		}
+		return d
+	}
+	verify := func(auth []string, d models.TenantDomain) int {
+		return ts.request(http.MethodPost, fmt.Sprintf("/domains/%d/verify", d.ID), nil, nil, auth...)
+	}
+	login := func(host, email string) int {
+		body := gin.H{"email": email, "password": "password123"}
+		return ts.request(http.MethodPost, "/login", body, nil, "Host", host)
+	}
+
+	www := addDomain(acme, "WWW.Acme-Corp.test.", domains.MethodHTTP)
+	if www.Domain != "www.acme-corp.test" || www.Verified {
+		t.Errorf("domain = %+v, want the unverified www.acme-corp.test", www)
+	}
+	for name, body := range map[string]gin.H{
+		"platform domain": {"domain": "shop.example.com", "verification_method": domains.MethodDNS},
+		"unknown method":  {"domain": "shop.acme-corp.test", "verification_method": "email"},
+	} {
+		if code := ts.request(http.MethodPost, "/domains", body, nil, acme...); code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", name, code, http.StatusBadRequest)
+		}
+	}
+	if code := ts.request(http.MethodPost, "/domains", gin.H{"domain": "www.acme-corp.test", "verification_method": domains.MethodDNS}, nil, acme...); code != http.StatusConflict {
+		t.Errorf("adding the domain twice: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	// Unverified domains don't route, and the challenge must be published
+	if code := login("www.acme-corp.test", "admin@acme.com"); code != http.StatusBadRequest {
+		t.Errorf("login through the unverified domain: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := verify(acme, www); code != http.StatusUnprocessableEntity {
+		t.Errorf("verifying before publishing the challenge: status = %d, want %d", code, http.StatusUnprocessableEntity)
+	}
+	if code := verify(globex, www); code != http.StatusNotFound {
+		t.Errorf("verifying another tenant's domain: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	mu.Lock()
+	published["www.acme-corp.test/"+www.Challenge.Value] = true
+	mu.Unlock()
+	if code := verify(acme, www); code != http.StatusOK {
+		t.Fatalf("verifying the published HTTP challenge: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := login("www.acme-corp.test", "admin@acme.com"); code != http.StatusOK {
+		t.Errorf("login through the verified domain: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := login("www.acme-corp.test", "admin@globex.com"); code != http.StatusUnauthorized {
+		t.Errorf("Globex login through Acme's domain: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// A domain verified by one tenant can't be verified by another
+	taken := addDomain(globex, "www.acme-corp.test", domains.MethodDNS)
+	records[domains.DNSChallengePrefix+"www.acme-corp.test"] = []string{taken.Challenge.Value}
+	if code := verify(globex, taken); code != http.StatusConflict {
+		t.Errorf("verifying a domain verified by another tenant: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	apex := addDomain(globex, "globex.test", domains.MethodDNS)
+	records[domains.DNSChallengePrefix+"globex.test"] = []string{"unrelated", apex.Challenge.Value}
+	if code := verify(globex, apex); code != http.StatusOK {
+		t.Fatalf("verifying the published TXT challenge: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := login("globex.test", "admin@globex.com"); code != http.StatusOK {
+		t.Errorf("login through Globex's domain: status = %d, want %d", code, http.StatusOK)
+	}
+
+	// Removed domains stop routing
+	if code := ts.request(http.MethodDelete, fmt.Sprintf("/domains/%d", www.ID), nil, nil, globex...); code != http.StatusNotFound {
+		t.Errorf("removing another tenant's domain: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := ts.request(http.MethodDelete, fmt.Sprintf("/domains/%d", www.ID), nil, nil, acme...); code != http.StatusNoContent {
+		t.Fatalf("removing the domain: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := login("www.acme-corp.test", "admin@acme.com"); code != http.StatusBadRequest {
+		t.Errorf("login through the removed domain: status = %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	ts.createTenant("Initech", "initech")
+	token := ts.register("acme", "alice@example.com", "password123")
+	auth := []string{"Authorization", bearer(token)}
+
+	memberships := func(token string) []models.TenantMembership {
+		t.Helper()
+		var memberships []models.TenantMembership
+		if code := ts.request(http.MethodGet, "/me/tenants", nil, &memberships, "Authorization", bearer(token)); code != http.StatusOK {
+			t.Fatalf("listing memberships: status = %d, want %d", code, http.StatusOK)
+		}
+		return memberships
+	}
+	verify := func(slug, token string) int {
+		return ts.request(http.MethodPost, "/verify-email", gin.H{"token": token}, nil, middleware.TenantHeader, slug)
+	}
+
+	// Registering doesn't create a global identity until the email is verified
+	if m := memberships(token); len(m) != 0 {
+		t.Fatalf("memberships = %+v, want none before the email is verified", m)
+	}
+	first := ts.mail.token("alice@example.com")
+	if first == "" {
+		t.Fatal("no verification emailed on registration")
+	}
+	if code := ts.request(http.MethodPost, "/me/email-verification", nil, nil, auth...); code != http.StatusAccepted {
+		t.Fatalf("requesting another verification: status = %d, want %d", code, http.StatusAccepted)
+	}
+	second := ts.mail.token("alice@example.com")
+
+	tests := []struct {
+		name  string
+		slug  string
+		token string
+	}{
+		{"unknown token", "acme", "not-a-token"},
+		{"replaced token", "acme", first},
+		{"token of another tenant", "globex", second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := verify(tt.slug, tt.token); code != http.StatusNotFound {
+				t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+			}
+		})
+	}
+
+	if code := verify("acme", second); code != http.StatusOK {
+		t.Fatalf("verifying: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := verify("acme", second); code != http.StatusNotFound {
+		t.Errorf("verifying again: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if m := memberships(token); len(m) != 1 || m[0].Slug != "acme" {
+		t.Errorf("memberships = %+v, want Acme", m)
+	}
+	if code := ts.request(http.MethodPost, "/me/email-verification", nil, nil, auth...); code != http.StatusConflict {
+		t.Errorf("requesting a verification when linked: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	t.Run("registering with someone else's email", func(t *testing.T) {
+		// The response doesn't tell Mallory that the email has a global account
+		var resp struct{ Message string }
+		body := gin.H{"email": "alice@example.com", "password": "other-password1"}
+		code := ts.request(http.MethodPost, "/register", body, &resp, middleware.TenantHeader, "globex")
+		if code != http.StatusCreated || resp.Message != "User registered successfully" {
+			t.Fatalf("status = %d, response = %+v, want an ordinary registration", code, resp)
+		}
+
+		// Only Alice receives the verification, which links the user to her
+		// identity and its password once she verifies with that password
+		token := ts.mail.token("alice@example.com")
+		verify := func(password string) int {
+			body := gin.H{"token": token, "password": password}
+			return ts.request(http.MethodPost, "/verify-email", body, nil, middleware.TenantHeader, "globex")
+		}
+		if code := verify("other-password1"); code != http.StatusForbidden {
+			t.Errorf("verifying with Mallory's password: status = %d, want %d", code, http.StatusForbidden)
+		}
+		if code := verify("password123"); code != http.StatusOK {
+			t.Fatalf("verifying with Alice's password: status = %d, want %d", code, http.StatusOK)
+		}
+		login := func(password string) int {
+			body := gin.H{"email": "alice@example.com", "password": password}
+			return ts.request(http.MethodPost, "/login", body, nil, middleware.TenantHeader, "globex")
+		}
+		if code := login("other-password1"); code != http.StatusUnauthorized {
+			t.Errorf("login with Mallory's password: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code := login("password123"); code != http.StatusOK {
+			t.Errorf("login with Alice's password: status = %d, want %d", code, http.StatusOK)
+		}
+	})
+
+	t.Run("accepting an invitation for someone else's email", func(t *testing.T) {
+		admin := ts.register("initech", "admin@initech.com", "password123")
+		var inv models.Invitation
+		if code := ts.request(http.MethodPost, "/invitations", gin.H{"email": "alice@example.com"}, &inv, "Authorization", bearer(admin)); code != http.StatusCreated {
+			t.Fatalf("inviting: status = %d, want %d", code, http.StatusCreated)
+		}
+
+		var resp struct{ Token string }
+		code := ts.request(http.MethodPost, "/invitations/"+inv.Token+"/accept", gin.H{"password": "other-password1"}, &resp, middleware.TenantHeader, "initech")
+		if code != http.StatusCreated {
+			t.Fatalf("accepting: status = %d, want %d", code, http.StatusCreated)
+		}
+		if m := memberships(resp.Token); len(m) != 0 {
+			t.Errorf("memberships = %+v, want none before the email is verified", m)
+		}
+	})
+}
+
+func TestSwitchTenant(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createTenant("Acme", "acme")
+	initech := ts.createTenant("Initech", "initech")
+	ts.createTenant("Globex", "globex")
+	acmeToken := ts.register("acme", "alice@example.com", "password123")
+	ts.verifyEmail("acme", "alice@example.com")
+	initechAdmin := ts.register("initech", "admin@initech.com", "password123")
+	ts.register("initech", "alice@example.com", "password123")
+	globexToken := ts.register("globex", "bob@example.com", "password123")
+
+	switchTo := func(token, slug string, out interface{}) int {
+		return ts.request(http.MethodPost, "/token/switch-tenant", gin.H{"tenant": slug}, out, "Authorization", bearer(token))
+	}
+
+	var resp struct {
+		Token  string
+		Tenant models.Tenant
+	}
+	if code := switchTo(acmeToken, "initech", &resp); code != http.StatusOK || resp.Tenant.ID != initech.ID {
+		t.Fatalf("switching to Initech: status = %d, tenant = %+v, want Initech", code, resp.Tenant)
+	}
+	var me struct {
+		TenantID int    `json:"tenant_id"`
+		Email    string `json:"email"`
+	}
+	if code := ts.request(http.MethodGet, "/me", nil, &me, "Authorization", bearer(resp.Token)); code != http.StatusOK || me.TenantID != initech.ID {
+		t.Errorf("me with the switched token: status = %d, me = %+v, want Alice in Initech", code, me)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		slug  string
+		want  int
+	}{
+		{"tenant the identity isn't a member of", acmeToken, "globex", http.StatusForbidden},
+		{"unknown tenant", acmeToken, "unknown", http.StatusNotFound},
+		{"user without a global identity", globexToken, "acme", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := switchTo(tt.token, tt.slug, nil); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	// Deactivated users can't be switched to
+	if code := ts.request(http.MethodPatch, "/users/2", gin.H{"active": false}, nil, "Authorization", bearer(initechAdmin)); code != http.StatusOK {
+		t.Fatalf("deactivating Alice in Initech: status = %d, want %d", code, http.StatusOK)
+	}
+	if code := switchTo(acmeToken, "initech", nil); code != http.StatusForbidden {
+		t.Errorf("switching to a tenant where the user is deactivated: status = %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestUpdateMe(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	token := ts.register("acme", "alice@example.com", "password123")
+	ts.register("globex", "bob@example.com", "password123")
+	ts.verifyEmail("acme", "alice@example.com")
+	ts.verifyEmail("globex", "bob@example.com")
+	auth := []string{"Authorization", bearer(token)}
+
+	// Alice is linked, so the change waits until she verifies the new email
+	if code := ts.request(http.MethodPatch, "/me", gin.H{"email": "alice@acme.com"}, nil, auth...); code != http.StatusAccepted {
+		t.Fatalf("changing email: status = %d, want %d", code, http.StatusAccepted)
+	}
+	var user models.User
+	if code := ts.request(http.MethodGet, "/users/1", nil, &user, auth...); code != http.StatusOK || user.Email != "alice@example.com" {
+		t.Errorf("before verifying: status = %d, email = %q, want alice@example.com", code, user.Email)
+	}
+	ts.verifyEmail("acme", "alice@acme.com")
+	auth = []string{"Authorization", bearer(ts.login("acme", "alice@acme.com", "password123"))}
+
+	// bob@example.com is free in acme but belongs to another global account,
+	// so the change is refused and the tenant user keeps their email
+	if code := ts.request(http.MethodPatch, "/me", gin.H{"email": "bob@example.com"}, nil, auth...); code != http.StatusAccepted {
+		t.Fatalf("requesting another account's email: status = %d, want %d", code, http.StatusAccepted)
+	}
+	body := gin.H{"token": ts.mail.token("bob@example.com")}
+	if code := ts.request(http.MethodPost, "/verify-email", body, nil, middleware.TenantHeader, "acme"); code != http.StatusConflict {
+		t.Fatalf("taking another account's email: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := ts.request(http.MethodGet, "/users/1", nil, &user, auth...); code != http.StatusOK || user.Email != "alice@acme.com" {
+		t.Errorf("after the refused change: status = %d, email = %q, want alice@acme.com", code, user.Email)
+	}
+	ts.login("acme", "alice@acme.com", "password123")
+
+	t.Run("unlinked user", func(t *testing.T) {
+		token := ts.register("acme", "carol@example.com", "password123")
+		var resp struct {
+			User  models.User
+			Token string
+		}
+		code := ts.request(http.MethodPatch, "/me", gin.H{"email": "carol@acme.com"}, &resp, "Authorization", bearer(token))
+		if code != http.StatusOK || resp.User.Email != "carol@acme.com" || resp.Token == "" {
+			t.Errorf("changing email: status = %d, response = %+v, want carol@acme.com and a token", code, resp)
+		}
+	})
+}
+
+// forgeToken signs a token with a key the test server doesn't use
+func forgeToken(t *testing.T, userID, tenantID int, email string) string {
+	t.Helper()
+
+	token, err := middleware.NewTokenService(config.JWTConfig{SecretKey: "another-key", ExpirationHours: 1}).GenerateToken(userID, tenantID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestPosts(t *testing.T) {
+	ts := newTestServer(t)
+	ts.createTenant("Acme", "acme")
+	token := ts.register("acme", "user@acme.com", "password123")
+	auth := []string{"Authorization", bearer(token)}
+
+	var posts []models.Post
+	if code := ts.request(http.MethodGet, "/posts", nil, &posts, auth...); code != http.StatusOK {
+		t.Fatalf("listing posts: status = %d, want %d", code, http.StatusOK)
+	}
+	if len(posts) != 0 {
+		t.Errorf("new tenant has %d posts, want none", len(posts))
+	}
+
+	for i := 1; i <= 2; i++ {
+		var post models.Post
+		body := gin.H{"title": fmt.Sprintf("Post %d", i), "content": "Content"}
+		if code := ts.request(http.MethodPost, "/posts", body, &post, auth...); code != http.StatusCreated {
+			t.Fatalf("creating post: status = %d, want %d", code, http.StatusCreated)
+		}
+		if post.ID != i || post.UserID != 1 || post.Title != body["title"] {
+			t.Errorf("created post = %+v, want post %d by user 1", post, i)
+		}
+	}
+
+	if code := ts.request(http.MethodGet, "/posts", nil, &posts, auth...); code != http.StatusOK {
+		t.Fatalf("listing posts: status = %d, want %d", code, http.StatusOK)
+	}
+	if len(posts) != 2 || posts[0].ID != 2 || posts[1].ID != 1 {
+		t.Errorf("posts = %+v, want posts 2 and 1, newest first", posts)
+	}
+
+	var post models.Post
+	if code := ts.request(http.MethodGet, "/posts/1", nil, &post, auth...); code != http.StatusOK {
+		t.Fatalf("getting post: status = %d, want %d", code, http.StatusOK)
+	}
+	if post.ID != 1 || post.Title != "Post 1" {
+		t.Errorf("post = %+v, want post 1", post)
+	}
+
+	t.Run("authors and admins update and delete posts", func(t *testing.T) {
+		member := []string{"Authorization", bearer(ts.register("acme", "member@acme.com", "password123"))}
+		var own models.Post
+		ts.request(http.MethodPost, "/posts", gin.H{"title": "Mine", "content": "Content"}, &own, member...)
+		path := fmt.Sprintf("/posts/%d", own.ID)
+
+		if code := ts.request(http.MethodPut, "/posts/1", gin.H{"title": "Theirs", "content": "Content"}, nil, member...); code != http.StatusForbidden {
+			t.Errorf("updating another's post: status = %d, want %d", code, http.StatusForbidden)
+		}
+		if code := ts.request(http.MethodDelete, "/posts/1", nil, nil, member...); code != http.StatusForbidden {
+			t.Errorf("deleting another's post: status = %d, want %d", code, http.StatusForbidden)
+		}
+
+		var updated models.Post
+		if code := ts.request(http.MethodPut, path, gin.H{"title": "Edited", "content": "New"}, &updated, member...); code != http.StatusOK {
+			t.Fatalf("updating own post: status = %d, want %d", code, http.StatusOK)
+		}
+		if updated.ID != own.ID || updated.UserID != own.UserID || updated.Title != "Edited" || updated.Content != "New" || !updated.CreatedAt.Equal(own.CreatedAt) {
+			t.Errorf("updated post = %+v, want %+v edited", updated, own)
+		}
+		if code := ts.request(http.MethodPut, path, gin.H{"title": "Edited"}, nil, member...); code != http.StatusBadRequest {
+			t.Errorf("missing content: status = %d, want %d", code, http.StatusBadRequest)
+		}
+
+		// The tenant's first user is its admin
+		if code := ts.request(http.MethodDelete, path, nil, nil, auth...); code != http.StatusNoContent {
+			t.Fatalf("admin deleting post: status = %d, want %d", code, http.StatusNoContent)
+		}
+		if code := ts.request(http.MethodGet, path, nil, nil, auth...); code != http.StatusNotFound {
+			t.Errorf("deleted post: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := ts.request(http.MethodDelete, path, nil, nil, auth...); code != http.StatusNotFound {
+			t.Errorf("deleting again: status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    interface{}
+		headers []string
+		want    int
+	}{
+		{"missing title", http.MethodPost, "/posts", gin.H{"content": "Content"}, auth, http.StatusBadRequest},
+		{"unauthenticated create", http.MethodPost, "/posts", gin.H{"title": "T", "content": "C"}, nil, http.StatusUnauthorized},
+		{"unauthenticated list", http.MethodGet, "/posts", nil, nil, http.StatusUnauthorized},
+		{"unknown post", http.MethodGet, "/posts/42", nil, auth, http.StatusNotFound},
+		{"invalid post ID", http.MethodGet, "/posts/abc", nil, auth, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(tt.method, tt.path, tt.body, nil, tt.headers...); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrossTenantIsolation(t *testing.T) {
+	ts := newTestServer(t)
+	acme := ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+
+	acmeToken := ts.register("acme", "alice@acme.com", "password123")
+	globexToken := ts.register("globex", "bob@globex.com", "password123")
+
+	body := gin.H{"title": "Acme secret", "content": "Only for Acme"}
+	if code := ts.request(http.MethodPost, "/posts", body, nil, "Authorization", bearer(acmeToken)); code != http.StatusCreated {
+		t.Fatalf("creating post: status = %d, want %d", code, http.StatusCreated)
+	}
+
+	t.Run("posts are not listed in other tenants", func(t *testing.T) {
+		var posts []models.Post
+		if code := ts.request(http.MethodGet, "/posts", nil, &posts, "Authorization", bearer(globexToken)); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(posts) != 0 {
+			t.Errorf("Globex sees %d posts, want none", len(posts))
+		}
+	})
+
+	t.Run("posts can't be read by ID from other tenants", func(t *testing.T) {
+		if code := ts.request(http.MethodGet, "/posts/1", nil, nil, "Authorization", bearer(globexToken)); code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("tokens are rejected by other tenants", func(t *testing.T) {
+		addressing := [][]string{
+			{middleware.TenantHeader, "globex"},
+			{"Host", "globex.example.com"},
+		}
+		for _, headers := range addressing {
+			headers = append(headers, "Authorization", bearer(acmeToken))
+			if code := ts.request(http.MethodGet, "/posts", nil, nil, headers...); code != http.StatusUnauthorized {
+				t.Errorf("%s: status = %d, want %d", headers[0], code, http.StatusUnauthorized)
+			}
+		}
+		if code := ts.request(http.MethodGet, "/t/globex/posts", nil, nil, "Authorization", bearer(acmeToken)); code != http.StatusUnauthorized {
+			t.Errorf("path prefix: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("credentials are scoped to their tenant", func(t *testing.T) {
+		body := gin.H{"email": "alice@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/login", body, nil, middleware.TenantHeader, "globex"); code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("user IDs are per tenant", func(t *testing.T) {
+		// Both tenants have a user 1, Bob's token must not act as Alice
+		var me struct {
+			UserID   int    `json:"user_id"`
+			TenantID int    `json:"tenant_id"`
+			Email    string `json:"email"`
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, &me, "Authorization", bearer(globexToken)); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if me.TenantID == acme.ID || me.Email != "bob@globex.com" {
+			t.Errorf("me = %+v, want Bob in Globex", me)
+		}
+	})
+
+	t.Run("global identity joins another tenant", func(t *testing.T) {
+		ts.verifyEmail("acme", "alice@acme.com")
+
+		// Registering with a different password doesn't take over the
+		// identity, the new user stays in their own tenant
+		mallory := ts.register("globex", "alice@acme.com", "other-password1")
+		var memberships []models.TenantMembership
+		if code := ts.request(http.MethodGet, "/me/tenants", nil, &memberships, "Authorization", bearer(mallory)); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(memberships) != 0 {
+			t.Errorf("memberships = %+v, want none before the email is verified", memberships)
+		}
+
+		// With the same password Alice becomes a member of Initech, with no
+		// access to Acme's posts through that membership
+		ts.createTenant("Initech", "initech")
+		initechAlice := ts.register("initech", "alice@acme.com", "password123")
+		if code := ts.request(http.MethodGet, "/me/tenants", nil, &memberships, "Authorization", bearer(initechAlice)); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(memberships) != 2 || memberships[0].Slug != "acme" || memberships[1].Slug != "initech" {
+			t.Errorf("memberships = %+v, want Acme and Initech", memberships)
+		}
+		var posts []models.Post
+		if code := ts.request(http.MethodGet, "/posts", nil, &posts, "Authorization", bearer(initechAlice)); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(posts) != 0 {
+			t.Errorf("Alice sees %d posts in Initech, want none", len(posts))
+		}
+	})
+}
+
+func TestUserAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	acme := ts.createTenant("Acme", "acme")
+	adminToken := ts.register("acme", "admin@acme.com", "password123")
+	ts.register("acme", "member@acme.com", "password123")
+	auth := []string{"Authorization", bearer(adminToken)}
+
+	var user models.User
+	code := ts.request(http.MethodPatch, "/users/2", gin.H{"role": models.RoleAdmin}, &user, auth...)
+	if code != http.StatusOK || user.Role != models.RoleAdmin {
+		t.Fatalf("promoting member: status = %d, user = %+v, want an admin", code, user)
+	}
+	if code := ts.request(http.MethodPatch, "/users/2", gin.H{"role": models.RoleMember}, nil, auth...); code != http.StatusOK {
+		t.Fatalf("demoting member: status = %d, want %d", code, http.StatusOK)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		want   int
+	}{
+		{"demoting the last admin", http.MethodPatch, "/users/1", gin.H{"role": models.RoleMember}, http.StatusConflict},
+		{"deactivating the last admin", http.MethodPatch, "/users/1", gin.H{"active": false}, http.StatusConflict},
+		{"taking another user's email", http.MethodPatch, "/users/2", gin.H{"email": "admin@acme.com"}, http.StatusConflict},
+		{"updating an unknown user", http.MethodPatch, "/users/99", gin.H{"role": models.RoleAdmin}, http.StatusNotFound},
+		{"deleting an unknown user", http.MethodDelete, "/users/99", nil, http.StatusNotFound},
+		{"deleting yourself", http.MethodDelete, "/users/1", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(tt.method, tt.path, tt.body, nil, auth...); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	t.Run("email domains", func(t *testing.T) {
+		settings := &models.TenantSettings{RegistrationMode: models.RegistrationDomainRestricted, AllowedEmailDomains: []string{"acme.com"}}
+		if err := ts.store.UpdateTenantSettings(context.Background(), acme.ID, settings); err != nil {
+			t.Fatal(err)
+		}
+		defer ts.store.UpdateTenantSettings(context.Background(), acme.ID, &models.TenantSettings{RegistrationMode: models.RegistrationOpen})
+
+		// Domain-restricted tenants keep their users' emails within the
+		// approved domains
+		for path, email := range map[string]string{"/users/2": "member@example.com", "/me": "admin@example.com"} {
+			if code := ts.request(http.MethodPatch, path, gin.H{"email": email}, nil, auth...); code != http.StatusForbidden {
+				t.Errorf("%s to %s: status = %d, want %d", path, email, code, http.StatusForbidden)
+			}
+		}
+		if code := ts.request(http.MethodPatch, "/users/2", gin.H{"email": "member2@acme.com"}, nil, auth...); code != http.StatusOK {
+			t.Errorf("approved domain: status = %d, want %d", code, http.StatusOK)
+		}
+		ts.request(http.MethodPatch, "/users/2", gin.H{"email": "member@acme.com"}, nil, auth...)
+	})
+
+	// Deactivated users can't log in, deleted users are gone
+	if code := ts.request(http.MethodDelete, "/users/2", nil, nil, auth...); code != http.StatusNoContent {
+		t.Fatalf("deactivating member: status = %d, want %d", code, http.StatusNoContent)
+	}
+	login := gin.H{"email": "member@acme.com", "password": "password123"}
+	if code := ts.request(http.MethodPost, "/login", login, nil, middleware.TenantHeader, "acme"); code != http.StatusForbidden {
+		t.Errorf("deactivated login: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := ts.request(http.MethodDelete, "/users/2?hard=true", nil, nil, auth...); code != http.StatusNoContent {
+		t.Fatalf("deleting member: status = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := ts.request(http.MethodGet, "/users/2", nil, nil, auth...); code != http.StatusNotFound {
+		t.Errorf("deleted user: status = %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+	adminToken := ts.register("acme", "alice@acme.com", "password123")
+
+	t.Run("probes", func(t *testing.T) {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			if code := ts.request(http.MethodGet, path, nil, nil); code != http.StatusOK {
+				t.Errorf("%s: status = %d, want %d", path, code, http.StatusOK)
+			}
+		}
+	})
+
+	t.Run("probes don't resolve tenants", func(t *testing.T) {
+		if code := ts.request(http.MethodGet, "/healthz", nil, nil, middleware.TenantHeader, "unknown"); code != http.StatusOK {
+			t.Errorf("status = %d, want %d", code, http.StatusOK)
+		}
+	})
+
+	path := fmt.Sprintf("/admin/tenants/%d/health", tenant.ID)
+
+	t.Run("tenant health", func(t *testing.T) {
+		var health models.TenantHealth
+		if code := ts.request(http.MethodGet, path, nil, &health, middleware.AdminKeyHeader, "test-admin-key"); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if health.TenantID != tenant.ID || health.RowCounts["users"] != 1 {
+			t.Errorf("health = %+v, want tenant %d with 1 user", health, tenant.ID)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		headers []string
+		want    int
+	}{
+		{"no admin key", path, nil, http.StatusUnauthorized},
+		{"wrong admin key", path, []string{middleware.AdminKeyHeader, "wrong"}, http.StatusUnauthorized},
+		{"unknown tenant", "/admin/tenants/42/health", []string{middleware.AdminKeyHeader, "test-admin-key"}, http.StatusNotFound},
+		{"invalid tenant ID", "/admin/tenants/acme/health", []string{middleware.AdminKeyHeader, "test-admin-key"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := ts.request(http.MethodGet, tt.path, nil, nil, tt.headers...); code != tt.want {
+				t.Errorf("status = %d, want %d", code, tt.want)
+			}
+		})
+	}
+
+	t.Run("tenant admins are not platform admins", func(t *testing.T) {
+		if code := ts.request(http.MethodGet, path, nil, nil, "Authorization", bearer(adminToken)); code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("disabled without an admin key", func(t *testing.T) {
+		ts := newTestServerWithConfig(t, func(cfg *config.Config) { cfg.Admin.APIKey = "" })
+		if code := ts.request(http.MethodGet, path, nil, nil); code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) { cfg.Metrics.MaxTenantLabels = 1 })
+	ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	token := ts.register("acme", "alice@acme.com", "password123")
+	ts.register("globex", "bob@globex.com", "password123")
+
+	login := gin.H{"email": "alice@acme.com", "password": "password123"}
+	ts.request(http.MethodPost, "/login", login, nil, middleware.TenantHeader, "acme")
+	login["password"] = "wrong-password"
+	ts.request(http.MethodPost, "/login", login, nil, middleware.TenantHeader, "acme")
+	ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "globex", "Authorization", bearer(token))
+	ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "acme", "Authorization", "Bearer garbage")
+
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`multitenant_http_requests_total{method="POST",route="/tenants",status="201"} 2`,
+		`multitenant_http_request_duration_seconds_count{method="POST",route="/register"} 2`,
+		// Only the first tenant fits under the label limit
+		`multitenant_tenant_requests_total{tenant="acme"} 4`,
+		`multitenant_tenant_requests_total{tenant="other"} 2`,
+		`multitenant_tenant_provisioning_duration_seconds_count 2`,
+		`multitenant_logins_total{result="success"} 1`,
+		`multitenant_logins_total{result="failure"} 1`,
+		`multitenant_jwt_validation_errors_total{reason="tenant_mismatch"} 1`,
+		`multitenant_jwt_validation_errors_total{reason="invalid"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %s", want)
+		}
+	}
+	if strings.Contains(body, `tenant="globex"`) {
+		t.Error("metrics contain a tenant label beyond the limit")
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	ts := newTestServer(t)
+	ts.createTenant("Acme", "acme")
+	ts.register("acme", "alice@acme.com", "password123")
+
+	// A login continuing the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	body := gin.H{"email": "alice@acme.com", "password": "password123"}
+	code := ts.request(http.MethodPost, "/login", body, nil,
+		middleware.TenantHeader, "acme",
+		"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01",
+	)
+	if code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+
+	request, ok := spans["/login"]
+	if !ok {
+		t.Fatalf("no request span in the caller's trace, got %v", spans)
+	}
+	hasTenant := false
+	for _, attr := range request.Attributes() {
+		if attr.Key == tracing.TenantIDKey {
+			hasTenant = true
+		}
+	}
+	if !hasTenant {
+		t.Errorf("request span attributes = %v, want the tenant ID", request.Attributes())
+	}
+
+	check, ok := spans["CheckPassword"]
+	if !ok {
+		t.Fatalf("no password check span in the caller's trace, got %v", spans)
+	}
+	if check.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Error("password check span is not a child of the request span")
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := logging.NewHandler(&buf, config.LoggingConfig{Level: "info", Format: logging.FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(handler))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+	token := ts.register("acme", "alice@acme.com", "password123")
+
+	// entries returns the access log entries written since the last call
+	entries := func() []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var entry map[string]interface{}
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatalf("log line %q is not JSON: %v", line, err)
+			}
+			if entry["msg"] == "Request handled" {
+				out = append(out, entry)
+			}
+		}
+		buf.Reset()
+		return out
+	}
+	entries()
+
+	t.Run("request IDs are echoed and logged", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set(middleware.RequestIDHeader, "req-123")
+		req.Header.Set(middleware.TenantHeader, "acme")
+		req.Header.Set("Authorization", bearer(token))
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+
+		if got := w.Header().Get(middleware.RequestIDHeader); got != "req-123" {
+			t.Errorf("response request ID = %q, want req-123", got)
+		}
+		logged := entries()
+		if len(logged) != 1 {
+			t.Fatalf("%d access log entries, want 1", len(logged))
+		}
+		entry := logged[0]
+		if entry["request_id"] != "req-123" || entry["tenant_id"] != float64(tenant.ID) || entry["user_id"] != float64(1) {
+			t.Errorf("entry = %v, want the request ID, tenant ID and user ID", entry)
+		}
+	})
+
+	t.Run("malformed request IDs are replaced", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		req.Header.Set(middleware.RequestIDHeader, "not a valid id\n")
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+
+		got := w.Header().Get(middleware.RequestIDHeader)
+		if got == "" || strings.ContainsAny(got, " \n") {
+			t.Errorf("response request ID = %q, want a generated one", got)
+		}
+		if logged := entries(); len(logged) != 1 || logged[0]["request_id"] != got {
+			t.Errorf("entries = %v, want the generated request ID", logged)
+		}
+	})
+
+	t.Run("secrets are redacted", func(t *testing.T) {
+		ts.request(http.MethodPost, "/invitations/secret-invitation-token/accept",
+			gin.H{"password": "password123"}, nil, middleware.TenantHeader, "acme")
+		slog.Info("Login", "password", "password123", "Authorization", bearer(token))
+
+		out := buf.String()
+		for _, secret := range []string{"secret-invitation-token", "password123", token} {
+			if strings.Contains(out, secret) {
+				t.Errorf("logs contain %q:\n%s", secret, out)
+			}
+		}
+		if !strings.Contains(out, logging.Redacted) {
+			t.Errorf("logs don't mark redacted values:\n%s", out)
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.createTenant("Acme", "acme")
+	adminToken := ts.register("acme", "alice@acme.com", "password123")
+	ts.register("acme", "bob@acme.com", "password123")
+	ts.request(http.MethodPost, "/login", gin.H{"email": "bob@acme.com", "password": "wrong-password"}, nil, middleware.TenantHeader, "acme")
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil,
+		middleware.TenantHeader, "acme", "Authorization", bearer(adminToken))
+	ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "acme", "Authorization", bearer(adminToken))
+
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(adminToken)}
+
+	// export fetches an audit log export
+	export := func(path string, headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", path, w.Code, http.StatusOK)
+		}
+		return w
+	}
+
+	t.Run("mutating requests are recorded", func(t *testing.T) {
+		var events []models.AuditEvent
+		if code := ts.request(http.MethodGet, "/audit", nil, &events, admin...); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+
+		var actions []string
+		for _, e := range events {
+			actions = append(actions, e.Action)
+		}
+		want := []string{"post.create", "user.login", "user.register", "user.register"}
+		if strings.Join(actions, ",") != strings.Join(want, ",") {
+			t.Fatalf("actions = %v, want %v", actions, want)
+		}
+
+		post, failedLogin := events[0], events[1]
+		if post.ActorUserID == nil || *post.ActorUserID != 1 || post.TargetID != "1" || post.Status != http.StatusCreated ||
+			post.TenantID == nil || *post.TenantID != tenant.ID || post.RequestID == "" || len(post.After) == 0 {
+			t.Errorf("post event = %+v", post)
+		}
+		if failedLogin.ActorUserID != nil || failedLogin.ActorEmail != "bob@acme.com" || failedLogin.Status != http.StatusUnauthorized {
+			t.Errorf("failed login event = %+v, want bob's attempt without an actor", failedLogin)
+		}
+		if bytes.Contains(events[3].After, []byte("password")) {
+			t.Errorf("register event stores the password: %s", events[3].After)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		var events []models.AuditEvent
+		ts.request(http.MethodGet, "/audit?action=user.register&actor_user_id=2", nil, &events, admin...)
+		if len(events) != 1 || events[0].ActorEmail != "bob@acme.com" {
+			t.Errorf("events = %+v, want bob's registration", events)
+		}
+
+		if code := ts.request(http.MethodGet, "/audit?from=yesterday", nil, nil, admin...); code != http.StatusBadRequest {
+			t.Errorf("invalid from: status = %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("exports", func(t *testing.T) {
+		w := export("/audit?format=jsonl", admin...)
+		lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+		var first models.AuditEvent
+		if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 4 || first.Action != "user.register" || first.ActorEmail != "alice@acme.com" {
+			t.Errorf("JSON Lines export = %s, want 4 events oldest first", w.Body.String())
+		}
+
+		w = export("/audit?format=csv&target_type=user", admin...)
+		if !strings.Contains(w.Header().Get("Content-Disposition"), "audit.csv") {
+			t.Errorf("Content-Disposition = %q", w.Header().Get("Content-Disposition"))
+		}
+		if rows := strings.Split(strings.TrimSpace(w.Body.String()), "\n"); len(rows) != 4 || !strings.HasPrefix(rows[0], "id,occurred_at") {
+			t.Errorf("CSV export = %s, want a header and 3 user events", w.Body.String())
+		}
+	})
+
+	t.Run("members can't read the log", func(t *testing.T) {
+		var resp struct{ Token string }
+		ts.request(http.MethodPost, "/login", gin.H{"email": "bob@acme.com", "password": "password123"}, &resp, middleware.TenantHeader, "acme")
+		if code := ts.request(http.MethodGet, "/audit", nil, nil, middleware.TenantHeader, "acme", "Authorization", bearer(resp.Token)); code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("platform log", func(t *testing.T) {
+		// Refused requests without a tenant or actor aren't recorded
+		ts.request(http.MethodPost, "/register", gin.H{"email": "mallory@example.com", "password": "password123"}, nil)
+		ts.request(http.MethodPut, "/admin/plans/free", gin.H{}, nil, middleware.AdminKeyHeader, "wrong-key")
+
+		var events []models.AuditEvent
+		if code := ts.request(http.MethodGet, "/admin/audit", nil, &events, middleware.AdminKeyHeader, "test-admin-key"); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if len(events) != 1 || events[0].Action != "tenant.create" || events[0].TenantID == nil || *events[0].TenantID != tenant.ID {
+			t.Errorf("events = %+v, want the tenant creation", events)
+		}
+	})
+
+	t.Run("verification detects tampering", func(t *testing.T) {
+		var result models.AuditVerification
+		ts.request(http.MethodGet, "/audit/verify", nil, &result, admin...)
+		if !result.Valid || result.Events < 5 {
+			t.Fatalf("verification = %+v, want a valid log", result)
+		}
+
+		err := ts.store.TamperAuditEvent(tenant.ID, 2, func(e *models.AuditEvent) { e.ActorEmail = "mallory@acme.com" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts.request(http.MethodGet, "/audit/verify", nil, &result, admin...)
+		if result.Valid || result.BrokenAt == nil || *result.BrokenAt != 2 {
+			t.Errorf("verification = %+v, want broken at event 2", result)
+		}
+
+		ts.request(http.MethodGet, "/admin/audit/verify", nil, &result, middleware.AdminKeyHeader, "test-admin-key")
+		if !result.Valid || result.Events != 1 {
+			t.Errorf("platform verification = %+v, want a valid log of 1 event", result)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.RateLimit.Plans = map[string]config.RateLimitPlan{
+			config.DefaultRateLimitPlan: {TenantPerMinute: 1, TenantBurst: 4, APIKeyPerMinute: 1, APIKeyBurst: 1},
+			models.DefaultPlan:          {TenantPerMinute: 60, TenantBurst: 100, UserPerMinute: 1, UserBurst: 2},
+		}
+	})
+	ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	token := ts.register("acme", "alice@acme.com", "password123")
+
+	// send makes a request, returning the response
+	send := func(path string, headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("users are limited per their tenant's plan", func(t *testing.T) {
+		auth := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+		w := send("/me", auth...)
+		if w.Code != http.StatusOK || w.Header().Get(ratelimit.LimitHeader) != "2" || w.Header().Get(ratelimit.RemainingHeader) != "1" {
+			t.Fatalf("first request: status %d, headers %v", w.Code, w.Header())
+		}
+		send("/me", auth...)
+
+		w = send("/me", auth...)
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+		if w.Header().Get(ratelimit.RetryAfterHeader) != "60" || w.Header().Get(ratelimit.RemainingHeader) != "0" {
+			t.Errorf("headers = %v, want a minute until the next token", w.Header())
+		}
+	})
+
+	t.Run("tenants don't share buckets", func(t *testing.T) {
+		if w := send("/posts", middleware.TenantHeader, "globex"); w.Code == http.StatusTooManyRequests {
+			t.Errorf("status = %d, globex is limited by acme's requests", w.Code)
+		}
+	})
+
+	t.Run("token-only requests are limited per their tenant", func(t *testing.T) {
+		ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+			cfg.RateLimit.Plans = map[string]config.RateLimitPlan{
+				models.DefaultPlan: {TenantPerMinute: 1, TenantBurst: 3, UserPerMinute: 60},
+			}
+		})
+		ts.createTenant("Acme", "acme")
+		token := ts.register("acme", "alice@acme.com", "password123")
+
+		// Requests resolving the tenant and carrying a token take one token
+		send := func(headers ...string) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			req.Header.Set("Authorization", bearer(token))
+			for i := 0; i+1 < len(headers); i += 2 {
+				req.Header.Set(headers[i], headers[i+1])
+			}
+			w := httptest.NewRecorder()
+			ts.router.ServeHTTP(w, req)
+			return w
+		}
+		if w := send(); w.Code != http.StatusOK || w.Header().Get(ratelimit.RemainingHeader) != "1" {
+			t.Fatalf("token only: status %d, headers %v", w.Code, w.Header())
+		}
+		if w := send(middleware.TenantHeader, "acme"); w.Code != http.StatusOK || w.Header().Get(ratelimit.RemainingHeader) != "0" {
+			t.Fatalf("resolved tenant: status %d, headers %v", w.Code, w.Header())
+		}
+		if w := send(); w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+	})
+
+	t.Run("unlisted plans get the default limits", func(t *testing.T) {
+		ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+			cfg.RateLimit.Plans = map[string]config.RateLimitPlan{
+				config.DefaultRateLimitPlan: {TenantPerMinute: 1, TenantBurst: 2},
+			}
+		})
+		ts.createTenant("Acme", "acme")
+
+		codes := make([]int, 3)
+		for i := range codes {
+			codes[i] = ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "acme")
+		}
+		if codes[2] != http.StatusTooManyRequests {
+			t.Errorf("statuses = %v, want the third request limited", codes)
+		}
+	})
+
+	t.Run("API keys", func(t *testing.T) {
+		admin := []string{middleware.AdminKeyHeader, "test-admin-key"}
+		if w := send("/admin/audit", admin...); w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+		if w := send("/admin/audit", admin...); w.Code != http.StatusTooManyRequests {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+			cfg.RateLimit.Backend = "none"
+			cfg.RateLimit.Plans = map[string]config.RateLimitPlan{
+				config.DefaultRateLimitPlan: {TenantPerMinute: 1, TenantBurst: 1},
+			}
+		})
+		ts.createTenant("Acme", "acme")
+		for i := 0; i < 3; i++ {
+			if code := ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "acme"); code == http.StatusTooManyRequests {
+				t.Fatalf("request %d was limited", i+1)
+			}
+		}
+	})
+}
+
+func TestQuotas(t *testing.T) {
+	ts := newTestServer(t)
+	admin := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	acme := ts.createTenant("Acme", "acme")
+
+	// assign creates a plan and moves the tenant to it
+	assign := func(tenant models.Tenant, plan string, quotas gin.H) {
+		t.Helper()
+		if code := ts.request(http.MethodPut, "/admin/plans/"+plan, quotas, nil, admin...); code != http.StatusOK {
+			t.Fatalf("saving plan %s: status %d", plan, code)
+		}
+		path := fmt.Sprintf("/admin/tenants/%d/plan", tenant.ID)
+		if code := ts.request(http.MethodPut, path, gin.H{"plan": plan}, nil, admin...); code != http.StatusOK {
+			t.Fatalf("assigning plan %s: status %d", plan, code)
+		}
+	}
+	assign(acme, "tiny", gin.H{"max_users": 1, "max_posts": 1})
+	token := ts.register("acme", "alice@acme.com", "password123")
+	auth := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+
+	t.Run("users", func(t *testing.T) {
+		var resp map[string]interface{}
+		code := ts.request(http.MethodPost, "/register", gin.H{"email": "bob@acme.com", "password": "password123"}, &resp, middleware.TenantHeader, "acme")
+		if code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", code, http.StatusForbidden)
+		}
+		if resp["quota"] != models.QuotaUsers || resp["limit"] != float64(1) {
+			t.Errorf("response = %v, want the users quota of 1", resp)
+		}
+	})
+
+	t.Run("posts", func(t *testing.T) {
+		post := gin.H{"title": "Hello", "content": "World"}
+		if code := ts.request(http.MethodPost, "/posts", post, nil, auth...); code != http.StatusCreated {
+			t.Fatalf("first post: status %d", code)
+		}
+		var resp map[string]interface{}
+		if code := ts.request(http.MethodPost, "/posts", post, &resp, auth...); code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", code, http.StatusForbidden)
+		}
+		if resp["quota"] != models.QuotaPosts {
+			t.Errorf("response = %v, want the posts quota", resp)
+		}
+	})
+
+	t.Run("requests per day", func(t *testing.T) {
+		globex := ts.createTenant("Globex", "globex")
+		assign(globex, "metered", gin.H{"max_requests_per_day": 3})
+
+		codes := make([]int, 4)
+		for i := range codes {
+			codes[i] = ts.request(http.MethodGet, "/posts", nil, nil, middleware.TenantHeader, "globex")
+		}
+		if codes[2] == http.StatusTooManyRequests || codes[3] != http.StatusTooManyRequests {
+			t.Errorf("statuses = %v, want the fourth request over quota", codes)
+		}
+	})
+
+	t.Run("token-only requests per day", func(t *testing.T) {
+		initech := ts.createTenant("Initech", "initech")
+		assign(initech, "metered", gin.H{"max_requests_per_day": 3})
+		token := ts.register("initech", "peter@initech.com", "password123")
+
+		// The tenant is resolved and authenticated, counting once
+		if code := ts.request(http.MethodGet, "/me", nil, nil, middleware.TenantHeader, "initech", "Authorization", bearer(token)); code != http.StatusOK {
+			t.Fatalf("resolved tenant: status %d", code)
+		}
+		codes := make([]int, 2)
+		for i := range codes {
+			codes[i] = ts.request(http.MethodGet, "/me", nil, nil, "Authorization", bearer(token))
+		}
+		if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+			t.Errorf("statuses = %v, want the fourth request over quota", codes)
+		}
+		if got := ts.server.meter.RequestsToday(initech.ID); got != 3 {
+			t.Errorf("requests today = %d, want 3", got)
+		}
+	})
+
+	t.Run("unknown plan or tenant", func(t *testing.T) {
+		if code := ts.request(http.MethodPut, fmt.Sprintf("/admin/tenants/%d/plan", acme.ID), gin.H{"plan": "gold"}, nil, admin...); code != http.StatusNotFound {
+			t.Errorf("unknown plan: status = %d, want %d", code, http.StatusNotFound)
+		}
+		if code := ts.request(http.MethodPut, "/admin/tenants/999/plan", gin.H{"plan": "tiny"}, nil, admin...); code != http.StatusNotFound {
+			t.Errorf("unknown tenant: status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		path := fmt.Sprintf("/tenants/%d/usage", acme.ID)
+		var usage models.TenantUsage
+		if code := ts.request(http.MethodGet, path, nil, &usage, auth...); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if usage.Plan.Name != "tiny" || usage.Current.Users != 1 || usage.Current.Posts != 1 || usage.RequestsToday == 0 {
+			t.Errorf("usage = %+v, want tiny's user, post and requests", usage)
+		}
+
+		ts.server.meter.Flush(context.Background())
+		if code := ts.request(http.MethodGet, "/admin"+path, nil, &usage, admin...); code != http.StatusOK {
+			t.Fatalf("platform admin: status = %d, want %d", code, http.StatusOK)
+		}
+		if len(usage.Daily) != 1 || usage.Daily[0].Requests != usage.RequestsToday || usage.Daily[0].Posts != 1 {
+			t.Errorf("daily usage = %+v, want today's %d requests and 1 post", usage.Daily, usage.RequestsToday)
+		}
+
+		other := fmt.Sprintf("/tenants/%d/usage", acme.ID+1)
+		if code := ts.request(http.MethodGet, other, nil, nil, auth...); code != http.StatusForbidden {
+			t.Errorf("other tenant: status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+}
+
+func TestBilling(t *testing.T) {
+	stripe := billingtest.NewStripe(t)
+	const secret = "whsec_test"
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Billing = config.BillingConfig{
+			Provider:              "stripe",
+			APIURL:                stripe.URL,
+			SecretKey:             "sk_test",
+			WebhookSecret:         secret,
+			Prices:                map[string]string{"pro": "price_pro"},
+			ReportIntervalSeconds: 60,
+		}
+	})
+	ctx := context.Background()
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	acme := ts.createTenant("Acme", "acme")
+	token := ts.register("acme", "alice@acme.com", "password123")
+	auth := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+
+	if code := ts.request(http.MethodPut, "/admin/plans/pro", gin.H{}, nil, platform...); code != http.StatusOK {
+		t.Fatalf("saving plan: status %d", code)
+	}
+	planPath := fmt.Sprintf("/admin/tenants/%d/plan", acme.ID)
+	var tenant models.Tenant
+	if code := ts.request(http.MethodPut, planPath, gin.H{"plan": "pro"}, &tenant, platform...); code != http.StatusOK {
+		t.Fatalf("assigning plan: status %d", code)
+	}
+	if tenant.SubscriptionStatus != models.SubscriptionActive {
+		t.Errorf("subscription status = %q, want %q", tenant.SubscriptionStatus, models.SubscriptionActive)
+	}
+	sub, err := ts.store.TenantBilling(ctx, acme.ID)
+	if err != nil || sub.CustomerID == "" || sub.SubscriptionItemID == "" {
+		t.Fatalf("billing = %+v, %v, want a customer and subscription", sub, err)
+	}
+	if requests := stripe.Requests(http.MethodPost, "/v1/subscriptions"); len(requests) != 1 || requests[0].Form.Get("items[0][price]") != "price_pro" {
+		t.Errorf("subscription requests = %+v, want one for price_pro", requests)
+	}
+
+	// webhook delivers a signed event about the tenant's subscription
+	webhook := func(id, eventType, signature string) int {
+		t.Helper()
+		payload, header := billingtest.Event(secret, id, eventType, map[string]interface{}{
+			"id":           "in_" + id,
+			"customer":     sub.CustomerID,
+			"subscription": sub.SubscriptionID,
+		})
+		if signature != "" {
+			header = signature
+		}
+		req := httptest.NewRequest(http.MethodPost, "/billing/webhook", bytes.NewReader(payload))
+		req.Header.Set(billing.SignatureHeader, header)
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("unsigned webhooks are rejected", func(t *testing.T) {
+		if code := webhook("evt_forged", "invoice.payment_failed", "t=1,v1=forged"); code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", code, http.StatusBadRequest)
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, nil, auth...); code != http.StatusOK {
+			t.Errorf("status = %d, want the tenant active", code)
+		}
+	})
+
+	t.Run("failed payments suspend the tenant", func(t *testing.T) {
+		if code := webhook("evt_failed", "invoice.payment_failed", ""); code != http.StatusOK {
+			t.Fatalf("webhook: status = %d, want %d", code, http.StatusOK)
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, nil, auth...); code != http.StatusPaymentRequired {
+			t.Errorf("status = %d, want %d", code, http.StatusPaymentRequired)
+		}
+		// Tokens are checked even when the request doesn't name the tenant
+		if code := ts.request(http.MethodGet, "/me", nil, nil, "Authorization", bearer(token)); code != http.StatusPaymentRequired {
+			t.Errorf("token only: status = %d, want %d", code, http.StatusPaymentRequired)
+		}
+
+		var events []models.AuditEvent
+		ts.request(http.MethodGet, "/admin/audit?action=tenant.suspend", nil, &events, platform...)
+		if len(events) != 1 {
+			t.Errorf("%d suspension events, want 1", len(events))
+		}
+	})
+
+	t.Run("paid invoices resume it", func(t *testing.T) {
+		if code := webhook("evt_paid", "invoice.paid", ""); code != http.StatusOK {
+			t.Fatalf("webhook: status = %d, want %d", code, http.StatusOK)
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, nil, auth...); code != http.StatusOK {
+			t.Errorf("status = %d, want %d", code, http.StatusOK)
+		}
+	})
+
+	t.Run("redelivered events are ignored", func(t *testing.T) {
+		if code := webhook("evt_failed", "invoice.payment_failed", ""); code != http.StatusOK {
+			t.Fatalf("webhook: status = %d, want %d", code, http.StatusOK)
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, nil, auth...); code != http.StatusOK {
+			t.Errorf("status = %d, want the tenant still active", code)
+		}
+	})
+
+	t.Run("usage is reported once", func(t *testing.T) {
+		ts.server.meter.Flush(ctx)
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		daily, _ := ts.store.DailyUsage(ctx, acme.ID, day, day)
+		if len(daily) != 1 || daily[0].Requests == 0 {
+			t.Fatalf("daily usage = %+v, want today's requests", daily)
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := ts.server.billing.ReportUsage(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := stripe.Usage(sub.SubscriptionItemID); got != daily[0].Requests {
+			t.Errorf("reported usage = %d, want %d", got, daily[0].Requests)
+		}
+		if records := stripe.Requests(http.MethodPost, "/v1/subscription_items/"+sub.SubscriptionItemID+"/usage_records"); len(records) != 1 {
+			t.Errorf("%d usage records, want 1", len(records))
+		}
+	})
+
+	t.Run("provider failures keep the plan", func(t *testing.T) {
+		stripe.SetFailing(true)
+		defer stripe.SetFailing(false)
+		if code := ts.request(http.MethodPut, planPath, gin.H{"plan": models.DefaultPlan}, nil, platform...); code != http.StatusBadGateway {
+			t.Fatalf("status = %d, want %d", code, http.StatusBadGateway)
+		}
+		if tenant, _ := ts.store.TenantByID(ctx, acme.ID); tenant.Plan != "pro" {
+			t.Errorf("plan = %q, want pro", tenant.Plan)
+		}
+	})
+
+	t.Run("unbilled plans cancel the subscription", func(t *testing.T) {
+		if code := ts.request(http.MethodPut, planPath, gin.H{"plan": models.DefaultPlan}, &tenant, platform...); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		if tenant.SubscriptionStatus != models.SubscriptionNone {
+			t.Errorf("subscription status = %q, want %q", tenant.SubscriptionStatus, models.SubscriptionNone)
+		}
+		// The first attempt failed above
+		if len(stripe.Requests(http.MethodDelete, "/v1/subscriptions/"+sub.SubscriptionID)) != 2 {
+			t.Error("subscription wasn't cancelled")
+		}
+
+		// The cancelled subscription's events no longer apply
+		if code := webhook("evt_late", "invoice.payment_failed", ""); code != http.StatusOK {
+			t.Fatalf("webhook: status = %d, want %d", code, http.StatusOK)
+		}
+		if code := ts.request(http.MethodGet, "/me", nil, nil, auth...); code != http.StatusOK {
+			t.Errorf("status = %d, want the tenant active", code)
+		}
+	})
+
+	t.Run("subscribing again is a new attempt", func(t *testing.T) {
+		if code := ts.request(http.MethodPut, planPath, gin.H{"plan": "pro"}, nil, platform...); code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", code, http.StatusOK)
+		}
+		requests := stripe.Requests(http.MethodPost, "/v1/subscriptions")
+		if len(requests) != 2 {
+			t.Fatalf("%d subscription requests, want 2", len(requests))
+		}
+		first, second := requests[0].IdempotencyKey, requests[1].IdempotencyKey
+		if first != fmt.Sprintf("tenant-%d-plan-pro-0", acme.ID) || second != fmt.Sprintf("tenant-%d-plan-pro-1", acme.ID) {
+			t.Errorf("idempotency keys = %q and %q, want attempts 0 and 1", first, second)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		ts := newTestServer(t)
+		req := httptest.NewRequest(http.MethodPost, "/billing/webhook", strings.NewReader("{}"))
+		w := httptest.NewRecorder()
+		ts.router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+// webhookReceiver is a webhook endpoint recording the deliveries it receives
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	t.Helper()
+
+	r := &webhookReceiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// received returns the requests and bodies received so far
+func (r *webhookReceiver) received() ([]*http.Request, [][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*http.Request(nil), r.requests...), append([][]byte(nil), r.bodies...)
+}
+
+func TestWebhooks(t *testing.T) {
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Webhooks.AllowPrivateTargets = true
+		cfg.Webhooks.MaxAttempts = 3
+	})
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	receiver := newWebhookReceiver(t)
+	// Publish the admin's registration before the webhook exists
+	if err := ts.server.relay.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var hook models.Webhook
+	code := ts.request(http.MethodPost, "/webhooks", gin.H{
+		"url":         receiver.URL,
+		"event_types": []string{models.EventPostCreated, models.EventUserRegistered},
+	}, &hook, admin...)
+	if code != http.StatusCreated || hook.Secret == "" {
+		t.Fatalf("creating webhook: status %d, webhook %+v", code, hook)
+	}
+	deliveriesPath := fmt.Sprintf("/webhooks/%d/deliveries", hook.ID)
+
+	t.Run("validation", func(t *testing.T) {
+		for _, body := range []gin.H{
+			{"url": "ftp://example.com/hook", "event_types": []string{models.EventPostCreated}},
+			{"url": receiver.URL, "event_types": []string{"post.archived"}},
+			{"url": receiver.URL, "event_types": []string{}},
+		} {
+			if code := ts.request(http.MethodPost, "/webhooks", body, nil, admin...); code != http.StatusBadRequest {
+				t.Errorf("%v: status = %d, want %d", body, code, http.StatusBadRequest)
+			}
+		}
+
+		var webhooks []models.Webhook
+		ts.request(http.MethodGet, "/webhooks", nil, &webhooks, admin...)
+		if len(webhooks) != 1 || webhooks[0].Secret != "" {
+			t.Errorf("webhooks = %+v, want the one webhook without its secret", webhooks)
+		}
+	})
+
+	t.Run("events are delivered signed", func(t *testing.T) {
+		member := ts.register("acme", "bob@acme.com", "password123")
+		var post models.Post
+		ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, &post,
+			middleware.TenantHeader, "acme", "Authorization", bearer(member))
+		// Other tenants' events don't reach the webhook
+		ts.register("globex", "carol@globex.com", "password123")
+
+		if err := ts.server.relay.Relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.server.dispatcher.Dispatch(ctx); err != nil {
+			t.Fatal(err)
+		}
+		requests, bodies := receiver.received()
+		if len(requests) != 2 {
+			t.Fatalf("%d deliveries, want 2", len(requests))
+		}
+
+		types := map[string]bool{}
+		for i, req := range requests {
+			var event struct {
+				ID       string
+				Type     string
+				TenantID int `json:"tenant_id"`
+				Data     json.RawMessage
+			}
+			if err := json.Unmarshal(bodies[i], &event); err != nil {
+				t.Fatal(err)
+			}
+			types[event.Type] = true
+			if event.TenantID != acme.ID || req.Header.Get(webhook.EventIDHeader) != event.ID || req.Header.Get(webhook.EventTypeHeader) != event.Type {
+				t.Errorf("delivery %s: headers %v don't match the event %+v", bodies[i], req.Header, event)
+			}
+
+			var sent int64
+			var signature string
+			fmt.Sscanf(strings.Replace(req.Header.Get(webhook.SignatureHeader), ",v1=", " ", 1), "t=%d %s", &sent, &signature)
+			if signature != webhook.Sign(hook.Secret, sent, bodies[i]) {
+				t.Errorf("signature header %q doesn't match the body", req.Header.Get(webhook.SignatureHeader))
+			}
+		}
+		if !types[models.EventPostCreated] || !types[models.EventUserRegistered] {
+			t.Errorf("delivered event types %v, want post.created and user.registered", types)
+		}
+
+		var deliveries []models.WebhookDelivery
+		ts.request(http.MethodGet, deliveriesPath, nil, &deliveries, admin...)
+		if len(deliveries) != 2 || deliveries[0].Status != models.DeliveryDelivered || deliveries[0].Attempts != 1 {
+			t.Errorf("deliveries = %+v, want 2 delivered", deliveries)
+		}
+	})
+
+	t.Run("failures are retried with backoff until they fail", func(t *testing.T) {
+		receiver.setStatus(http.StatusInternalServerError)
+		ts.register("acme", "dave@acme.com", "password123")
+		ts.server.relay.Relay(ctx)
+
+		var deliveries []models.WebhookDelivery
+		for attempt := 1; attempt <= 3; attempt++ {
+			ts.server.dispatcher.Dispatch(ctx)
+			// A delivery isn't retried before its backoff passes
+			ts.server.dispatcher.Dispatch(ctx)
+			ts.request(http.MethodGet, deliveriesPath+"?limit=1", nil, &deliveries, admin...)
+			if len(deliveries) != 1 || deliveries[0].Attempts != attempt {
+				t.Fatalf("after attempt %d: deliveries = %+v", attempt, deliveries)
+			}
+			ts.store.ExpediteWebhookDeliveries(acme.ID)
+		}
+		d := deliveries[0]
+		if d.Status != models.DeliveryFailed || d.LastStatusCode == nil || *d.LastStatusCode != http.StatusInternalServerError || d.LastError == "" {
+			t.Errorf("delivery = %+v, want failed with status 500", d)
+		}
+
+		t.Run("and can be redelivered", func(t *testing.T) {
+			receiver.setStatus(http.StatusNoContent)
+			var redelivery models.WebhookDelivery
+			path := fmt.Sprintf("%s/%d/redeliver", deliveriesPath, d.ID)
+			if code := ts.request(http.MethodPost, path, nil, &redelivery, admin...); code != http.StatusAccepted {
+				t.Fatalf("status = %d, want %d", code, http.StatusAccepted)
+			}
+			if redelivery.EventID != d.EventID || redelivery.Status != models.DeliveryPending {
+				t.Errorf("redelivery = %+v, want the event %s pending", redelivery, d.EventID)
+			}
+
+			ts.server.dispatcher.Dispatch(ctx)
+			ts.request(http.MethodGet, deliveriesPath+"?limit=1", nil, &deliveries, admin...)
+			if len(deliveries) != 1 || deliveries[0].ID != redelivery.ID || deliveries[0].Status != models.DeliveryDelivered {
+				t.Errorf("deliveries = %+v, want the redelivery delivered", deliveries)
+			}
+
+			if code := ts.request(http.MethodPost, deliveriesPath+"/999/redeliver", nil, nil, admin...); code != http.StatusNotFound {
+				t.Errorf("unknown delivery: status = %d, want %d", code, http.StatusNotFound)
+			}
+		})
+	})
+
+	t.Run("private targets are refused unless allowed", func(t *testing.T) {
+		ts := newTestServer(t)
+		tenant := ts.createTenant("Initech", "initech")
+		admin := []string{middleware.TenantHeader, "initech", "Authorization", bearer(ts.register("initech", "admin@initech.com", "password123"))}
+		var private models.Webhook
+		ts.request(http.MethodPost, "/webhooks", gin.H{"url": receiver.URL, "event_types": []string{models.EventPostCreated}}, &private, admin...)
+		ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil, admin...)
+
+		before, _ := receiver.received()
+		ts.server.relay.Relay(ctx)
+		ts.server.dispatcher.Dispatch(ctx)
+		if after, _ := receiver.received(); len(after) != len(before) {
+			t.Error("delivered to a loopback address")
+		}
+		deliveries, _ := ts.store.ListDeliveries(ctx, tenant.ID, private.ID, 1, 0)
+		if len(deliveries) != 1 || !strings.Contains(deliveries[0].LastError, "not a public address") {
+			t.Errorf("deliveries = %+v, want an error about the target", deliveries)
+		}
+	})
+
+	t.Run("members can't manage webhooks", func(t *testing.T) {
+		member := ts.register("acme", "erin@acme.com", "password123")
+		if code := ts.request(http.MethodGet, "/webhooks", nil, nil, middleware.TenantHeader, "acme", "Authorization", bearer(member)); code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("deleting removes the webhook", func(t *testing.T) {
+		path := fmt.Sprintf("/webhooks/%d", hook.ID)
+		if code := ts.request(http.MethodDelete, path, nil, nil, admin...); code != http.StatusNoContent {
+			t.Fatalf("status = %d, want %d", code, http.StatusNoContent)
+		}
+		if code := ts.request(http.MethodGet, deliveriesPath, nil, nil, admin...); code != http.StatusNotFound {
+			t.Errorf("deliveries: status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Webhooks.AllowPrivateTargets = true
+	})
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	receiver := newWebhookReceiver(t)
+	var hook models.Webhook
+	ts.request(http.MethodPost, "/webhooks", gin.H{"url": receiver.URL, "event_types": []string{models.EventPostCreated}}, &hook, admin...)
+
+	var mu sync.Mutex
+	var published []models.Event
+	failures := 1
+	ts.server.bus.Subscribe("test", func(ctx context.Context, event models.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, event)
+		if failures > 0 {
+			failures--
+			return errors.New("unavailable")
+		}
+		return nil
+	}, models.EventPostCreated)
+	publishedCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(published)
+	}
+
+	// Drain the admin's registration, which the test subscriber doesn't get
+	ts.server.relay.Relay(ctx)
+	if n := publishedCount(); n != 0 {
+		t.Fatalf("%d events published to the subscriber, want 0", n)
+	}
+
+	var post models.Post
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, &post, admin...)
+
+	ts.server.relay.Relay(ctx)
+	pending, _ := ts.store.OutboxEvents(acme.ID)
+	if publishedCount() != 1 || len(pending) != 1 || pending[0].Attempts != 1 {
+		t.Fatalf("after a failure: published %d, outbox %+v, want the event kept with 1 attempt", publishedCount(), pending)
+	}
+
+	// Not retried before the backoff passes
+	ts.server.relay.Relay(ctx)
+	if n := publishedCount(); n != 1 {
+		t.Fatalf("published %d times before the backoff passed, want 1", n)
+	}
+
+	ts.store.ExpediteOutboxEvents(acme.ID)
+	ts.server.relay.Relay(ctx)
+	ts.server.relay.Relay(ctx)
+	pending, _ = ts.store.OutboxEvents(acme.ID)
+	if publishedCount() != 2 || len(pending) != 0 {
+		t.Fatalf("after the retry: published %d, outbox %+v, want 2 and empty", publishedCount(), pending)
+	}
+
+	mu.Lock()
+	first, event := published[0], published[1]
+	mu.Unlock()
+	var data models.Post
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != models.EventPostCreated || event.TenantID != acme.ID || event.ID != first.ID || data.ID != post.ID {
+		t.Errorf("event = %+v, want post.created for post %d", event, post.ID)
+	}
+
+	// The webhook, queued both times the event was published, gets it once
+	ts.server.dispatcher.Dispatch(ctx)
+	if requests, _ := receiver.received(); len(requests) != 1 {
+		t.Errorf("%d webhook deliveries, want 1", len(requests))
+	}
+}
+
+// sseEvent is an event read from a Server-Sent Events stream
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSE reads the next event of a stream, skipping comments
+func readSSE(r *bufio.Reader) (sseEvent, error) {
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return e, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.ID != "" || e.Data != "" {
+				return e, nil
+			}
+		case strings.HasPrefix(line, ":"):
+		default:
+			field, value, _ := strings.Cut(line, ": ")
+			switch field {
+			case "id":
+				e.ID = value
+			case "event":
+				e.Event = value
+			case "data":
+				e.Data = value
+			}
+		}
+	}
+}
+
+func TestPostFeed(t *testing.T) {
+	ts := newTestServer(t)
+	acme := ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	token := ts.register("acme", "admin@acme.com", "password123")
+	auth := []string{"Authorization", bearer(token)}
+	globex := []string{"Authorization", bearer(ts.register("globex", "admin@globex.com", "password123"))}
+
+	server := httptest.NewServer(ts.router)
+	t.Cleanup(server.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// openStream opens an SSE stream, authenticated like EventSource would
+	openStream := func(t *testing.T, lastEventID string) *bufio.Reader {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/posts/stream?access_token="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("status = %d, content type %q, want an event stream", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	// readEvents reads n events and checks their types
+	readEvents := func(t *testing.T, r *bufio.Reader, types ...string) []sseEvent {
+		t.Helper()
+		var events []sseEvent
+		for _, want := range types {
+			e, err := readSSE(r)
+			if err != nil {
+				t.Fatalf("reading event: %v", err)
+			}
+			var event models.Event
+			if err := json.Unmarshal([]byte(e.Data), &event); err != nil {
+				t.Fatal(err)
+			}
+			if e.Event != want || event.Type != want || event.TenantID != acme.ID {
+				t.Fatalf("event %+v, want %s of tenant %d", e, want, acme.ID)
+			}
+			events = append(events, e)
+		}
+		return events
+	}
+
+	stream := openStream(t, "")
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Elsewhere", "content": "Content"}, nil, globex...)
+	var post models.Post
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, &post, auth...)
+	path := fmt.Sprintf("/posts/%d", post.ID)
+	ts.request(http.MethodPut, path, gin.H{"title": "Hello", "content": "Edited"}, nil, auth...)
+	ts.request(http.MethodDelete, path, nil, nil, auth...)
+
+	events := readEvents(t, stream, models.EventPostCreated, models.EventPostUpdated, models.EventPostDeleted)
+	var data models.Post
+	json.Unmarshal([]byte(events[1].Data), &struct{ Data *models.Post }{&data})
+	if data.ID != post.ID || data.Content != "Edited" {
+		t.Errorf("post.updated data = %+v, want post %d edited", data, post.ID)
+	}
+
+	t.Run("resumes after Last-Event-ID", func(t *testing.T) {
+		resumed := openStream(t, events[0].ID)
+		replayed := readEvents(t, resumed, models.EventPostUpdated, models.EventPostDeleted)
+		if replayed[0].ID != events[1].ID || replayed[1].ID != events[2].ID {
+			t.Errorf("replayed %+v, want the events after %s", replayed, events[0].ID)
+		}
+
+		// Then carries on live, without repeating the replayed events
+		ts.request(http.MethodPost, "/posts", gin.H{"title": "Again", "content": "World"}, nil, auth...)
+		readEvents(t, resumed, models.EventPostCreated)
+		readEvents(t, stream, models.EventPostCreated)
+	})
+
+	t.Run("WebSocket", func(t *testing.T) {
+		config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http")+"/posts/ws?last_event_id=0", server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Header.Set("Authorization", bearer(token))
+		ws, err := websocket.DialConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		// The tenant's post events so far, then the live ones
+		ts.request(http.MethodPost, "/posts", gin.H{"title": "Live", "content": "World"}, nil, auth...)
+		var received []string
+		var last int64
+		for len(received) < 5 {
+			var event models.FeedEvent
+			if err := websocket.JSON.Receive(ws, &event); err != nil {
+				t.Fatalf("after %v: %v", received, err)
+			}
+			if event.Seq <= last || event.TenantID != acme.ID {
+				t.Errorf("event %+v out of order or of another tenant", event)
+			}
+			last = event.Seq
+			received = append(received, event.Type)
+		}
+		want := []string{models.EventPostCreated, models.EventPostUpdated, models.EventPostDeleted, models.EventPostCreated, models.EventPostCreated}
+		if !slices.Equal(received, want) {
+			t.Errorf("received %v, want %v", received, want)
+		}
+	})
+
+	t.Run("rejected requests", func(t *testing.T) {
+		if code := ts.request(http.MethodGet, "/posts/stream", nil, nil, middleware.TenantHeader, "acme"); code != http.StatusUnauthorized {
+			t.Errorf("unauthenticated: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code := ts.request(http.MethodGet, "/posts/stream?access_token=invalid", nil, nil, middleware.TenantHeader, "acme"); code != http.StatusUnauthorized {
+			t.Errorf("invalid token: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+		if code := ts.request(http.MethodGet, "/posts/stream", nil, nil, append(auth, "Last-Event-ID", "abc")...); code != http.StatusBadRequest {
+			t.Errorf("invalid Last-Event-ID: status = %d, want %d", code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("shutting down ends the streams", func(t *testing.T) {
+		ts.server.CloseStreams()
+		// After the event of the WebSocket subtest still unread
+		readEvents(t, stream, models.EventPostCreated)
+		if e, err := readSSE(stream); err != io.EOF {
+			t.Errorf("read %+v, %v, want the stream to end", e, err)
+		}
+		if code := ts.request(http.MethodGet, "/posts/stream", nil, nil, auth...); code != http.StatusServiceUnavailable {
+			t.Errorf("new stream: status = %d, want %d", code, http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// upload posts an archive with the form fields as multipart form data and
+// decodes the JSON response into out, if not nil
+func (ts *testServer) upload(path string, archive []byte, fields map[string]string, out interface{}, headers ...string) int {
+	ts.t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	part, err := mw.CreateFormFile("archive", "export.tar.gz")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	part.Write(archive)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			ts.t.Fatalf("POST %s: decoding response %q: %v", path, w.Body.String(), err)
+		}
+	}
+	return w.Code
+}
+
+func TestTenantExport(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	ts.createTenant("Globex", "globex")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	member := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "bob@acme.com", "password123"))}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	var post models.Post
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, &post, member...)
+	settings := &models.TenantSettings{RegistrationMode: models.RegistrationInviteOnly, AllowedEmailDomains: []string{}}
+	if err := ts.store.UpdateTenantSettings(ctx, acme.ID, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	exportPath := fmt.Sprintf("/tenants/%d/export", acme.ID)
+	if code := ts.request(http.MethodPost, exportPath, nil, nil, member...); code != http.StatusForbidden {
+		t.Errorf("export by a member: status = %d, want %d", code, http.StatusForbidden)
+	}
+	globex := []string{middleware.TenantHeader, "globex", "Authorization", bearer(ts.register("globex", "carol@globex.com", "password123"))}
+	if code := ts.request(http.MethodPost, exportPath, nil, nil, globex...); code != http.StatusForbidden {
+		t.Errorf("export by another tenant's admin: status = %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Bob changes the password of his global identity in Globex
+	ts.verifyEmail("acme", "bob@acme.com")
+	bobGlobex := []string{middleware.TenantHeader, "globex", "Authorization", bearer(ts.register("globex", "bob@acme.com", "password123"))}
+	change := gin.H{"current_password": "password123", "new_password": "identity-password"}
+	if code := ts.request(http.MethodPost, "/me/password", change, nil, bobGlobex...); code != http.StatusOK {
+		t.Fatalf("changing bob's password: status %d", code)
+	}
+	bob, err := ts.store.UserByEmail(ctx, acme.ID, "bob@acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := ts.store.IdentityByUser(ctx, acme.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var job models.Job
+	if code := ts.request(http.MethodPost, exportPath, nil, &job, admin...); code != http.StatusAccepted || job.Status != models.JobPending {
+		t.Fatalf("export: status %d, job %+v", code, job)
+	}
+	jobPath := fmt.Sprintf("/tenants/%d/exports/%d", acme.ID, job.ID)
+	if code := ts.request(http.MethodGet, jobPath+"/archive", nil, nil, admin...); code != http.StatusConflict {
+		t.Errorf("download before completion: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := ts.request(http.MethodGet, fmt.Sprintf("/admin/tenants/%d/exports/%d", acme.ID+1, job.ID), nil, nil, platform...); code != http.StatusNotFound {
+		t.Errorf("export of another tenant: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, jobPath, nil, &job, admin...)
+	if job.Status != models.JobCompleted || job.Attempts != 1 || job.CompletedAt == nil {
+		t.Fatalf("job = %+v, want completed after 1 attempt", job)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin"+jobPath+"/archive", nil)
+	req.Header.Set(middleware.AdminKeyHeader, "test-admin-key")
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("download: status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive := w.Body.Bytes()
+
+	manifest, data, err := transfer.Read(bytes.NewReader(archive), ts.store.TenantSchemaVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Tenant.Slug != "acme" || manifest.Settings.RegistrationMode != models.RegistrationInviteOnly {
+		t.Errorf("manifest = %+v, want acme's tenant and settings", manifest)
+	}
+	if len(data.Users) != 2 || len(data.Posts) != 1 || data.Users[0].PasswordHash == "" {
+		t.Errorf("data = %+v, want 2 users with password hashes and 1 post", data)
+	}
+	for _, u := range data.Users {
+		if u.PasswordHash == identity.Password {
+			t.Errorf("user %s was exported with the password hash of their global identity", u.Email)
+		}
+	}
+
+	var imported models.Job
+	code := ts.upload("/admin/tenants/import", archive, map[string]string{"name": "Acme Copy"}, &imported, platform...)
+	if code != http.StatusAccepted || imported.TenantID != 0 {
+		t.Fatalf("import: status %d, job %+v", code, imported)
+	}
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, fmt.Sprintf("/admin/tenants/imports/%d", imported.ID), nil, &imported, platform...)
+	if imported.Status != models.JobCompleted || imported.TenantID == 0 {
+		t.Fatalf("import job = %+v, want completed with a tenant", imported)
+	}
+
+	t.Run("imported tenant", func(t *testing.T) {
+		tenant, err := ts.store.TenantByID(ctx, imported.TenantID)
+		if err != nil || tenant.Slug != "acme-copy" {
+			t.Fatalf("tenant = %+v, %v, want acme-copy", tenant, err)
+		}
+		var resp struct{ Token string }
+		body := gin.H{"email": "bob@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/login", body, &resp, middleware.TenantHeader, "acme-copy"); code != http.StatusOK {
+			t.Fatalf("login: status %d, want %d", code, http.StatusOK)
+		}
+		user, err := ts.store.UserByEmail(ctx, tenant.ID, "bob@acme.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var posts []models.Post
+		ts.request(http.MethodGet, "/posts", nil, &posts, middleware.TenantHeader, "acme-copy", "Authorization", bearer(resp.Token))
+		if len(posts) != 1 || posts[0].Title != "Hello" || posts[0].UserID != user.ID {
+			t.Errorf("posts = %+v, want the post of user %d", posts, user.ID)
+		}
+		copied, err := ts.store.TenantSettings(ctx, tenant.ID)
+		if err != nil || copied.RegistrationMode != models.RegistrationInviteOnly {
+			t.Errorf("settings = %+v, %v, want invite only", copied, err)
+		}
+	})
+
+	t.Run("rejected archives", func(t *testing.T) {
+		if code := ts.upload("/admin/tenants/import", archive, map[string]string{"name": "Acme Copy"}, nil, platform...); code != http.StatusConflict {
+			t.Errorf("existing slug: status = %d, want %d", code, http.StatusConflict)
+		}
+		if code := ts.upload("/admin/tenants/import", []byte("not an archive"), map[string]string{"name": "Junk"}, nil, platform...); code != http.StatusBadRequest {
+			t.Errorf("junk: status = %d, want %d", code, http.StatusBadRequest)
+		}
+
+		var newer bytes.Buffer
+		if err := transfer.Write(&newer, &transfer.Manifest{SchemaVersion: ts.store.TenantSchemaVersion() + 1, Settings: *settings}, data); err != nil {
+			t.Fatal(err)
+		}
+		var resp struct{ Error string }
+		code := ts.upload("/admin/tenants/import", newer.Bytes(), map[string]string{"name": "Future"}, &resp, platform...)
+		if code != http.StatusBadRequest || !strings.Contains(resp.Error, "schema version") {
+			t.Errorf("newer schema: status %d, error %q, want %d", code, resp.Error, http.StatusBadRequest)
+		}
+		if code := ts.upload("/admin/tenants/import", archive, map[string]string{"name": "Acme Copy"}, nil); code != http.StatusUnauthorized {
+			t.Errorf("without the admin key: status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("interrupted import is resumed", func(t *testing.T) {
+		var job models.Job
+		ts.upload("/admin/tenants/import", archive, map[string]string{"name": "Acme Resumed"}, &job, platform...)
+
+		// A replica claims the job and commits the data, then stops before
+		// recording the outcome
+		claimed, err := ts.store.ClaimJob(ctx, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.server.transfer.Import(ctx, claimed); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.server.runner.RunPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := ts.store.JobByID(ctx, job.ID); stored.Status != models.JobRunning {
+			t.Fatalf("job = %+v, want running until its lease expires", stored)
+		}
+
+		ts.store.ExpireJobLeases()
+		if err := ts.server.runner.RunPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		stored, _ := ts.store.JobByID(ctx, job.ID)
+		if stored.Status != models.JobCompleted || stored.Attempts != 2 || stored.TenantID != claimed.TenantID {
+			t.Fatalf("job = %+v, want completed after 2 attempts with tenant %d", stored, claimed.TenantID)
+		}
+		data, err := ts.store.ExportTenantData(ctx, claimed.TenantID)
+		if err != nil || len(data.Users) != 2 || len(data.Posts) != 1 {
+			t.Errorf("data = %+v, %v, want the records imported once", data, err)
+		}
+	})
+}
+
+func TestTenantSnapshots(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	var post models.Post
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Before", "content": "Snapshot"}, &post, admin...)
+
+	snapshotsPath := fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID)
+	if code := ts.request(http.MethodPost, snapshotsPath, nil, nil, admin...); code != http.StatusUnauthorized {
+		t.Errorf("snapshot without the admin key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ts.request(http.MethodPost, fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID+99), nil, nil, platform...); code != http.StatusNotFound {
+		t.Errorf("snapshot of a missing tenant: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	var job models.Job
+	if code := ts.request(http.MethodPost, snapshotsPath, gin.H{"label": "Before the cleanup"}, &job, platform...); code != http.StatusAccepted || job.Type != models.JobSnapshot {
+		t.Fatalf("snapshot: status %d, job %+v", code, job)
+	}
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, fmt.Sprintf("/admin/jobs/%d", job.ID), nil, &job, platform...)
+	if job.Status != models.JobCompleted {
+		t.Fatalf("job = %+v, want completed", job)
+	}
+
+	var snapshots []models.Snapshot
+	ts.request(http.MethodGet, snapshotsPath, nil, &snapshots, platform...)
+	if len(snapshots) != 1 || snapshots[0].JobID != job.ID || snapshots[0].Label != "Before the cleanup" ||
+		snapshots[0].Method != models.SnapshotLogical || snapshots[0].Size == 0 || snapshots[0].SchemaVersion != ts.store.TenantSchemaVersion() {
+		t.Fatalf("snapshots = %+v, want the snapshot of job %d", snapshots, job.ID)
+	}
+	snapshot := snapshots[0]
+	snapshotPath := fmt.Sprintf("%s/%d", snapshotsPath, snapshot.ID)
+	globex := ts.createTenant("Globex", "globex")
+	if code := ts.request(http.MethodGet, fmt.Sprintf("/admin/tenants/%d/snapshots/%d", globex.ID, snapshot.ID), nil, nil, platform...); code != http.StatusNotFound {
+		t.Errorf("snapshot of another tenant: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Changes made after the snapshot are undone by restoring it
+	ts.request(http.MethodDelete, fmt.Sprintf("/posts/%d", post.ID), nil, nil, admin...)
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "After", "content": "Snapshot"}, nil, admin...)
+	ts.verifyEmail("acme", "admin@acme.com")
+	user, err := ts.store.UserByEmail(ctx, acme.ID, "admin@acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.IdentityByUser(ctx, acme.ID, user.ID); err != nil {
+		t.Fatalf("identity before the restore: %v", err)
+	}
+
+	if code := ts.request(http.MethodPost, snapshotPath+"/restore", gin.H{"target": "elsewhere"}, nil, platform...); code != http.StatusBadRequest {
+		t.Errorf("unknown target: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := ts.request(http.MethodPost, snapshotPath+"/restore", gin.H{"target": "new"}, nil, platform...); code != http.StatusBadRequest {
+		t.Errorf("new tenant without a name: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := ts.request(http.MethodPost, snapshotPath+"/restore", gin.H{"target": "new", "name": "Globex"}, nil, platform...); code != http.StatusConflict {
+		t.Errorf("new tenant with a taken slug: status = %d, want %d", code, http.StatusConflict)
+	}
+
+	var restore models.Job
+	if code := ts.request(http.MethodPost, snapshotPath+"/restore", gin.H{"target": "existing"}, &restore, platform...); code != http.StatusAccepted || restore.TenantID != acme.ID {
+		t.Fatalf("restore: status %d, job %+v", code, restore)
+	}
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, fmt.Sprintf("/admin/jobs/%d", restore.ID), nil, &restore, platform...)
+	if restore.Status != models.JobCompleted {
+		t.Fatalf("restore job = %+v, want completed", restore)
+	}
+
+	var posts []models.Post
+	ts.request(http.MethodGet, "/posts", nil, &posts, admin...)
+	if len(posts) != 1 || posts[0].ID != post.ID || posts[0].Title != "Before" {
+		t.Errorf("posts = %+v, want the post of the snapshot", posts)
+	}
+	if _, err := ts.store.IdentityByUser(ctx, acme.ID, user.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("identity after the restore: %v, want the membership removed", err)
+	}
+	var created models.Post
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Next", "content": "Post"}, &created, admin...)
+	if created.ID <= post.ID {
+		t.Errorf("new post ID = %d, want after %d", created.ID, post.ID)
+	}
+
+	t.Run("restore into a new tenant", func(t *testing.T) {
+		var job models.Job
+		code := ts.request(http.MethodPost, snapshotPath+"/restore", gin.H{"target": "new", "name": "Acme Restored"}, &job, platform...)
+		if code != http.StatusAccepted || job.TenantID != 0 {
+			t.Fatalf("restore: status %d, job %+v", code, job)
+		}
+		if err := ts.server.runner.RunPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		ts.request(http.MethodGet, fmt.Sprintf("/admin/jobs/%d", job.ID), nil, &job, platform...)
+		if job.Status != models.JobCompleted || job.TenantID == 0 {
+			t.Fatalf("job = %+v, want completed with a tenant", job)
+		}
+
+		var resp struct{ Token string }
+		body := gin.H{"email": "admin@acme.com", "password": "password123"}
+		if code := ts.request(http.MethodPost, "/login", body, &resp, middleware.TenantHeader, "acme-restored"); code != http.StatusOK {
+			t.Fatalf("login: status %d, want %d", code, http.StatusOK)
+		}
+		var posts []models.Post
+		ts.request(http.MethodGet, "/posts", nil, &posts, middleware.TenantHeader, "acme-restored", "Authorization", bearer(resp.Token))
+		if len(posts) != 1 || posts[0].Title != "Before" {
+			t.Errorf("posts = %+v, want the post of the snapshot", posts)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if code := ts.request(http.MethodDelete, snapshotPath, nil, nil, platform...); code != http.StatusNoContent {
+			t.Fatalf("delete: status = %d, want %d", code, http.StatusNoContent)
+		}
+		if code := ts.request(http.MethodGet, snapshotPath, nil, nil, platform...); code != http.StatusNotFound {
+			t.Errorf("deleted snapshot: status = %d, want %d", code, http.StatusNotFound)
+		}
+		key := fmt.Sprintf("snapshots/%d/%d.snapshot", acme.ID, snapshot.JobID)
+		if _, err := ts.server.archives.Get(ctx, key); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("archive of the deleted snapshot: %v, want it deleted", err)
+		}
+	})
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Backup.RetentionCount = 2
+		cfg.Backup.RetentionDays = 30
+	})
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	snapshotsPath := fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID)
+
+	var jobs []int64
+	for i := 0; i < 3; i++ {
+		var job models.Job
+		ts.request(http.MethodPost, snapshotsPath, nil, &job, platform...)
+		if err := ts.server.runner.RunPending(ctx); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, job.ID)
+	}
+	var snapshots []models.Snapshot
+	ts.request(http.MethodGet, snapshotsPath, nil, &snapshots, platform...)
+	if len(snapshots) != 2 || snapshots[0].JobID != jobs[2] || snapshots[1].JobID != jobs[1] {
+		t.Fatalf("snapshots = %+v, want the newest 2", snapshots)
+	}
+
+	ts.store.AgeSnapshots(acme.ID, 31*24*time.Hour)
+	if err := ts.server.backup.Prune(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, snapshotsPath, nil, &snapshots, platform...)
+	if len(snapshots) != 0 {
+		t.Errorf("snapshots = %+v, want the expired ones deleted", snapshots)
+	}
+}
+
+func TestSnapshotsInS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			hash := sha256.Sum256(body)
+			if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer s3.Close()
+
+	ts := newTestServerWithConfig(t, func(cfg *config.Config) {
+		cfg.Storage.Backend = "s3"
+		cfg.Storage.S3Endpoint = s3.URL
+		cfg.Storage.S3Bucket = "snapshots"
+		cfg.Storage.S3AccessKeyID = "test-key"
+		cfg.Storage.S3SecretAccessKey = "test-secret"
+	})
+	ctx := context.Background()
+	acme := ts.createTenant("Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.register("acme", "admin@acme.com", "password123"))}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Stored", "content": "In S3"}, nil, admin...)
+
+	var job models.Job
+	ts.request(http.MethodPost, fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID), nil, &job, platform...)
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var snapshots []models.Snapshot
+	ts.request(http.MethodGet, fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID), nil, &snapshots, platform...)
+	if len(snapshots) != 1 {
+		t.Fatalf("snapshots = %+v, want 1", snapshots)
+	}
+	key := fmt.Sprintf("/snapshots/snapshots/%d/%d.snapshot", acme.ID, job.ID)
+	mu.Lock()
+	stored := int64(len(objects[key]))
+	mu.Unlock()
+	if stored == 0 || stored != snapshots[0].Size {
+		t.Fatalf("object %s has %d bytes, want the snapshot's %d", key, stored, snapshots[0].Size)
+	}
+
+	var restore models.Job
+	path := fmt.Sprintf("/admin/tenants/%d/snapshots/%d/restore", acme.ID, snapshots[0].ID)
+	ts.request(http.MethodPost, path, gin.H{"target": "new", "name": "Acme Copy"}, &restore, platform...)
+	if err := ts.server.runner.RunPending(ctx); err != nil {
+		t.Fatal(err)
+	}
+	ts.request(http.MethodGet, fmt.Sprintf("/admin/jobs/%d", restore.ID), nil, &restore, platform...)
+	if restore.Status != models.JobCompleted {
+		t.Fatalf("restore job = %+v, want completed", restore)
+	}
+	data, err := ts.store.ExportTenantData(ctx, restore.TenantID)
+	if err != nil || len(data.Posts) != 1 || data.Posts[0].Title != "Stored" {
+		t.Errorf("data = %+v, %v, want the post of the snapshot", data, err)
+	}
+}
+
+func TestTenantTemplates(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	demo := ts.createTenant("Demo", "demo")
+	author := []string{middleware.TenantHeader, "demo", "Authorization", bearer(ts.register("demo", "author@demo.com", "password123"))}
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Welcome", "content": "Sample content"}, nil, author...)
+	settings := &models.TenantSettings{RegistrationMode: models.RegistrationDomainRestricted, AllowedEmailDomains: []string{"acme.com"}}
+	if err := ts.store.UpdateTenantSettings(ctx, demo.ID, settings); err != nil {
+		t.Fatal(err)
+	}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+
+	body := gin.H{"name": "Acme", "template_id": demo.ID, "copy_settings": true, "seed_data": true}
+	if code := ts.request(http.MethodPost, "/tenants", body, nil, platform...); code != http.StatusNotFound {
+		t.Errorf("tenant that isn't a template: status = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := ts.request(http.MethodPut, fmt.Sprintf("/admin/tenants/%d/template", demo.ID), gin.H{"is_template": true}, nil); code != http.StatusUnauthorized {
+		t.Errorf("marking without the admin key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ts.request(http.MethodPut, fmt.Sprintf("/admin/tenants/%d/template", demo.ID), gin.H{}, nil, platform...); code != http.StatusBadRequest {
+		t.Errorf("marking without a state: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	var marked models.Tenant
+	if code := ts.request(http.MethodPut, fmt.Sprintf("/admin/tenants/%d/template", demo.ID), gin.H{"is_template": true}, &marked, platform...); code != http.StatusOK || !marked.IsTemplate {
+		t.Fatalf("marking: status %d, tenant %+v", code, marked)
+	}
+
+	// Only platform admins create tenants from templates
+	if code := ts.request(http.MethodPost, "/tenants", body, nil); code != http.StatusUnauthorized {
+		t.Errorf("without the admin key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ts.request(http.MethodPost, "/tenants", body, nil, middleware.AdminKeyHeader, "wrong-key"); code != http.StatusUnauthorized {
+		t.Errorf("with a wrong admin key: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ts.request(http.MethodPost, "/tenants", gin.H{"name": "Initech", "seed_data": true}, nil, platform...); code != http.StatusBadRequest {
+		t.Errorf("seed data without a template: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	var acme models.Tenant
+	if code := ts.request(http.MethodPost, "/tenants", body, &acme, platform...); code != http.StatusCreated || acme.Slug != "acme" || acme.IsTemplate {
+		t.Fatalf("create from template: status %d, tenant %+v", code, acme)
+	}
+	if code := ts.request(http.MethodPost, "/tenants", body, nil, platform...); code != http.StatusConflict {
+		t.Errorf("taken name: status = %d, want %d", code, http.StatusConflict)
+	}
+	if code := ts.request(http.MethodPost, "/tenants", gin.H{"name": "Nowhere", "template_id": 999}, nil, platform...); code != http.StatusNotFound {
+		t.Errorf("missing template: status = %d, want %d", code, http.StatusNotFound)
+	}
+
+	copied, err := ts.store.TenantSettings(ctx, acme.ID)
+	if err != nil || copied.RegistrationMode != models.RegistrationDomainRestricted || !slices.Equal(copied.AllowedEmailDomains, []string{"acme.com"}) {
+		t.Errorf("settings = %+v, %v, want the template's", copied, err)
+	}
+
+	// The template's users aren't copied, so its credentials don't open the
+	// new tenant, and the first user registering becomes the admin once their
+	// email is verified, as the copied settings require
+	login := gin.H{"email": "author@demo.com", "password": "password123"}
+	if code := ts.request(http.MethodPost, "/login", login, nil, middleware.TenantHeader, "acme"); code != http.StatusUnauthorized {
+		t.Errorf("login of a template user: status = %d, want %d", code, http.StatusUnauthorized)
+	}
+	ts.register("acme", "alice@acme.com", "password123")
+	ts.verifyEmail("acme", "alice@acme.com")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.login("acme", "alice@acme.com", "password123"))}
+	var me models.User
+	ts.request(http.MethodGet, "/me", nil, &me, admin...)
+	if me.Role != models.RoleAdmin {
+		t.Errorf("role of the first user = %q, want %q", me.Role, models.RoleAdmin)
+	}
+	ts.register("acme", "bob@acme.com", "password123")
+	ts.verifyEmail("acme", "bob@acme.com")
+	member := []string{middleware.TenantHeader, "acme", "Authorization", bearer(ts.login("acme", "bob@acme.com", "password123"))}
+	ts.request(http.MethodGet, "/me", nil, &me, member...)
+	if me.Role != models.RoleMember {
+		t.Errorf("role of the second user = %q, want %q", me.Role, models.RoleMember)
+	}
+
+	var users []models.User
+	ts.request(http.MethodGet, "/users", nil, &users, admin...)
+	if len(users) != 3 {
+		t.Errorf("users = %+v, want the seed author, alice and bob", users)
+	}
+	for _, u := range users {
+		if u.Email == "author@demo.com" || (u.Email == models.SeedAuthorEmail && u.Active) {
+			t.Errorf("user %+v, want no template users and an inactive seed author", u)
+		}
+	}
+	var posts []models.Post
+	ts.request(http.MethodGet, "/posts", nil, &posts, admin...)
+	if len(posts) != 1 || posts[0].Title != "Welcome" {
+		t.Errorf("posts = %+v, want the template's", posts)
+	}
+
+	// The copy is independent of the template
+	ts.request(http.MethodPost, "/posts", gin.H{"title": "Ours", "content": "Acme"}, nil, admin...)
+	ts.request(http.MethodGet, "/posts", nil, &posts, author...)
+	if len(posts) != 1 {
+		t.Errorf("template has %d posts, want 1", len(posts))
+	}
+
+	t.Run("settings and seed data are opt-in", func(t *testing.T) {
+		var globex models.Tenant
+		if code := ts.request(http.MethodPost, "/tenants", gin.H{"name": "Globex", "template_id": demo.ID}, &globex, platform...); code != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+		}
+		settings, err := ts.store.TenantSettings(ctx, globex.ID)
+		if err != nil || settings.RegistrationMode != models.RegistrationOpen {
+			t.Errorf("settings = %+v, %v, want the defaults", settings, err)
+		}
+		data, err := ts.store.ExportTenantData(ctx, globex.ID)
+		if err != nil || len(data.Users) != 0 || len(data.Posts) != 0 {
+			t.Errorf("data = %+v, %v, want an empty tenant", data, err)
+		}
+	})
+}
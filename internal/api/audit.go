@@ -0,0 +1,240 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+)
+
+// Export formats of the audit log endpoints
+const (
+	auditFormatJSON  = "json"
+	auditFormatJSONL = "jsonl"
+	auditFormatCSV   = "csv"
+)
+
+// @Summary     List audit events
+// @Description List the audit events of the current tenant, newest first, or export every matching event oldest first as JSON Lines or CSV (admin only)
+// @Tags        audit
+// @Produce     json
+// @Produce     plain
+// @Security    BearerAuth
+// @Param       actor_user_id query int false "Filter by acting user"
+// @Param       action query string false "Filter by action, e.g. user.update"
+// @Param       target_type query string false "Filter by target type, e.g. user"
+// @Param       target_id query string false "Filter by target ID"
+// @Param       from query string false "Only events at or after this RFC 3339 time"
+// @Param       to query string false "Only events before this RFC 3339 time"
+// @Param       format query string false "json, or jsonl or csv to export" Enums(json, jsonl, csv) default(json)
+// @Param       limit query int false "Maximum number of events to return, ignored by exports" default(50)
+// @Param       offset query int false "Number of events to skip, ignored by exports" default(0)
+// @Success     200 {array} models.AuditEvent "Audit events"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /audit [get]
+func (s *Server) GetAuditEvents(c *gin.Context) {
+	s.listAuditEvents(c, c.GetInt("tenant_id"))
+}
+
+// @Summary     Verify the audit log
+// @Description Check the hash chain of the current tenant's audit log (admin only)
+// @Tags        audit
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {object} models.AuditVerification "Verification result"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /audit/verify [get]
+func (s *Server) VerifyAuditLog(c *gin.Context) {
+	s.verifyAuditLog(c, c.GetInt("tenant_id"))
+}
+
+// @Summary     List platform audit events
+// @Description List the platform audit events, like tenant creation and requests that didn't resolve a tenant, newest first, or export them oldest first as JSON Lines or CSV (platform admin only)
+// @Tags        audit
+// @Produce     json
+// @Produce     plain
+// @Security    AdminKey
+// @Param       actor_user_id query int false "Filter by acting user"
+// @Param       action query string false "Filter by action, e.g. tenant.create"
+// @Param       target_type query string false "Filter by target type, e.g. tenant"
+// @Param       target_id query string false "Filter by target ID"
+// @Param       from query string false "Only events at or after this RFC 3339 time"
+// @Param       to query string false "Only events before this RFC 3339 time"
+// @Param       format query string false "json, or jsonl or csv to export" Enums(json, jsonl, csv) default(json)
+// @Param       limit query int false "Maximum number of events to return, ignored by exports" default(50)
+// @Param       offset query int false "Number of events to skip, ignored by exports" default(0)
+// @Success     200 {array} models.AuditEvent "Audit events"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/audit [get]
+func (s *Server) GetPlatformAuditEvents(c *gin.Context) {
+	s.listAuditEvents(c, 0)
+}
+
+// @Summary     Verify the platform audit log
+// @Description Check the hash chain of the platform audit log (platform admin only)
+// @Tags        audit
+// @Produce     json
+// @Security    AdminKey
+// @Success     200 {object} models.AuditVerification "Verification result"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/audit/verify [get]
+func (s *Server) VerifyPlatformAuditLog(c *gin.Context) {
+	s.verifyAuditLog(c, 0)
+}
+
+// listAuditEvents serves the events of a tenant's log, or of the platform log
+// for tenant 0
+func (s *Server) listAuditEvents(c *gin.Context, tenantID int) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+
+	format := c.DefaultQuery("format", auditFormatJSON)
+	switch format {
+	case auditFormatJSON:
+		if filter.Limit, filter.Offset, ok = pagination(c); !ok {
+			return
+		}
+	case auditFormatJSONL, auditFormatCSV:
+		// Exports hold every matching event in chain order
+		filter.Ascending = true
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format, must be json, jsonl or csv"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	events, err := s.audit.ListAuditEvents(ctx, tenantID, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error fetching audit events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching audit events"})
+		return
+	}
+
+	switch format {
+	case auditFormatJSONL:
+		c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		encoder := json.NewEncoder(c.Writer)
+		for i := range events {
+			if err := encoder.Encode(&events[i]); err != nil {
+				return
+			}
+		}
+	case auditFormatCSV:
+		c.Header("Content-Disposition", `attachment; filename="audit.csv"`)
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		writeAuditCSV(c.Writer, events)
+	default:
+		c.JSON(http.StatusOK, events)
+	}
+}
+
+// verifyAuditLog checks the hash chain of a tenant's log, or of the platform
+// log for tenant 0
+func (s *Server) verifyAuditLog(c *gin.Context, tenantID int) {
+	ctx := c.Request.Context()
+	events, err := s.audit.ListAuditEvents(ctx, tenantID, models.AuditFilter{Ascending: true})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error fetching audit events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching audit events"})
+		return
+	}
+
+	c.JSON(http.StatusOK, audit.Verify(events))
+}
+
+// auditFilter parses the filter query parameters, writing a bad request
+// response when one is invalid
+func auditFilter(c *gin.Context) (models.AuditFilter, bool) {
+	filter := models.AuditFilter{
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+	}
+
+	if value := c.Query("actor_user_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid actor_user_id filter"})
+			return filter, false
+		}
+		filter.ActorUserID = id
+	}
+
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s filter, must be an RFC 3339 time", bound.param)})
+			return filter, false
+		}
+		*bound.value = t
+	}
+
+	return filter, true
+}
+
+// auditCSVHeader names the columns written by writeAuditCSV
+var auditCSVHeader = []string{"id", "occurred_at", "tenant_id", "actor_user_id", "actor_email", "action", "target_type",
+	"target_id", "ip", "request_id", "status", "before", "after", "prev_hash", "hash"}
+
+// writeAuditCSV writes the events as CSV, with before and after as JSON
+func writeAuditCSV(w http.ResponseWriter, events []models.AuditEvent) {
+	optional := func(id *int) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.Itoa(*id)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write(auditCSVHeader)
+	for _, e := range events {
+		writer.Write([]string{
+			strconv.FormatInt(e.ID, 10),
+			e.OccurredAt.Format(time.RFC3339Nano),
+			optional(e.TenantID),
+			optional(e.ActorUserID),
+			e.ActorEmail,
+			e.Action,
+			e.TargetType,
+			e.TargetID,
+			e.IP,
+			e.RequestID,
+			strconv.Itoa(e.Status),
+			string(e.Before),
+			string(e.After),
+			e.PrevHash,
+			e.Hash,
+		})
+	}
+	writer.Flush()
+}
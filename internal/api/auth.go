@@ -6,9 +6,10 @@ import (
 
 	"github.com/gin-gonic/gin"
 
-	"golang-multi-tenant/internal/database"
-	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
 	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
 )
 
 // @Summary     Register a new user
@@ -16,60 +17,100 @@ import (
 // @Tags        auth
 // @Accept      json
 // @Produce     json
+// @Param       X-Tenant header string false "Tenant slug"
 // @Param       request body models.RegisterRequest true "Registration details"
-// @Success     201 {object} map[string]interface{} "User registered successfully"
+// @Success     201 {object} map[string]interface{} "User registered successfully, without a token if the email must be verified first"
 // @Failure     400 {object} map[string]string "Bad request"
+// @Failure     403 {object} map[string]string "Registration not allowed or user quota exceeded"
 // @Failure     409 {object} map[string]string "User already exists"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /register [post]
-func Register(c *gin.Context) {
+func (s *Server) Register(c *gin.Context) {
 	var req models.RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !checkPasswordPolicy(c, req.Password) {
+		return
+	}
 
-	// Get tenant database
-	tenantDB, err := database.GetTenantDB(req.TenantID)
+	// Resolve tenant from the host, header or path
+	tenantID, err := requestTenantID(c, req.TenantID)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.tenants.TenantByID(ctx, tenantID); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
 		return
 	}
+	audit.Describe(c, audit.Details{TenantID: tenantID, ActorEmail: req.Email, Action: "user.register"})
 
-	// Check if user already exists
-	var exists bool
-	err = tenantDB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = $1)", req.Email).Scan(&exists)
+	// Enforce the tenant's registration mode
+	settings, err := s.tenants.TenantSettings(ctx, tenantID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	if err := checkRegistrationAllowed(settings, req.Email); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
 
-	if exists {
+	// Check if user already exists
+	if _, err := s.users.UserByEmail(ctx, tenantID, req.Email); err == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 		return
+	} else if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !s.checkQuota(c, tenantID, models.QuotaUsers) {
+		return
 	}
 
-	// Hash password
-	hashedPassword, err := models.HashPassword(req.Password)
+	hashedPassword, err := models.HashPassword(ctx, req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
 		return
 	}
 
-	// Create user in tenant database
-	var userID int
-	err = tenantDB.QueryRow(`
-        INSERT INTO users (email, password)
-        VALUES ($1, $2)
-        RETURNING id`,
-		req.Email, hashedPassword).Scan(&userID)
-	if err != nil {
+	// Domain-restricted tenants only admit users who prove the email is
+	// theirs, so their users stay inactive until then
+	verify := settings.RegistrationMode == models.RegistrationDomainRestricted
+
+	// Create user in tenant database; the first user of a tenant without active
+	// users becomes its admin
+	user, err := s.users.CreateUser(ctx, tenantID, req.Email, hashedPassword, !verify)
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
 		return
 	}
 
+	// Knowing the password of the global account with the email proves it too
+	if s.claimIdentity(c, tenantID, user, req.Password, verify) && verify {
+		active := true
+		if user, err = s.users.UpdateUser(ctx, tenantID, user.ID, models.UpdateUserRequest{Active: &active}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+			return
+		}
+	}
+	audit.Describe(c, audit.Details{ActorUserID: user.ID, TargetType: "user", TargetID: audit.Target(user.ID), After: user})
+
+	if !user.Active {
+		c.JSON(http.StatusCreated, gin.H{"message": "User registered, verify your email to activate your account"})
+		return
+	}
+
 	// Generate JWT token
-	token, err := middleware.GenerateToken(userID, req.TenantID, req.Email)
+	token, err := s.tokens.GenerateToken(user.ID, tenantID, user.Email)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
@@ -86,35 +127,59 @@ func Register(c *gin.Context) {
 // @Tags        auth
 // @Accept      json
 // @Produce     json
+// @Param       X-Tenant header string false "Tenant slug"
 // @Param       request body models.LoginRequest true "Login credentials"
 // @Success     200 {object} map[string]interface{} "Login successful"
 // @Failure     400 {object} map[string]string "Bad request"
 // @Failure     401 {object} map[string]string "Invalid credentials"
+// @Failure     403 {object} map[string]string "Account is deactivated"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /login [post]
-func Login(c *gin.Context) {
+func (s *Server) Login(c *gin.Context) {
 	var req models.LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get tenant database
-	tenantDB, err := database.GetTenantDB(req.TenantID)
+	// Resolve tenant from the host, header or path
+	tenantID, err := requestTenantID(c, req.TenantID)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.tenants.TenantByID(ctx, tenantID); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
 		return
 	}
+	audit.Describe(c, audit.Details{TenantID: tenantID, ActorEmail: req.Email, Action: "user.login"})
 
-	var user models.User
+	// Look the user up through their global identity first, falling back to
+	// users that haven't been linked to an identity yet
+	var user *models.User
 	var hashedPassword string
-	err = tenantDB.QueryRow(`
-        SELECT id, email, password
-        FROM users
-        WHERE email = $1`,
-		req.Email).Scan(&user.ID, &user.Email, &hashedPassword)
+	linked := false
+	ident, err := s.identities.IdentityByEmail(ctx, req.Email)
+	if err == nil {
+		var userID int
+		userID, err = s.identities.MemberUserID(ctx, ident.ID, tenantID)
+		if err == nil {
+			linked = true
+			hashedPassword = ident.Password
+			user, err = s.users.UserByID(ctx, tenantID, userID)
+		}
+	}
+	if err == sql.ErrNoRows && !linked {
+		user, err = s.users.UserByEmail(ctx, tenantID, req.Email)
+		if err == nil {
+			hashedPassword = user.Password
+		}
+	}
 
 	if err == sql.ErrNoRows {
+		s.metrics.Login(false)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	} else if err != nil {
@@ -123,18 +188,53 @@ func Login(c *gin.Context) {
 	}
 
 	// Check password
-	if !models.CheckPassword(req.Password, hashedPassword) {
+	audit.Describe(c, audit.Details{TargetType: "user", TargetID: audit.Target(user.ID)})
+	if !models.CheckPassword(ctx, req.Password, hashedPassword) {
+		s.metrics.Login(false)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	if !user.Active {
+		s.metrics.Login(false)
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated"})
+		return
+	}
+	if linked {
+		user.Email = ident.Email
+	}
+	audit.Describe(c, audit.Details{ActorUserID: user.ID})
+
+	// Upgrade the stored hash if the hashing algorithm or parameters changed
+	if models.PasswordNeedsRehash(hashedPassword) {
+		if newHash, err := models.HashPassword(ctx, req.Password); err == nil {
+			hashedPassword = newHash
+			if linked {
+				err = s.identities.UpdateIdentityPassword(ctx, ident.ID, newHash)
+			} else {
+				err = s.users.UpdatePassword(ctx, tenantID, user.ID, newHash)
+			}
+			if err != nil {
+				logging.FromContext(ctx).Error("Error rehashing password", "user_id", user.ID, "error", err)
+			}
+		}
+	}
+
+	// Link users that know the password of the identity with their email.
+	// Others, including users created before global identities existed, are
+	// linked once they verify their email.
+	if !linked && ident != nil && models.CheckPassword(ctx, req.Password, ident.Password) {
+		s.linkIdentity(ctx, ident.ID, tenantID, user.ID)
+	}
+
 	// Generate JWT token
-	token, err := middleware.GenerateToken(user.ID, req.TenantID, user.Email)
+	token, err := s.tokens.GenerateToken(user.ID, tenantID, user.Email)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
 		return
 	}
 
+	s.metrics.Login(true)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Login successful",
 		"token":   token,
@@ -149,14 +249,26 @@ func Login(c *gin.Context) {
 // @Success     200 {object} map[string]interface{} "User information"
 // @Failure     401 {object} map[string]string "Unauthorized"
 // @Router      /me [get]
-func Me(c *gin.Context) {
+func (s *Server) Me(c *gin.Context) {
 	userID, _ := c.Get("user_id")
 	tenantID, _ := c.Get("tenant_id")
 	email, _ := c.Get("email")
+	role, _ := c.Get("role")
 
 	c.JSON(http.StatusOK, gin.H{
 		"user_id":   userID,
 		"tenant_id": tenantID,
 		"email":     email,
+		"role":      role,
 	})
-} 
\ No newline at end of file
+}
+
+// checkPasswordPolicy responds with the requirement a new password fails, if
+// any, and reports whether it satisfies the password policy
+func checkPasswordPolicy(c *gin.Context, password string) bool {
+	if err := models.DefaultPasswordPolicy.Check(password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
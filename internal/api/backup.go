@@ -0,0 +1,284 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/backup"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+)
+
+// @Summary     Snapshot a tenant
+// @Description Start taking a snapshot of a tenant's database with the configured method: logical, a gzipped copy of every row, or pg_dump. Poll the returned job with /admin/jobs/{job_id}; once it completes the snapshot is listed. Older snapshots beyond the retention policy are then deleted. (platform admin only)
+// @Tags        backup
+// @Accept      json
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       snapshot body models.CreateSnapshotRequest false "Snapshot label"
+// @Success     202 {object} models.Job "Snapshot job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/snapshots [post]
+func (s *Server) CreateSnapshot(c *gin.Context) {
+	tenantID, ok := s.snapshotTenant(c)
+	if !ok {
+		return
+	}
+	var req models.CreateSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	params, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding snapshot parameters"})
+		return
+	}
+	job := models.Job{Type: models.JobSnapshot, TenantID: tenantID, Params: params}
+	if err := s.runner.Enqueue(ctx, &job); err != nil {
+		logging.FromContext(ctx).Error("Error creating snapshot job", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating snapshot job"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Platform: true, TenantID: tenantID, Action: "tenant.snapshot", TargetType: "job", TargetID: strconv.FormatInt(job.ID, 10), After: req})
+	c.JSON(http.StatusAccepted, job)
+}
+
+// @Summary     List snapshots
+// @Description List a tenant's snapshots, newest first (platform admin only)
+// @Tags        backup
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Success     200 {array} models.Snapshot "Snapshots"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/snapshots [get]
+func (s *Server) GetSnapshots(c *gin.Context) {
+	tenantID, ok := s.snapshotTenant(c)
+	if !ok {
+		return
+	}
+
+	snapshots, err := s.snapshots.Snapshots(c.Request.Context(), tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, snapshots)
+}
+
+// @Summary     Get a snapshot
+// @Description Get a snapshot of a tenant (platform admin only)
+// @Tags        backup
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       snapshot_id path int true "Snapshot ID"
+// @Success     200 {object} models.Snapshot "Snapshot"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Snapshot not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/snapshots/{snapshot_id} [get]
+func (s *Server) GetSnapshot(c *gin.Context) {
+	snapshot, ok := s.snapshotParam(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, snapshot)
+}
+
+// @Summary     Delete a snapshot
+// @Description Delete a snapshot of a tenant and its archive (platform admin only)
+// @Tags        backup
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       snapshot_id path int true "Snapshot ID"
+// @Success     204 "No content"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Snapshot not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/snapshots/{snapshot_id} [delete]
+func (s *Server) DeleteSnapshot(c *gin.Context) {
+	snapshot, ok := s.snapshotParam(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if err := s.backup.Delete(ctx, snapshot); err != nil {
+		logging.FromContext(ctx).Error("Error deleting snapshot", "snapshot_id", snapshot.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting snapshot"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Platform: true, TenantID: snapshot.TenantID, Action: "snapshot.delete", TargetType: "snapshot", TargetID: strconv.FormatInt(snapshot.ID, 10), Before: snapshot})
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary     Restore a snapshot
+// @Description Start restoring a snapshot, either into its tenant, replacing the tenant's database, or into a new tenant. Memberships of global identities in the restored tenant are removed; users are linked again when they log in. Tenant settings aren't part of snapshots. Poll the returned job with /admin/jobs/{job_id}; a restore into a new tenant records the tenant's ID on the job. (platform admin only)
+// @Tags        backup
+// @Accept      json
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       snapshot_id path int true "Snapshot ID"
+// @Param       restore body models.RestoreSnapshotRequest true "Restore target"
+// @Success     202 {object} models.Job "Restore job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Snapshot not found"
+// @Failure     409 {object} map[string]string "Tenant already exists"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/snapshots/{snapshot_id}/restore [post]
+func (s *Server) RestoreSnapshot(c *gin.Context) {
+	snapshot, ok := s.snapshotParam(c)
+	if !ok {
+		return
+	}
+	var req models.RestoreSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	job := models.Job{Type: models.JobRestore}
+	if req.Target == models.RestoreNew {
+		if req.Slug == "" {
+			req.Slug = models.Slugify(req.Name)
+		}
+		if !models.IsValidSlug(req.Slug) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant slug"})
+			return
+		}
+		if _, err := s.tenants.TenantBySlug(ctx, req.Slug); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Tenant with this name or slug already exists"})
+			return
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	} else {
+		req.Name, req.Slug = "", ""
+		job.TenantID = snapshot.TenantID
+	}
+
+	params, err := json.Marshal(backup.RestoreParams{SnapshotID: snapshot.ID, RestoreSnapshotRequest: req})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding restore parameters"})
+		return
+	}
+	job.Params = params
+	if err := s.runner.Enqueue(ctx, &job); err != nil {
+		logging.FromContext(ctx).Error("Error creating restore job", "snapshot_id", snapshot.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating restore job"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Platform: true, TenantID: snapshot.TenantID, Action: "tenant.restore", TargetType: "job", TargetID: strconv.FormatInt(job.ID, 10),
+		After: gin.H{"snapshot_id": snapshot.ID, "target": req.Target, "name": req.Name, "slug": req.Slug}})
+	c.JSON(http.StatusAccepted, job)
+}
+
+// @Summary     Get a job
+// @Description Get the state of a background job of any type, such as a snapshot or a restore (platform admin only)
+// @Tags        backup
+// @Produce     json
+// @Security    AdminKey
+// @Param       job_id path int true "Job ID"
+// @Success     200 {object} models.Job "Job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Job not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/jobs/{job_id} [get]
+func (s *Server) GetJob(c *gin.Context) {
+	jobID, err := strconv.ParseInt(c.Param("job_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return
+	}
+
+	job, err := s.jobs.JobByID(c.Request.Context(), jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// snapshotTenant parses the tenant ID of the snapshot routes and checks that
+// the tenant exists. It writes the error response and returns false if the
+// request can't proceed.
+func (s *Server) snapshotTenant(c *gin.Context) (int, bool) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, false
+	}
+
+	if _, err := s.tenants.TenantByID(c.Request.Context(), tenantID); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return 0, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return 0, false
+	}
+	return tenantID, true
+}
+
+// snapshotParam looks up the snapshot of the request's tenant named by the
+// snapshot_id parameter, writing the error response and returning false if
+// there is none
+func (s *Server) snapshotParam(c *gin.Context) (*models.Snapshot, bool) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return nil, false
+	}
+	snapshotID, err := strconv.ParseInt(c.Param("snapshot_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid snapshot ID"})
+		return nil, false
+	}
+
+	snapshot, err := s.snapshots.SnapshotByID(c.Request.Context(), snapshotID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && snapshot.TenantID != tenantID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Snapshot not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return snapshot, true
+}
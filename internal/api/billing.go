@@ -0,0 +1,67 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/logging"
+)
+
+// maxWebhookBytes bounds the size of billing webhooks
+const maxWebhookBytes = 1 << 20
+
+// @Summary     Receive billing webhooks
+// @Description Receive payment events from the billing provider, verified by their signature. Failed payments suspend the tenant, successful ones resume it.
+// @Tags        billing
+// @Accept      json
+// @Produce     json
+// @Param       Stripe-Signature header string true "Webhook signature"
+// @Success     200 {object} map[string]string "Event received"
+// @Failure     400 {object} map[string]string "Invalid webhook"
+// @Failure     404 {object} map[string]string "Billing is disabled"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /billing/webhook [post]
+func (s *Server) BillingWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error reading webhook"})
+		return
+	}
+
+	event, err := s.billing.ParseEvent(payload, c.Request.Header)
+	if errors.Is(err, billing.ErrDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Billing is disabled"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook"})
+		return
+	}
+	audit.Describe(c, audit.Details{Platform: true, Action: "billing.webhook", TargetType: "billing_event", TargetID: event.ID})
+
+	ctx := c.Request.Context()
+	before, after, err := s.billing.HandleEvent(ctx, event)
+	if err != nil {
+		// The provider delivers the event again
+		logging.FromContext(ctx).Error("Error handling billing event", "event_id", event.ID, "type", event.Type, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error handling event"})
+		return
+	}
+	if after != nil {
+		action := "billing.update"
+		switch {
+		case before.SuspendedAt == nil && after.SuspendedAt != nil:
+			action = "tenant.suspend"
+		case before.SuspendedAt != nil && after.SuspendedAt == nil:
+			action = "tenant.resume"
+		}
+		audit.Describe(c, audit.Details{TenantID: after.TenantID, Action: action, TargetType: "tenant", TargetID: audit.Target(after.TenantID), Before: before, After: after})
+		logging.FromContext(ctx).Info("Billing event applied", "event_id", event.ID, "type", event.Type, "tenant_id", after.TenantID, "status", after.Status)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Event received"})
+}
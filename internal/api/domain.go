@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/domains"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// @Summary     Add a custom domain
+// @Description Add a custom domain for the current tenant and return the challenge proving ownership
+// @Tags        domains
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.CreateDomainRequest true "Domain details"
+// @Success     201 {object} models.TenantDomain "Domain added successfully"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     409 {object} map[string]string "Domain already added"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /domains [post]
+func (s *Server) CreateDomain(c *gin.Context) {
+	var req models.CreateDomainRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetInt("tenant_id")
+	domain := domains.NormalizeDomain(req.Domain)
+	if baseDomain := s.resolver.BaseDomain(); baseDomain != "" &&
+		(domain == baseDomain || strings.HasSuffix(domain, "."+baseDomain)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Domains under the platform domain cannot be added"})
+		return
+	}
+
+	token, err := domains.NewToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating verification token"})
+		return
+	}
+
+	d := models.TenantDomain{
+		TenantID:           tenantID,
+		Domain:             domain,
+		VerificationMethod: req.VerificationMethod,
+		VerificationToken:  token,
+	}
+	err = s.domains.CreateDomain(c.Request.Context(), &d)
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Domain already added"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error adding domain"})
+		return
+	}
+
+	d.Challenge = domains.Challenge(&d)
+	audit.Describe(c, audit.Details{Action: "domain.create", TargetType: "domain", TargetID: audit.Target(d.ID), After: d})
+	c.JSON(http.StatusCreated, d)
+}
+
+// @Summary     List custom domains
+// @Description List the custom domains of the current tenant
+// @Tags        domains
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {array} models.TenantDomain "List of domains"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /domains [get]
+func (s *Server) GetDomains(c *gin.Context) {
+	tenantID := c.GetInt("tenant_id")
+
+	domainList, err := s.domains.ListDomains(c.Request.Context(), tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching domains"})
+		return
+	}
+	for i := range domainList {
+		if !domainList[i].Verified {
+			domainList[i].Challenge = domains.Challenge(&domainList[i])
+		}
+	}
+
+	c.JSON(http.StatusOK, domainList)
+}
+
+// @Summary     Verify a custom domain
+// @Description Check the DNS-TXT or HTTP challenge of a domain and start routing it to the current tenant
+// @Tags        domains
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "Domain ID"
+// @Success     200 {object} models.TenantDomain "Domain verified"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     404 {object} map[string]string "Domain not found"
+// @Failure     409 {object} map[string]string "Domain verified by another tenant"
+// @Failure     422 {object} map[string]string "Challenge not satisfied"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /domains/{id}/verify [post]
+func (s *Server) VerifyDomain(c *gin.Context) {
+	audit.Describe(c, audit.Details{Action: "domain.verify"})
+	d, ok := s.findDomain(c)
+	if !ok {
+		return
+	}
+	audit.Describe(c, audit.Details{TargetType: "domain", TargetID: audit.Target(d.ID)})
+
+	if d.VerifiedAt == nil {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), 15*time.Second)
+		defer cancel()
+
+		// The cause stays in the logs, it could describe hosts behind the platform
+		if err := s.verifier.Verify(ctx, d); err != nil {
+			logging.FromContext(ctx).Info("Domain verification failed", "domain", d.Domain, "method", d.VerificationMethod, "error", err)
+			d.Challenge = domains.Challenge(d)
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Domain verification failed: the challenge was not found", "challenge": d.Challenge})
+			return
+		}
+
+		err := s.domains.MarkDomainVerified(c.Request.Context(), d)
+		if err == repository.ErrConflict {
+			c.JSON(http.StatusConflict, gin.H{"error": "Domain is already verified by another tenant"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying domain"})
+			return
+		}
+	}
+
+	d.Verified = true
+	audit.Describe(c, audit.Details{After: d})
+	c.JSON(http.StatusOK, d)
+}
+
+// @Summary     Remove a custom domain
+// @Description Remove a custom domain from the current tenant
+// @Tags        domains
+// @Security    BearerAuth
+// @Param       id path int true "Domain ID"
+// @Success     204 "Domain removed"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     404 {object} map[string]string "Domain not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /domains/{id} [delete]
+func (s *Server) DeleteDomain(c *gin.Context) {
+	audit.Describe(c, audit.Details{Action: "domain.delete"})
+	d, ok := s.findDomain(c)
+	if !ok {
+		return
+	}
+	audit.Describe(c, audit.Details{TargetType: "domain", TargetID: audit.Target(d.ID), Before: d})
+
+	if err := s.domains.DeleteDomain(c.Request.Context(), d.TenantID, d.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error removing domain"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// findDomain loads the domain named by the :id parameter, scoped to the
+// caller's tenant, writing an error response when it can't be found
+func (s *Server) findDomain(c *gin.Context) (*models.TenantDomain, bool) {
+	tenantID := c.GetInt("tenant_id")
+	domainID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid domain ID"})
+		return nil, false
+	}
+
+	d, err := s.domains.DomainByID(c.Request.Context(), tenantID, domainID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return d, true
+}
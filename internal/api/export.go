@@ -0,0 +1,304 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/transfer"
+)
+
+// @Summary     Export a tenant
+// @Description Start exporting a tenant's users, posts, invitations and webhooks to an archive: a gzipped tar with a manifest.json, recording the tenant schema version, and a JSON Lines file per table. Users include the password hashes stored in the tenant, never those of their global identities, and webhooks their secrets. Poll the returned job until it completes, then download the archive. Tenant admins can only export their own tenant; platform admins use /admin/tenants/{id}/export.
+// @Tags        export
+// @Produce     json
+// @Security    BearerAuth
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Success     202 {object} models.Job "Export job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /tenants/{id}/export [post]
+func (s *Server) ExportTenant(c *gin.Context) {
+	tenantID, ok := exportTenantID(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.tenants.TenantByID(ctx, tenantID); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	archive, err := transfer.ArchiveKey("exports")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating archive name"})
+		return
+	}
+	job := models.Job{Type: models.JobExport, TenantID: tenantID, Archive: archive}
+	if err := s.runner.Enqueue(ctx, &job); err != nil {
+		logging.FromContext(ctx).Error("Error creating export job", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating export job"})
+		return
+	}
+
+	_, platform := c.Get("user_id")
+	audit.Describe(c, audit.Details{Platform: !platform, TenantID: tenantID, Action: "tenant.export", TargetType: "job", TargetID: strconv.FormatInt(job.ID, 10)})
+	c.JSON(http.StatusAccepted, job)
+}
+
+// @Summary     Get an export
+// @Description Get the state of a tenant's export job. Tenant admins can only get the exports of their own tenant; platform admins use /admin/tenants/{id}/exports/{job_id}.
+// @Tags        export
+// @Produce     json
+// @Security    BearerAuth
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       job_id path int true "Export job ID"
+// @Success     200 {object} models.Job "Export job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Export not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /tenants/{id}/exports/{job_id} [get]
+func (s *Server) GetExport(c *gin.Context) {
+	job, ok := s.exportJob(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// @Summary     Download an export
+// @Description Download the archive of a completed export job. Tenant admins can only download the exports of their own tenant; platform admins use /admin/tenants/{id}/exports/{job_id}/archive.
+// @Tags        export
+// @Produce     application/gzip
+// @Security    BearerAuth
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       job_id path int true "Export job ID"
+// @Success     200 {file} file "Archive"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Export not found"
+// @Failure     409 {object} map[string]string "Export not completed"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /tenants/{id}/exports/{job_id}/archive [get]
+func (s *Server) DownloadExport(c *gin.Context) {
+	job, ok := s.exportJob(c)
+	if !ok {
+		return
+	}
+	if job.Status != models.JobCompleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Export is not completed"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	archive, err := s.archives.Get(ctx, job.Archive)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error opening export archive", "job_id", job.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error opening archive"})
+		return
+	}
+	defer archive.Close()
+
+	filename := fmt.Sprintf("tenant-%d-export-%d.tar.gz", job.TenantID, job.ID)
+	c.DataFromReader(http.StatusOK, -1, "application/gzip", archive, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", filename),
+	})
+}
+
+// @Summary     Import a tenant
+// @Description Upload an export archive to provision a new tenant from it. The archive's manifest is checked right away: its tenant schema version must be between the oldest supported one and this server's. The import then runs as a job; poll it until it completes. Records get new IDs, with references remapped. Users keep their password hashes but aren't linked to global identities until they verify their email. (platform admin only)
+// @Tags        export
+// @Accept      multipart/form-data
+// @Produce     json
+// @Security    AdminKey
+// @Param       archive formData file true "Export archive"
+// @Param       name formData string true "Name of the new tenant"
+// @Param       slug formData string false "Slug of the new tenant, derived from the name if empty"
+// @Success     202 {object} models.Job "Import job"
+// @Failure     400 {object} map[string]string "Bad request or incompatible archive"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     409 {object} map[string]string "Tenant already exists"
+// @Failure     413 {object} map[string]string "Archive too large"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/import [post]
+func (s *Server) ImportTenant(c *gin.Context) {
+	maxBytes := int64(s.cfg.Jobs.MaxImportMegabytes) << 20
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+
+	var req models.ImportTenantRequest
+	if err := c.ShouldBind(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Archive is larger than %d MB", s.cfg.Jobs.MaxImportMegabytes)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Describe(c, audit.Details{Platform: true, Action: "tenant.import"})
+	if req.Slug == "" {
+		req.Slug = models.Slugify(req.Name)
+	}
+	if !models.IsValidSlug(req.Slug) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant slug"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.tenants.TenantBySlug(ctx, req.Slug); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tenant with this name or slug already exists"})
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	header, err := c.FormFile("archive")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Archive is required"})
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading archive"})
+		return
+	}
+	defer file.Close()
+
+	manifest, err := s.transfer.CheckArchive(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading archive"})
+		return
+	}
+
+	archive, err := transfer.ArchiveKey("imports")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating archive name"})
+		return
+	}
+	if err := s.archives.Put(ctx, archive, file); err != nil {
+		logging.FromContext(ctx).Error("Error storing import archive", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error storing archive"})
+		return
+	}
+
+	params, err := json.Marshal(req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encoding import parameters"})
+		return
+	}
+	job := models.Job{Type: models.JobImport, Params: params, Archive: archive}
+	if err := s.runner.Enqueue(ctx, &job); err != nil {
+		logging.FromContext(ctx).Error("Error creating import job", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating import job"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{TargetType: "job", TargetID: strconv.FormatInt(job.ID, 10),
+		After: gin.H{"name": req.Name, "slug": req.Slug, "exported_tenant": manifest.Tenant, "schema_version": manifest.SchemaVersion}})
+	c.JSON(http.StatusAccepted, job)
+}
+
+// @Summary     Get an import
+// @Description Get the state of an import job, including the ID of the tenant it created. (platform admin only)
+// @Tags        export
+// @Produce     json
+// @Security    AdminKey
+// @Param       job_id path int true "Import job ID"
+// @Success     200 {object} models.Job "Import job"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Import not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/imports/{job_id} [get]
+func (s *Server) GetImport(c *gin.Context) {
+	job, ok := s.jobParam(c, models.JobImport, "Import not found")
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// exportTenantID parses the tenant ID of the export routes, which tenant
+// admins may only use for their own tenant. It writes the error response and
+// returns false if the request can't proceed.
+func exportTenantID(c *gin.Context) (int, bool) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, false
+	}
+	// Tenant admins are authenticated with a token of their tenant
+	if _, ok := c.Get("user_id"); ok && tenantID != c.GetInt("tenant_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return 0, false
+	}
+	return tenantID, true
+}
+
+// exportJob looks up the export job of the request's tenant, writing the
+// error response and returning false if there is none
+func (s *Server) exportJob(c *gin.Context) (*models.Job, bool) {
+	tenantID, ok := exportTenantID(c)
+	if !ok {
+		return nil, false
+	}
+	job, ok := s.jobParam(c, models.JobExport, "Export not found")
+	if !ok {
+		return nil, false
+	}
+	if job.TenantID != tenantID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return nil, false
+	}
+	return job, true
+}
+
+// jobParam looks up the job of a type named by the job_id parameter, writing
+// the error response and returning false if there is none
+func (s *Server) jobParam(c *gin.Context, jobType, notFound string) (*models.Job, bool) {
+	jobID, err := strconv.ParseInt(c.Param("job_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job ID"})
+		return nil, false
+	}
+
+	job, err := s.jobs.JobByID(c.Request.Context(), jobID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && job.Type != jobType) {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/logging"
+)
+
+// @Summary     Liveness probe
+// @Description Report that the process is running
+// @Tags        health
+// @Produce     json
+// @Success     200 {object} map[string]string "Alive"
+// @Router      /healthz [get]
+func (s *Server) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// @Summary     Readiness probe
+// @Description Check that the management database is reachable and its migrations are current
+// @Tags        health
+// @Produce     json
+// @Success     200 {object} map[string]string "Ready"
+// @Failure     503 {object} map[string]string "Not ready"
+// @Router      /readyz [get]
+func (s *Server) Readyz(c *gin.Context) {
+	if err := s.tenants.Ready(c.Request.Context()); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Readiness check failed", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// @Summary     Tenant diagnostics
+// @Description Ping a tenant's database and report its schema version, connection pool statistics, size and estimated row counts (platform admin only)
+// @Tags        health
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Success     200 {object} models.TenantHealth "Tenant health"
+// @Failure     400 {object} map[string]string "Invalid tenant ID"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     503 {object} map[string]string "Tenant database unavailable"
+// @Router      /admin/tenants/{id}/health [get]
+func (s *Server) TenantHealth(c *gin.Context) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	health, err := s.tenants.TenantHealth(c.Request.Context(), tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		// Only platform admins get here, the cause is what they are after
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Tenant database unavailable", "details": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, health)
+}
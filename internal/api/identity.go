@@ -0,0 +1,359 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// emailVerificationTTL is how long an email verification stays valid
+const emailVerificationTTL = 24 * time.Hour
+
+// linkIdentity links a tenant user to an existing identity. Callers must have
+// verified the password against the identity. Failures are logged rather than
+// returned.
+func (s *Server) linkIdentity(ctx context.Context, identityID, tenantID, userID int) {
+	if err := s.identities.LinkIdentity(ctx, identityID, tenantID, userID); err != nil {
+		logging.FromContext(ctx).Error("Error linking user to identity", "tenant_id", tenantID, "user_id", userID, "error", err)
+	}
+}
+
+// claimIdentity links a new tenant user to the identity with their email if
+// password is that identity's, as signing in with it would, and reports
+// whether it did. Otherwise the user is emailed a verification that creates
+// the identity once confirmed if there is none, and activates the user if
+// activate is set, so registering with someone else's email never claims
+// their global account. Callers respond the same either way, unless the user awaits
+// activation, which keeps whether the email has a global account to those
+// who don't know its password.
+func (s *Server) claimIdentity(c *gin.Context, tenantID int, user *models.User, password string, activate bool) bool {
+	ctx := c.Request.Context()
+	ident, err := s.identities.IdentityByEmail(ctx, user.Email)
+	if err == nil && models.CheckPassword(ctx, password, ident.Password) {
+		s.linkIdentity(ctx, ident.ID, tenantID, user.ID)
+		return true
+	} else if err != nil && err != sql.ErrNoRows {
+		logging.FromContext(ctx).Error("Error looking up identity", "tenant_id", tenantID, "user_id", user.ID, "error", err)
+		return false
+	}
+
+	v := models.EmailVerification{TenantID: tenantID, UserID: user.ID, Email: user.Email, Activate: activate}
+	if err := s.sendVerificationEmail(c, v); err != nil {
+		logging.FromContext(ctx).Error("Error creating email verification", "tenant_id", tenantID, "user_id", user.ID, "error", err)
+	}
+	return false
+}
+
+// sendVerificationEmail stores the email verification with a new token and
+// emails the token to the verification's email. The configured verification
+// URL may contain {tenant} and {token} placeholders to link to the frontend's
+// verification page.
+func (s *Server) sendVerificationEmail(c *gin.Context, v models.EmailVerification) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	v.ExpiresAt = time.Now().Add(emailVerificationTTL)
+	if err := s.identities.CreateEmailVerification(c.Request.Context(), &v, hashToken(token)); err != nil {
+		return err
+	}
+
+	tenantSlug := s.tenantSlug(c, v.TenantID)
+	body := fmt.Sprintf("Verify your email to use your account in %s from your other organizations.\n\n", tenantSlug)
+	if v.Activate {
+		body = fmt.Sprintf("Verify your email to activate your account in %s.\n\n", tenantSlug)
+	} else if v.EmailChange {
+		body = fmt.Sprintf("Verify this email to make it the email of your account in %s and your other organizations.\n\n", tenantSlug)
+	}
+	if url := s.cfg.Mail.VerificationURL; url != "" {
+		url = strings.NewReplacer("{tenant}", tenantSlug, "{token}", token).Replace(url)
+		body += fmt.Sprintf("Verify it at %s\n", url)
+	} else {
+		body += fmt.Sprintf("Verify it with the token %s\n", token)
+	}
+	if !v.EmailChange {
+		body += "\nIf you already have an account with this email, verify with its password.\n"
+	}
+	body += fmt.Sprintf("The verification expires at %s.\n", v.ExpiresAt.Format(time.RFC1123))
+
+	if err := s.mailer.Send(v.Email, "Verify your email for "+tenantSlug, body); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Error sending email verification", "user_id", v.UserID, "error", err)
+	}
+	return nil
+}
+
+// @Summary     Verify email
+// @Description Verify a user's email with the emailed token, activating users who registered in a domain-restricted tenant and creating a global account with that email for the user if there is none. If there is one already, the user is linked to it when verifying with its password. A verification of a linked user's new email changes their email instead.
+// @Tags        auth
+// @Accept      json
+// @Produce     json
+// @Param       X-Tenant header string false "Tenant slug"
+// @Param       request body models.VerifyEmailRequest true "Verification token"
+// @Success     200 {object} map[string]string "Email verified"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     403 {object} map[string]string "Email has a global account, verify with its password"
+// @Failure     404 {object} map[string]string "Verification not found or expired"
+// @Failure     409 {object} map[string]string "Email already in use"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /verify-email [post]
+func (s *Server) VerifyEmail(c *gin.Context) {
+	var req models.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID, err := requestTenantID(c, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Describe(c, audit.Details{TenantID: tenantID, Action: "user.verify_email"})
+
+	ctx := c.Request.Context()
+	v, err := s.identities.ConsumeEmailVerification(ctx, tenantID, hashToken(req.Token))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Verification not found or expired"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if v.EmailChange {
+		s.changeEmail(c, tenantID, v)
+		return
+	}
+
+	// The user may have changed their email since the verification was sent
+	user, err := s.users.UserByID(ctx, tenantID, v.UserID)
+	if err == sql.ErrNoRows || (err == nil && user.Email != v.Email) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Verification not found or expired"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	audit.Describe(c, audit.Details{ActorUserID: user.ID, ActorEmail: user.Email, TargetType: "user", TargetID: audit.Target(user.ID)})
+
+	// Proving the email doesn't prove the global account with it is the
+	// user's, so joining one takes its password as well. The verification is
+	// put back for the user to retry with it.
+	ident, err := s.identities.IdentityByEmail(ctx, user.Email)
+	if err == nil && !models.CheckPassword(ctx, req.Password, ident.Password) {
+		if err := s.identities.CreateEmailVerification(ctx, v, hashToken(req.Token)); err != nil {
+			logging.FromContext(ctx).Error("Error restoring email verification", "tenant_id", tenantID, "user_id", user.ID, "error", err)
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email has a global account, verify with its password"})
+		return
+	} else if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if v.Activate && !user.Active {
+		active := true
+		if _, err := s.users.UpdateUser(ctx, tenantID, user.ID, models.UpdateUserRequest{Active: &active}); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
+			return
+		}
+	}
+
+	if ident != nil {
+		err = s.identities.LinkIdentity(ctx, ident.ID, tenantID, user.ID)
+	} else {
+		err = s.identities.CreateIdentity(ctx, tenantID, user.ID, user.Email, user.Password)
+	}
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already in use"})
+		return
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Error linking user to identity", "tenant_id", tenantID, "user_id", user.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// changeEmail applies a linked user's verified email change to the tenant
+// user and their identity. The tenant user goes first and gets its email back
+// if the identity fails, so the two never disagree.
+func (s *Server) changeEmail(c *gin.Context, tenantID int, v *models.EmailVerification) {
+	ctx := c.Request.Context()
+
+	// The user may have been deleted or unlinked since the verification was sent
+	user, err := s.users.UserByID(ctx, tenantID, v.UserID)
+	var ident *models.Identity
+	if err == nil {
+		audit.Describe(c, audit.Details{ActorUserID: user.ID, ActorEmail: user.Email, Action: "user.change_email", TargetType: "user", TargetID: audit.Target(user.ID)})
+		ident, err = s.identities.IdentityByUser(ctx, tenantID, user.ID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Verification not found or expired"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	updated, err := s.users.UpdateEmail(ctx, tenantID, user.ID, v.Email)
+	if err == nil {
+		err = s.identities.UpdateIdentityEmail(ctx, ident.ID, v.Email)
+		if err != nil {
+			if _, restoreErr := s.users.UpdateEmail(ctx, tenantID, user.ID, user.Email); restoreErr != nil {
+				logging.FromContext(ctx).Error("Error restoring user email", "user_id", user.ID, "error", restoreErr)
+			}
+		}
+	}
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already in use"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error verifying email"})
+		return
+	}
+	audit.Describe(c, audit.Details{Before: user, After: updated})
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed"})
+}
+
+// @Summary     Request email verification
+// @Description Email the current user a new verification that links them to the global account with their email
+// @Tags        user
+// @Produce     json
+// @Security    BearerAuth
+// @Success     202 {object} map[string]string "Verification sent"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     409 {object} map[string]string "Already linked to a global account"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /me/email-verification [post]
+func (s *Server) RequestEmailVerification(c *gin.Context) {
+	ctx := c.Request.Context()
+	tenantID := c.GetInt("tenant_id")
+	userID := c.GetInt("user_id")
+	audit.Describe(c, audit.Details{Action: "user.request_email_verification", TargetType: "user", TargetID: audit.Target(userID)})
+
+	if _, err := s.identities.IdentityByUser(ctx, tenantID, userID); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Already linked to a global account"})
+		return
+	} else if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	user, err := s.users.UserByID(ctx, tenantID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	v := models.EmailVerification{TenantID: tenantID, UserID: user.ID, Email: user.Email}
+	if err := s.sendVerificationEmail(c, v); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating verification"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}
+
+// @Summary     List my tenants
+// @Description List the tenants the current user's global identity is a member of
+// @Tags        user
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {array} models.TenantMembership "List of memberships"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /me/tenants [get]
+func (s *Server) GetMyTenants(c *gin.Context) {
+	memberships, err := s.identities.Memberships(c.Request.Context(), c.GetInt("tenant_id"), c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching tenants"})
+		return
+	}
+
+	c.JSON(http.StatusOK, memberships)
+}
+
+// @Summary     Switch tenant
+// @Description Issue a token for another tenant the current user's global identity is a member of
+// @Tags        auth
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.SwitchTenantRequest true "Target tenant"
+// @Success     200 {object} map[string]interface{} "Token for the target tenant"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Not a member of the tenant"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /token/switch-tenant [post]
+func (s *Server) SwitchTenant(c *gin.Context) {
+	var req models.SwitchTenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	ident, err := s.identities.IdentityByUser(ctx, c.GetInt("tenant_id"), c.GetInt("user_id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this tenant"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	tenant, err := s.tenants.TenantBySlug(ctx, req.Tenant)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Verify membership
+	userID, err := s.identities.MemberUserID(ctx, ident.ID, tenant.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a member of this tenant"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// The membership's user must still be active in the target tenant
+	user, err := s.users.UserByID(ctx, tenant.ID, userID)
+	if err == sql.ErrNoRows || (err == nil && !user.Active) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is deactivated in this tenant"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Action: "token.switch_tenant", TargetType: "tenant", TargetID: audit.Target(tenant.ID)})
+	token, err := s.tokens.GenerateToken(userID, tenant.ID, ident.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":  token,
+		"tenant": tenant,
+	})
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// defaultInvitationTTL is how long an invitation stays valid unless the request says otherwise
+const defaultInvitationTTL = 72 * time.Hour
+
+// @Summary     Invite a user
+// @Description Invite a user by email into the current tenant with a pre-assigned role (admin only)
+// @Tags        invitations
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.CreateInvitationRequest true "Invitation details"
+// @Success     201 {object} models.Invitation "Invitation created"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     409 {object} map[string]string "User already exists"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /invitations [post]
+func (s *Server) CreateInvitation(c *gin.Context) {
+	var req models.CreateInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.RoleMember
+	}
+	ttl := defaultInvitationTTL
+	if req.ExpiresInHours > 0 {
+		ttl = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+
+	tenantID := c.GetInt("tenant_id")
+	if _, err := s.users.UserByEmail(c.Request.Context(), tenantID, req.Email); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	} else if err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating invitation token"})
+		return
+	}
+
+	invitedBy := c.GetInt("user_id")
+	inv := models.Invitation{Email: req.Email, Role: req.Role, InvitedBy: &invitedBy, ExpiresAt: time.Now().Add(ttl)}
+	if err := s.invitations.CreateInvitation(c.Request.Context(), tenantID, &inv, hashToken(token)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating invitation"})
+		return
+	}
+	// Described before the token is set, it grants access to the tenant
+	audit.Describe(c, audit.Details{Action: "invitation.create", TargetType: "invitation", TargetID: audit.Target(inv.ID), After: inv})
+	inv.Token = token
+
+	s.sendInvitationEmail(c, &inv)
+
+	c.JSON(http.StatusCreated, inv)
+}
+
+// @Summary     List invitations
+// @Description List the pending invitations of the current tenant (admin only)
+// @Tags        invitations
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {array} models.Invitation "List of invitations"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /invitations [get]
+func (s *Server) GetInvitations(c *gin.Context) {
+	invitations, err := s.invitations.PendingInvitations(c.Request.Context(), c.GetInt("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invitations)
+}
+
+// @Summary     Revoke an invitation
+// @Description Revoke a pending invitation of the current tenant (admin only)
+// @Tags        invitations
+// @Security    BearerAuth
+// @Param       id path int true "Invitation ID"
+// @Success     204 "Invitation revoked"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Invitation not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /invitations/{id} [delete]
+func (s *Server) DeleteInvitation(c *gin.Context) {
+	invitationID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invitation ID"})
+		return
+	}
+	audit.Describe(c, audit.Details{Action: "invitation.delete", TargetType: "invitation", TargetID: audit.Target(invitationID)})
+
+	err = s.invitations.DeleteInvitation(c.Request.Context(), c.GetInt("tenant_id"), invitationID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking invitation"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary     Accept an invitation
+// @Description Accept an invitation and create the invited user in the tenant
+// @Tags        invitations
+// @Accept      json
+// @Produce     json
+// @Param       X-Tenant header string false "Tenant slug"
+// @Param       token path string true "Invitation token"
+// @Param       request body models.AcceptInvitationRequest true "Password for the new account"
+// @Success     201 {object} map[string]interface{} "User registered successfully"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     403 {object} map[string]string "User quota exceeded"
+// @Failure     404 {object} map[string]string "Invitation not found or expired"
+// @Failure     409 {object} map[string]string "User already exists"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /invitations/{token}/accept [post]
+func (s *Server) AcceptInvitation(c *gin.Context) {
+	var req models.AcceptInvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkPasswordPolicy(c, req.Password) {
+		return
+	}
+
+	tenantID, err := requestTenantID(c, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	audit.Describe(c, audit.Details{Action: "invitation.accept"})
+
+	ctx := c.Request.Context()
+	if _, err := s.tenants.TenantByID(ctx, tenantID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	if !s.checkQuota(c, tenantID, models.QuotaUsers) {
+		return
+	}
+
+	inv, err := s.invitations.PendingInvitation(ctx, tenantID, hashToken(c.Param("token")))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	hashedPassword, err := models.HashPassword(ctx, req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		return
+	}
+
+	// Accepting claims the invitation again, so it stays single-use when
+	// accepted concurrently
+	user, err := s.invitations.AcceptInvitation(ctx, tenantID, inv.ID, hashedPassword)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invitation not found or expired"})
+		return
+	} else if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating user"})
+		return
+	}
+
+	// The token was also shown to the inviting admin, so it doesn't prove
+	// the invitee owns the email
+	s.claimIdentity(c, tenantID, user, req.Password, false)
+	audit.Describe(c, audit.Details{ActorUserID: user.ID, ActorEmail: user.Email, TargetType: "user", TargetID: audit.Target(user.ID),
+		After: gin.H{"email": user.Email, "role": user.Role}})
+
+	token, err := s.tokens.GenerateToken(user.ID, tenantID, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "User registered successfully",
+		"token":   token,
+	})
+}
+
+// newToken generates a random URL-safe token for invitations and email verifications
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// tenantSlug returns the slug of the request's tenant for links in emails,
+// empty if it can't be looked up
+func (s *Server) tenantSlug(c *gin.Context, tenantID int) string {
+	if tenant, ok := middleware.ResolvedTenant(c); ok {
+		return tenant.Slug
+	}
+	tenant, err := s.tenants.TenantByID(c.Request.Context(), tenantID)
+	if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Error looking up tenant slug", "tenant_id", tenantID, "error", err)
+		return ""
+	}
+	return tenant.Slug
+}
+
+// hashToken returns the digest stored in place of the token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendInvitationEmail emails the invitation. The configured invitation URL may
+// contain {tenant} and {token} placeholders to link to the frontend's accept page.
+func (s *Server) sendInvitationEmail(c *gin.Context, inv *models.Invitation) {
+	tenantSlug := s.tenantSlug(c, c.GetInt("tenant_id"))
+
+	body := fmt.Sprintf("You have been invited to join %s as %s.\n\n", tenantSlug, inv.Role)
+	if url := s.cfg.Mail.InvitationURL; url != "" {
+		url = strings.NewReplacer("{tenant}", tenantSlug, "{token}", inv.Token).Replace(url)
+		body += fmt.Sprintf("Accept the invitation at %s\n", url)
+	} else {
+		body += fmt.Sprintf("Accept the invitation with the token %s\n", inv.Token)
+	}
+	body += fmt.Sprintf("\nThe invitation expires at %s.\n", inv.ExpiresAt.Format(time.RFC1123))
+
+	if err := s.mailer.Send(inv.Email, "You have been invited to "+tenantSlug, body); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Error sending invitation", "invitation_id", inv.ID, "error", err)
+	}
+}
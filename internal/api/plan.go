@@ -0,0 +1,291 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+)
+
+// defaultUsageDays is the number of days of usage reported by default
+const defaultUsageDays = 30
+
+// @Summary     List plans
+// @Description List the plans tenants can be on and their quotas (platform admin only)
+// @Tags        plans
+// @Produce     json
+// @Security    AdminKey
+// @Success     200 {array} models.Plan "Plans"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/plans [get]
+func (s *Server) GetPlans(c *gin.Context) {
+	plans, err := s.plans.Plans(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, plans)
+}
+
+// @Summary     Create or replace a plan
+// @Description Set the quotas of a plan, creating it if it doesn't exist. Omitted quotas are unlimited. (platform admin only)
+// @Tags        plans
+// @Accept      json
+// @Produce     json
+// @Security    AdminKey
+// @Param       name path string true "Plan name"
+// @Param       request body models.UpdatePlanRequest true "Plan quotas"
+// @Success     200 {object} models.Plan "Plan"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/plans/{name} [put]
+func (s *Server) UpdatePlan(c *gin.Context) {
+	var req models.UpdatePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := c.Param("name")
+	if len(name) > 64 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Plan name can be at most 64 characters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	details := audit.Details{Action: "plan.update", TargetType: "plan", TargetID: name}
+	if before, err := s.plans.PlanByName(ctx, name); err == nil {
+		details.Before = before
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	plan := &models.Plan{
+		Name:              name,
+		MaxUsers:          req.MaxUsers,
+		MaxPosts:          req.MaxPosts,
+		MaxStorageBytes:   req.MaxStorageBytes,
+		MaxRequestsPerDay: req.MaxRequestsPerDay,
+	}
+	details.After = plan
+	audit.Describe(c, details)
+
+	if err := s.plans.SavePlan(ctx, plan); err != nil {
+		logging.FromContext(ctx).Error("Error saving plan", "plan", name, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving plan"})
+		return
+	}
+	s.meter.InvalidatePlans()
+
+	c.JSON(http.StatusOK, plan)
+}
+
+// @Summary     Assign a tenant's plan
+// @Description Move a tenant to another plan, updating its subscription at the billing provider. Its quotas apply from the next request. (platform admin only)
+// @Tags        plans
+// @Accept      json
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       request body models.AssignPlanRequest true "Plan to assign"
+// @Success     200 {object} models.Tenant "Tenant"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Tenant or plan not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Failure     502 {object} map[string]string "Billing provider error"
+// @Router      /admin/tenants/{id}/plan [put]
+func (s *Server) AssignTenantPlan(c *gin.Context) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+
+	var req models.AssignPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant, err := s.tenants.TenantByID(ctx, tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	audit.Describe(c, audit.Details{
+		Platform:   true,
+		TenantID:   tenantID,
+		Action:     "tenant.assign_plan",
+		TargetType: "tenant",
+		TargetID:   audit.Target(tenantID),
+		Before:     gin.H{"plan": tenant.Plan},
+		After:      gin.H{"plan": req.Plan},
+	})
+
+	if _, err := s.plans.PlanByName(ctx, req.Plan); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// The tenant stays on its plan unless the subscription follows
+	if err := s.billing.SyncPlan(ctx, tenant, req.Plan); err != nil {
+		logging.FromContext(ctx).Error("Error updating subscription", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Error updating the subscription at the billing provider"})
+		return
+	}
+
+	if err := s.plans.AssignPlan(ctx, tenantID, req.Plan); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+		return
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Error assigning plan", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error assigning plan"})
+		return
+	}
+
+	if tenant, err = s.tenants.TenantByID(ctx, tenantID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, tenant)
+}
+
+// @Summary     Get tenant usage
+// @Description Report a tenant's current resources and daily usage against the quotas of its plan. Tenant admins can only get the usage of their own tenant; platform admins use /admin/tenants/{id}/usage.
+// @Tags        plans
+// @Produce     json
+// @Security    BearerAuth
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       days query int false "Number of days of daily usage, including today" default(30)
+// @Success     200 {object} models.TenantUsage "Tenant usage"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /tenants/{id}/usage [get]
+func (s *Server) GetTenantUsage(c *gin.Context) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return
+	}
+	// Tenant admins are authenticated with a token of their tenant
+	if _, ok := c.Get("user_id"); ok && tenantID != c.GetInt("tenant_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return
+	}
+
+	days, err := strconv.Atoi(c.DefaultQuery("days", strconv.Itoa(defaultUsageDays)))
+	if err != nil || days < 1 || days > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid days, must be between 1 and 366"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant, err := s.tenants.TenantByID(ctx, tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	plan, err := s.plans.PlanByName(ctx, tenant.Plan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	current, err := s.usage.ResourceUsage(ctx, tenantID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error measuring usage", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error measuring usage"})
+		return
+	}
+
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	daily, err := s.usage.DailyUsage(ctx, tenantID, to.AddDate(0, 0, 1-days), to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.TenantUsage{
+		TenantID:      tenantID,
+		Plan:          *plan,
+		Current:       *current,
+		RequestsToday: s.meter.RequestsToday(tenantID),
+		Daily:         daily,
+	})
+}
+
+// checkQuota checks that the tenant's plan allows adding to each of the
+// quotas, writing the error response and returning false when it doesn't
+func (s *Server) checkQuota(c *gin.Context, tenantID int, quotas ...string) bool {
+	ctx := c.Request.Context()
+	tenant, err := s.tenants.TenantByID(ctx, tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	plan, err := s.plans.PlanByName(ctx, tenant.Plan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	// Measuring usage costs queries, skip it on unlimited plans
+	limited := false
+	for _, quota := range quotas {
+		limited = limited || plan.Limit(quota) != nil
+	}
+	if !limited {
+		return true
+	}
+
+	current, err := s.usage.ResourceUsage(ctx, tenantID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error measuring usage", "tenant_id", tenantID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error measuring usage"})
+		return false
+	}
+	used := map[string]int64{
+		models.QuotaUsers:        int64(current.Users),
+		models.QuotaPosts:        int64(current.Posts),
+		models.QuotaStorageBytes: current.StorageBytes,
+	}
+
+	for _, quota := range quotas {
+		if err := plan.Allow(quota, used[quota]); err != nil {
+			var quotaErr *models.QuotaError
+			errors.As(err, &quotaErr)
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "quota": quotaErr.Quota, "limit": quotaErr.Limit})
+			return false
+		}
+	}
+	return true
+}
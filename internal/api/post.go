@@ -1,13 +1,14 @@
 package api
 
 import (
+	"database/sql"
 	"net/http"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"golang-multi-tenant/internal/database"
+	"golang-multi-tenant/internal/audit"
+
 	"golang-multi-tenant/internal/models"
 )
 
@@ -21,39 +22,33 @@ import (
 // @Success     201 {object} models.Post "Post created successfully"
 // @Failure     400 {object} map[string]string "Bad request"
 // @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Post or storage quota exceeded"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /posts [post]
-func CreatePost(c *gin.Context) {
+func (s *Server) CreatePost(c *gin.Context) {
     var req models.CreatePostRequest
     if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
 
-    // Get user info from context (set by auth middleware)
-    userID := c.GetInt("user_id")
-    tenantID := c.GetInt("tenant_id")
-
-    // Get tenant database
-    tenantDB, err := database.GetTenantDB(tenantID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+    if !s.checkQuota(c, c.GetInt("tenant_id"), models.QuotaPosts, models.QuotaStorageBytes) {
         return
     }
 
-    // Create post
-    var post models.Post
-    err = tenantDB.QueryRow(`
-        INSERT INTO posts (user_id, title, content, updated_at)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, user_id, title, content, created_at, updated_at`,
-        userID, req.Title, req.Content, time.Now(),
-    ).Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt)
+    // Get user info from context (set by auth middleware)
+    post := models.Post{
+        UserID:  c.GetInt("user_id"),
+        Title:   req.Title,
+        Content: req.Content,
+    }
 
-    if err != nil {
+    // Create post
+    if err := s.posts.CreatePost(c.Request.Context(), c.GetInt("tenant_id"), &post); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating post"})
         return
     }
+    audit.Describe(c, audit.Details{Action: "post.create", TargetType: "post", TargetID: audit.Target(post.ID), After: post})
 
     c.JSON(http.StatusCreated, post)
 }
@@ -67,45 +62,12 @@ func CreatePost(c *gin.Context) {
 // @Failure     401 {object} map[string]string "Unauthorized"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /posts [get]
-func GetPosts(c *gin.Context) {
-    tenantID := c.GetInt("tenant_id")
-
-    // Get tenant database
-    tenantDB, err := database.GetTenantDB(tenantID)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
-        return
-    }
-
-    // Get all posts
-    rows, err := tenantDB.Query(`
-        SELECT id, user_id, title, content, created_at, updated_at
-        FROM posts
-        ORDER BY created_at DESC
-    `)
+func (s *Server) GetPosts(c *gin.Context) {
+    posts, err := s.posts.ListPosts(c.Request.Context(), c.GetInt("tenant_id"))
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching posts"})
         return
     }
-    defer rows.Close()
-
-    var posts []models.Post
-    for rows.Next() {
-        var post models.Post
-        err := rows.Scan(
-            &post.ID,
-            &post.UserID,
-            &post.Title,
-            &post.Content,
-            &post.CreatedAt,
-            &post.UpdatedAt,
-        )
-        if err != nil {
-            c.JSON(http.StatusInternalServerError, gin.H{"error": "Error scanning posts"})
-            return
-        }
-        posts = append(posts, post)
-    }
 
     c.JSON(http.StatusOK, posts)
 }
@@ -121,40 +83,119 @@ func GetPosts(c *gin.Context) {
 // @Failure     404 {object} map[string]string "Post not found"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /posts/{id} [get]
-func GetPost(c *gin.Context) {
-    tenantID := c.GetInt("tenant_id")
+func (s *Server) GetPost(c *gin.Context) {
     postID, err := strconv.Atoi(c.Param("id"))
     if err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
         return
     }
 
-    // Get tenant database
-    tenantDB, err := database.GetTenantDB(tenantID)
+    post, err := s.posts.PostByID(c.Request.Context(), c.GetInt("tenant_id"), postID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
         return
     }
 
-    var post models.Post
-    err = tenantDB.QueryRow(`
-        SELECT id, user_id, title, content, created_at, updated_at
-        FROM posts
-        WHERE id = $1`,
-        postID,
-    ).Scan(
-        &post.ID,
-        &post.UserID,
-        &post.Title,
-        &post.Content,
-        &post.CreatedAt,
-        &post.UpdatedAt,
-    )
+    c.JSON(http.StatusOK, post)
+}
 
-    if err != nil {
+// @Summary     Update a post
+// @Description Update the title and content of a post; members can only update their own posts
+// @Tags        posts
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "Post ID"
+// @Param       request body models.UpdatePostRequest true "Post details"
+// @Success     200 {object} models.Post "Post updated successfully"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Not the author, or storage quota exceeded"
+// @Failure     404 {object} map[string]string "Post not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /posts/{id} [put]
+func (s *Server) UpdatePost(c *gin.Context) {
+    var req models.UpdatePostRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    before, ok := s.ownPost(c)
+    if !ok {
+        return
+    }
+    if !s.checkQuota(c, c.GetInt("tenant_id"), models.QuotaStorageBytes) {
+        return
+    }
+
+    post := *before
+    post.Title = req.Title
+    post.Content = req.Content
+    if err := s.posts.UpdatePost(c.Request.Context(), c.GetInt("tenant_id"), &post); err == sql.ErrNoRows {
         c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
         return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating post"})
+        return
     }
+    audit.Describe(c, audit.Details{Action: "post.update", TargetType: "post", TargetID: audit.Target(post.ID), Before: before, After: post})
 
     c.JSON(http.StatusOK, post)
-} 
\ No newline at end of file
+}
+
+// @Summary     Delete a post
+// @Description Delete a post; members can only delete their own posts
+// @Tags        posts
+// @Security    BearerAuth
+// @Param       id path int true "Post ID"
+// @Success     204 "Post deleted"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Not the author"
+// @Failure     404 {object} map[string]string "Post not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /posts/{id} [delete]
+func (s *Server) DeletePost(c *gin.Context) {
+    post, ok := s.ownPost(c)
+    if !ok {
+        return
+    }
+
+    if err := s.posts.DeletePost(c.Request.Context(), c.GetInt("tenant_id"), post.ID); err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting post"})
+        return
+    }
+    audit.Describe(c, audit.Details{Action: "post.delete", TargetType: "post", TargetID: audit.Target(post.ID), Before: post})
+
+    c.Status(http.StatusNoContent)
+}
+
+// ownPost loads the post named in the path, which the caller must have
+// written unless they are an admin. It writes the error response and returns
+// false when the post can't be changed.
+func (s *Server) ownPost(c *gin.Context) (*models.Post, bool) {
+    postID, err := strconv.Atoi(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid post ID"})
+        return nil, false
+    }
+
+    post, err := s.posts.PostByID(c.Request.Context(), c.GetInt("tenant_id"), postID)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Post not found"})
+        return nil, false
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return nil, false
+    }
+
+    if post.UserID != c.GetInt("user_id") && c.GetString("role") != models.RoleAdmin {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+        return nil, false
+    }
+    return post, true
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// @Summary     Get tenant settings
+// @Description Get the registration settings of the current tenant (admin only)
+// @Tags        tenant
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {object} models.TenantSettings "Tenant settings"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /settings [get]
+func (s *Server) GetSettings(c *gin.Context) {
+	settings, err := s.tenants.TenantSettings(c.Request.Context(), c.GetInt("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// @Summary     Update tenant settings
+// @Description Switch the current tenant between open, invite-only and domain-restricted registration (admin only)
+// @Tags        tenant
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.UpdateTenantSettingsRequest true "Settings to update"
+// @Success     200 {object} models.TenantSettings "Tenant settings"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /settings [patch]
+func (s *Server) UpdateSettings(c *gin.Context) {
+	var req models.UpdateTenantSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetInt("tenant_id")
+	settings, err := s.tenants.TenantSettings(c.Request.Context(), tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	audit.Describe(c, audit.Details{Action: "settings.update", TargetType: "tenant", TargetID: audit.Target(tenantID), Before: *settings})
+
+	if req.RegistrationMode != nil {
+		settings.RegistrationMode = *req.RegistrationMode
+	}
+	if req.AllowedEmailDomains != nil {
+		settings.AllowedEmailDomains = make([]string, len(req.AllowedEmailDomains))
+		for i, domain := range req.AllowedEmailDomains {
+			settings.AllowedEmailDomains[i] = strings.ToLower(domain)
+		}
+	}
+
+	if settings.RegistrationMode == models.RegistrationDomainRestricted && len(settings.AllowedEmailDomains) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Domain-restricted registration requires at least one allowed email domain"})
+		return
+	}
+
+	if err := s.tenants.UpdateTenantSettings(c.Request.Context(), tenantID, settings); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating settings"})
+		return
+	}
+	audit.Describe(c, audit.Details{After: settings})
+
+	c.JSON(http.StatusOK, settings)
+}
+
+// checkRegistrationAllowed returns an error if the tenant's settings don't
+// allow the email to register without an invitation
+func checkRegistrationAllowed(settings *models.TenantSettings, email string) error {
+	switch settings.RegistrationMode {
+	case models.RegistrationInviteOnly:
+		return errors.New("Registration is by invitation only")
+	case models.RegistrationDomainRestricted:
+		if !emailDomainAllowed(settings, email) {
+			return errors.New("Registration is restricted to approved email domains")
+		}
+	}
+	return nil
+}
+
+// emailDomainAllowed reports whether the tenant's settings allow users with
+// the email, which domain-restricted tenants limit to their approved domains
+func emailDomainAllowed(settings *models.TenantSettings, email string) bool {
+	if settings.RegistrationMode != models.RegistrationDomainRestricted {
+		return true
+	}
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	for _, allowed := range settings.AllowedEmailDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEmailDomain responds with an error if the tenant doesn't allow users
+// with the email, and reports whether it does
+func (s *Server) checkEmailDomain(c *gin.Context, tenantID int, email string) bool {
+	settings, err := s.tenants.TenantSettings(c.Request.Context(), tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if !emailDomainAllowed(settings, email) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email addresses are restricted to approved domains"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"golang-multi-tenant/internal/feed"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+)
+
+// feedKeepAlive is how often idle streams are pinged, so that proxies don't
+// close them and dead clients are noticed
+const feedKeepAlive = 25 * time.Second
+
+// @Summary     Stream post events
+// @Description Stream the post.created, post.updated and post.deleted events of the current tenant as Server-Sent Events, named by type with the event as data. Each event's ID is its sequence number; reconnecting with the Last-Event-ID header replays the events missed while they are kept. EventSource can't send headers, so the token may be given in the access_token query parameter.
+// @Tags        posts
+// @Produce     text/event-stream
+// @Security    BearerAuth
+// @Param       Last-Event-ID header int false "Resume after this event"
+// @Param       access_token query string false "JWT, for clients that can't send the Authorization header"
+// @Success     200 {object} models.Event "Stream of events"
+// @Failure     400 {object} map[string]string "Invalid Last-Event-ID"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     503 {object} map[string]string "Shutting down"
+// @Router      /posts/stream [get]
+func (s *Server) StreamPosts(c *gin.Context) {
+	after, ok := lastEventID(c, c.GetHeader("Last-Event-ID"))
+	if !ok {
+		return
+	}
+	stream, ok := s.subscribeFeed(c)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	// Streams outlive the server's write timeout
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(c.Request.Context()).Warn("Error clearing the write deadline of a stream", "error", err)
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	send := func(event models.FeedEvent) error {
+		data, err := json.Marshal(event.Event)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+	s.streamFeed(c.Request.Context(), c.GetInt("tenant_id"), after, stream, send, ping)
+}
+
+// @Summary     Stream post events over WebSocket
+// @Description Stream the post.created, post.updated and post.deleted events of the current tenant over a WebSocket, one JSON message per event. Connecting with last_event_id set to the last seq received replays the events missed while they are kept. Browsers can't send headers with WebSockets, so the token may be given in the access_token query parameter. Messages from the client are ignored.
+// @Tags        posts
+// @Security    BearerAuth
+// @Param       last_event_id query int false "Resume after this event"
+// @Param       access_token query string false "JWT, for clients that can't send the Authorization header"
+// @Success     101 {object} models.FeedEvent "Switching to the WebSocket protocol"
+// @Failure     400 {object} map[string]string "Invalid last_event_id"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     503 {object} map[string]string "Shutting down"
+// @Router      /posts/ws [get]
+func (s *Server) PostsWebSocket(c *gin.Context) {
+	after, ok := lastEventID(c, c.Query("last_event_id"))
+	if !ok {
+		return
+	}
+	stream, ok := s.subscribeFeed(c)
+	if !ok {
+		return
+	}
+	defer stream.Close()
+
+	// The connection outlives the server's read and write timeouts
+	rc := http.NewResponseController(c.Writer)
+	if err := errors.Join(rc.SetReadDeadline(time.Time{}), rc.SetWriteDeadline(time.Time{})); err != nil {
+		logging.FromContext(c.Request.Context()).Warn("Error clearing the deadlines of a WebSocket", "error", err)
+	}
+
+	tenantID := c.GetInt("tenant_id")
+	server := websocket.Server{
+		// The token, not a cookie, authenticates the connection, so pages of
+		// any origin may open it
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(c.Request.Context())
+			defer cancel()
+			// Hijacked connections aren't watched by the server, reading
+			// notices the client leaving
+			go func() {
+				defer cancel()
+				io.Copy(io.Discard, ws)
+			}()
+
+			send := func(event models.FeedEvent) error {
+				return websocket.JSON.Send(ws, event)
+			}
+			ping := func() error {
+				ws.PayloadType = websocket.PingFrame
+				_, err := ws.Write(nil)
+				return err
+			}
+			s.streamFeed(ctx, tenantID, after, stream, send, ping)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
+
+// lastEventID parses the sequence number a client resumes after, nil if it
+// starts afresh. It writes the error response and returns false if invalid.
+func lastEventID(c *gin.Context, value string) (*int64, bool) {
+	if value == "" {
+		return nil, true
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid last event ID"})
+		return nil, false
+	}
+	return &seq, true
+}
+
+// subscribeFeed opens a stream of the tenant's post events, writing the error
+// response and returning false if the server is shutting down
+func (s *Server) subscribeFeed(c *gin.Context) (*feed.Stream, bool) {
+	stream, err := s.feed.Subscribe(c.Request.Context(), c.GetInt("tenant_id"))
+	if errors.Is(err, feed.ErrClosed) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return nil, false
+	} else if err != nil {
+		// The client went away
+		c.Abort()
+		return nil, false
+	}
+	return stream, true
+}
+
+// streamFeed replays the events following after, if given, and then sends
+// the events of stream, pinging while idle, until ctx is done, sending fails
+// or the stream closes
+func (s *Server) streamFeed(ctx context.Context, tenantID int, after *int64, stream *feed.Stream, send func(models.FeedEvent) error, ping func() error) {
+	// Subscribed first, so events committed while replaying arrive on the
+	// stream too and are skipped there
+	replayed := map[int64]bool{}
+	if after != nil {
+		var err error
+		if replayed, err = s.feed.Replay(ctx, tenantID, *after, send); err != nil {
+			logging.FromContext(ctx).Warn("Error replaying post events", "error", err)
+			return
+		}
+	}
+
+	ticker := time.NewTicker(feedKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-stream.Events:
+			if !ok {
+				return
+			}
+			if replayed[event.Seq] {
+				continue
+			}
+			if err := send(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CloseStreams ends the open post streams, so that shutting down the HTTP
+// server doesn't wait for them
+func (s *Server) CloseStreams() {
+	s.feed.Close()
+}
@@ -1,64 +1,180 @@
 package api
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"golang-multi-tenant/internal/database"
+	"golang-multi-tenant/internal/audit"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/middleware"
 	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
 )
 
 // @Summary     Create a new tenant
-// @Description Create a new tenant in the system and set up its database
+// @Description Create a new tenant in the system and set up its database. Platform admins can create it from a template tenant with a template_id and the X-Admin-Key header. The template's users aren't copied; with copy_settings the tenant starts with the template's registration settings, and with seed_data with its posts, attributed to an anonymous deactivated author. The first user to register becomes the admin.
 // @Tags        tenant
 // @Accept      json
 // @Produce     json
+// @Param       X-Admin-Key header string false "Platform admin key, required with a template_id"
 // @Param       request body models.CreateTenantRequest true "Tenant details"
 // @Success     201 {object} models.Tenant "Tenant created successfully"
 // @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Template used without the admin key"
+// @Failure     404 {object} map[string]string "Template not found"
 // @Failure     409 {object} map[string]string "Tenant already exists"
 // @Failure     500 {object} map[string]string "Internal server error"
 // @Router      /tenants [post]
-func CreateTenant(c *gin.Context) {
+func (s *Server) CreateTenant(c *gin.Context) {
 	var req models.CreateTenantRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if tenant with same name exists
-	var exists bool
-	err := database.MainDB.QueryRow("SELECT EXISTS(SELECT 1 FROM tenants WHERE name = $1)", req.Name).Scan(&exists)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	audit.Describe(c, audit.Details{Platform: true, Action: "tenant.create"})
+	if req.Slug == "" {
+		req.Slug = models.Slugify(req.Name)
+	}
+	if !models.IsValidSlug(req.Slug) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant slug"})
 		return
 	}
 
-	if exists {
-		c.JSON(http.StatusConflict, gin.H{"error": "Tenant with this name already exists"})
+	// Tenants are only created from tenants marked as templates, by platform admins
+	if req.TemplateID == 0 && (req.CopySettings || req.SeedData) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "copy_settings and seed_data require a template_id"})
 		return
 	}
+	if req.TemplateID != 0 {
+		if !middleware.HasAdminKey(c, s.cfg.Admin.APIKey) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Creating a tenant from a template requires the admin key"})
+			return
+		}
+		template, err := s.tenants.TenantByID(c.Request.Context(), req.TemplateID)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !template.IsTemplate) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
 
-	// Create tenant database
-	dbName, err := database.CreateTenantDB(req.Name)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating tenant database: " + err.Error()})
+	// Create the tenant database and record
+	start := time.Now()
+	var tenant *models.Tenant
+	var err error
+	if req.TemplateID != 0 {
+		opts := models.TemplateOptions{Settings: req.CopySettings, SeedData: req.SeedData}
+		tenant, err = s.tenants.CreateTenantFromTemplate(c.Request.Context(), req.Name, req.Slug, req.TemplateID, opts)
+	} else {
+		tenant, err = s.tenants.CreateTenant(c.Request.Context(), req.Name, req.Slug)
+	}
+	if err != repository.ErrConflict {
+		s.metrics.TenantProvisioned(time.Since(start), err)
+	}
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Tenant with this name or slug already exists"})
+		return
+	} else if err != nil {
+		logging.FromContext(c.Request.Context()).Error("Error creating tenant", "slug", req.Slug, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating tenant"})
 		return
 	}
 
-	// Create tenant record in management database
-	var tenant models.Tenant
-	err = database.MainDB.QueryRow(`
-        INSERT INTO tenants (name, db_name)
-        VALUES ($1, $2)
-        RETURNING id, name, created_at`,
-		req.Name, dbName).Scan(&tenant.ID, &tenant.Name, &tenant.CreatedAt)
-	
+	// A failed subscription is retried by assigning the plan again
+	ctx := c.Request.Context()
+	if err := s.billing.SyncPlan(ctx, tenant, tenant.Plan); err != nil {
+		logging.FromContext(ctx).Error("Error subscribing tenant", "tenant_id", tenant.ID, "error", err)
+	} else if subscribed, err := s.tenants.TenantByID(ctx, tenant.ID); err == nil {
+		tenant = subscribed
+	}
+	details := audit.Details{Platform: true, TenantID: tenant.ID, TargetType: "tenant", TargetID: audit.Target(tenant.ID), After: tenant}
+	if req.TemplateID != 0 {
+		details.After = gin.H{"tenant": tenant, "template_id": req.TemplateID, "copy_settings": req.CopySettings, "seed_data": req.SeedData}
+	}
+	audit.Describe(c, details)
+
+	c.JSON(http.StatusCreated, tenant)
+}
+
+// @Summary     Mark a tenant as a template
+// @Description Mark a tenant as a template, which platform admins can create tenants from with POST /tenants and its template_id, or unmark it. New tenants can copy its registration settings and posts, never its users. (platform admin only)
+// @Tags        tenant
+// @Accept      json
+// @Produce     json
+// @Security    AdminKey
+// @Param       id path int true "Tenant ID"
+// @Param       request body models.SetTemplateRequest true "Template state"
+// @Success     200 {object} models.Tenant "Tenant"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Admin API is disabled"
+// @Failure     404 {object} map[string]string "Tenant not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /admin/tenants/{id}/template [put]
+func (s *Server) SetTenantTemplate(c *gin.Context) {
+	tenantID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating tenant record"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, tenant)
-} 
\ No newline at end of file
+	var req models.SetTemplateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant, err := s.tenants.TenantByID(ctx, tenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	audit.Describe(c, audit.Details{
+		Platform:   true,
+		TenantID:   tenantID,
+		Action:     "tenant.set_template",
+		TargetType: "tenant",
+		TargetID:   audit.Target(tenantID),
+		Before:     gin.H{"is_template": tenant.IsTemplate},
+		After:      gin.H{"is_template": *req.IsTemplate},
+	})
+
+	if err := s.tenants.SetTenantTemplate(ctx, tenantID, *req.IsTemplate); errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	tenant.IsTemplate = *req.IsTemplate
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+// requestTenantID returns the tenant resolved by the tenant resolver. The
+// deprecated tenant_id field of the request body doesn't identify the tenant,
+// it is only rejected if it names a different one.
+func requestTenantID(c *gin.Context, bodyTenantID int) (int, error) {
+	tenant, resolved := middleware.ResolvedTenant(c)
+	switch {
+	case !resolved:
+		return 0, errors.New("Tenant could not be resolved")
+	case bodyTenantID != 0 && bodyTenantID != tenant.ID:
+		return 0, errors.New("Tenant ID does not match the resolved tenant")
+	default:
+		return tenant.ID, nil
+	}
+}
@@ -0,0 +1,411 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// @Summary     List users
+// @Description List the users of the current tenant (admin only)
+// @Tags        users
+// @Produce     json
+// @Security    BearerAuth
+// @Param       active query bool false "Filter by active state"
+// @Param       limit query int false "Maximum number of users to return" default(50)
+// @Param       offset query int false "Number of users to skip" default(0)
+// @Success     200 {array} models.User "List of users"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /users [get]
+func (s *Server) GetUsers(c *gin.Context) {
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return
+	}
+
+	var active *bool
+	if value := c.Query("active"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid active filter"})
+			return
+		}
+		active = &parsed
+	}
+
+	users, err := s.users.ListUsers(c.Request.Context(), c.GetInt("tenant_id"), active, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// @Summary     Get a user by ID
+// @Description Get a user of the current tenant (admins, or the user themself)
+// @Tags        users
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "User ID"
+// @Success     200 {object} models.User "User details"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "User not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /users/{id} [get]
+func (s *Server) GetUser(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	if c.GetString("role") != models.RoleAdmin && userID != c.GetInt("user_id") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		return
+	}
+
+	user, err := s.users.UserByID(c.Request.Context(), c.GetInt("tenant_id"), userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// @Summary     Update a user
+// @Description Update the email, role or active state of a user of the current tenant (admin only)
+// @Tags        users
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "User ID"
+// @Param       request body models.UpdateUserRequest true "Fields to update"
+// @Success     200 {object} models.User "User updated"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden or email domain not approved"
+// @Failure     404 {object} map[string]string "User not found"
+// @Failure     409 {object} map[string]string "Email already in use, managed globally or last admin"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /users/{id} [patch]
+func (s *Server) UpdateUser(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetInt("tenant_id")
+	audit.Describe(c, audit.Details{Action: "user.update", TargetType: "user", TargetID: audit.Target(userID)})
+	if before, err := s.users.UserByID(c.Request.Context(), tenantID, userID); err == nil {
+		audit.Describe(c, audit.Details{Before: before})
+	}
+
+	if req.Email != nil && !s.checkEmailDomain(c, tenantID, *req.Email) {
+		return
+	}
+
+	// The email of a linked user belongs to their global identity
+	if req.Email != nil {
+		if _, err := s.identities.IdentityByUser(c.Request.Context(), tenantID, userID); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is managed by the user's global account"})
+			return
+		} else if err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+	}
+
+	// Demoting or deactivating the last active admin is refused
+	user, err := s.users.UpdateUser(c.Request.Context(), tenantID, userID, req)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err == repository.ErrLastAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "The tenant must keep at least one active admin"})
+		return
+	} else if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already in use"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating user"})
+		return
+	}
+	audit.Describe(c, audit.Details{After: user})
+
+	// A pending verification must not activate a user the admin deactivated
+	if req.Active != nil && !*req.Active {
+		s.deleteEmailVerification(c, tenantID, userID)
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// @Summary     Delete a user
+// @Description Deactivate a user of the current tenant, or permanently delete the user and their posts with hard=true (admin only)
+// @Tags        users
+// @Security    BearerAuth
+// @Param       id path int true "User ID"
+// @Param       hard query bool false "Permanently delete the user and their posts"
+// @Success     204 "User deleted"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "User not found"
+// @Failure     409 {object} map[string]string "Last admin"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /users/{id} [delete]
+func (s *Server) DeleteUser(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	hard, err := strconv.ParseBool(c.DefaultQuery("hard", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hard parameter"})
+		return
+	}
+
+	action := "user.deactivate"
+	if hard {
+		action = "user.delete"
+	}
+	audit.Describe(c, audit.Details{Action: action, TargetType: "user", TargetID: audit.Target(userID)})
+	if before, err := s.users.UserByID(c.Request.Context(), c.GetInt("tenant_id"), userID); err == nil {
+		audit.Describe(c, audit.Details{Before: before})
+	}
+
+	if userID == c.GetInt("user_id") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You cannot delete your own account"})
+		return
+	}
+
+	// Posts of a hard-deleted user are deleted with them
+	if hard {
+		err = s.users.DeleteUser(c.Request.Context(), c.GetInt("tenant_id"), userID)
+	} else {
+		err = s.users.DeactivateUser(c.Request.Context(), c.GetInt("tenant_id"), userID)
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err == repository.ErrLastAdmin {
+		c.JSON(http.StatusConflict, gin.H{"error": "The tenant must keep at least one active admin"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting user"})
+		return
+	}
+
+	if hard {
+		if err := s.identities.UnlinkIdentity(c.Request.Context(), c.GetInt("tenant_id"), userID); err != nil {
+			logging.FromContext(c.Request.Context()).Error("Error removing membership of deleted user", "deleted_user_id", userID, "error", err)
+		}
+	}
+	s.deleteEmailVerification(c, c.GetInt("tenant_id"), userID)
+
+	c.Status(http.StatusNoContent)
+}
+
+// deleteEmailVerification deletes the pending email verification of a
+// deactivated or deleted user, logging failures
+func (s *Server) deleteEmailVerification(c *gin.Context, tenantID, userID int) {
+	if err := s.identities.DeleteEmailVerification(c.Request.Context(), tenantID, userID); err != nil {
+		logging.FromContext(c.Request.Context()).Error("Error deleting email verification", "tenant_id", tenantID, "target_user_id", userID, "error", err)
+	}
+}
+
+// @Summary     Update current user
+// @Description Update the current user's profile and return a token reflecting the change. Users linked to a global account are emailed a verification to their new email instead, which changes the email once confirmed with POST /verify-email.
+// @Tags        user
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.UpdateMeRequest true "Fields to update"
+// @Success     200 {object} map[string]interface{} "User updated"
+// @Success     202 {object} map[string]string "Verification sent to the new email"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Email domain not approved"
+// @Failure     409 {object} map[string]string "Email already in use"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /me [patch]
+func (s *Server) UpdateMe(c *gin.Context) {
+	var req models.UpdateMeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetInt("user_id")
+	tenantID := c.GetInt("tenant_id")
+
+	email := c.GetString("email")
+	if req.Email != nil {
+		email = *req.Email
+		if !s.checkEmailDomain(c, tenantID, email) {
+			return
+		}
+	}
+
+	ident, err := s.identities.IdentityByUser(ctx, tenantID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating user"})
+		return
+	}
+
+	// Linked users change the email of their global identity as well, which
+	// waits until they verify the new email, so that no one points a global
+	// account at an email they don't own
+	if ident != nil && email != ident.Email {
+		audit.Describe(c, audit.Details{Action: "user.request_email_change", TargetType: "user", TargetID: audit.Target(userID)})
+		v := models.EmailVerification{TenantID: tenantID, UserID: userID, Email: email, EmailChange: true}
+		if err := s.sendVerificationEmail(c, v); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating verification"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"message": "Verify your new email to change it"})
+		return
+	}
+
+	user, err := s.users.UpdateEmail(ctx, tenantID, userID, email)
+	if err == repository.ErrConflict {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already in use"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating user"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Action: "user.update_profile", TargetType: "user", TargetID: audit.Target(user.ID), After: user})
+
+	// The email is part of the token claims, so issue a fresh token
+	token, err := s.tokens.GenerateToken(user.ID, tenantID, user.Email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user":  user,
+		"token": token,
+	})
+}
+
+// @Summary     Change password
+// @Description Change the current user's password, which applies to every tenant of their global account
+// @Tags        user
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.ChangePasswordRequest true "Current and new password"
+// @Success     200 {object} map[string]string "Password changed"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Current password is incorrect"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /me/password [post]
+func (s *Server) ChangePassword(c *gin.Context) {
+	var req models.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checkPasswordPolicy(c, req.NewPassword) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetInt("user_id")
+	tenantID := c.GetInt("tenant_id")
+
+	// Linked users authenticate with the password of their global identity
+	var hashedPassword string
+	ident, err := s.identities.IdentityByUser(ctx, tenantID, userID)
+	if err == nil {
+		hashedPassword = ident.Password
+	} else if err == sql.ErrNoRows {
+		var user *models.User
+		user, err = s.users.UserByID(ctx, tenantID, userID)
+		if err == nil {
+			hashedPassword = user.Password
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !models.CheckPassword(ctx, req.CurrentPassword, hashedPassword) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	newHash, err := models.HashPassword(ctx, req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error hashing password"})
+		return
+	}
+
+	if ident != nil {
+		err = s.identities.UpdateIdentityPassword(ctx, ident.ID, newHash)
+	}
+	if err == nil {
+		err = s.users.UpdatePassword(ctx, tenantID, userID, newHash)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error changing password"})
+		return
+	}
+
+	audit.Describe(c, audit.Details{Action: "user.change_password", TargetType: "user", TargetID: audit.Target(userID)})
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
+
+// userIDParam parses the :id parameter, writing an error response when invalid
+func userIDParam(c *gin.Context) (int, bool) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return 0, false
+	}
+	return userID, true
+}
+
+// pagination parses the limit and offset query parameters, writing an error
+// response when invalid
+func pagination(c *gin.Context) (int, int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit, must be between 1 and 200"})
+		return 0, 0, false
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid offset"})
+		return 0, 0, false
+	}
+	return limit, offset, true
+}
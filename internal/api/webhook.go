@@ -0,0 +1,206 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/webhook"
+)
+
+// @Summary     Create a webhook
+// @Description Subscribe a URL to events of the current tenant. Deliveries are POSTed as JSON and signed in the X-Webhook-Signature header, t=<unix time>,v1=<hex HMAC-SHA256 of "<time>.<body>"> keyed with the webhook's secret, which is only returned here.
+// @Tags        webhooks
+// @Accept      json
+// @Produce     json
+// @Security    BearerAuth
+// @Param       request body models.CreateWebhookRequest true "Webhook details"
+// @Success     201 {object} models.Webhook "Webhook created, including its secret"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /webhooks [post]
+func (s *Server) CreateWebhook(c *gin.Context) {
+	var req models.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := webhook.CheckURL(req.URL); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook URL: " + err.Error()})
+		return
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating webhook secret"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	w := models.Webhook{URL: req.URL, Secret: secret, EventTypes: req.EventTypes}
+	if err := s.webhooks.CreateWebhook(ctx, c.GetInt("tenant_id"), &w); err != nil {
+		logging.FromContext(ctx).Error("Error creating webhook", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating webhook"})
+		return
+	}
+
+	logged := w
+	logged.Secret = ""
+	audit.Describe(c, audit.Details{Action: "webhook.create", TargetType: "webhook", TargetID: audit.Target(w.ID), After: logged})
+	c.JSON(http.StatusCreated, w)
+}
+
+// @Summary     List webhooks
+// @Description List the webhooks of the current tenant, without their secrets
+// @Tags        webhooks
+// @Produce     json
+// @Security    BearerAuth
+// @Success     200 {array} models.Webhook "List of webhooks"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /webhooks [get]
+func (s *Server) GetWebhooks(c *gin.Context) {
+	webhooks, err := s.webhooks.ListWebhooks(c.Request.Context(), c.GetInt("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// @Summary     Delete a webhook
+// @Description Delete a webhook of the current tenant along with its delivery log
+// @Tags        webhooks
+// @Security    BearerAuth
+// @Param       id path int true "Webhook ID"
+// @Success     204 "Webhook deleted"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Webhook not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /webhooks/{id} [delete]
+func (s *Server) DeleteWebhook(c *gin.Context) {
+	audit.Describe(c, audit.Details{Action: "webhook.delete"})
+	w, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+	w.Secret = ""
+	audit.Describe(c, audit.Details{TargetType: "webhook", TargetID: audit.Target(w.ID), Before: w})
+
+	err := s.webhooks.DeleteWebhook(c.Request.Context(), c.GetInt("tenant_id"), w.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting webhook"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// @Summary     List webhook deliveries
+// @Description List the deliveries of a webhook, newest first, with the outcome of their last attempt
+// @Tags        webhooks
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "Webhook ID"
+// @Param       limit query int false "Maximum number of deliveries to return" default(50)
+// @Param       offset query int false "Number of deliveries to skip" default(0)
+// @Success     200 {array} models.WebhookDelivery "List of deliveries"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Webhook not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /webhooks/{id}/deliveries [get]
+func (s *Server) GetWebhookDeliveries(c *gin.Context) {
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return
+	}
+	w, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	deliveries, err := s.webhooks.ListDeliveries(c.Request.Context(), c.GetInt("tenant_id"), w.ID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error fetching deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// @Summary     Redeliver a webhook event
+// @Description Queue the event of a delivery for the webhook again. The new delivery keeps the event ID, so receivers can recognize the event.
+// @Tags        webhooks
+// @Produce     json
+// @Security    BearerAuth
+// @Param       id path int true "Webhook ID"
+// @Param       delivery_id path int true "Delivery ID"
+// @Success     202 {object} models.WebhookDelivery "Delivery queued"
+// @Failure     400 {object} map[string]string "Bad request"
+// @Failure     401 {object} map[string]string "Unauthorized"
+// @Failure     403 {object} map[string]string "Forbidden"
+// @Failure     404 {object} map[string]string "Webhook or delivery not found"
+// @Failure     500 {object} map[string]string "Internal server error"
+// @Router      /webhooks/{id}/deliveries/{delivery_id}/redeliver [post]
+func (s *Server) RedeliverWebhook(c *gin.Context) {
+	audit.Describe(c, audit.Details{Action: "webhook.redeliver"})
+	deliveryID, err := strconv.ParseInt(c.Param("delivery_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+		return
+	}
+	w, ok := s.findWebhook(c)
+	if !ok {
+		return
+	}
+
+	delivery, err := s.webhooks.Redeliver(c.Request.Context(), c.GetInt("tenant_id"), w.ID, deliveryID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error queueing delivery"})
+		return
+	}
+	audit.Describe(c, audit.Details{TargetType: "webhook", TargetID: audit.Target(w.ID),
+		After: gin.H{"delivery_id": delivery.ID, "redelivered_id": deliveryID, "event_id": delivery.EventID}})
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// findWebhook loads the webhook named by the :id parameter from the caller's
+// tenant, writing an error response when it can't be found
+func (s *Server) findWebhook(c *gin.Context) (*models.Webhook, bool) {
+	webhookID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+		return nil, false
+	}
+
+	w, err := s.webhooks.WebhookByID(c.Request.Context(), c.GetInt("tenant_id"), webhookID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, false
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return w, true
+}
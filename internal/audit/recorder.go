@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// detailsKey is the Gin context key of the handler's Details
+const detailsKey = "audit"
+
+// Details describes the change a request makes, beyond what the middleware
+// can tell from the request itself. Zero fields are filled in from the
+// request context.
+type Details struct {
+	// Platform records the event in the platform log, TenantID then names the
+	// tenant the event concerns
+	Platform bool
+	// TenantID overrides the tenant resolved for the request, for requests
+	// naming their tenant in the body
+	TenantID    int
+	ActorUserID int
+	ActorEmail  string
+	Action      string
+	TargetType  string
+	TargetID    string
+	Before      interface{}
+	After       interface{}
+}
+
+// Describe adds details to the audit event of the request. The non-zero
+// fields of d replace the ones of earlier calls.
+func Describe(c *gin.Context, d Details) {
+	current := details(c)
+	if d.Platform {
+		current.Platform = true
+	}
+	if d.TenantID != 0 {
+		current.TenantID = d.TenantID
+	}
+	if d.ActorUserID != 0 {
+		current.ActorUserID = d.ActorUserID
+	}
+	if d.ActorEmail != "" {
+		current.ActorEmail = d.ActorEmail
+	}
+	if d.Action != "" {
+		current.Action = d.Action
+	}
+	if d.TargetType != "" {
+		current.TargetType = d.TargetType
+	}
+	if d.TargetID != "" {
+		current.TargetID = d.TargetID
+	}
+	if d.Before != nil {
+		current.Before = d.Before
+	}
+	if d.After != nil {
+		current.After = d.After
+	}
+	c.Set(detailsKey, current)
+}
+
+// Target returns the ID of a target as used in audit events
+func Target(id int) string {
+	return strconv.Itoa(id)
+}
+
+// details returns the details described so far
+func details(c *gin.Context) Details {
+	if value, ok := c.Get(detailsKey); ok {
+		if d, ok := value.(Details); ok {
+			return d
+		}
+	}
+	return Details{}
+}
+
+// Middleware records an audit event for every mutating request once it has
+// been handled. Events go to the log of the request's tenant; requests without
+// a tenant are recorded in the platform log, unless they were refused without
+// an authenticated actor.
+func Middleware(repo repository.AuditRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		// Unmatched paths change nothing and would let scanners fill the log
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+
+		d := details(c)
+		event := models.AuditEvent{
+			ActorEmail: d.ActorEmail,
+			Action:     d.Action,
+			TargetType: d.TargetType,
+			TargetID:   d.TargetID,
+			IP:         c.ClientIP(),
+			RequestID:  c.GetString("request_id"),
+			Status:     c.Writer.Status(),
+			Before:     summary(d.Before),
+			After:      summary(d.After),
+		}
+		if event.Action == "" {
+			// Path routes register the same handlers under /t/:slug
+			event.Action = c.Request.Method + " " + strings.TrimPrefix(route, "/t/:slug")
+		}
+
+		actorUserID := d.ActorUserID
+		if actorUserID == 0 {
+			actorUserID = c.GetInt("user_id")
+		}
+		if actorUserID != 0 {
+			event.ActorUserID = &actorUserID
+		}
+		if event.ActorEmail == "" {
+			event.ActorEmail = c.GetString("email")
+		}
+
+		tenantID := d.TenantID
+		if tenantID == 0 {
+			tenantID = c.GetInt("tenant_id")
+		}
+		logTenantID := tenantID
+		if d.Platform {
+			logTenantID = 0
+			if tenantID != 0 {
+				event.TenantID = &tenantID
+			}
+		}
+
+		// Anyone can send requests that are refused before naming a tenant or
+		// an actor; recording them would let them fill the platform log
+		if logTenantID == 0 && !d.Platform && actorUserID == 0 && event.Status >= 400 && event.Status < 500 {
+			return
+		}
+
+		ctx := c.Request.Context()
+		if err := repo.AppendAuditEvent(ctx, logTenantID, &event); err != nil {
+			logging.FromContext(ctx).Error("Error recording audit event", "action", event.Action, "error", err)
+		}
+	}
+}
+
+// summary marshals the state of a target, nil if there is none
+func summary(state interface{}) json.RawMessage {
+	if state == nil {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,242 @@
+// Package backup takes snapshots of tenant databases, keeps them in the
+// archive storage under a retention policy and restores them into the
+// snapshot's tenant or a new one. Snapshots and restores run as background
+// jobs.
+package backup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/jobs"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/storage"
+)
+
+// pruneInterval is how often the retention policy is applied to every tenant
+const pruneInterval = time.Hour
+
+// RestoreParams are the parameters of a restore job
+type RestoreParams struct {
+	SnapshotID int64 `json:"snapshot_id"`
+	models.RestoreSnapshotRequest
+}
+
+// Service runs the snapshot and restore jobs
+type Service struct {
+	tenants   repository.TenantStore
+	snapshots repository.SnapshotRepository
+	data      repository.TenantDataRepository
+	jobs      repository.JobRepository
+	archives  storage.Storage
+	billing   *billing.Service
+	method    string
+	// keep is how many snapshots are kept per tenant, 0 keeps all
+	keep int
+	// maxAge is how long snapshots are kept, 0 keeps them forever
+	maxAge time.Duration
+}
+
+// NewService creates a service keeping the snapshots in archives
+func NewService(cfg config.BackupConfig, repos repository.Repositories, archives storage.Storage, billingService *billing.Service) *Service {
+	return &Service{
+		tenants:   repos.Tenants,
+		snapshots: repos.Snapshots,
+		data:      repos.TenantData,
+		jobs:      repos.Jobs,
+		archives:  archives,
+		billing:   billingService,
+		method:    cfg.Method,
+		keep:      cfg.RetentionCount,
+		maxAge:    time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+	}
+}
+
+// Register sets the service as the handler of the snapshot and restore jobs
+func (s *Service) Register(runner *jobs.Runner) {
+	runner.Handle(models.JobSnapshot, s.Snapshot)
+	runner.Handle(models.JobRestore, s.Restore)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Snapshot dumps the job's tenant into the storage and records the snapshot,
+// then applies the retention policy to the tenant
+func (s *Service) Snapshot(ctx context.Context, job *models.Job) error {
+	var req models.CreateSnapshotRequest
+	if len(job.Params) > 0 {
+		if err := json.Unmarshal(job.Params, &req); err != nil {
+			return fmt.Errorf("error decoding snapshot parameters: %v", err)
+		}
+	}
+	if _, err := s.tenants.TenantByID(ctx, job.TenantID); errors.Is(err, sql.ErrNoRows) {
+		return jobs.Fail("Tenant not found")
+	} else if err != nil {
+		return err
+	}
+
+	// A job started again overwrites the archive of its interrupted attempt
+	snapshot := &models.Snapshot{
+		TenantID:  job.TenantID,
+		JobID:     job.ID,
+		Label:     req.Label,
+		Method:    s.method,
+		Key:       fmt.Sprintf("snapshots/%d/%d.snapshot", job.TenantID, job.ID),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// The dump is streamed into the storage
+	pr, pw := io.Pipe()
+	dumped := make(chan error, 1)
+	go func() {
+		version, err := s.snapshots.DumpTenant(ctx, job.TenantID, s.method, pw)
+		snapshot.SchemaVersion = version
+		pw.CloseWithError(err)
+		dumped <- err
+	}()
+	archive := &countingReader{r: pr}
+	putErr := s.archives.Put(ctx, snapshot.Key, archive)
+	pr.CloseWithError(putErr)
+	if err := <-dumped; err != nil {
+		return fmt.Errorf("error taking snapshot: %w", err)
+	}
+	if putErr != nil {
+		return fmt.Errorf("error storing snapshot: %w", putErr)
+	}
+	snapshot.Size = archive.n
+
+	if err := s.snapshots.CreateSnapshot(ctx, snapshot); err != nil && !errors.Is(err, repository.ErrConflict) {
+		return err
+	}
+	if err := s.pruneTenant(ctx, job.TenantID); err != nil {
+		logging.FromContext(ctx).Error("Error applying the snapshot retention", "tenant_id", job.TenantID, "error", err)
+	}
+	return nil
+}
+
+// Restore restores the snapshot named by the job's parameters into the
+// snapshot's tenant, or into a tenant it provisions first. A job started
+// again after its replica stopped restores into the tenant it created.
+func (s *Service) Restore(ctx context.Context, job *models.Job) error {
+	var params RestoreParams
+	if err := json.Unmarshal(job.Params, &params); err != nil {
+		return fmt.Errorf("error decoding restore parameters: %v", err)
+	}
+
+	snapshot, err := s.snapshots.SnapshotByID(ctx, params.SnapshotID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return jobs.Fail("Snapshot not found")
+	} else if err != nil {
+		return err
+	}
+	if v := s.data.TenantSchemaVersion(); snapshot.SchemaVersion > v {
+		return jobs.Fail("Snapshot was taken at schema version %d, newer than this server's %d; upgrade the server first", snapshot.SchemaVersion, v)
+	}
+
+	if job.TenantID == 0 {
+		tenant, err := s.tenants.CreateTenant(ctx, params.Name, params.Slug)
+		if errors.Is(err, repository.ErrConflict) {
+			return jobs.Fail("Tenant with this name or slug already exists")
+		} else if err != nil {
+			return err
+		}
+		if err := s.jobs.SetJobTenant(ctx, job.ID, tenant.ID); err != nil {
+			return err
+		}
+		job.TenantID = tenant.ID
+
+		// A failed subscription is retried by assigning the plan again
+		if err := s.billing.SyncPlan(ctx, tenant, tenant.Plan); err != nil {
+			logging.FromContext(ctx).Error("Error subscribing tenant", "tenant_id", tenant.ID, "error", err)
+		}
+	}
+
+	r, err := s.archives.Get(ctx, snapshot.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return jobs.Fail("Snapshot archive not found")
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return s.snapshots.RestoreTenant(ctx, job.TenantID, snapshot.Method, snapshot.SchemaVersion, r)
+}
+
+// Delete deletes a snapshot and its archive
+func (s *Service) Delete(ctx context.Context, snapshot *models.Snapshot) error {
+	if err := s.archives.Delete(ctx, snapshot.Key); err != nil {
+		return err
+	}
+	return s.snapshots.DeleteSnapshot(ctx, snapshot.ID)
+}
+
+// pruneTenant deletes the tenant's snapshots beyond the newest ones kept or
+// older than the retention
+func (s *Service) pruneTenant(ctx context.Context, tenantID int) error {
+	snapshots, err := s.snapshots.Snapshots(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	for i, snapshot := range snapshots {
+		expired := s.maxAge > 0 && time.Since(snapshot.CreatedAt) > s.maxAge
+		if (s.keep > 0 && i >= s.keep) || expired {
+			if err := s.Delete(ctx, &snapshot); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Prune applies the retention policy to the snapshots of every tenant
+func (s *Service) Prune(ctx context.Context) error {
+	ids, err := s.tenants.TenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := s.pruneTenant(ctx, id); err != nil {
+			logging.FromContext(ctx).Error("Error applying the snapshot retention", "tenant_id", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// Run applies the retention policy every hour until ctx is cancelled
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Prune(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error pruning snapshots", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Package billing subscribes tenants to their plans at a billing provider,
+// reports their metered requests and suspends them when payments fail
+package billing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/models"
+)
+
+var (
+	// ErrDisabled is returned for webhooks when no billing provider is configured
+	ErrDisabled = errors.New("billing is disabled")
+	// ErrInvalidSignature is returned for webhooks that weren't signed by the provider
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+// Subscription is a tenant's subscription at the provider
+type Subscription struct {
+	CustomerID string
+	ID         string
+	// ItemID is the subscription item usage is reported to
+	ItemID string
+	Status string
+}
+
+// UsageRecord is a number of requests reported for a subscription
+type UsageRecord struct {
+	ItemID    string
+	Quantity  int64
+	Timestamp time.Time
+	// IdempotencyKey makes retries of the same report count once
+	IdempotencyKey string
+}
+
+// Event is a payment event received from the provider
+type Event struct {
+	ID             string
+	Type           string
+	CustomerID     string
+	SubscriptionID string
+	// Status is the subscription state the event moves the customer to,
+	// empty for events that don't change it
+	Status string
+}
+
+// Provider is a billing provider
+type Provider interface {
+	// Subscribe subscribes a tenant to a plan, creating its customer if
+	// customerID is empty. It returns nil if the plan isn't billed. Retries
+	// with the same attempt, the number of subscriptions the tenant had
+	// before, return the subscription the first one created.
+	Subscribe(ctx context.Context, tenant *models.Tenant, customerID, plan string, attempt int) (*Subscription, error)
+	// ChangePlan moves a subscription to another plan, cancelling it and
+	// returning nil if the plan isn't billed
+	ChangePlan(ctx context.Context, sub *Subscription, plan string) (*Subscription, error)
+	// ReportUsage adds requests to a subscription's metered usage
+	ReportUsage(ctx context.Context, record UsageRecord) error
+	// ParseEvent checks the signature of a webhook and decodes its event
+	ParseEvent(payload []byte, header http.Header) (*Event, error)
+}
+
+// NewProvider creates the configured billing provider
+func NewProvider(cfg config.BillingConfig) Provider {
+	if cfg.Provider == "stripe" {
+		return NewStripe(cfg)
+	}
+	return Noop{}
+}
+
+// Noop is the provider used when billing is disabled: no plan is billed and
+// webhooks are rejected
+type Noop struct{}
+
+// Subscribe doesn't subscribe the tenant
+func (Noop) Subscribe(ctx context.Context, tenant *models.Tenant, customerID, plan string, attempt int) (*Subscription, error) {
+	return nil, nil
+}
+
+// ChangePlan leaves the tenant without a subscription
+func (Noop) ChangePlan(ctx context.Context, sub *Subscription, plan string) (*Subscription, error) {
+	return nil, nil
+}
+
+// ReportUsage discards the usage
+func (Noop) ReportUsage(ctx context.Context, record UsageRecord) error {
+	return nil
+}
+
+// ParseEvent returns ErrDisabled
+func (Noop) ParseEvent(payload []byte, header http.Header) (*Event, error) {
+	return nil, ErrDisabled
+}
@@ -0,0 +1,152 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// reportWindow is how far back unreported requests are reported, covering the
+// requests flushed after midnight and provider outages of up to a day
+const reportWindow = 48 * time.Hour
+
+// Service keeps the tenants' subscriptions in line with their plans, reports
+// their metered requests and suspends them while their payments fail
+type Service struct {
+	provider Provider
+	repo     repository.BillingRepository
+	now      func() time.Time
+}
+
+// NewService creates a billing service
+func NewService(provider Provider, repo repository.BillingRepository) *Service {
+	return &Service{provider: provider, repo: repo, now: time.Now}
+}
+
+// ParseEvent checks the signature of a webhook and decodes its event
+func (s *Service) ParseEvent(payload []byte, header http.Header) (*Event, error) {
+	return s.provider.ParseEvent(payload, header)
+}
+
+// SyncPlan subscribes a tenant to a plan, moves its subscription to it or
+// cancels the subscription, as the plan's pricing requires
+func (s *Service) SyncPlan(ctx context.Context, tenant *models.Tenant, plan string) error {
+	b, err := s.repo.TenantBilling(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+
+	var sub *Subscription
+	if b.SubscriptionID == "" {
+		sub, err = s.provider.Subscribe(ctx, tenant, b.CustomerID, plan, b.Subscriptions)
+		if err != nil || sub == nil {
+			return err
+		}
+		b.Subscriptions++
+	} else {
+		current := &Subscription{CustomerID: b.CustomerID, ID: b.SubscriptionID, ItemID: b.SubscriptionItemID, Status: b.Status}
+		if sub, err = s.provider.ChangePlan(ctx, current, plan); err != nil {
+			return err
+		}
+	}
+
+	if sub == nil {
+		// Plans that aren't billed can't fall behind on payments
+		b.SubscriptionID, b.SubscriptionItemID = "", ""
+		s.setStatus(b, models.SubscriptionNone)
+	} else {
+		b.CustomerID, b.SubscriptionID, b.SubscriptionItemID = sub.CustomerID, sub.ID, sub.ItemID
+		s.setStatus(b, sub.Status)
+	}
+	return s.repo.SaveTenantBilling(ctx, b)
+}
+
+// setStatus sets the subscription status, suspending or resuming the tenant
+func (s *Service) setStatus(b *models.TenantBilling, status string) {
+	b.Status = status
+	if !models.SubscriptionSuspends(status) {
+		b.SuspendedAt = nil
+	} else if b.SuspendedAt == nil {
+		now := s.now()
+		b.SuspendedAt = &now
+	}
+}
+
+// HandleEvent applies a payment event to the subscription of the customer it
+// is about. It returns the tenant's billing before and after, or nils if the
+// event doesn't change any tenant's subscription.
+func (s *Service) HandleEvent(ctx context.Context, event *Event) (before, after *models.TenantBilling, err error) {
+	if event.Status == "" || event.CustomerID == "" {
+		return nil, nil, nil
+	}
+
+	// Providers deliver events at least once, an old event redelivered must
+	// not undo a newer one. Events of earlier subscriptions, e.g. the one
+	// cancelled by moving to a plan that isn't billed, don't apply.
+	err = s.repo.ApplyBillingEvent(ctx, event.ID, event.Type, event.CustomerID, func(b *models.TenantBilling) bool {
+		if event.SubscriptionID != b.SubscriptionID || b.SubscriptionID == "" {
+			return false
+		}
+		previous := *b
+		before = &previous
+		s.setStatus(b, event.Status)
+		after = b
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// ReportUsage reports the metered requests of subscribed tenants that
+// weren't reported yet
+func (s *Service) ReportUsage(ctx context.Context) error {
+	now := s.now()
+	usage, err := s.repo.UnbilledUsage(ctx, now.UTC().Add(-reportWindow))
+	if err != nil {
+		return err
+	}
+
+	log := logging.FromContext(ctx)
+	for _, u := range usage {
+		day := u.Day.Format(time.DateOnly)
+		record := UsageRecord{
+			ItemID:    u.SubscriptionItemID,
+			Quantity:  u.Requests - u.BilledRequests,
+			Timestamp: now,
+			// The key only repeats when reporting the same requests again
+			IdempotencyKey: fmt.Sprintf("usage-%d-%s-%d-%d", u.TenantID, day, u.BilledRequests, u.Requests),
+		}
+		if err := s.provider.ReportUsage(ctx, record); err != nil {
+			log.Error("Error reporting usage", "tenant_id", u.TenantID, "day", day, "error", err)
+			continue
+		}
+		if err := s.repo.MarkBilled(ctx, u.TenantID, u.Day, u.Requests); err != nil {
+			log.Error("Error recording reported usage", "tenant_id", u.TenantID, "day", day, "error", err)
+		}
+	}
+	return nil
+}
+
+// Run reports usage every interval until ctx is cancelled
+func (s *Service) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.ReportUsage(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error listing usage to report", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
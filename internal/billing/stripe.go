@@ -0,0 +1,264 @@
+package billing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/models"
+)
+
+// SignatureHeader carries the signature of Stripe webhooks
+const SignatureHeader = "Stripe-Signature"
+
+// signatureTolerance is how old a webhook signature may be, against replays
+const signatureTolerance = 5 * time.Minute
+
+// Stripe bills through the Stripe API, or any server implementing the same
+// endpoints, subscribing tenants to metered prices
+type Stripe struct {
+	apiURL        string
+	secretKey     string
+	webhookSecret string
+	prices        map[string]string
+	client        *http.Client
+	now           func() time.Time
+}
+
+// NewStripe creates a Stripe provider
+func NewStripe(cfg config.BillingConfig) *Stripe {
+	return &Stripe{
+		apiURL:        strings.TrimRight(cfg.APIURL, "/"),
+		secretKey:     cfg.SecretKey,
+		webhookSecret: cfg.WebhookSecret,
+		prices:        cfg.Prices,
+		client:        &http.Client{Timeout: 30 * time.Second},
+		now:           time.Now,
+	}
+}
+
+// stripeSubscription is a subscription as returned by the API
+type stripeSubscription struct {
+	ID       string `json:"id"`
+	Customer string `json:"customer"`
+	Status   string `json:"status"`
+	Items    struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+func (s stripeSubscription) subscription() *Subscription {
+	sub := &Subscription{CustomerID: s.Customer, ID: s.ID, Status: s.Status}
+	if len(s.Items.Data) > 0 {
+		sub.ItemID = s.Items.Data[0].ID
+	}
+	return sub
+}
+
+// Subscribe subscribes a tenant to the plan's price, creating its customer if
+// customerID is empty. It returns nil if the plan has no price.
+func (s *Stripe) Subscribe(ctx context.Context, tenant *models.Tenant, customerID, plan string, attempt int) (*Subscription, error) {
+	price, ok := s.prices[plan]
+	if !ok {
+		return nil, nil
+	}
+
+	if customerID == "" {
+		var customer struct {
+			ID string `json:"id"`
+		}
+		form := url.Values{
+			"name":                  {tenant.Name},
+			"metadata[tenant_id]":   {strconv.Itoa(tenant.ID)},
+			"metadata[tenant_slug]": {tenant.Slug},
+		}
+		// A retry after a lost response gets the same customer back
+		key := fmt.Sprintf("customer-tenant-%d", tenant.ID)
+		if err := s.call(ctx, http.MethodPost, "/v1/customers", form, key, &customer); err != nil {
+			return nil, fmt.Errorf("creating customer: %w", err)
+		}
+		customerID = customer.ID
+	}
+
+	var sub stripeSubscription
+	form := url.Values{
+		"customer":            {customerID},
+		"items[0][price]":     {price},
+		"metadata[tenant_id]": {strconv.Itoa(tenant.ID)},
+	}
+	// A retry after a lost response gets the same subscription back, while
+	// subscribing again after a cancellation is a new attempt
+	key := fmt.Sprintf("tenant-%d-plan-%s-%d", tenant.ID, plan, attempt)
+	if err := s.call(ctx, http.MethodPost, "/v1/subscriptions", form, key, &sub); err != nil {
+		return nil, fmt.Errorf("creating subscription: %w", err)
+	}
+	if sub.Customer == "" {
+		sub.Customer = customerID
+	}
+	return sub.subscription(), nil
+}
+
+// ChangePlan moves a subscription to the plan's price, cancelling it and
+// returning nil if the plan has no price
+func (s *Stripe) ChangePlan(ctx context.Context, sub *Subscription, plan string) (*Subscription, error) {
+	price, ok := s.prices[plan]
+	if !ok {
+		if err := s.call(ctx, http.MethodDelete, "/v1/subscriptions/"+url.PathEscape(sub.ID), nil, "", nil); err != nil {
+			return nil, fmt.Errorf("cancelling subscription: %w", err)
+		}
+		return nil, nil
+	}
+
+	form := url.Values{"price": {price}}
+	if err := s.call(ctx, http.MethodPost, "/v1/subscription_items/"+url.PathEscape(sub.ItemID), form, "", nil); err != nil {
+		return nil, fmt.Errorf("changing subscription price: %w", err)
+	}
+	changed := *sub
+	return &changed, nil
+}
+
+// ReportUsage adds a usage record to a subscription item
+func (s *Stripe) ReportUsage(ctx context.Context, record UsageRecord) error {
+	form := url.Values{
+		"quantity":  {strconv.FormatInt(record.Quantity, 10)},
+		"timestamp": {strconv.FormatInt(record.Timestamp.Unix(), 10)},
+		"action":    {"increment"},
+	}
+	path := "/v1/subscription_items/" + url.PathEscape(record.ItemID) + "/usage_records"
+	if err := s.call(ctx, http.MethodPost, path, form, record.IdempotencyKey, nil); err != nil {
+		return fmt.Errorf("reporting usage: %w", err)
+	}
+	return nil
+}
+
+// call sends a form encoded API request and decodes the response into out,
+// if not nil
+func (s *Stripe) call(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, s.apiURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.secretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, apiErr.Error.Message)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// ParseEvent checks the Stripe-Signature header of a webhook and decodes the
+// subscription and invoice events that change a customer's subscription
+func (s *Stripe) ParseEvent(payload []byte, header http.Header) (*Event, error) {
+	if err := s.verifySignature(payload, header.Get(SignatureHeader)); err != nil {
+		return nil, err
+	}
+
+	var raw struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID           string `json:"id"`
+				Customer     string `json:"customer"`
+				Subscription string `json:"subscription"`
+				Status       string `json:"status"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("decoding event: %w", err)
+	}
+	if raw.ID == "" || raw.Type == "" {
+		return nil, fmt.Errorf("decoding event: missing id or type")
+	}
+
+	object := raw.Data.Object
+	event := &Event{ID: raw.ID, Type: raw.Type, CustomerID: object.Customer}
+	switch raw.Type {
+	case "customer.subscription.created", "customer.subscription.updated":
+		event.SubscriptionID, event.Status = object.ID, object.Status
+	case "customer.subscription.deleted":
+		event.SubscriptionID, event.Status = object.ID, models.SubscriptionCanceled
+	case "invoice.payment_failed":
+		event.SubscriptionID, event.Status = object.Subscription, models.SubscriptionPastDue
+	case "invoice.paid", "invoice.payment_succeeded":
+		event.SubscriptionID, event.Status = object.Subscription, models.SubscriptionActive
+	}
+	return event, nil
+}
+
+// verifySignature checks a Stripe-Signature header, t=<unix time>,v1=<hex
+// HMAC-SHA256 of "<time>.<payload>">, against the webhook secret
+func (s *Stripe) verifySignature(payload []byte, header string) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if age := s.now().Sub(time.Unix(unix, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	expected := Sign(s.webhookSecret, unix, payload)
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// Sign returns the v1 signature of a webhook payload sent at unix time t
+func Sign(secret string, t int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", t)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
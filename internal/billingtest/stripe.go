@@ -0,0 +1,148 @@
+// Package billingtest serves a stub of the Stripe API for tests, recording
+// the customers, subscriptions and usage records created through it
+package billingtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-multi-tenant/internal/billing"
+)
+
+// Request is an API request received by the stub
+type Request struct {
+	Method         string
+	Path           string
+	Form           url.Values
+	IdempotencyKey string
+}
+
+// Stripe is a stub of the Stripe API endpoints used by billing.Stripe
+type Stripe struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []Request
+	// usage are the reported quantities by subscription item
+	usage map[string]int64
+	// reports are the idempotency keys of the usage records created
+	reports map[string]bool
+	nextID  int
+	failing bool
+}
+
+// NewStripe starts a stub, closed when the test finishes
+func NewStripe(t testing.TB) *Stripe {
+	t.Helper()
+
+	s := &Stripe{usage: make(map[string]int64), reports: make(map[string]bool)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetFailing makes the stub answer every request with a server error
+func (s *Stripe) SetFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+// Requests returns the requests received with a method and path prefix
+func (s *Stripe) Requests(method, pathPrefix string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var requests []Request
+	for _, r := range s.requests {
+		if r.Method == method && strings.HasPrefix(r.Path, pathPrefix) {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// Usage returns the quantity reported for a subscription item, counting
+// retried records once
+func (s *Stripe) Usage(itemID string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.usage[itemID]
+}
+
+func (s *Stripe) serve(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{"error": map[string]string{"message": "No API key provided"}})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": map[string]string{"message": err.Error()}})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Form: r.PostForm, IdempotencyKey: r.Header.Get("Idempotency-Key")})
+	if s.failing {
+		writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": map[string]string{"message": "Stub failure"}})
+		return
+	}
+
+	s.nextID++
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/customers":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": fmt.Sprintf("cus_%d", s.nextID)})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/subscriptions":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":       fmt.Sprintf("sub_%d", s.nextID),
+			"customer": r.PostForm.Get("customer"),
+			"status":   "active",
+			"items":    map[string]interface{}{"data": []map[string]string{{"id": fmt.Sprintf("si_%d", s.nextID)}}},
+		})
+	case r.Method == http.MethodDelete && len(parts) == 3 && parts[1] == "subscriptions":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": parts[2], "status": "canceled"})
+	case r.Method == http.MethodPost && len(parts) == 3 && parts[1] == "subscription_items":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": parts[2], "price": r.PostForm.Get("price")})
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[1] == "subscription_items" && parts[3] == "usage_records":
+		quantity, err := strconv.ParseInt(r.PostForm.Get("quantity"), 10, 64)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": map[string]string{"message": "Invalid quantity"}})
+			return
+		}
+		if key := r.Header.Get("Idempotency-Key"); key == "" || !s.reports[key] {
+			s.reports[key] = true
+			s.usage[parts[2]] += quantity
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": fmt.Sprintf("mbur_%d", s.nextID), "quantity": quantity})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": map[string]string{"message": "Unrecognized request URL"}})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Event returns the payload of a webhook event about object and its
+// Stripe-Signature header, signed with secret
+func Event(secret, id, eventType string, object map[string]interface{}) ([]byte, string) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":   id,
+		"type": eventType,
+		"data": map[string]interface{}{"object": object},
+	})
+	t := time.Now().Unix()
+	return payload, fmt.Sprintf("t=%d,v1=%s", t, billing.Sign(secret, t, payload))
+}
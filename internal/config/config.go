@@ -0,0 +1,646 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// sampleJWTSecrets are placeholder secrets from documentation and samples that must never be used
+var sampleJWTSecrets = []string{"your-super-secret-key-here", "secret", "changeme"}
+
+// Config is the application configuration
+type Config struct {
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	JWT       JWTConfig       `yaml:"jwt" toml:"jwt"`
+	Password  PasswordConfig  `yaml:"password" toml:"password"`
+	Tenant    TenantConfig    `yaml:"tenant" toml:"tenant"`
+	Domains   DomainsConfig   `yaml:"domains" toml:"domains"`
+	Mail      MailConfig      `yaml:"mail" toml:"mail"`
+	Admin     AdminConfig     `yaml:"admin" toml:"admin"`
+	Metrics   MetricsConfig   `yaml:"metrics" toml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Logging   LoggingConfig   `yaml:"logging" toml:"logging"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit"`
+	Usage     UsageConfig     `yaml:"usage" toml:"usage"`
+	Billing   BillingConfig   `yaml:"billing" toml:"billing"`
+	Webhooks  WebhooksConfig  `yaml:"webhooks" toml:"webhooks"`
+	Events    EventsConfig    `yaml:"events" toml:"events"`
+	Storage   StorageConfig   `yaml:"storage" toml:"storage"`
+	Jobs      JobsConfig      `yaml:"jobs" toml:"jobs"`
+	Backup    BackupConfig    `yaml:"backup" toml:"backup"`
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Addr string `yaml:"addr" toml:"addr" env:"SERVER_ADDR"`
+	// Timeouts in seconds, 0 disables the timeout
+	ReadTimeoutSeconds  int `yaml:"read_timeout_seconds" toml:"read_timeout_seconds" env:"SERVER_READ_TIMEOUT_SECONDS"`
+	WriteTimeoutSeconds int `yaml:"write_timeout_seconds" toml:"write_timeout_seconds" env:"SERVER_WRITE_TIMEOUT_SECONDS"`
+	IdleTimeoutSeconds  int `yaml:"idle_timeout_seconds" toml:"idle_timeout_seconds" env:"SERVER_IDLE_TIMEOUT_SECONDS"`
+	// ShutdownTimeoutSeconds bounds how long in-flight requests and background
+	// workers are waited for on shutdown
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_seconds" toml:"shutdown_timeout_seconds" env:"SERVER_SHUTDOWN_TIMEOUT_SECONDS"`
+}
+
+// DatabaseConfig configures the Postgres connections
+type DatabaseConfig struct {
+	Host     string `yaml:"host" toml:"host" env:"DB_HOST"`
+	Port     int    `yaml:"port" toml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" toml:"user" env:"DB_USER"`
+	Password string `yaml:"password" toml:"password" env:"DB_PASSWORD"`
+	// AdminDB is the database connected to for creating other databases
+	AdminDB string `yaml:"admin_db" toml:"admin_db" env:"DB_ADMIN_NAME"`
+	// ManagementDB is the database holding tenants and other platform data
+	ManagementDB string `yaml:"management_db" toml:"management_db" env:"DB_MANAGEMENT_NAME"`
+	SSLMode      string `yaml:"sslmode" toml:"sslmode" env:"DB_SSLMODE"`
+	SSLRootCert  string `yaml:"sslrootcert" toml:"sslrootcert" env:"DB_SSLROOTCERT"`
+	SSLCert      string `yaml:"sslcert" toml:"sslcert" env:"DB_SSLCERT"`
+	SSLKey       string `yaml:"sslkey" toml:"sslkey" env:"DB_SSLKEY"`
+	// BinDir is the directory of pg_dump and pg_restore, which are looked up
+	// on the PATH if empty
+	BinDir string `yaml:"bin_dir" toml:"bin_dir" env:"DB_BIN_DIR"`
+}
+
+// JWTConfig configures token signing
+type JWTConfig struct {
+	SecretKey       string `yaml:"secret_key" toml:"secret_key" env:"JWT_SECRET_KEY"`
+	ExpirationHours int    `yaml:"expiration_hours" toml:"expiration_hours" env:"JWT_EXPIRATION_HOURS"`
+}
+
+// Upper bounds of the argon2id parameters, applied to the configuration and to
+// stored hashes, which may come from imported archives
+const (
+	MaxArgon2MemoryKiB   = 256 * 1024
+	MaxArgon2Iterations  = 16
+	MaxArgon2Parallelism = 255
+)
+
+// PasswordConfig configures password hashing and the password policy
+type PasswordConfig struct {
+	HashAlgorithm     string `yaml:"hash_algorithm" toml:"hash_algorithm" env:"PASSWORD_HASH_ALGORITHM"`
+	BcryptCost        int    `yaml:"bcrypt_cost" toml:"bcrypt_cost" env:"BCRYPT_COST"`
+	Argon2MemoryKiB   int    `yaml:"argon2_memory_kib" toml:"argon2_memory_kib" env:"ARGON2_MEMORY_KIB"`
+	Argon2Iterations  int    `yaml:"argon2_iterations" toml:"argon2_iterations" env:"ARGON2_ITERATIONS"`
+	Argon2Parallelism int    `yaml:"argon2_parallelism" toml:"argon2_parallelism" env:"ARGON2_PARALLELISM"`
+	MinLength         int    `yaml:"min_length" toml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength         int    `yaml:"max_length" toml:"max_length" env:"PASSWORD_MAX_LENGTH"`
+	MinCharClasses    int    `yaml:"min_char_classes" toml:"min_char_classes" env:"PASSWORD_MIN_CHAR_CLASSES"`
+	BreachedList      string `yaml:"breached_list" toml:"breached_list" env:"PASSWORD_BREACHED_LIST"`
+}
+
+// TenantConfig configures tenant resolution
+type TenantConfig struct {
+	ResolutionStrategies []string `yaml:"resolution_strategies" toml:"resolution_strategies" env:"TENANT_RESOLUTION_STRATEGIES"`
+	BaseDomain           string   `yaml:"base_domain" toml:"base_domain" env:"TENANT_BASE_DOMAIN"`
+}
+
+// DomainsConfig configures custom domain verification
+type DomainsConfig struct {
+	ChallengeDNSServer string `yaml:"challenge_dns_server" toml:"challenge_dns_server" env:"DOMAIN_CHALLENGE_DNS_SERVER"`
+	ChallengeHTTPAddr  string `yaml:"challenge_http_addr" toml:"challenge_http_addr" env:"DOMAIN_CHALLENGE_HTTP_ADDR"`
+}
+
+// MailConfig configures outgoing email
+type MailConfig struct {
+	SMTPHost        string `yaml:"smtp_host" toml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort        int    `yaml:"smtp_port" toml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername    string `yaml:"smtp_username" toml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword    string `yaml:"smtp_password" toml:"smtp_password" env:"SMTP_PASSWORD"`
+	From            string `yaml:"from" toml:"from" env:"SMTP_FROM"`
+	InvitationURL   string `yaml:"invitation_url" toml:"invitation_url" env:"INVITATION_URL"`
+	VerificationURL string `yaml:"verification_url" toml:"verification_url" env:"VERIFICATION_URL"`
+}
+
+// AdminConfig configures the platform administration API
+type AdminConfig struct {
+	// APIKey must be sent in the X-Admin-Key header; admin routes are disabled without it
+	APIKey string `yaml:"api_key" toml:"api_key" env:"ADMIN_API_KEY"`
+}
+
+// MetricsConfig configures the Prometheus metrics
+type MetricsConfig struct {
+	// MaxTenantLabels is the number of tenants, and of tenant databases, given
+	// their own label value; the rest are reported as "other"
+	MaxTenantLabels int `yaml:"max_tenant_labels" toml:"max_tenant_labels" env:"METRICS_MAX_TENANT_LABELS"`
+}
+
+// TracingConfig configures OpenTelemetry tracing
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `yaml:"exporter" toml:"exporter" env:"TRACING_EXPORTER"`
+	// OTLPEndpoint is the URL of the OTLP/HTTP collector, e.g. http://localhost:4318.
+	// The standard OTEL_EXPORTER_OTLP_* variables are used when empty.
+	OTLPEndpoint string `yaml:"otlp_endpoint" toml:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT"`
+	ServiceName  string `yaml:"service_name" toml:"service_name" env:"TRACING_SERVICE_NAME"`
+}
+
+// LoggingConfig configures the structured logger
+type LoggingConfig struct {
+	// Level is debug, info, warn or error
+	Level string `yaml:"level" toml:"level" env:"LOG_LEVEL"`
+	// Format is json or text
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT"`
+}
+
+// RateLimitConfig configures request rate limiting
+type RateLimitConfig struct {
+	// Backend is none, memory or postgres; postgres shares the limits between replicas
+	Backend string `yaml:"backend" toml:"backend" env:"RATE_LIMIT_BACKEND"`
+	// Plans holds the limits of each tenant plan. Tenants on a plan that isn't
+	// listed get the "default" plan's limits.
+	Plans map[string]RateLimitPlan `yaml:"plans" toml:"plans"`
+}
+
+// RateLimitPlan sets the token buckets of a plan, refilled at the per minute
+// rate up to the burst size. A rate of 0 doesn't limit the scope, a burst of 0
+// is the per minute rate.
+type RateLimitPlan struct {
+	TenantPerMinute int `yaml:"tenant_per_minute" toml:"tenant_per_minute"`
+	TenantBurst     int `yaml:"tenant_burst" toml:"tenant_burst"`
+	UserPerMinute   int `yaml:"user_per_minute" toml:"user_per_minute"`
+	UserBurst       int `yaml:"user_burst" toml:"user_burst"`
+	APIKeyPerMinute int `yaml:"api_key_per_minute" toml:"api_key_per_minute"`
+	APIKeyBurst     int `yaml:"api_key_burst" toml:"api_key_burst"`
+}
+
+// UsageConfig configures usage metering
+type UsageConfig struct {
+	// FlushIntervalSeconds is how often the requests counted by each replica are
+	// added to the daily usage, and so how far replicas can overshoot a daily
+	// request quota together
+	FlushIntervalSeconds int `yaml:"flush_interval_seconds" toml:"flush_interval_seconds" env:"USAGE_FLUSH_INTERVAL_SECONDS"`
+}
+
+// BillingConfig configures the billing provider
+type BillingConfig struct {
+	// Provider is none or stripe
+	Provider string `yaml:"provider" toml:"provider" env:"BILLING_PROVIDER"`
+	// APIURL is the provider's API, e.g. a local stub in development
+	APIURL        string `yaml:"api_url" toml:"api_url" env:"BILLING_API_URL"`
+	SecretKey     string `yaml:"secret_key" toml:"secret_key" env:"BILLING_SECRET_KEY"`
+	WebhookSecret string `yaml:"webhook_secret" toml:"webhook_secret" env:"BILLING_WEBHOOK_SECRET"`
+	// Prices maps plan names to the metered price their tenants subscribe to.
+	// Plans without a price aren't billed.
+	Prices map[string]string `yaml:"prices" toml:"prices"`
+	// ReportIntervalSeconds is how often metered requests are reported
+	ReportIntervalSeconds int `yaml:"report_interval_seconds" toml:"report_interval_seconds" env:"BILLING_REPORT_INTERVAL_SECONDS"`
+}
+
+// WebhooksConfig configures the delivery of tenant events to their webhooks
+type WebhooksConfig struct {
+	// PollIntervalSeconds is how often the tenant databases are checked for
+	// deliveries that are due
+	PollIntervalSeconds int `yaml:"poll_interval_seconds" toml:"poll_interval_seconds" env:"WEBHOOK_POLL_INTERVAL_SECONDS"`
+	TimeoutSeconds      int `yaml:"timeout_seconds" toml:"timeout_seconds" env:"WEBHOOK_TIMEOUT_SECONDS"`
+	// MaxAttempts is the number of attempts after which a delivery fails for good
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	// RetryBaseSeconds is the delay before the first retry, doubled for each
+	// further retry up to an hour
+	RetryBaseSeconds int `yaml:"retry_base_seconds" toml:"retry_base_seconds" env:"WEBHOOK_RETRY_BASE_SECONDS"`
+	// AllowPrivateTargets allows webhooks on loopback and private addresses,
+	// e.g. in development; otherwise they could reach internal services
+	AllowPrivateTargets bool `yaml:"allow_private_targets" toml:"allow_private_targets" env:"WEBHOOK_ALLOW_PRIVATE_TARGETS"`
+}
+
+// EventsConfig configures the relay publishing the events of the tenants'
+// outboxes
+type EventsConfig struct {
+	// PollIntervalSeconds is how often the outboxes are checked for events to
+	// publish
+	PollIntervalSeconds int `yaml:"poll_interval_seconds" toml:"poll_interval_seconds" env:"EVENTS_POLL_INTERVAL_SECONDS"`
+	// RetentionHours is how long published events are kept in the outboxes
+	RetentionHours int `yaml:"retention_hours" toml:"retention_hours" env:"EVENTS_RETENTION_HOURS"`
+}
+
+// StorageConfig configures where archives, such as tenant exports and
+// snapshots, are stored
+type StorageConfig struct {
+	// Backend is local or s3
+	Backend string `yaml:"backend" toml:"backend" env:"STORAGE_BACKEND"`
+	// Dir is the directory the local backend stores archives in; replicas
+	// must share it
+	Dir string `yaml:"dir" toml:"dir" env:"STORAGE_DIR"`
+	// S3Endpoint is the URL of an S3 compatible service, addressed with
+	// path-style requests
+	S3Endpoint        string `yaml:"s3_endpoint" toml:"s3_endpoint" env:"STORAGE_S3_ENDPOINT"`
+	S3Region          string `yaml:"s3_region" toml:"s3_region" env:"STORAGE_S3_REGION"`
+	S3Bucket          string `yaml:"s3_bucket" toml:"s3_bucket" env:"STORAGE_S3_BUCKET"`
+	S3AccessKeyID     string `yaml:"s3_access_key_id" toml:"s3_access_key_id" env:"STORAGE_S3_ACCESS_KEY_ID"`
+	S3SecretAccessKey string `yaml:"s3_secret_access_key" toml:"s3_secret_access_key" env:"STORAGE_S3_SECRET_ACCESS_KEY"`
+}
+
+// JobsConfig configures the background jobs run on tenants, such as exports
+// and imports
+type JobsConfig struct {
+	// PollIntervalSeconds is how often pending jobs are looked for; jobs
+	// created by a replica start on it right away
+	PollIntervalSeconds int `yaml:"poll_interval_seconds" toml:"poll_interval_seconds" env:"JOBS_POLL_INTERVAL_SECONDS"`
+	// RetentionHours is how long finished jobs and their archives are kept
+	RetentionHours int `yaml:"retention_hours" toml:"retention_hours" env:"JOBS_RETENTION_HOURS"`
+	// MaxImportMegabytes bounds the size of uploaded import archives
+	MaxImportMegabytes int `yaml:"max_import_megabytes" toml:"max_import_megabytes" env:"JOBS_MAX_IMPORT_MEGABYTES"`
+}
+
+// BackupConfig configures the snapshots of tenant databases
+type BackupConfig struct {
+	// Method is logical, copying the rows of every table, or pg_dump
+	Method string `yaml:"method" toml:"method" env:"BACKUP_METHOD"`
+	// RetentionCount is how many snapshots are kept per tenant, 0 keeps all
+	RetentionCount int `yaml:"retention_count" toml:"retention_count" env:"BACKUP_RETENTION_COUNT"`
+	// RetentionDays is how long snapshots are kept, 0 keeps them forever
+	RetentionDays int `yaml:"retention_days" toml:"retention_days" env:"BACKUP_RETENTION_DAYS"`
+}
+
+// DefaultRateLimitPlan names the plan applied to tenants without limits of their own
+const DefaultRateLimitPlan = "default"
+
+// Default returns the configuration used for settings that aren't configured
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:                   "0.0.0.0:8080",
+			ReadTimeoutSeconds:     15,
+			WriteTimeoutSeconds:    30,
+			IdleTimeoutSeconds:     60,
+			ShutdownTimeoutSeconds: 30,
+		},
+		Database: DatabaseConfig{
+			Host:         "localhost",
+			Port:         5432,
+			User:         "postgres",
+			AdminDB:      "postgres",
+			ManagementDB: "tenant_management",
+			SSLMode:      "disable",
+		},
+		JWT: JWTConfig{
+			ExpirationHours: 24,
+		},
+		Password: PasswordConfig{
+			HashAlgorithm:     "argon2id",
+			BcryptCost:        10,
+			Argon2MemoryKiB:   19 * 1024,
+			Argon2Iterations:  2,
+			Argon2Parallelism: 1,
+			MinLength:         8,
+			MaxLength:         72,
+			MinCharClasses:    2,
+		},
+		Tenant: TenantConfig{
+			ResolutionStrategies: []string{"domain", "header", "subdomain", "path"},
+		},
+		Mail: MailConfig{
+			SMTPPort: 587,
+		},
+		Metrics: MetricsConfig{
+			MaxTenantLabels: 100,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "golang-multi-tenant",
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		RateLimit: RateLimitConfig{
+			Backend: "memory",
+			Plans: map[string]RateLimitPlan{
+				DefaultRateLimitPlan: {
+					TenantPerMinute: 1200,
+					TenantBurst:     200,
+					UserPerMinute:   300,
+					UserBurst:       60,
+					APIKeyPerMinute: 600,
+					APIKeyBurst:     100,
+				},
+			},
+		},
+		Usage: UsageConfig{
+			FlushIntervalSeconds: 30,
+		},
+		Billing: BillingConfig{
+			Provider:              "none",
+			APIURL:                "https://api.stripe.com",
+			ReportIntervalSeconds: 3600,
+		},
+		Webhooks: WebhooksConfig{
+			PollIntervalSeconds: 5,
+			TimeoutSeconds:      10,
+			MaxAttempts:         10,
+			RetryBaseSeconds:    30,
+		},
+		Events: EventsConfig{
+			PollIntervalSeconds: 2,
+			RetentionHours:      168,
+		},
+		Storage: StorageConfig{
+			Backend:  "local",
+			Dir:      "data",
+			S3Region: "us-east-1",
+		},
+		Jobs: JobsConfig{
+			PollIntervalSeconds: 5,
+			RetentionHours:      168,
+			MaxImportMegabytes:  100,
+		},
+		Backup: BackupConfig{
+			Method:         "logical",
+			RetentionCount: 7,
+			RetentionDays:  30,
+		},
+	}
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the YAML or TOML file at path (if not empty), the .env file and
+// the process environment
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+		}
+	}
+
+	// .env never overrides variables already set in the environment
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading .env file: %v", err)
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile decodes a YAML or TOML file, chosen by extension, over cfg
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, cfg)
+	case ".toml":
+		return toml.Unmarshal(data, cfg)
+	default:
+		return fmt.Errorf("unsupported config file extension %q", ext)
+	}
+}
+
+// applyEnv overrides the fields tagged with `env` from the environment
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := t.Field(i).Tag.Get("env")
+		value, set := os.LookupEnv(key)
+		if key == "" || !set || value == "" {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+			field.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %v", key, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration for values the application can't run with
+func (cfg *Config) Validate() error {
+	var problems []string
+
+	if cfg.Server.Addr == "" {
+		problems = append(problems, "server address is required")
+	}
+	if cfg.Server.ReadTimeoutSeconds < 0 || cfg.Server.WriteTimeoutSeconds < 0 || cfg.Server.IdleTimeoutSeconds < 0 {
+		problems = append(problems, "server timeouts can't be negative")
+	}
+	if cfg.Server.ShutdownTimeoutSeconds < 1 {
+		problems = append(problems, "server shutdown timeout must be at least 1 second")
+	}
+
+	switch cfg.Database.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported database sslmode %q", cfg.Database.SSLMode))
+	}
+	if (cfg.Database.SSLCert == "") != (cfg.Database.SSLKey == "") {
+		problems = append(problems, "database sslcert and sslkey must be set together")
+	}
+	for _, file := range []string{cfg.Database.SSLRootCert, cfg.Database.SSLCert, cfg.Database.SSLKey} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			problems = append(problems, fmt.Sprintf("database TLS file: %v", err))
+		}
+	}
+
+	secret := strings.TrimSpace(cfg.JWT.SecretKey)
+	if secret == "" {
+		problems = append(problems, "JWT secret key is required")
+	}
+	for _, sample := range sampleJWTSecrets {
+		if secret == sample {
+			problems = append(problems, "JWT secret key is a sample value, generate a random one (e.g. openssl rand -hex 32)")
+		}
+	}
+	if cfg.JWT.ExpirationHours < 1 {
+		problems = append(problems, "JWT expiration must be at least 1 hour")
+	}
+
+	switch cfg.Password.HashAlgorithm {
+	case "argon2id":
+		p := cfg.Password
+		if p.Argon2MemoryKiB < 1 || p.Argon2MemoryKiB > MaxArgon2MemoryKiB ||
+			p.Argon2Iterations < 1 || p.Argon2Iterations > MaxArgon2Iterations ||
+			p.Argon2Parallelism < 1 || p.Argon2Parallelism > MaxArgon2Parallelism {
+			problems = append(problems, fmt.Sprintf("argon2id parameters must be positive, with memory at most %d KiB, iterations at most %d and parallelism at most %d",
+				MaxArgon2MemoryKiB, MaxArgon2Iterations, MaxArgon2Parallelism))
+		}
+	case "bcrypt":
+		if cfg.Password.BcryptCost < 4 || cfg.Password.BcryptCost > 31 {
+			problems = append(problems, "bcrypt cost must be between 4 and 31")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported password hash algorithm %q", cfg.Password.HashAlgorithm))
+	}
+
+	if cfg.Metrics.MaxTenantLabels < 0 {
+		problems = append(problems, "metrics tenant label limit can't be negative")
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown tracing exporter %q", cfg.Tracing.Exporter))
+	}
+
+	switch strings.ToLower(cfg.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown log level %q", cfg.Logging.Level))
+	}
+	switch cfg.Logging.Format {
+	case "json", "text":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown log format %q", cfg.Logging.Format))
+	}
+
+	switch cfg.RateLimit.Backend {
+	case "none", "memory", "postgres":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown rate limit backend %q", cfg.RateLimit.Backend))
+	}
+	for name, plan := range cfg.RateLimit.Plans {
+		if plan.TenantPerMinute < 0 || plan.TenantBurst < 0 || plan.UserPerMinute < 0 || plan.UserBurst < 0 ||
+			plan.APIKeyPerMinute < 0 || plan.APIKeyBurst < 0 {
+			problems = append(problems, fmt.Sprintf("rate limits of plan %q can't be negative", name))
+		}
+	}
+
+	if cfg.Usage.FlushIntervalSeconds < 1 {
+		problems = append(problems, "usage flush interval must be at least 1 second")
+	}
+
+	switch cfg.Billing.Provider {
+	case "none":
+	case "stripe":
+		if cfg.Billing.SecretKey == "" || cfg.Billing.WebhookSecret == "" {
+			problems = append(problems, "the stripe billing provider requires a secret key and a webhook secret")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown billing provider %q", cfg.Billing.Provider))
+	}
+	if cfg.Billing.ReportIntervalSeconds < 1 {
+		problems = append(problems, "billing report interval must be at least 1 second")
+	}
+
+	if cfg.Webhooks.PollIntervalSeconds < 1 || cfg.Webhooks.TimeoutSeconds < 1 || cfg.Webhooks.RetryBaseSeconds < 1 {
+		problems = append(problems, "webhook poll interval, timeout and retry delay must be at least 1 second")
+	}
+	if cfg.Webhooks.MaxAttempts < 1 {
+		problems = append(problems, "webhook max attempts must be at least 1")
+	}
+
+	if cfg.Events.PollIntervalSeconds < 1 {
+		problems = append(problems, "events poll interval must be at least 1 second")
+	}
+	if cfg.Events.RetentionHours < 1 {
+		problems = append(problems, "events retention must be at least 1 hour")
+	}
+
+	switch cfg.Storage.Backend {
+	case "local":
+		if cfg.Storage.Dir == "" {
+			problems = append(problems, "the local storage backend requires a directory")
+		}
+	case "s3":
+		if cfg.Storage.S3Endpoint == "" || cfg.Storage.S3Region == "" || cfg.Storage.S3Bucket == "" ||
+			cfg.Storage.S3AccessKeyID == "" || cfg.Storage.S3SecretAccessKey == "" {
+			problems = append(problems, "the s3 storage backend requires an endpoint, region, bucket and access key")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown storage backend %q", cfg.Storage.Backend))
+	}
+	if cfg.Jobs.PollIntervalSeconds < 1 {
+		problems = append(problems, "jobs poll interval must be at least 1 second")
+	}
+	if cfg.Jobs.RetentionHours < 1 {
+		problems = append(problems, "jobs retention must be at least 1 hour")
+	}
+	if cfg.Jobs.MaxImportMegabytes < 1 {
+		problems = append(problems, "jobs import size limit must be at least 1 megabyte")
+	}
+	switch cfg.Backup.Method {
+	case "logical", "pg_dump":
+	default:
+		problems = append(problems, fmt.Sprintf("unknown backup method %q", cfg.Backup.Method))
+	}
+	if cfg.Backup.RetentionCount < 0 || cfg.Backup.RetentionDays < 0 {
+		problems = append(problems, "backup retention can't be negative")
+	}
+
+	for _, strategy := range cfg.Tenant.ResolutionStrategies {
+		switch strategy {
+		case "domain", "header", "subdomain", "path":
+		default:
+			problems = append(problems, fmt.Sprintf("unknown tenant resolution strategy %q", strategy))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// DSN returns the lib/pq connection string for the named database
+func (d DatabaseConfig) DSN(dbName string) string {
+	params := [][2]string{
+		{"host", d.Host},
+		{"port", strconv.Itoa(d.Port)},
+		{"user", d.User},
+		{"password", d.Password},
+		{"dbname", dbName},
+		{"sslmode", d.SSLMode},
+		{"sslrootcert", d.SSLRootCert},
+		{"sslcert", d.SSLCert},
+		{"sslkey", d.SSLKey},
+	}
+
+	var parts []string
+	for _, p := range params {
+		if p[1] == "" {
+			continue
+		}
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p[1])
+		parts = append(parts, fmt.Sprintf("%s='%s'", p[0], value))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// isolate runs the test in an empty directory with every configuration
+// variable unset, restoring both afterwards. Unset rather than empty
+// variables let a .env file set them.
+func isolate(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	for _, key := range envKeys(reflect.TypeOf(Config{})) {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	return dir
+}
+
+// envKeys returns the variables of the fields tagged with `env`
+func envKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			keys = append(keys, envKeys(field.Type)...)
+		} else if key := field.Tag.Get("env"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSourceOrder(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+jwt:
+  secret_key: file-secret
+logging:
+  format: text
+  level: warn
+tracing:
+  service_name: from-file
+`,
+		"config.toml": `
+[jwt]
+secret_key = "file-secret"
+
+[logging]
+format = "text"
+level = "warn"
+
+[tracing]
+service_name = "from-file"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			dir := isolate(t)
+			path := filepath.Join(dir, name)
+			writeFile(t, path, content)
+			writeFile(t, filepath.Join(dir, ".env"), "LOG_LEVEL=error\nTRACING_SERVICE_NAME=from-dotenv\n")
+			t.Setenv("TRACING_SERVICE_NAME", "from-env")
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Each source overrides the ones before it
+			tests := []struct {
+				setting string
+				got     interface{}
+				want    interface{}
+			}{
+				{"default", cfg.Metrics.MaxTenantLabels, Default().Metrics.MaxTenantLabels},
+				{"file", cfg.Logging.Format, "text"},
+				{"file", cfg.JWT.SecretKey, "file-secret"},
+				{".env over file", cfg.Logging.Level, "error"},
+				{"environment over .env and file", cfg.Tracing.ServiceName, "from-env"},
+			}
+			for _, tt := range tests {
+				if tt.got != tt.want {
+					t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadEnvironment(t *testing.T) {
+	isolate(t)
+	t.Setenv("JWT_SECRET_KEY", "env-secret")
+	t.Setenv("DB_PORT", "6543")
+	t.Setenv("TENANT_RESOLUTION_STRATEGIES", "header, path,")
+
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.JWT.SecretKey != "env-secret" || cfg.Database.Port != 6543 {
+		t.Errorf("secret = %q, port = %d, want env-secret and 6543", cfg.JWT.SecretKey, cfg.Database.Port)
+	}
+	if got := cfg.Tenant.ResolutionStrategies; !reflect.DeepEqual(got, []string{"header", "path"}) {
+		t.Errorf("resolution strategies = %q, want header and path", got)
+	}
+
+	// Empty variables leave the value of the other sources
+	t.Setenv("DB_PORT", "")
+	if cfg, err := Load(""); err != nil || cfg.Database.Port != Default().Database.Port {
+		t.Errorf("empty DB_PORT: port = %v, err = %v, want the default", cfg, err)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    string
+	}{
+		{"unsupported file extension", "config.json", `{}`, nil, "unsupported config file extension"},
+		{"malformed file", "config.yaml", "jwt: [", nil, "error reading config file"},
+		{"invalid integer", "", "", map[string]string{"JWT_SECRET_KEY": "env-secret", "DB_PORT": "five"}, "invalid value for DB_PORT"},
+		{"invalid boolean", "", "", map[string]string{"JWT_SECRET_KEY": "env-secret", "WEBHOOK_ALLOW_PRIVATE_TARGETS": "maybe"}, "invalid value for WEBHOOK_ALLOW_PRIVATE_TARGETS"},
+		{"invalid configuration", "", "", nil, "JWT secret key is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := isolate(t)
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(dir, tt.file)
+				writeFile(t, path, tt.content)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := Load(path)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg := Default()
+		cfg.JWT.SecretKey = "a-random-secret"
+		return cfg
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("defaults with a secret: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string
+	}{
+		{"missing server address", func(cfg *Config) { cfg.Server.Addr = "" }, "server address is required"},
+		{"negative timeout", func(cfg *Config) { cfg.Server.ReadTimeoutSeconds = -1 }, "server timeouts can't be negative"},
+		{"unknown sslmode", func(cfg *Config) { cfg.Database.SSLMode = "sometimes" }, `unsupported database sslmode "sometimes"`},
+		{"sslcert without sslkey", func(cfg *Config) { cfg.Database.SSLCert = "client.crt" }, "sslcert and sslkey must be set together"},
+		{"missing TLS file", func(cfg *Config) { cfg.Database.SSLRootCert = "/nonexistent/root.crt" }, "database TLS file"},
+		{"sample JWT secret", func(cfg *Config) { cfg.JWT.SecretKey = "changeme" }, "JWT secret key is a sample value"},
+		{"blank JWT secret", func(cfg *Config) { cfg.JWT.SecretKey = "  " }, "JWT secret key is required"},
+		{"short JWT expiration", func(cfg *Config) { cfg.JWT.ExpirationHours = 0 }, "JWT expiration must be at least 1 hour"},
+		{"unknown hash algorithm", func(cfg *Config) { cfg.Password.HashAlgorithm = "md5" }, `unsupported password hash algorithm "md5"`},
+		{"argon2id memory out of range", func(cfg *Config) { cfg.Password.Argon2MemoryKiB = MaxArgon2MemoryKiB + 1 }, "argon2id parameters must be positive"},
+		{"argon2id parallelism out of range", func(cfg *Config) { cfg.Password.Argon2Parallelism = 0 }, "argon2id parameters must be positive"},
+		{"bcrypt cost out of range", func(cfg *Config) {
+			cfg.Password.HashAlgorithm = "bcrypt"
+			cfg.Password.BcryptCost = 3
+		}, "bcrypt cost must be between 4 and 31"},
+		{"unknown tracing exporter", func(cfg *Config) { cfg.Tracing.Exporter = "zipkin" }, `unknown tracing exporter "zipkin"`},
+		{"unknown log level", func(cfg *Config) { cfg.Logging.Level = "verbose" }, `unknown log level "verbose"`},
+		{"unknown rate limit backend", func(cfg *Config) { cfg.RateLimit.Backend = "redis" }, `unknown rate limit backend "redis"`},
+		{"stripe without keys", func(cfg *Config) { cfg.Billing.Provider = "stripe" }, "requires a secret key and a webhook secret"},
+		{"s3 without bucket", func(cfg *Config) { cfg.Storage.Backend = "s3" }, "the s3 storage backend requires"},
+		{"unknown backup method", func(cfg *Config) { cfg.Backup.Method = "rsync" }, `unknown backup method "rsync"`},
+		{"unknown resolution strategy", func(cfg *Config) { cfg.Tenant.ResolutionStrategies = []string{"cookie"} }, `unknown tenant resolution strategy "cookie"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+
+	// Every problem is reported at once
+	cfg := valid()
+	cfg.Server.Addr = ""
+	cfg.Logging.Format = "xml"
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "server address is required; unknown log format") {
+		t.Errorf("err = %v, want both problems", err)
+	}
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// auditColumns are the columns read by scanAuditEvent, the platform log also
+// has a tenant_id column
+const auditColumns = "id, occurred_at, actor_user_id, actor_email, action, target_type, target_id, ip, request_id, status, before, after, prev_hash, hash"
+
+// auditLockID is the advisory lock key held while appending to an audit log.
+// Advisory locks are scoped to their database, so each log has its own.
+const auditLockID = 7283562
+
+// Audit is the Postgres implementation of repository.AuditRepository. Tenant
+// logs are kept in the tenant databases, the platform log in the management
+// database.
+type Audit struct {
+	tenants repository.TenantStore
+}
+
+// NewAudit creates an audit repository
+func NewAudit(tenants repository.TenantStore) *Audit {
+	return &Audit{tenants: tenants}
+}
+
+func (a *Audit) db(ctx context.Context, tenantID int) (*sql.DB, error) {
+	if tenantID == 0 {
+		return a.tenants.MainDB(), nil
+	}
+	return a.tenants.TenantDB(ctx, tenantID)
+}
+
+func scanAuditEvent(row rowScanner, platform bool) (*models.AuditEvent, error) {
+	var e models.AuditEvent
+	var tenantID, actorUserID sql.NullInt64
+	var before, after []byte
+	dest := []interface{}{&e.ID, &e.OccurredAt, &actorUserID, &e.ActorEmail, &e.Action, &e.TargetType, &e.TargetID,
+		&e.IP, &e.RequestID, &e.Status, &before, &after, &e.PrevHash, &e.Hash}
+	if platform {
+		dest = append(dest, &tenantID)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	e.OccurredAt = e.OccurredAt.UTC()
+	if tenantID.Valid {
+		id := int(tenantID.Int64)
+		e.TenantID = &id
+	}
+	if actorUserID.Valid {
+		id := int(actorUserID.Int64)
+		e.ActorUserID = &id
+	}
+	if before != nil {
+		e.Before = json.RawMessage(before)
+	}
+	if after != nil {
+		e.After = json.RawMessage(after)
+	}
+	return &e, nil
+}
+
+// nullJSON stores empty JSON as NULL
+func nullJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+// AppendAuditEvent seals the event onto the end of the tenant's log, or of the
+// platform log when tenantID is 0
+func (a *Audit) AppendAuditEvent(ctx context.Context, tenantID int, event *models.AuditEvent) error {
+	db, err := a.db(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialize appends, each event must link to the one written before it.
+	// An advisory lock leaves the table free for readers and for backups.
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", auditLockID); err != nil {
+		return err
+	}
+
+	prevHash := audit.GenesisHash
+	err = tx.QueryRowContext(ctx, "SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1").Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if tenantID != 0 {
+		event.TenantID = &tenantID
+	}
+	audit.Seal(prevHash, event)
+
+	var actorUserID interface{}
+	if event.ActorUserID != nil {
+		actorUserID = *event.ActorUserID
+	}
+	columns := "occurred_at, actor_user_id, actor_email, action, target_type, target_id, ip, request_id, status, before, after, prev_hash, hash"
+	args := []interface{}{event.OccurredAt, actorUserID, event.ActorEmail, event.Action, event.TargetType, event.TargetID,
+		event.IP, event.RequestID, event.Status, nullJSON(event.Before), nullJSON(event.After), event.PrevHash, event.Hash}
+	if tenantID == 0 {
+		var eventTenantID interface{}
+		if event.TenantID != nil {
+			eventTenantID = *event.TenantID
+		}
+		columns += ", tenant_id"
+		args = append(args, eventTenantID)
+	}
+
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	err = tx.QueryRowContext(ctx,
+		fmt.Sprintf("INSERT INTO audit_events (%s) VALUES (%s) RETURNING id", columns, strings.Join(placeholders, ", ")),
+		args...,
+	).Scan(&event.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListAuditEvents returns the events of the tenant's log, or of the platform
+// log when tenantID is 0, matching the filter
+func (a *Audit) ListAuditEvents(ctx context.Context, tenantID int, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	db, err := a.db(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	platform := tenantID == 0
+	columns := auditColumns
+	if platform {
+		columns += ", tenant_id"
+	}
+
+	var conditions []string
+	args := []interface{}{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.ActorUserID != 0 {
+		where("actor_user_id = $%d", filter.ActorUserID)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		where("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		where("target_id = $%d", filter.TargetID)
+	}
+	if !filter.From.IsZero() {
+		where("occurred_at >= $%d", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		where("occurred_at < $%d", filter.To.UTC())
+	}
+
+	query := "SELECT " + columns + " FROM audit_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if filter.Ascending {
+		query += " ORDER BY id"
+	} else {
+		query += " ORDER BY id DESC"
+	}
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit, filter.Offset)
+		query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+	}
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows, platform)
+		if err != nil {
+			return nil, err
+		}
+		if !platform {
+			event.TenantID = &tenantID
+		}
+		events = append(events, *event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// billingColumns are the columns read by scanTenantBilling
+const billingColumns = `id, COALESCE(billing_customer_id, ''), COALESCE(billing_subscription_id, ''),
+	COALESCE(billing_subscription_item_id, ''), subscription_status, suspended_at, billing_subscriptions`
+
+// Billing is the Postgres implementation of repository.BillingRepository
+type Billing struct {
+	db *sql.DB
+}
+
+// NewBilling creates a billing repository on the tenant management database
+func NewBilling(db *sql.DB) *Billing {
+	return &Billing{db: db}
+}
+
+func scanTenantBilling(row *sql.Row) (*models.TenantBilling, error) {
+	var b models.TenantBilling
+	var suspendedAt sql.NullTime
+	err := row.Scan(&b.TenantID, &b.CustomerID, &b.SubscriptionID, &b.SubscriptionItemID, &b.Status, &suspendedAt, &b.Subscriptions)
+	if err != nil {
+		return nil, err
+	}
+	if suspendedAt.Valid {
+		b.SuspendedAt = &suspendedAt.Time
+	}
+	return &b, nil
+}
+
+// TenantBilling returns the billing state of a tenant
+func (r *Billing) TenantBilling(ctx context.Context, tenantID int) (*models.TenantBilling, error) {
+	return scanTenantBilling(r.db.QueryRowContext(ctx, "SELECT "+billingColumns+" FROM tenants WHERE id = $1", tenantID))
+}
+
+// TenantBillingByCustomer finds the tenant with a customer ID at the provider
+func (r *Billing) TenantBillingByCustomer(ctx context.Context, customerID string) (*models.TenantBilling, error) {
+	return scanTenantBilling(r.db.QueryRowContext(ctx, "SELECT "+billingColumns+" FROM tenants WHERE billing_customer_id = $1", customerID))
+}
+
+// SaveTenantBilling stores a tenant's customer, subscription and status
+func (r *Billing) SaveTenantBilling(ctx context.Context, b *models.TenantBilling) error {
+	return saveTenantBilling(ctx, r.db.ExecContext, b)
+}
+
+// saveTenantBilling stores a tenant's billing through exec, the ExecContext of
+// a database or transaction
+func saveTenantBilling(ctx context.Context, exec func(context.Context, string, ...interface{}) (sql.Result, error), b *models.TenantBilling) error {
+	result, err := exec(ctx, `
+		UPDATE tenants SET
+			billing_customer_id = NULLIF($2, ''),
+			billing_subscription_id = NULLIF($3, ''),
+			billing_subscription_item_id = NULLIF($4, ''),
+			subscription_status = $5,
+			suspended_at = $6,
+			billing_subscriptions = $7
+		WHERE id = $1`,
+		b.TenantID, b.CustomerID, b.SubscriptionID, b.SubscriptionItemID, b.Status, b.SuspendedAt, b.Subscriptions,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ApplyBillingEvent records a payment event and passes the billing of the
+// customer's tenant to apply, saving it if apply returns true, all in one
+// transaction. Events recorded before, and their redeliveries racing with
+// them, are skipped without calling apply.
+func (r *Billing) ApplyBillingEvent(ctx context.Context, eventID, eventType, customerID string, apply func(b *models.TenantBilling) bool) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"INSERT INTO billing_events (id, type) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING", eventID, eventType,
+	)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		return err
+	}
+
+	b, err := scanTenantBilling(tx.QueryRowContext(ctx,
+		"SELECT "+billingColumns+" FROM tenants WHERE billing_customer_id = $1 FOR UPDATE", customerID))
+	if err == sql.ErrNoRows {
+		return tx.Commit()
+	} else if err != nil {
+		return err
+	}
+
+	if apply(b) {
+		if err := saveTenantBilling(ctx, tx.ExecContext, b); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UnbilledUsage lists the days since since on which subscribed tenants made
+// requests that weren't reported yet
+func (r *Billing) UnbilledUsage(ctx context.Context, since time.Time) ([]models.UnbilledUsage, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT u.tenant_id, t.billing_subscription_item_id, u.day, u.requests, u.billed_requests
+		FROM tenant_usage_daily u
+		JOIN tenants t ON t.id = u.tenant_id
+		WHERE t.billing_subscription_item_id IS NOT NULL AND u.day >= $1 AND u.requests > u.billed_requests
+		ORDER BY u.day, u.tenant_id`,
+		since.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []models.UnbilledUsage
+	for rows.Next() {
+		var u models.UnbilledUsage
+		if err := rows.Scan(&u.TenantID, &u.SubscriptionItemID, &u.Day, &u.Requests, &u.BilledRequests); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// MarkBilled records that a tenant's requests on a day were reported
+func (r *Billing) MarkBilled(ctx context.Context, tenantID int, day time.Time, requests int64) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE tenant_usage_daily SET billed_requests = GREATEST(billed_requests, $3)
+		WHERE tenant_id = $1 AND day = $2`,
+		tenantID, day.Format(time.DateOnly), requests,
+	)
+	return err
+}
@@ -1,175 +1,420 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
 	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/lib/pq"
-)
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
 
-var (
-	MainDB *sql.DB
-	TenantDBs map[string]*sql.DB = make(map[string]*sql.DB)
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/tracing"
 )
 
-// InitDB initializes the main database connection
-func InitDB() {
-	mainConnStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=postgres sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-	)
+// Registry holds the connection to the tenant management database and the
+// connection pools of the tenant databases opened so far. It implements
+// repository.TenantStore.
+type Registry struct {
+	cfg  config.DatabaseConfig
+	main *sql.DB
+
+	mu      sync.Mutex
+	tenants map[string]*sql.DB
+}
 
-	var err error
-	MainDB, err = sql.Open("postgres", mainConnStr)
+// Open connects to the tenant management database, creating and migrating it
+// if needed
+func Open(cfg config.DatabaseConfig) (*Registry, error) {
+	adminDB, err := sql.Open("postgres", cfg.DSN(cfg.AdminDB))
 	if err != nil {
-		log.Fatal("Error connecting to main database:", err)
+		return nil, fmt.Errorf("error connecting to main database: %v", err)
 	}
+	defer func() {
+		if err := adminDB.Close(); err != nil {
+			slog.Error("Error closing admin database connection", "error", err)
+		}
+	}()
 
-	err = MainDB.Ping()
-	if err != nil {
-		log.Fatal("Error pinging main database:", err)
+	if err := adminDB.Ping(); err != nil {
+		return nil, fmt.Errorf("error pinging main database: %v", err)
 	}
 
 	// Create main tenant management database
-	_, err = MainDB.Exec("CREATE DATABASE tenant_management")
+	_, err = adminDB.Exec(fmt.Sprintf("CREATE DATABASE %s", pq.QuoteIdentifier(cfg.ManagementDB)))
 	if err != nil && !strings.Contains(err.Error(), "already exists") {
-		log.Fatal("Error creating tenant management database:", err)
+		return nil, fmt.Errorf("error creating tenant management database: %v", err)
 	}
 
 	// Connect to tenant management database
-	managementConnStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=tenant_management sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
+	mainDB, err := openDB(cfg.DSN(cfg.ManagementDB), tracing.DBNameKey.String(cfg.ManagementDB))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to tenant management database: %v", err)
+	}
+
+	// Create or upgrade tables in tenant management database
+	if err := migrate(mainDB, managementMigrations); err != nil {
+		mainDB.Close()
+		return nil, fmt.Errorf("error migrating tenant management database: %v", err)
+	}
+
+	return &Registry{
+		cfg:     cfg,
+		main:    mainDB,
+		tenants: make(map[string]*sql.DB),
+	}, nil
+}
+
+// openDB opens a connection pool whose queries are traced with the attributes
+func openDB(dsn string, attrs ...attribute.KeyValue) (*sql.DB, error) {
+	return otelsql.Open("postgres", dsn,
+		otelsql.WithAttributes(attrs...),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+		}),
 	)
+}
+
+// MainDB returns the tenant management database
+func (r *Registry) MainDB() *sql.DB {
+	return r.main
+}
+
+// Close closes the management database and every tenant pool
+func (r *Registry) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for dbName, db := range r.tenants {
+		if err := db.Close(); err != nil {
+			slog.Error("Error closing tenant database connection", "db_name", dbName, "error", err)
+		}
+		delete(r.tenants, dbName)
+	}
+	return r.main.Close()
+}
+
+// TenantByID looks up a tenant by its ID
+func (r *Registry) TenantByID(ctx context.Context, tenantID int) (*models.Tenant, error) {
+	ctx, span := tracing.Start(ctx, "TenantByID", tracing.TenantIDKey.Int(tenantID))
+	defer span.End()
+
+	return scanTenant(r.main.QueryRowContext(ctx,
+		"SELECT "+tenantColumns+" FROM tenants WHERE id = $1", tenantID,
+	))
+}
+
+// TenantBySlug looks up a tenant by its slug
+func (r *Registry) TenantBySlug(ctx context.Context, slug string) (*models.Tenant, error) {
+	ctx, span := tracing.Start(ctx, "TenantBySlug", attribute.String("tenant.slug", slug))
+	defer span.End()
+
+	return scanTenant(r.main.QueryRowContext(ctx,
+		"SELECT "+tenantColumns+" FROM tenants WHERE slug = $1", slug,
+	))
+}
+
+// TenantByDomain looks up the tenant a verified custom domain is mapped to
+func (r *Registry) TenantByDomain(ctx context.Context, domain string) (*models.Tenant, error) {
+	ctx, span := tracing.Start(ctx, "TenantByDomain", attribute.String("tenant.domain", domain))
+	defer span.End()
 
-	MainDB, err = sql.Open("postgres", managementConnStr)
+	return scanTenant(r.main.QueryRowContext(ctx, `
+		SELECT t.id, t.name, t.slug, t.plan, t.subscription_status, t.suspended_at, t.is_template, t.created_at
+		FROM tenant_domains d
+		JOIN tenants t ON t.id = d.tenant_id
+		WHERE d.domain = $1 AND d.verified_at IS NOT NULL`,
+		domain,
+	))
+}
+
+// tenantColumns are the columns read by scanTenant
+const tenantColumns = "id, name, slug, plan, subscription_status, suspended_at, is_template, created_at"
+
+func scanTenant(row *sql.Row) (*models.Tenant, error) {
+	var tenant models.Tenant
+	var suspendedAt sql.NullTime
+	if err := row.Scan(&tenant.ID, &tenant.Name, &tenant.Slug, &tenant.Plan, &tenant.SubscriptionStatus, &suspendedAt, &tenant.IsTemplate, &tenant.CreatedAt); err != nil {
+		return nil, err
+	}
+	if suspendedAt.Valid {
+		tenant.SuspendedAt = &suspendedAt.Time
+	}
+	return &tenant, nil
+}
+
+// CreateTenant creates the tenant's database and registers the tenant. It
+// returns repository.ErrConflict if the name or slug is taken.
+func (r *Registry) CreateTenant(ctx context.Context, name, slug string) (*models.Tenant, error) {
+	ctx, span := tracing.Start(ctx, "CreateTenant", attribute.String("tenant.slug", slug))
+	defer span.End()
+
+	// Check if tenant with same name or slug exists
+	var exists bool
+	err := r.main.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM tenants WHERE name = $1 OR slug = $2)", name, slug).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, repository.ErrConflict
+	}
+
+	// Create tenant database
+	dbName, err := r.createTenantDB(ctx, name)
 	if err != nil {
-		log.Fatal("Error connecting to tenant management database:", err)
+		return nil, err
 	}
 
-	// Create necessary tables in tenant management database
-	createMainTables()
+	// Create tenant record in management database
+	return scanTenant(r.main.QueryRowContext(ctx, `
+		INSERT INTO tenants (name, slug, db_name)
+		VALUES ($1, $2, $3)
+		RETURNING `+tenantColumns,
+		name, slug, dbName,
+	))
 }
 
-// createMainTables creates tables in the main tenant management database
-func createMainTables() {
-	// Create tenants table
-	_, err := MainDB.Exec(`
-		CREATE TABLE IF NOT EXISTS tenants (
-			id SERIAL PRIMARY KEY,
-			name VARCHAR(255) NOT NULL UNIQUE,
-			db_name VARCHAR(255) NOT NULL UNIQUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// TenantIDs lists the IDs of every tenant
+func (r *Registry) TenantIDs(ctx context.Context) ([]int, error) {
+	rows, err := r.main.QueryContext(ctx, "SELECT id FROM tenants ORDER BY id")
 	if err != nil {
-		log.Fatal("Error creating tenants table:", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
 }
 
-// GetTenantDB gets or creates a connection to a tenant's database
-func GetTenantDB(tenantID int) (*sql.DB, error) {
+// TenantDB gets or creates a connection to a tenant's database
+func (r *Registry) TenantDB(ctx context.Context, tenantID int) (*sql.DB, error) {
+	ctx, span := tracing.Start(ctx, "TenantDB", tracing.TenantIDKey.Int(tenantID))
+	defer span.End()
+
 	// Get tenant info from main database
 	var dbName string
-	err := MainDB.QueryRow("SELECT db_name FROM tenants WHERE id = $1", tenantID).Scan(&dbName)
+	err := r.main.QueryRowContext(ctx, "SELECT db_name FROM tenants WHERE id = $1", tenantID).Scan(&dbName)
 	if err != nil {
-		return nil, fmt.Errorf("tenant not found: %v", err)
+		return nil, fmt.Errorf("tenant not found: %w", err)
 	}
+	span.SetAttributes(tracing.DBNameKey.String(dbName))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	// Check if we already have a connection
-	if db, exists := TenantDBs[dbName]; exists {
+	if db, exists := r.tenants[dbName]; exists {
 		return db, nil
 	}
 
-	// Create new connection
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		dbName,
-	)
-
-	db, err := sql.Open("postgres", connStr)
+	// Create new connection, tagging its queries with the tenant
+	db, err := openDB(r.cfg.DSN(dbName), tracing.TenantIDKey.Int(tenantID), tracing.DBNameKey.String(dbName))
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to tenant database: %v", err)
 	}
 
-	TenantDBs[dbName] = db
+	// Bring databases created by older versions up to date
+	if err := migrate(db, tenantMigrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating tenant database: %v", err)
+	}
+
+	r.tenants[dbName] = db
 	return db, nil
 }
 
-// CreateTenantDB creates a new database for a tenant
-func CreateTenantDB(tenantName string) (string, error) {
-	// Generate database name
-	dbName := fmt.Sprintf("tenant_%s", strings.ToLower(strings.ReplaceAll(tenantName, " ", "_")))
+// tenantDSN returns the connection string of a tenant's database, for
+// connections outside its pool. The database is migrated first.
+func (r *Registry) tenantDSN(ctx context.Context, tenantID int) (string, error) {
+	if _, err := r.TenantDB(ctx, tenantID); err != nil {
+		return "", err
+	}
+
+	dbName, err := r.tenantDBName(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+	return r.cfg.DSN(dbName), nil
+}
+
+// tenantDBName returns the name of a tenant's database
+func (r *Registry) tenantDBName(ctx context.Context, tenantID int) (string, error) {
+	var dbName string
+	err := r.main.QueryRowContext(ctx, "SELECT db_name FROM tenants WHERE id = $1", tenantID).Scan(&dbName)
+	if err != nil {
+		return "", fmt.Errorf("tenant not found: %w", err)
+	}
+	return dbName, nil
+}
+
+// replaceTenantDB creates a database filled by load, migrates it and swaps
+// it in for the tenant's database, whose pool is closed and which is then
+// dropped. The tenant's users are unlinked from their identities, as the new
+// database may hold other users under their IDs.
+func (r *Registry) replaceTenantDB(ctx context.Context, tenantID int, load func(db *sql.DB, dbName string) error) error {
+	oldName, err := r.tenantDBName(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	newName := fmt.Sprintf("tenant_%d_%d", tenantID, time.Now().UnixNano())
+	if _, err := r.main.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(newName)); err != nil {
+		return fmt.Errorf("error creating tenant database: %v", err)
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			r.dropDB(context.WithoutCancel(ctx), newName)
+		}
+	}()
+
+	db, err := sql.Open("postgres", r.cfg.DSN(newName))
+	if err != nil {
+		return fmt.Errorf("error connecting to new tenant database: %v", err)
+	}
+	defer db.Close()
+	if err := load(db, newName); err != nil {
+		return err
+	}
+	if err := migrate(db, tenantMigrations); err != nil {
+		return fmt.Errorf("error migrating tenant database: %v", err)
+	}
+	db.Close()
+
+	tx, err := r.main.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE tenants SET db_name = $1 WHERE id = $2 AND db_name = $3", newName, tenantID, oldName)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("the database of tenant %d was replaced concurrently", tenantID)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM memberships WHERE tenant_id = $1", tenantID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM email_verifications WHERE tenant_id = $1", tenantID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	swapped = true
+
+	// Requests already running on the old pool finish first
+	r.mu.Lock()
+	if pool, ok := r.tenants[oldName]; ok {
+		if err := pool.Close(); err != nil {
+			slog.Error("Error closing tenant database connection", "db_name", oldName, "error", err)
+		}
+		delete(r.tenants, oldName)
+	}
+	r.mu.Unlock()
+
+	r.dropDB(context.WithoutCancel(ctx), oldName)
+	return nil
+}
+
+// dropDB drops a database, disconnecting its clients, such as the pools of
+// other replicas. Failures are only logged, leaving the database behind.
+func (r *Registry) dropDB(ctx context.Context, dbName string) {
+	if _, err := r.main.ExecContext(ctx, fmt.Sprintf("DROP DATABASE IF EXISTS %s WITH (FORCE)", pq.QuoteIdentifier(dbName))); err != nil {
+		slog.Error("Error dropping tenant database", "db_name", dbName, "error", err)
+	}
+}
+
+// createTenantDB creates a new database for a tenant
+func (r *Registry) createTenantDB(ctx context.Context, tenantName string) (string, error) {
+	dbName := newTenantDBName(tenantName)
 
 	// Create new database
-	_, err := MainDB.Exec(fmt.Sprintf("CREATE DATABASE %s", dbName))
+	_, err := r.main.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(dbName))
 	if err != nil {
 		return "", fmt.Errorf("error creating tenant database: %v", err)
 	}
 
-	// Connect to new database
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		dbName,
-	)
-
-	db, err := sql.Open("postgres", connStr)
+	// Connect to new database. The pool is closed again, TenantDB opens one
+	// tagged with the tenant ID, which isn't known yet.
+	db, err := sql.Open("postgres", r.cfg.DSN(dbName))
 	if err != nil {
 		return "", fmt.Errorf("error connecting to new tenant database: %v", err)
 	}
+	defer db.Close()
 
 	// Create tenant-specific tables
-	err = createTenantTables(db)
+	err = migrate(db, tenantMigrations)
 	if err != nil {
 		return "", fmt.Errorf("error creating tenant tables: %v", err)
 	}
 
-	TenantDBs[dbName] = db
 	return dbName, nil
 }
 
-// createTenantTables creates necessary tables in a tenant's database
-func createTenantTables(db *sql.DB) error {
-	// Create users table
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			email VARCHAR(255) NOT NULL UNIQUE,
-			password VARCHAR(255) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// newTenantDBName generates the database name of a new tenant
+func newTenantDBName(tenantName string) string {
+	return fmt.Sprintf("tenant_%s", strings.ToLower(strings.ReplaceAll(tenantName, " ", "_")))
+}
+
+// TenantSettings reads the registration settings of a tenant
+func (r *Registry) TenantSettings(ctx context.Context, tenantID int) (*models.TenantSettings, error) {
+	var settings models.TenantSettings
+	err := r.main.QueryRowContext(ctx,
+		"SELECT registration_mode, allowed_email_domains FROM tenants WHERE id = $1", tenantID,
+	).Scan(&settings.RegistrationMode, pq.Array(&settings.AllowedEmailDomains))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if settings.AllowedEmailDomains == nil {
+		settings.AllowedEmailDomains = []string{}
 	}
+	return &settings, nil
+}
 
-	// Create posts table
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS posts (
-			id SERIAL PRIMARY KEY,
-			user_id INT NOT NULL REFERENCES users(id),
-			title VARCHAR(255) NOT NULL,
-			content TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// UpdateTenantSettings stores the registration settings of a tenant
+func (r *Registry) UpdateTenantSettings(ctx context.Context, tenantID int, settings *models.TenantSettings) error {
+	_, err := r.main.ExecContext(ctx,
+		"UPDATE tenants SET registration_mode = $1, allowed_email_domains = $2 WHERE id = $3",
+		settings.RegistrationMode, pq.Array(settings.AllowedEmailDomains), tenantID,
+	)
 	return err
-} 
\ No newline at end of file
+}
+
+// Repositories returns the Postgres implementations of the repositories
+func (r *Registry) Repositories() repository.Repositories {
+	return repository.Repositories{
+		Tenants:     r,
+		Users:       NewUsers(r),
+		Invitations: NewInvitations(r),
+		Domains:     NewDomains(r.main),
+		Posts:       NewPosts(r),
+		Identities:  NewIdentities(r.main),
+		Audit:       NewAudit(r),
+		Plans:       NewPlans(r.main),
+		Usage:       NewUsage(r),
+		Billing:     NewBilling(r.main),
+		Webhooks:    NewWebhooks(r),
+		Outbox:      NewOutbox(r),
+		Jobs:        NewJobs(r.main),
+		TenantData:  NewTenantData(r),
+		Snapshots:   NewSnapshots(r),
+	}
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// domainColumns are the columns read by scanDomain
+const domainColumns = "id, tenant_id, domain, verification_method, verification_token, verified_at, created_at"
+
+// Domains is the Postgres implementation of repository.DomainRepository,
+// keeping the custom domains in the tenant management database as they route
+// requests to the tenants
+type Domains struct {
+	db *sql.DB
+}
+
+// NewDomains creates a domain repository on the tenant management database
+func NewDomains(db *sql.DB) *Domains {
+	return &Domains{db: db}
+}
+
+func scanDomain(row rowScanner) (*models.TenantDomain, error) {
+	var d models.TenantDomain
+	err := row.Scan(&d.ID, &d.TenantID, &d.Domain, &d.VerificationMethod, &d.VerificationToken, &d.VerifiedAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Verified = d.VerifiedAt != nil
+	return &d, nil
+}
+
+// CreateDomain stores a domain and fills in its generated fields
+func (r *Domains) CreateDomain(ctx context.Context, domain *models.TenantDomain) error {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO tenant_domains (tenant_id, domain, verification_method, verification_token)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`,
+		domain.TenantID, domain.Domain, domain.VerificationMethod, domain.VerificationToken,
+	).Scan(&domain.ID, &domain.CreatedAt)
+	if isUniqueViolation(err) {
+		return repository.ErrConflict
+	}
+	return err
+}
+
+// ListDomains returns the tenant's domains ordered by name
+func (r *Domains) ListDomains(ctx context.Context, tenantID int) ([]models.TenantDomain, error) {
+	rows, err := r.db.QueryContext(ctx,
+		"SELECT "+domainColumns+" FROM tenant_domains WHERE tenant_id = $1 ORDER BY domain", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	domains := []models.TenantDomain{}
+	for rows.Next() {
+		d, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, *d)
+	}
+	return domains, rows.Err()
+}
+
+// DomainByID returns a domain of the tenant
+func (r *Domains) DomainByID(ctx context.Context, tenantID, domainID int) (*models.TenantDomain, error) {
+	return scanDomain(r.db.QueryRowContext(ctx,
+		"SELECT "+domainColumns+" FROM tenant_domains WHERE id = $1 AND tenant_id = $2", domainID, tenantID))
+}
+
+// MarkDomainVerified records that the domain's challenge was satisfied; the
+// unique index on verified domains rejects a domain another tenant verified
+func (r *Domains) MarkDomainVerified(ctx context.Context, domain *models.TenantDomain) error {
+	err := r.db.QueryRowContext(ctx,
+		"UPDATE tenant_domains SET verified_at = CURRENT_TIMESTAMP WHERE id = $1 AND tenant_id = $2 RETURNING verified_at",
+		domain.ID, domain.TenantID,
+	).Scan(&domain.VerifiedAt)
+	if isUniqueViolation(err) {
+		return repository.ErrConflict
+	} else if err != nil {
+		return err
+	}
+	domain.Verified = true
+	return nil
+}
+
+// DeleteDomain removes a domain of the tenant
+func (r *Domains) DeleteDomain(ctx context.Context, tenantID, domainID int) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM tenant_domains WHERE id = $1 AND tenant_id = $2", domainID, tenantID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
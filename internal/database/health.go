@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// Ready checks that the management database is reachable and migrated
+func (r *Registry) Ready(ctx context.Context) error {
+	if err := r.main.PingContext(ctx); err != nil {
+		return fmt.Errorf("error pinging tenant management database: %v", err)
+	}
+
+	version, err := SchemaVersion(ctx, r.main)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	if version != ManagementSchemaVersion() {
+		return fmt.Errorf("tenant management database is at schema version %d, want %d", version, ManagementSchemaVersion())
+	}
+	return nil
+}
+
+// TenantHealth pings a tenant's database and collects its schema version, pool
+// statistics, size and row counts
+func (r *Registry) TenantHealth(ctx context.Context, tenantID int) (*models.TenantHealth, error) {
+	db, err := r.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("error pinging tenant database: %v", err)
+	}
+
+	health := &models.TenantHealth{
+		TenantID:            tenantID,
+		PingMillis:          time.Since(start).Milliseconds(),
+		LatestSchemaVersion: TenantSchemaVersion(),
+		RowCounts:           make(map[string]int64),
+		Pool:                poolStats(db.Stats()),
+	}
+
+	if health.SchemaVersion, err = SchemaVersion(ctx, db); err != nil {
+		return nil, fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	err = db.QueryRowContext(ctx, "SELECT pg_database_size(current_database())").Scan(&health.DatabaseSizeBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading database size: %v", err)
+	}
+
+	// Estimates from the statistics collector, counting every table could be
+	// slow on the large tenants this is meant to debug
+	rows, err := db.QueryContext(ctx, "SELECT relname, n_live_tup FROM pg_stat_user_tables WHERE schemaname = 'public'")
+	if err != nil {
+		return nil, fmt.Errorf("error reading row counts: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table string
+		var count int64
+		if err := rows.Scan(&table, &count); err != nil {
+			return nil, err
+		}
+		health.RowCounts[table] = count
+	}
+	return health, rows.Err()
+}
+
+// PoolStats reports the statistics of the management pool and the tenant
+// pools opened so far, by database name
+func (r *Registry) PoolStats() map[string]models.PoolStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := map[string]models.PoolStats{
+		r.cfg.ManagementDB: poolStats(r.main.Stats()),
+	}
+	for dbName, db := range r.tenants {
+		stats[dbName] = poolStats(db.Stats())
+	}
+	return stats
+}
+
+func poolStats(stats sql.DBStats) models.PoolStats {
+	return models.PoolStats{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMillis: stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
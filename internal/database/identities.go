@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// Identities is the Postgres implementation of repository.IdentityRepository
+type Identities struct {
+	db *sql.DB
+}
+
+// NewIdentities creates an identity repository on the tenant management database
+func NewIdentities(db *sql.DB) *Identities {
+	return &Identities{db: db}
+}
+
+func scanIdentity(row *sql.Row) (*models.Identity, error) {
+	var i models.Identity
+	if err := row.Scan(&i.ID, &i.Email, &i.Password); err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// IdentityByEmail returns the identity with the given email
+func (r *Identities) IdentityByEmail(ctx context.Context, email string) (*models.Identity, error) {
+	return scanIdentity(r.db.QueryRowContext(ctx,
+		"SELECT id, email, password FROM identities WHERE email = $1", email,
+	))
+}
+
+// IdentityByUser returns the identity a tenant user is linked to
+func (r *Identities) IdentityByUser(ctx context.Context, tenantID, userID int) (*models.Identity, error) {
+	return scanIdentity(r.db.QueryRowContext(ctx, `
+		SELECT i.id, i.email, i.password
+		FROM identities i
+		JOIN memberships m ON m.identity_id = i.id
+		WHERE m.tenant_id = $1 AND m.user_id = $2`,
+		tenantID, userID,
+	))
+}
+
+// MemberUserID returns the ID of the identity's user in a tenant
+func (r *Identities) MemberUserID(ctx context.Context, identityID, tenantID int) (int, error) {
+	var userID int
+	err := r.db.QueryRowContext(ctx,
+		"SELECT user_id FROM memberships WHERE identity_id = $1 AND tenant_id = $2", identityID, tenantID,
+	).Scan(&userID)
+	return userID, err
+}
+
+// Memberships lists the tenants of the identity a tenant user is linked to
+func (r *Identities) Memberships(ctx context.Context, tenantID, userID int) ([]models.TenantMembership, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT t.id, t.name, t.slug, m.user_id
+		FROM memberships m
+		JOIN tenants t ON t.id = m.tenant_id
+		WHERE m.identity_id = (SELECT identity_id FROM memberships WHERE tenant_id = $1 AND user_id = $2)
+		ORDER BY t.name`,
+		tenantID, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	memberships := []models.TenantMembership{}
+	for rows.Next() {
+		var m models.TenantMembership
+		if err := rows.Scan(&m.TenantID, &m.Name, &m.Slug, &m.UserID); err != nil {
+			return nil, err
+		}
+		m.Current = m.TenantID == tenantID
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+// CreateIdentity creates an identity with the email and passwordHash and
+// links a tenant user to it, returning ErrConflict if the email already has
+// an identity. Callers must have verified the email.
+func (r *Identities) CreateIdentity(ctx context.Context, tenantID, userID int, email, passwordHash string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var identityID int
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO identities (email, password) VALUES ($1, $2) RETURNING id",
+		email, passwordHash,
+	).Scan(&identityID)
+	if isUniqueViolation(err) {
+		return repository.ErrConflict
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO memberships (identity_id, tenant_id, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		identityID, tenantID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LinkIdentity links a tenant user to an existing identity. Callers must have
+// verified the identity's password.
+func (r *Identities) LinkIdentity(ctx context.Context, identityID, tenantID, userID int) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO memberships (identity_id, tenant_id, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		identityID, tenantID, userID,
+	)
+	return err
+}
+
+// UnlinkIdentity removes a tenant user's membership
+func (r *Identities) UnlinkIdentity(ctx context.Context, tenantID, userID int) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM memberships WHERE tenant_id = $1 AND user_id = $2", tenantID, userID)
+	return err
+}
+
+// UpdateIdentityEmail changes an identity's email
+func (r *Identities) UpdateIdentityEmail(ctx context.Context, identityID int, email string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE identities SET email = $1, updated_at = $2 WHERE id = $3", email, time.Now(), identityID)
+	if isUniqueViolation(err) {
+		return repository.ErrConflict
+	}
+	return err
+}
+
+// UpdateIdentityPassword replaces an identity's password hash
+func (r *Identities) UpdateIdentityPassword(ctx context.Context, identityID int, passwordHash string) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE identities SET password = $1, updated_at = $2 WHERE id = $3", passwordHash, time.Now(), identityID)
+	return err
+}
+
+// CreateEmailVerification stores a verification by the digest of its token,
+// replacing the pending one of the same user
+func (r *Identities) CreateEmailVerification(ctx context.Context, v *models.EmailVerification, tokenHash string) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO email_verifications (token_hash, tenant_id, user_id, email, expires_at, activate, email_change)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (tenant_id, user_id) DO UPDATE
+		SET token_hash = EXCLUDED.token_hash, email = EXCLUDED.email, expires_at = EXCLUDED.expires_at,
+			activate = email_verifications.activate OR EXCLUDED.activate, email_change = EXCLUDED.email_change,
+			created_at = CURRENT_TIMESTAMP`,
+		tokenHash, v.TenantID, v.UserID, v.Email, v.ExpiresAt, v.Activate, v.EmailChange,
+	)
+	return err
+}
+
+// ConsumeEmailVerification deletes and returns the tenant's unexpired
+// verification with the token digest, so that each token is used once
+func (r *Identities) ConsumeEmailVerification(ctx context.Context, tenantID int, tokenHash string) (*models.EmailVerification, error) {
+	v := models.EmailVerification{TenantID: tenantID}
+	err := r.db.QueryRowContext(ctx, `
+		DELETE FROM email_verifications
+		WHERE token_hash = $1 AND tenant_id = $2 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id, email, expires_at, activate, email_change`,
+		tokenHash, tenantID,
+	).Scan(&v.UserID, &v.Email, &v.ExpiresAt, &v.Activate, &v.EmailChange)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// DeleteEmailVerification deletes the pending verification of a tenant user
+func (r *Identities) DeleteEmailVerification(ctx context.Context, tenantID, userID int) error {
+	_, err := r.db.ExecContext(ctx, "DELETE FROM email_verifications WHERE tenant_id = $1 AND user_id = $2", tenantID, userID)
+	return err
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// invitationColumns are the columns read by scanInvitation
+const invitationColumns = "id, email, role, invited_by, expires_at, accepted_at, created_at"
+
+// Invitations is the Postgres implementation of
+// repository.InvitationRepository, keeping the invitations in the tenant
+// databases
+type Invitations struct {
+	tenants repository.TenantStore
+}
+
+// NewInvitations creates an invitation repository
+func NewInvitations(tenants repository.TenantStore) *Invitations {
+	return &Invitations{tenants: tenants}
+}
+
+func scanInvitation(row rowScanner) (*models.Invitation, error) {
+	var inv models.Invitation
+	err := row.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.InvitedBy, &inv.ExpiresAt, &inv.AcceptedAt, &inv.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// CreateInvitation stores an invitation with the digest of its token and fills
+// in its generated fields
+func (r *Invitations) CreateInvitation(ctx context.Context, tenantID int, invitation *models.Invitation, tokenHash string) error {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO invitations (email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`,
+		invitation.Email, invitation.Role, tokenHash, invitation.InvitedBy, invitation.ExpiresAt,
+	).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// PendingInvitations lists the invitations neither accepted nor expired, newest first
+func (r *Invitations) PendingInvitations(ctx context.Context, tenantID int) ([]models.Invitation, error) {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+invitationColumns+`
+		FROM invitations
+		WHERE accepted_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		inv, err := scanInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *inv)
+	}
+	return invitations, rows.Err()
+}
+
+// PendingInvitation returns the invitation with the token digest if it is
+// neither accepted nor expired
+func (r *Invitations) PendingInvitation(ctx context.Context, tenantID int, tokenHash string) (*models.Invitation, error) {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanInvitation(db.QueryRowContext(ctx, `
+		SELECT `+invitationColumns+`
+		FROM invitations
+		WHERE token_hash = $1 AND accepted_at IS NULL AND expires_at > CURRENT_TIMESTAMP`,
+		tokenHash,
+	))
+}
+
+// DeleteInvitation deletes an invitation that wasn't accepted
+func (r *Invitations) DeleteInvitation(ctx context.Context, tenantID, invitationID int) error {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM invitations WHERE id = $1 AND accepted_at IS NULL", invitationID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AcceptInvitation marks a pending invitation accepted and creates the invited
+// user, appending the user.registered event to the outbox in the same
+// transaction
+func (r *Invitations) AcceptInvitation(ctx context.Context, tenantID, invitationID int, passwordHash string) (*models.User, error) {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Claim the invitation; the conditions make it single-use and expiring
+	user := models.User{TenantID: tenantID, Active: true}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE invitations SET accepted_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND accepted_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING email, role`,
+		invitationID,
+	).Scan(&user.Email, &user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO users (email, password, role)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, updated_at`,
+		user.Email, passwordHash, user.Role,
+	).Scan(&user.ID, &user.CreatedAt, &user.UpdatedAt)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := events.Record(ctx, tx, models.EventUserRegistered, tenantID, &user); err != nil {
+		return nil, err
+	}
+
+	return &user, tx.Commit()
+}
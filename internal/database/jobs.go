@@ -0,0 +1,141 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// jobColumns are the columns read by scanJob
+const jobColumns = `id, type, COALESCE(tenant_id, 0), status, params, archive, error, attempts,
+	created_at, started_at, completed_at`
+
+// Jobs is the Postgres implementation of repository.JobRepository
+type Jobs struct {
+	db *sql.DB
+}
+
+// NewJobs creates a job repository on the tenant management database
+func NewJobs(db *sql.DB) *Jobs {
+	return &Jobs{db: db}
+}
+
+func scanJob(row rowScanner) (*models.Job, error) {
+	var job models.Job
+	var params []byte
+	var startedAt, completedAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Type, &job.TenantID, &job.Status, &params, &job.Archive, &job.Error, &job.Attempts,
+		&job.CreatedAt, &startedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Params = params
+	if startedAt.Valid {
+		job.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		job.CompletedAt = &completedAt.Time
+	}
+	return &job, nil
+}
+
+// CreateJob stores a pending job and fills in its generated fields
+func (j *Jobs) CreateJob(ctx context.Context, job *models.Job) error {
+	params := []byte(job.Params)
+	if len(params) == 0 {
+		params = []byte("{}")
+	}
+
+	created, err := scanJob(j.db.QueryRowContext(ctx, `
+		INSERT INTO tenant_jobs (type, tenant_id, params, archive)
+		VALUES ($1, NULLIF($2, 0), $3, $4)
+		RETURNING `+jobColumns,
+		job.Type, job.TenantID, params, job.Archive,
+	))
+	if err != nil {
+		return err
+	}
+	*job = *created
+	return nil
+}
+
+// JobByID looks up a job
+func (j *Jobs) JobByID(ctx context.Context, jobID int64) (*models.Job, error) {
+	return scanJob(j.db.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM tenant_jobs WHERE id = $1", jobID))
+}
+
+// ClaimJob marks the oldest due job running and returns it, postponing its
+// next attempt by lease. Jobs claimed by another replica are skipped rather
+// than waited for.
+func (j *Jobs) ClaimJob(ctx context.Context, lease time.Duration) (*models.Job, error) {
+	return scanJob(j.db.QueryRowContext(ctx, `
+		UPDATE tenant_jobs SET
+			status = 'running',
+			attempts = attempts + 1,
+			started_at = CURRENT_TIMESTAMP,
+			next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+		WHERE id = (
+			SELECT id FROM tenant_jobs
+			WHERE status IN ('pending', 'running') AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns,
+		lease.Seconds(),
+	))
+}
+
+// ExtendJob postpones the next attempt of a running job by lease
+func (j *Jobs) ExtendJob(ctx context.Context, jobID int64, lease time.Duration) error {
+	_, err := j.db.ExecContext(ctx, `
+		UPDATE tenant_jobs SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		WHERE id = $1 AND status = 'running'`,
+		jobID, lease.Seconds(),
+	)
+	return err
+}
+
+// SetJobTenant records the tenant a job created
+func (j *Jobs) SetJobTenant(ctx context.Context, jobID int64, tenantID int) error {
+	_, err := j.db.ExecContext(ctx, "UPDATE tenant_jobs SET tenant_id = $2 WHERE id = $1", jobID, tenantID)
+	return err
+}
+
+// FinishJob records that a job completed or failed with the message
+func (j *Jobs) FinishJob(ctx context.Context, jobID int64, status, message string) error {
+	_, err := j.db.ExecContext(ctx, `
+		UPDATE tenant_jobs SET status = $2, error = $3, next_attempt_at = NULL, completed_at = CURRENT_TIMESTAMP
+		WHERE id = $1`,
+		jobID, status, message,
+	)
+	return err
+}
+
+// DeleteFinishedJobs deletes the jobs finished longer than olderThan ago and
+// returns them
+func (j *Jobs) DeleteFinishedJobs(ctx context.Context, olderThan time.Duration) ([]models.Job, error) {
+	rows, err := j.db.QueryContext(ctx, `
+		DELETE FROM tenant_jobs
+		WHERE completed_at < CURRENT_TIMESTAMP - make_interval(secs => $1)
+		RETURNING `+jobColumns,
+		olderThan.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []models.Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
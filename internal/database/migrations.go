@@ -0,0 +1,366 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrationLockID is the advisory lock key held while migrations run, so that
+// concurrent requests opening the same database don't apply migrations twice
+const migrationLockID = 7283561
+
+// managementMigrations are applied in order to the tenant management database.
+// Append new migrations to the end; never edit one that has been released.
+var managementMigrations = []string{
+	// 1: tenants
+	`CREATE TABLE IF NOT EXISTS tenants (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		db_name VARCHAR(255) NOT NULL UNIQUE,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 2: tenant slugs used for subdomain, header and path resolution
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS slug VARCHAR(63) UNIQUE;
+	WITH s AS (
+		SELECT id, trim(both '-' from regexp_replace(lower(name), '[^a-z0-9]+', '-', 'g')) AS slug
+		FROM tenants WHERE slug IS NULL
+	)
+	UPDATE tenants t
+	SET slug = CASE WHEN (SELECT count(*) FROM s s2 WHERE s2.slug = s.slug) > 1 THEN s.slug || '-' || s.id ELSE s.slug END
+	FROM s WHERE t.id = s.id;
+	ALTER TABLE tenants ALTER COLUMN slug SET NOT NULL`,
+	// 3: custom domains
+	`CREATE TABLE IF NOT EXISTS tenant_domains (
+		id SERIAL PRIMARY KEY,
+		tenant_id INT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		domain VARCHAR(253) NOT NULL,
+		verification_method VARCHAR(16) NOT NULL,
+		verification_token VARCHAR(64) NOT NULL,
+		verified_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (tenant_id, domain)
+	);
+	CREATE UNIQUE INDEX IF NOT EXISTS tenant_domains_verified_domain ON tenant_domains (domain) WHERE verified_at IS NOT NULL`,
+	// 4: registration settings
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS registration_mode VARCHAR(32) NOT NULL DEFAULT 'open';
+	ALTER TABLE tenants ADD COLUMN IF NOT EXISTS allowed_email_domains TEXT[] NOT NULL DEFAULT '{}'`,
+	// 5: global identities and their per-tenant memberships
+	`CREATE TABLE IF NOT EXISTS identities (
+		id SERIAL PRIMARY KEY,
+		email VARCHAR(255) NOT NULL UNIQUE,
+		password VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS memberships (
+		identity_id INT NOT NULL REFERENCES identities(id) ON DELETE CASCADE,
+		tenant_id INT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		user_id INT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (identity_id, tenant_id),
+		UNIQUE (tenant_id, user_id)
+	)`,
+	// 6: platform audit log; before/after are JSON, not JSONB, so that the
+	// hashed text is kept as written
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMP NOT NULL,
+		tenant_id INT,
+		actor_user_id INT,
+		actor_email VARCHAR(255) NOT NULL DEFAULT '',
+		action VARCHAR(128) NOT NULL,
+		target_type VARCHAR(64) NOT NULL DEFAULT '',
+		target_id VARCHAR(64) NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		request_id VARCHAR(128) NOT NULL DEFAULT '',
+		status INT NOT NULL,
+		before JSON,
+		after JSON,
+		prev_hash CHAR(64) NOT NULL,
+		hash CHAR(64) NOT NULL UNIQUE
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_occurred_at ON audit_events (occurred_at);
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+	DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+	CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	// 7: tenant plans and the token buckets of the shared rate limiter
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS plan VARCHAR(64) NOT NULL DEFAULT 'free';
+	CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+		key VARCHAR(255) PRIMARY KEY,
+		tokens DOUBLE PRECISION NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS rate_limit_buckets_updated_at ON rate_limit_buckets (updated_at)`,
+	// 8: plan quotas, NULL is unlimited, and daily usage metering
+	`CREATE TABLE IF NOT EXISTS plans (
+		name VARCHAR(64) PRIMARY KEY,
+		max_users INT,
+		max_posts INT,
+		max_storage_bytes BIGINT,
+		max_requests_per_day BIGINT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO plans (name) VALUES ('free') ON CONFLICT DO NOTHING;
+	INSERT INTO plans (name) SELECT DISTINCT plan FROM tenants ON CONFLICT DO NOTHING;
+	ALTER TABLE tenants DROP CONSTRAINT IF EXISTS tenants_plan_fkey;
+	ALTER TABLE tenants ADD CONSTRAINT tenants_plan_fkey FOREIGN KEY (plan) REFERENCES plans(name);
+	CREATE TABLE IF NOT EXISTS tenant_usage_daily (
+		tenant_id INT NOT NULL REFERENCES tenants(id),
+		day DATE NOT NULL,
+		requests BIGINT NOT NULL DEFAULT 0,
+		users INT NOT NULL DEFAULT 0,
+		posts INT NOT NULL DEFAULT 0,
+		storage_bytes BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (tenant_id, day)
+	)`,
+	// 9: billing subscriptions, the requests reported for billing and the
+	// payment events received
+	`ALTER TABLE tenants
+		ADD COLUMN IF NOT EXISTS billing_customer_id VARCHAR(255) UNIQUE,
+		ADD COLUMN IF NOT EXISTS billing_subscription_id VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS billing_subscription_item_id VARCHAR(255),
+		ADD COLUMN IF NOT EXISTS subscription_status VARCHAR(32) NOT NULL DEFAULT 'none',
+		ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMP;
+	ALTER TABLE tenant_usage_daily ADD COLUMN IF NOT EXISTS billed_requests BIGINT NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS billing_events (
+		id VARCHAR(255) PRIMARY KEY,
+		type VARCHAR(255) NOT NULL,
+		received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 10: background jobs on tenants, such as exports and imports; a running
+	// job is claimed again once its lease runs out
+	`CREATE TABLE IF NOT EXISTS tenant_jobs (
+		id BIGSERIAL PRIMARY KEY,
+		type VARCHAR(32) NOT NULL,
+		tenant_id INT REFERENCES tenants(id) ON DELETE CASCADE,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		params JSONB NOT NULL DEFAULT '{}',
+		archive VARCHAR(255) NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		started_at TIMESTAMP,
+		completed_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS tenant_jobs_due ON tenant_jobs (next_attempt_at) WHERE status IN ('pending', 'running');
+	CREATE INDEX IF NOT EXISTS tenant_jobs_completed_at ON tenant_jobs (completed_at) WHERE completed_at IS NOT NULL`,
+	// 11: snapshots of tenant databases, one per snapshot job
+	`CREATE TABLE IF NOT EXISTS tenant_snapshots (
+		id BIGSERIAL PRIMARY KEY,
+		tenant_id INT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		job_id BIGINT NOT NULL UNIQUE,
+		label VARCHAR(255) NOT NULL DEFAULT '',
+		method VARCHAR(16) NOT NULL,
+		schema_version INT NOT NULL,
+		size BIGINT NOT NULL,
+		storage_key VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS tenant_snapshots_tenant ON tenant_snapshots (tenant_id, created_at)`,
+	// 12: template tenants that new tenants are created from
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS is_template BOOLEAN NOT NULL DEFAULT FALSE`,
+	// 13: email verifications that link tenant users to identities, one per
+	// user; only a SHA-256 digest of the token is stored
+	`CREATE TABLE IF NOT EXISTS email_verifications (
+		token_hash VARCHAR(64) PRIMARY KEY,
+		tenant_id INT NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+		user_id INT NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (tenant_id, user_id)
+	)`,
+	// 14: the number of billing subscriptions created for each tenant, which
+	// numbers the idempotency keys of new subscriptions
+	`ALTER TABLE tenants ADD COLUMN IF NOT EXISTS billing_subscriptions INT NOT NULL DEFAULT 0`,
+	// 15: email verifications that activate users who registered in a
+	// domain-restricted tenant
+	`ALTER TABLE email_verifications ADD COLUMN IF NOT EXISTS activate BOOLEAN NOT NULL DEFAULT FALSE`,
+	// 16: email verifications that change the email of linked users
+	`ALTER TABLE email_verifications ADD COLUMN IF NOT EXISTS email_change BOOLEAN NOT NULL DEFAULT FALSE`,
+}
+
+// tenantMigrations are applied in order to every tenant database.
+// Append new migrations to the end; never edit one that has been released.
+var tenantMigrations = []string{
+	// 1: users and posts
+	`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		email VARCHAR(255) NOT NULL UNIQUE,
+		password VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS posts (
+		id SERIAL PRIMARY KEY,
+		user_id INT NOT NULL REFERENCES users(id),
+		title VARCHAR(255) NOT NULL,
+		content TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 2: user roles and deactivation; the oldest user becomes the tenant admin
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(32) NOT NULL DEFAULT 'member';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS active BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+	UPDATE users SET role = 'admin' WHERE id = (SELECT MIN(id) FROM users)`,
+	// 3: invitations; only a SHA-256 digest of the token is stored
+	`CREATE TABLE IF NOT EXISTS invitations (
+		id SERIAL PRIMARY KEY,
+		email VARCHAR(255) NOT NULL,
+		role VARCHAR(32) NOT NULL,
+		token_hash VARCHAR(64) NOT NULL UNIQUE,
+		invited_by INT REFERENCES users(id) ON DELETE SET NULL,
+		expires_at TIMESTAMP NOT NULL,
+		accepted_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 4: audit log; before/after are JSON, not JSONB, so that the hashed text
+	// is kept as written
+	`CREATE TABLE IF NOT EXISTS audit_events (
+		id BIGSERIAL PRIMARY KEY,
+		occurred_at TIMESTAMP NOT NULL,
+		actor_user_id INT,
+		actor_email VARCHAR(255) NOT NULL DEFAULT '',
+		action VARCHAR(128) NOT NULL,
+		target_type VARCHAR(64) NOT NULL DEFAULT '',
+		target_id VARCHAR(64) NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		request_id VARCHAR(128) NOT NULL DEFAULT '',
+		status INT NOT NULL,
+		before JSON,
+		after JSON,
+		prev_hash CHAR(64) NOT NULL,
+		hash CHAR(64) NOT NULL UNIQUE
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_occurred_at ON audit_events (occurred_at);
+	CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'audit_events is append-only';
+	END
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS audit_events_append_only ON audit_events;
+	CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON audit_events
+		FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
+	DROP TRIGGER IF EXISTS audit_events_no_truncate ON audit_events;
+	CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON audit_events
+		FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only()`,
+	// 5: webhooks; their deliveries are the outbox of the events, queued in
+	// the transaction making the change, and the delivery log
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		url VARCHAR(2048) NOT NULL,
+		secret VARCHAR(255) NOT NULL,
+		event_types TEXT[] NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_id VARCHAR(64) NOT NULL,
+		event_type VARCHAR(64) NOT NULL,
+		payload JSONB NOT NULL,
+		status VARCHAR(16) NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_status_code INT,
+		last_error TEXT NOT NULL DEFAULT '',
+		delivered_at TIMESTAMP,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id)`,
+	// 6: outbox of the domain events, appended in the transaction making the
+	// change and published by the relay; deliveries are queued from the events
+	`CREATE TABLE IF NOT EXISTS outbox_events (
+		id BIGSERIAL PRIMARY KEY,
+		event_id VARCHAR(64) NOT NULL UNIQUE,
+		type VARCHAR(64) NOT NULL,
+		data JSONB NOT NULL,
+		occurred_at TIMESTAMP NOT NULL,
+		published_at TIMESTAMP,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS outbox_events_due ON outbox_events (next_attempt_at) WHERE published_at IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_events_published ON outbox_events (published_at) WHERE published_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_event ON webhook_deliveries (event_id)`,
+	// 7: notify the listeners of the outbox of each event on commit, with its
+	// sequence number as payload
+	`CREATE OR REPLACE FUNCTION outbox_events_notify() RETURNS trigger AS $$
+	BEGIN
+		PERFORM pg_notify('` + outboxChannel + `', NEW.id::TEXT);
+		RETURN NULL;
+	END
+	$$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS outbox_events_notify ON outbox_events;
+	CREATE TRIGGER outbox_events_notify AFTER INSERT ON outbox_events
+		FOR EACH ROW EXECUTE FUNCTION outbox_events_notify()`,
+}
+
+// ManagementSchemaVersion is the version the management database is migrated to
+func ManagementSchemaVersion() int {
+	return len(managementMigrations)
+}
+
+// TenantSchemaVersion is the version tenant databases are migrated to
+func TenantSchemaVersion() int {
+	return len(tenantMigrations)
+}
+
+// SchemaVersion returns the latest migration applied to db
+func SchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// migrate applies the pending migrations to db and records them in schema_migrations
+func migrate(db *sql.DB, migrations []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("error acquiring migration lock: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+
+	var current int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", version, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			return fmt.Errorf("error recording migration %d: %v", version, err)
+		}
+	}
+
+	return tx.Commit()
+}
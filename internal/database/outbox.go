@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+
+	"golang-multi-tenant/internal/models"
+)
+
+const (
+	// outboxChannel is the channel notified of the events committed to the
+	// outbox of a tenant database
+	outboxChannel = "outbox_events"
+	// listenerBuffer is how many notifications a listener may fall behind by
+	// before it is dropped
+	listenerBuffer = 256
+	// listenerPingInterval is how often listening connections are checked, so
+	// that lost ones are noticed
+	listenerPingInterval = 30 * time.Second
+)
+
+// outboxEventColumns are the columns read by scanOutboxEvents
+const outboxEventColumns = "id, event_id, type, data, occurred_at, attempts"
+
+// Outbox is the Postgres implementation of repository.OutboxRepository,
+// reading the outbox_events table of the tenant databases
+type Outbox struct {
+	tenants *Registry
+}
+
+// NewOutbox creates an outbox repository
+func NewOutbox(tenants *Registry) *Outbox {
+	return &Outbox{tenants: tenants}
+}
+
+func scanOutboxEvents(rows *sql.Rows, tenantID int) ([]models.OutboxEvent, error) {
+	defer rows.Close()
+
+	events := []models.OutboxEvent{}
+	for rows.Next() {
+		e := models.OutboxEvent{Event: models.Event{TenantID: tenantID}}
+		var data []byte
+		if err := rows.Scan(&e.Seq, &e.ID, &e.Type, &data, &e.OccurredAt, &e.Attempts); err != nil {
+			return nil, err
+		}
+		e.Data = data
+		e.OccurredAt = e.OccurredAt.UTC()
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ClaimEvents returns up to limit unpublished events that are due, oldest
+// first, postponing their next attempt by lease. Events claimed by another
+// replica are skipped rather than waited for.
+func (o *Outbox) ClaimEvents(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		WITH claimed AS (
+			UPDATE outbox_events
+			SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+			WHERE id IN (
+				SELECT id FROM outbox_events
+				WHERE published_at IS NULL AND next_attempt_at <= CURRENT_TIMESTAMP
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING `+outboxEventColumns+`
+		)
+		SELECT * FROM claimed ORDER BY id`,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxEvents(rows, tenantID)
+}
+
+// MarkPublished records that an event was published
+func (o *Outbox) MarkPublished(ctx context.Context, tenantID int, seq int64) error {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE outbox_events SET published_at = CURRENT_TIMESTAMP, next_attempt_at = NULL
+		WHERE id = $1`,
+		seq,
+	)
+	return err
+}
+
+// RecordPublishFailure stores why an event couldn't be published and
+// postpones its next attempt by retryIn
+func (o *Outbox) RecordPublishFailure(ctx context.Context, tenantID int, seq int64, message string, retryIn time.Duration) error {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE outbox_events SET
+			attempts = attempts + 1,
+			last_error = $2,
+			next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $3)
+		WHERE id = $1`,
+		seq, message, retryIn.Seconds(),
+	)
+	return err
+}
+
+// DeletePublishedEvents deletes the events published longer than olderThan ago
+func (o *Outbox) DeletePublishedEvents(ctx context.Context, tenantID int, olderThan time.Duration) error {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		"DELETE FROM outbox_events WHERE published_at < CURRENT_TIMESTAMP - make_interval(secs => $1)",
+		olderThan.Seconds(),
+	)
+	return err
+}
+
+// Listen sends the sequence number of each event committed to the tenant's
+// outbox from now on, notified by the outbox_events trigger. It holds a
+// connection of its own, outside the tenant's pool, until the channel closes.
+func (o *Outbox) Listen(ctx context.Context, tenantID int) (<-chan int64, error) {
+	dsn, err := o.tenants.tenantDSN(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make(chan *pq.Notification, listenerBuffer)
+	conn, err := pq.NewListenerConn(dsn, notifications)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Listen(outboxChannel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	seqs := make(chan int64, listenerBuffer)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(listenerPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// A lost connection closes notifications
+				if err := conn.Ping(); err != nil {
+					conn.Close()
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer close(seqs)
+		defer func() {
+			close(done)
+			conn.Close()
+			// Unblock the connection's reader until it closes notifications
+			for range notifications {
+			}
+		}()
+
+		for {
+			select {
+			case n, ok := <-notifications:
+				if !ok {
+					return
+				}
+				seq, err := strconv.ParseInt(n.Extra, 10, 64)
+				if err != nil {
+					continue
+				}
+				select {
+				case seqs <- seq:
+				default:
+					// Fallen behind; the caller catches up from the outbox
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return seqs, nil
+}
+
+// EventBySeq returns a committed event, published or not
+func (o *Outbox) EventBySeq(ctx context.Context, tenantID int, seq int64) (*models.OutboxEvent, error) {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT "+outboxEventColumns+" FROM outbox_events WHERE id = $1", seq)
+	if err != nil {
+		return nil, err
+	}
+	events, err := scanOutboxEvents(rows, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &events[0], nil
+}
+
+// EventsAfter returns up to limit committed events following seq, in order.
+// Published events are only kept for the retention, so older ones are gone.
+func (o *Outbox) EventsAfter(ctx context.Context, tenantID int, seq int64, limit int) ([]models.OutboxEvent, error) {
+	db, err := o.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx,
+		"SELECT "+outboxEventColumns+" FROM outbox_events WHERE id > $1 ORDER BY id LIMIT $2",
+		seq, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxEvents(rows, tenantID)
+}
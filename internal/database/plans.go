@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// planColumns are the columns read by scanPlan
+const planColumns = "name, max_users, max_posts, max_storage_bytes, max_requests_per_day"
+
+// Plans is the Postgres implementation of repository.PlanRepository
+type Plans struct {
+	db *sql.DB
+}
+
+// NewPlans creates a plan repository on the tenant management database
+func NewPlans(db *sql.DB) *Plans {
+	return &Plans{db: db}
+}
+
+func scanPlan(row rowScanner) (*models.Plan, error) {
+	var p models.Plan
+	var maxUsers, maxPosts, maxStorage, maxRequests sql.NullInt64
+	if err := row.Scan(&p.Name, &maxUsers, &maxPosts, &maxStorage, &maxRequests); err != nil {
+		return nil, err
+	}
+	if maxUsers.Valid {
+		n := int(maxUsers.Int64)
+		p.MaxUsers = &n
+	}
+	if maxPosts.Valid {
+		n := int(maxPosts.Int64)
+		p.MaxPosts = &n
+	}
+	if maxStorage.Valid {
+		p.MaxStorageBytes = &maxStorage.Int64
+	}
+	if maxRequests.Valid {
+		p.MaxRequestsPerDay = &maxRequests.Int64
+	}
+	return &p, nil
+}
+
+// Plans lists the plans by name
+func (r *Plans) Plans(ctx context.Context) ([]models.Plan, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+planColumns+" FROM plans ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	plans := []models.Plan{}
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, rows.Err()
+}
+
+// PlanByName returns the named plan
+func (r *Plans) PlanByName(ctx context.Context, name string) (*models.Plan, error) {
+	return scanPlan(r.db.QueryRowContext(ctx, "SELECT "+planColumns+" FROM plans WHERE name = $1", name))
+}
+
+// SavePlan creates or replaces a plan
+func (r *Plans) SavePlan(ctx context.Context, plan *models.Plan) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO plans (name, max_users, max_posts, max_storage_bytes, max_requests_per_day)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (name) DO UPDATE SET
+			max_users = EXCLUDED.max_users,
+			max_posts = EXCLUDED.max_posts,
+			max_storage_bytes = EXCLUDED.max_storage_bytes,
+			max_requests_per_day = EXCLUDED.max_requests_per_day`,
+		plan.Name, plan.MaxUsers, plan.MaxPosts, plan.MaxStorageBytes, plan.MaxRequestsPerDay,
+	)
+	return err
+}
+
+// AssignPlan moves a tenant to a plan, returning sql.ErrNoRows if either
+// doesn't exist
+func (r *Plans) AssignPlan(ctx context.Context, tenantID int, plan string) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE tenants SET plan = $1 WHERE id = $2 AND EXISTS (SELECT 1 FROM plans WHERE name = $1)", plan, tenantID,
+	)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
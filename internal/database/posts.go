@@ -0,0 +1,159 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// postColumns are the columns read by scanPost
+const postColumns = "id, user_id, title, content, created_at, updated_at"
+
+// Posts is the Postgres implementation of repository.PostRepository
+type Posts struct {
+	tenants repository.TenantStore
+}
+
+// NewPosts creates a post repository storing posts in the tenant databases
+func NewPosts(tenants repository.TenantStore) *Posts {
+	return &Posts{tenants: tenants}
+}
+
+func scanPost(row rowScanner) (*models.Post, error) {
+	var post models.Post
+	if err := row.Scan(&post.ID, &post.UserID, &post.Title, &post.Content, &post.CreatedAt, &post.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// CreatePost inserts the post and fills in its generated fields, appending the
+// post.created event to the outbox in the same transaction
+func (p *Posts) CreatePost(ctx context.Context, tenantID int, post *models.Post) error {
+	db, err := p.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	created, err := scanPost(tx.QueryRowContext(ctx, `
+		INSERT INTO posts (user_id, title, content, updated_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+postColumns,
+		post.UserID, post.Title, post.Content, time.Now(),
+	))
+	if err != nil {
+		return err
+	}
+
+	if err := events.Record(ctx, tx, models.EventPostCreated, tenantID, created); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*post = *created
+	return nil
+}
+
+// UpdatePost updates the post's title and content and fills in the rest of
+// it, appending the post.updated event to the outbox in the same transaction
+func (p *Posts) UpdatePost(ctx context.Context, tenantID int, post *models.Post) error {
+	db, err := p.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	updated, err := scanPost(tx.QueryRowContext(ctx, `
+		UPDATE posts SET title = $1, content = $2, updated_at = $3
+		WHERE id = $4
+		RETURNING `+postColumns,
+		post.Title, post.Content, time.Now(), post.ID,
+	))
+	if err != nil {
+		return err
+	}
+
+	if err := events.Record(ctx, tx, models.EventPostUpdated, tenantID, updated); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*post = *updated
+	return nil
+}
+
+// DeletePost deletes a post, appending the post.deleted event to the outbox in
+// the same transaction
+func (p *Posts) DeletePost(ctx context.Context, tenantID, postID int) error {
+	db, err := p.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	deleted, err := scanPost(tx.QueryRowContext(ctx, "DELETE FROM posts WHERE id = $1 RETURNING "+postColumns, postID))
+	if err != nil {
+		return err
+	}
+
+	if err := events.Record(ctx, tx, models.EventPostDeleted, tenantID, deleted); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListPosts returns the tenant's posts, newest first
+func (p *Posts) ListPosts(ctx context.Context, tenantID int) ([]models.Post, error) {
+	db, err := p.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT "+postColumns+" FROM posts ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var posts []models.Post
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, *post)
+	}
+	return posts, rows.Err()
+}
+
+// PostByID returns a post of the tenant
+func (p *Posts) PostByID(ctx context.Context, tenantID, postID int) (*models.Post, error) {
+	db, err := p.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return scanPost(db.QueryRowContext(ctx, "SELECT "+postColumns+" FROM posts WHERE id = $1", postID))
+}
@@ -0,0 +1,370 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// snapshotColumns are the columns read by scanSnapshot
+const snapshotColumns = "id, tenant_id, job_id, label, method, schema_version, size, storage_key, created_at"
+
+// Snapshots is the Postgres implementation of repository.SnapshotRepository
+type Snapshots struct {
+	tenants *Registry
+}
+
+// NewSnapshots creates a snapshot repository for the tenants of the registry
+func NewSnapshots(tenants *Registry) *Snapshots {
+	return &Snapshots{tenants: tenants}
+}
+
+func scanSnapshot(row rowScanner) (*models.Snapshot, error) {
+	var s models.Snapshot
+	err := row.Scan(&s.ID, &s.TenantID, &s.JobID, &s.Label, &s.Method, &s.SchemaVersion, &s.Size, &s.Key, &s.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSnapshot records a snapshot and sets its ID
+func (s *Snapshots) CreateSnapshot(ctx context.Context, snapshot *models.Snapshot) error {
+	err := s.tenants.main.QueryRowContext(ctx, `
+		INSERT INTO tenant_snapshots (tenant_id, job_id, label, method, schema_version, size, storage_key, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id`,
+		snapshot.TenantID, snapshot.JobID, snapshot.Label, snapshot.Method, snapshot.SchemaVersion, snapshot.Size,
+		snapshot.Key, snapshot.CreatedAt,
+	).Scan(&snapshot.ID)
+	if isUniqueViolation(err) {
+		return repository.ErrConflict
+	}
+	return err
+}
+
+// Snapshots lists the tenant's snapshots, newest first
+func (s *Snapshots) Snapshots(ctx context.Context, tenantID int) ([]models.Snapshot, error) {
+	rows, err := s.tenants.main.QueryContext(ctx,
+		"SELECT "+snapshotColumns+" FROM tenant_snapshots WHERE tenant_id = $1 ORDER BY created_at DESC, id DESC", tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	snapshots := []models.Snapshot{}
+	for rows.Next() {
+		snapshot, err := scanSnapshot(rows)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *snapshot)
+	}
+	return snapshots, rows.Err()
+}
+
+// SnapshotByID looks up a snapshot
+func (s *Snapshots) SnapshotByID(ctx context.Context, snapshotID int64) (*models.Snapshot, error) {
+	return scanSnapshot(s.tenants.main.QueryRowContext(ctx,
+		"SELECT "+snapshotColumns+" FROM tenant_snapshots WHERE id = $1", snapshotID))
+}
+
+// DeleteSnapshot deletes the record of a snapshot
+func (s *Snapshots) DeleteSnapshot(ctx context.Context, snapshotID int64) error {
+	_, err := s.tenants.main.ExecContext(ctx, "DELETE FROM tenant_snapshots WHERE id = $1", snapshotID)
+	return err
+}
+
+// DumpTenant writes a snapshot of the tenant database: a gzipped stream of
+// its rows for the logical method, or pg_dump's custom format
+func (s *Snapshots) DumpTenant(ctx context.Context, tenantID int, method string, w io.Writer) (int, error) {
+	db, err := s.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return 0, err
+	}
+
+	switch method {
+	case models.SnapshotLogical:
+		return dumpLogical(ctx, db, w)
+	case models.SnapshotPGDump:
+		version, err := SchemaVersion(ctx, db)
+		if err != nil {
+			return 0, err
+		}
+		dbName, err := s.tenants.tenantDBName(ctx, tenantID)
+		if err != nil {
+			return 0, err
+		}
+		err = s.tenants.runTool(ctx, "pg_dump", nil, w, "--format=custom", "--no-owner", "--no-privileges", dbName)
+		return version, err
+	}
+	return 0, fmt.Errorf("unknown snapshot method %q", method)
+}
+
+// RestoreTenant restores a snapshot into a new database that then replaces
+// the tenant's
+func (s *Snapshots) RestoreTenant(ctx context.Context, tenantID int, method string, schemaVersion int, r io.Reader) error {
+	if schemaVersion < 1 || schemaVersion > len(tenantMigrations) {
+		return fmt.Errorf("can't restore a snapshot at schema version %d", schemaVersion)
+	}
+
+	return s.tenants.replaceTenantDB(ctx, tenantID, func(db *sql.DB, dbName string) error {
+		switch method {
+		case models.SnapshotLogical:
+			// The rows are restored into the tables as they were when the
+			// snapshot was taken, later migrations are applied afterwards
+			if err := migrate(db, tenantMigrations[:schemaVersion]); err != nil {
+				return fmt.Errorf("error creating tenant tables: %v", err)
+			}
+			return restoreLogical(ctx, db, r)
+		case models.SnapshotPGDump:
+			return s.tenants.runTool(ctx, "pg_restore", r, io.Discard,
+				"--no-owner", "--no-privileges", "--exit-on-error", "--single-transaction", "--dbname="+dbName)
+		}
+		return fmt.Errorf("unknown snapshot method %q", method)
+	})
+}
+
+// logicalRow is a line of a logical snapshot. The row is the JSON text
+// Postgres rendered it as, kept verbatim so that JSON columns, such as the
+// hashed details of audit events, are restored byte for byte.
+type logicalRow struct {
+	Table string `json:"table"`
+	Row   string `json:"row"`
+}
+
+// dumpLogical writes the rows of every table in one repeatable read
+// transaction, so that they are consistent, and returns the schema version
+func dumpLogical(ctx context.Context, db *sql.DB, w io.Writer) (int, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	tables, err := tableOrder(ctx, tx)
+	if err != nil {
+		return 0, err
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	for _, table := range tables {
+		if err := dumpTable(ctx, tx, enc, table); err != nil {
+			return 0, fmt.Errorf("error reading %s: %w", table, err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+func dumpTable(ctx context.Context, tx *sql.Tx, enc *json.Encoder, table string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", pq.QuoteIdentifier(table)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		line := logicalRow{Table: table}
+		if err := rows.Scan(&line.Row); err != nil {
+			return err
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// tableOrder lists the tables of the tenant schema, besides
+// schema_migrations, with every table after the ones it refers to
+func tableOrder(ctx context.Context, tx *sql.Tx) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.relname::text,
+			COALESCE(array_agg(DISTINCT f.relname::text) FILTER (WHERE f.oid IS NOT NULL AND f.oid <> c.oid), '{}')
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		LEFT JOIN pg_constraint k ON k.conrelid = c.oid AND k.contype = 'f'
+		LEFT JOIN pg_class f ON f.oid = k.confrelid
+		WHERE n.nspname = 'public' AND c.relkind = 'r' AND c.relname <> 'schema_migrations'
+		GROUP BY c.relname
+		ORDER BY c.relname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	refs := make(map[string][]string)
+	for rows.Next() {
+		var table string
+		var refers []string
+		if err := rows.Scan(&table, pq.Array(&refers)); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+		refs[table] = refers
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ordered := make([]string, 0, len(tables))
+	done := make(map[string]bool, len(tables))
+	for len(ordered) < len(tables) {
+		progress := false
+		for _, table := range tables {
+			if done[table] {
+				continue
+			}
+			ready := true
+			for _, ref := range refs[table] {
+				ready = ready && done[ref]
+			}
+			if ready {
+				ordered = append(ordered, table)
+				done[table] = true
+				progress = true
+			}
+		}
+		if !progress {
+			return nil, fmt.Errorf("the foreign keys of the tenant tables form a cycle")
+		}
+	}
+	return ordered, nil
+}
+
+// restoreLogical inserts the rows of a logical snapshot in one transaction
+// and moves the sequences past the restored IDs
+func restoreLogical(ctx context.Context, db *sql.DB, r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inserts := make(map[string]*sql.Stmt)
+	dec := json.NewDecoder(gz)
+	for {
+		var line logicalRow
+		if err := dec.Decode(&line); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("error reading snapshot: %v", err)
+		}
+
+		insert, ok := inserts[line.Table]
+		if !ok {
+			table := pq.QuoteIdentifier(line.Table)
+			insert, err = tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s SELECT * FROM json_populate_record(NULL::%s, $1::json)", table, table))
+			if err != nil {
+				return fmt.Errorf("error restoring %s: %v", line.Table, err)
+			}
+			inserts[line.Table] = insert
+		}
+		if _, err := insert.ExecContext(ctx, line.Row); err != nil {
+			return fmt.Errorf("error restoring a row of %s: %v", line.Table, err)
+		}
+	}
+
+	if err := resetSequences(ctx, tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// resetSequences moves the sequence of every serial column past the largest
+// value in the column
+func resetSequences(ctx context.Context, tx *sql.Tx) error {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT table_name, column_name, pg_get_serial_sequence(quote_ident(table_name), column_name)
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND column_default LIKE 'nextval(%'`)
+	if err != nil {
+		return err
+	}
+	type serial struct{ table, column, sequence string }
+	var serials []serial
+	for rows.Next() {
+		var s serial
+		if err := rows.Scan(&s.table, &s.column, &s.sequence); err != nil {
+			rows.Close()
+			return err
+		}
+		serials = append(serials, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, s := range serials {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("SELECT setval($1, COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false)",
+			pq.QuoteIdentifier(s.column), pq.QuoteIdentifier(s.table)), s.sequence)
+		if err != nil {
+			return fmt.Errorf("error resetting the sequence of %s.%s: %v", s.table, s.column, err)
+		}
+	}
+	return nil
+}
+
+// runTool runs a PostgreSQL client program, such as pg_dump, passing the
+// connection settings in the environment rather than on the command line
+func (r *Registry) runTool(ctx context.Context, name string, stdin io.Reader, stdout io.Writer, args ...string) error {
+	path := name
+	if r.cfg.BinDir != "" {
+		path = filepath.Join(r.cfg.BinDir, name)
+	}
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = os.Environ()
+	for _, v := range [][2]string{
+		{"PGHOST", r.cfg.Host},
+		{"PGPORT", strconv.Itoa(r.cfg.Port)},
+		{"PGUSER", r.cfg.User},
+		{"PGPASSWORD", r.cfg.Password},
+		{"PGSSLMODE", r.cfg.SSLMode},
+		{"PGSSLROOTCERT", r.cfg.SSLRootCert},
+		{"PGSSLCERT", r.cfg.SSLCert},
+		{"PGSSLKEY", r.cfg.SSLKey},
+	} {
+		if v[1] != "" {
+			cmd.Env = append(cmd.Env, v[0]+"="+v[1])
+		}
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
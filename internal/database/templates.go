@@ -0,0 +1,195 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/tracing"
+)
+
+// SetTenantTemplate marks a tenant as a template or unmarks it
+func (r *Registry) SetTenantTemplate(ctx context.Context, tenantID int, isTemplate bool) error {
+	res, err := r.main.ExecContext(ctx, "UPDATE tenants SET is_template = $1 WHERE id = $2", isTemplate, tenantID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// CreateTenantFromTemplate creates a tenant from a template, copying the
+// template's database when opts ask for its seed data and its registration
+// settings when opts ask for them. It returns repository.ErrConflict if the
+// name or slug is taken.
+func (r *Registry) CreateTenantFromTemplate(ctx context.Context, name, slug string, templateID int, opts models.TemplateOptions) (*models.Tenant, error) {
+	ctx, span := tracing.Start(ctx, "CreateTenantFromTemplate",
+		attribute.String("tenant.slug", slug), attribute.Int("tenant.template_id", templateID))
+	defer span.End()
+
+	var exists bool
+	err := r.main.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM tenants WHERE name = $1 OR slug = $2)", name, slug).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, repository.ErrConflict
+	}
+
+	dbName := newTenantDBName(name)
+	if opts.SeedData {
+		err = r.cloneTenantDB(ctx, templateID, dbName)
+	} else {
+		dbName, err = r.createTenantDB(ctx, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	registered := false
+	defer func() {
+		if !registered {
+			r.dropDB(context.WithoutCancel(ctx), dbName)
+		}
+	}()
+
+	query := `
+		INSERT INTO tenants (name, slug, db_name)
+		VALUES ($1, $2, $3)
+		RETURNING ` + tenantColumns
+	args := []interface{}{name, slug, dbName}
+	if opts.Settings {
+		query = `
+		INSERT INTO tenants (name, slug, db_name, registration_mode, allowed_email_domains)
+		SELECT $1, $2, $3, registration_mode, allowed_email_domains FROM tenants WHERE id = $4
+		RETURNING ` + tenantColumns
+		args = append(args, templateID)
+	}
+	tenant, err := scanTenant(r.main.QueryRowContext(ctx, query, args...))
+	if isUniqueViolation(err) {
+		return nil, repository.ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+	registered = true
+	return tenant, nil
+}
+
+// cloneTenantDB creates a database holding a copy of a template tenant's,
+// prepared for a new tenant. The rows are copied, unless no session is
+// connected to the template and Postgres can copy the whole database with
+// CREATE DATABASE ... TEMPLATE. Connections to the template, this replica's
+// included, are never closed for it.
+func (r *Registry) cloneTenantDB(ctx context.Context, templateID int, dbName string) error {
+	templateName, err := r.tenantDBName(ctx, templateID)
+	if err != nil {
+		return err
+	}
+
+	var inUse bool
+	err = r.main.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM pg_stat_activity WHERE datname = $1)", templateName).Scan(&inUse)
+	if err != nil {
+		return err
+	}
+	copied := false
+	if !inUse {
+		_, err = r.main.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s",
+			pq.QuoteIdentifier(dbName), pq.QuoteIdentifier(templateName)))
+		// A session may have connected since
+		copied = err == nil
+		if err != nil && !isObjectInUse(err) {
+			return fmt.Errorf("error creating tenant database: %v", err)
+		}
+	}
+	if !copied {
+		if _, err := r.main.ExecContext(ctx, "CREATE DATABASE "+pq.QuoteIdentifier(dbName)); err != nil {
+			return fmt.Errorf("error creating tenant database: %v", err)
+		}
+	}
+
+	db, err := sql.Open("postgres", r.cfg.DSN(dbName))
+	if err == nil {
+		err = func() error {
+			// A copied database is brought up to date like the template would be
+			if err := migrate(db, tenantMigrations); err != nil {
+				return fmt.Errorf("error creating tenant tables: %v", err)
+			}
+			if !copied {
+				if err := r.copyTenantData(ctx, templateID, db); err != nil {
+					return fmt.Errorf("error copying template data: %v", err)
+				}
+			}
+			return prepareClone(ctx, db)
+		}()
+		db.Close()
+	}
+	if err != nil {
+		r.dropDB(context.WithoutCancel(ctx), dbName)
+		return err
+	}
+	return nil
+}
+
+// copyTenantData copies the rows of a tenant's database into the empty
+// tables of db. Opening the tenant's database brings it up to date first.
+func (r *Registry) copyTenantData(ctx context.Context, tenantID int, db *sql.DB) error {
+	src, err := r.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := dumpLogical(ctx, src, pw)
+		pw.CloseWithError(err)
+	}()
+	err = restoreLogical(ctx, db, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+// prepareClone keeps only the posts of a copy of a template's database. The
+// history, invitations and webhooks are removed, and the users are replaced
+// by an anonymous deactivated author of the posts, so that neither the
+// template's personal data nor its credentials reach the new tenant.
+func prepareClone(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the table owner can bypass the append-only audit log trigger
+	_, err = tx.ExecContext(ctx, `
+		ALTER TABLE audit_events DISABLE TRIGGER USER;
+		TRUNCATE audit_events, outbox_events, webhook_deliveries, webhooks, invitations;
+		ALTER TABLE audit_events ENABLE TRIGGER USER;
+		UPDATE posts SET user_id = (SELECT MIN(id) FROM users);
+		DELETE FROM users WHERE id <> (SELECT MIN(id) FROM users)`)
+	if err == nil {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE users SET email = $1, password = '', role = $2, active = FALSE, created_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP",
+			models.SeedAuthorEmail, models.RoleMember,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("error preparing tenant database: %v", err)
+	}
+	return tx.Commit()
+}
+
+// isObjectInUse reports whether err is Postgres refusing to copy a database
+// other sessions are connected to
+func isObjectInUse(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "55006"
+}
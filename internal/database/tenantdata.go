@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// TenantData is the Postgres implementation of repository.TenantDataRepository
+type TenantData struct {
+	tenants repository.TenantStore
+}
+
+// NewTenantData creates a repository reading and writing whole tenant databases
+func NewTenantData(tenants repository.TenantStore) *TenantData {
+	return &TenantData{tenants: tenants}
+}
+
+// TenantSchemaVersion is the version tenant databases are migrated to
+func (d *TenantData) TenantSchemaVersion() int {
+	return TenantSchemaVersion()
+}
+
+// ExportTenantData reads the tenant's users, posts, invitations and webhooks
+// in one repeatable read transaction, so that they are consistent
+func (d *TenantData) ExportTenantData(ctx context.Context, tenantID int) (*models.TenantData, error) {
+	db, err := d.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	data := &models.TenantData{}
+	if data.Users, err = exportUsers(ctx, tx); err != nil {
+		return nil, fmt.Errorf("error reading users: %w", err)
+	}
+	if data.Posts, err = exportPosts(ctx, tx); err != nil {
+		return nil, fmt.Errorf("error reading posts: %w", err)
+	}
+	if data.Invitations, err = exportInvitations(ctx, tx); err != nil {
+		return nil, fmt.Errorf("error reading invitations: %w", err)
+	}
+	if data.Webhooks, err = exportWebhooks(ctx, tx); err != nil {
+		return nil, fmt.Errorf("error reading webhooks: %w", err)
+	}
+	return data, tx.Commit()
+}
+
+func exportUsers(ctx context.Context, tx *sql.Tx) ([]models.UserRecord, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, email, password, role, active, created_at, updated_at FROM users ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.UserRecord{}
+	for rows.Next() {
+		var u models.UserRecord
+		if err := rows.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Role, &u.Active, &u.CreatedAt, &u.UpdatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func exportPosts(ctx context.Context, tx *sql.Tx) ([]models.Post, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, user_id, title, content, created_at, updated_at FROM posts ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []models.Post{}
+	for rows.Next() {
+		var p models.Post
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Title, &p.Content, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+func exportInvitations(ctx context.Context, tx *sql.Tx) ([]models.InvitationRecord, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT id, email, role, token_hash, invited_by, expires_at, accepted_at, created_at
+		FROM invitations ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.InvitationRecord{}
+	for rows.Next() {
+		var inv models.InvitationRecord
+		var invitedBy sql.NullInt64
+		var acceptedAt sql.NullTime
+		if err := rows.Scan(&inv.ID, &inv.Email, &inv.Role, &inv.TokenHash, &invitedBy, &inv.ExpiresAt, &acceptedAt, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		if invitedBy.Valid {
+			id := int(invitedBy.Int64)
+			inv.InvitedBy = &id
+		}
+		if acceptedAt.Valid {
+			inv.AcceptedAt = &acceptedAt.Time
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, rows.Err()
+}
+
+func exportWebhooks(ctx context.Context, tx *sql.Tx) ([]models.Webhook, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, url, secret, event_types, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var w models.Webhook
+		if err := rows.Scan(&w.ID, &w.URL, &w.Secret, pq.Array(&w.EventTypes), &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+// ImportTenantData stores data into a tenant without users in one
+// transaction. Records get new IDs from the tenant's sequences; references
+// to users that aren't in data are cleared.
+func (d *TenantData) ImportTenantData(ctx context.Context, tenantID int, data *models.TenantData) error {
+	db, err := d.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Keep registrations out until the import is committed
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users)").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrConflict
+	}
+
+	userIDs := make(map[int]int, len(data.Users))
+	for _, u := range data.Users {
+		var id int
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO users (email, password, role, active, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING id`,
+			u.Email, u.PasswordHash, u.Role, u.Active, u.CreatedAt, u.UpdatedAt,
+		).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("error importing user %d: %w", u.ID, err)
+		}
+		userIDs[u.ID] = id
+	}
+
+	for _, p := range data.Posts {
+		userID, ok := userIDs[p.UserID]
+		if !ok {
+			return fmt.Errorf("post %d belongs to user %d, who isn't imported", p.ID, p.UserID)
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO posts (user_id, title, content, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5)`,
+			userID, p.Title, p.Content, p.CreatedAt, p.UpdatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("error importing post %d: %w", p.ID, err)
+		}
+	}
+
+	for _, inv := range data.Invitations {
+		var invitedBy *int
+		if inv.InvitedBy != nil {
+			if id, ok := userIDs[*inv.InvitedBy]; ok {
+				invitedBy = &id
+			}
+		}
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO invitations (email, role, token_hash, invited_by, expires_at, accepted_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			inv.Email, inv.Role, inv.TokenHash, invitedBy, inv.ExpiresAt, inv.AcceptedAt, inv.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("error importing invitation %d: %w", inv.ID, err)
+		}
+	}
+
+	for _, w := range data.Webhooks {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO webhooks (url, secret, event_types, created_at)
+			VALUES ($1, $2, $3, $4)`,
+			w.URL, w.Secret, pq.Array(w.EventTypes), w.CreatedAt,
+		)
+		if err != nil {
+			return fmt.Errorf("error importing webhook %d: %w", w.ID, err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// Usage is the Postgres implementation of repository.UsageRepository. Usage
+// is measured in the tenant databases and metered in the management database.
+type Usage struct {
+	tenants repository.TenantStore
+}
+
+// NewUsage creates a usage repository
+func NewUsage(tenants repository.TenantStore) *Usage {
+	return &Usage{tenants: tenants}
+}
+
+// ResourceUsage counts a tenant's active users and posts and measures the size
+// of its database
+func (r *Usage) ResourceUsage(ctx context.Context, tenantID int) (*models.ResourceUsage, error) {
+	db, err := r.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var usage models.ResourceUsage
+	err = db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM users WHERE active),
+			(SELECT COUNT(*) FROM posts),
+			pg_database_size(current_database())`,
+	).Scan(&usage.Users, &usage.Posts, &usage.StorageBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// AddRequests adds n to a tenant's requests on a day, returning the day's total
+func (r *Usage) AddRequests(ctx context.Context, tenantID int, day time.Time, n int64) (int64, error) {
+	var total int64
+	err := r.tenants.MainDB().QueryRowContext(ctx, `
+		INSERT INTO tenant_usage_daily (tenant_id, day, requests)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id, day) DO UPDATE SET requests = tenant_usage_daily.requests + EXCLUDED.requests
+		RETURNING requests`,
+		tenantID, day.Format(time.DateOnly), n,
+	).Scan(&total)
+	return total, err
+}
+
+// RecordResources stores the resources a tenant used on a day
+func (r *Usage) RecordResources(ctx context.Context, tenantID int, day time.Time, usage *models.ResourceUsage) error {
+	_, err := r.tenants.MainDB().ExecContext(ctx, `
+		INSERT INTO tenant_usage_daily (tenant_id, day, users, posts, storage_bytes)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id, day) DO UPDATE SET
+			users = EXCLUDED.users,
+			posts = EXCLUDED.posts,
+			storage_bytes = EXCLUDED.storage_bytes`,
+		tenantID, day.Format(time.DateOnly), usage.Users, usage.Posts, usage.StorageBytes,
+	)
+	return err
+}
+
+// DailyUsage returns a tenant's usage on the days from from to to, oldest first
+func (r *Usage) DailyUsage(ctx context.Context, tenantID int, from, to time.Time) ([]models.DailyUsage, error) {
+	rows, err := r.tenants.MainDB().QueryContext(ctx, `
+		SELECT day, requests, users, posts, storage_bytes
+		FROM tenant_usage_daily
+		WHERE tenant_id = $1 AND day BETWEEN $2 AND $3
+		ORDER BY day`,
+		tenantID, from.Format(time.DateOnly), to.Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []models.DailyUsage{}
+	for rows.Next() {
+		var d models.DailyUsage
+		if err := rows.Scan(&d.Day, &d.Requests, &d.Users, &d.Posts, &d.StorageBytes); err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
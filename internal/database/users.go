@@ -0,0 +1,314 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// userColumns are the columns read by scanUser
+const userColumns = "id, email, password, role, active, created_at, updated_at"
+
+// Users is the Postgres implementation of repository.UserRepository
+type Users struct {
+	tenants repository.TenantStore
+}
+
+// NewUsers creates a user repository storing users in the tenant databases
+func NewUsers(tenants repository.TenantStore) *Users {
+	return &Users{tenants: tenants}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner, tenantID int) (*models.User, error) {
+	user := models.User{TenantID: tenantID}
+	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Role, &user.Active, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser creates a user, appending the user.registered event to the
+// outbox in the same transaction; the first user of a tenant without active
+// users, such as one created from a template, becomes its admin
+func (u *Users) CreateUser(ctx context.Context, tenantID int, email, passwordHash string, active bool) (*models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize user creation, otherwise concurrent first registrations
+	// could all see an empty table and all become admins
+	if _, err := tx.ExecContext(ctx, "LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		return nil, err
+	}
+
+	user, err := scanUser(tx.QueryRowContext(ctx, `
+		INSERT INTO users (email, password, role, active)
+		SELECT $1, $2, CASE WHEN EXISTS(SELECT 1 FROM users WHERE active) THEN $3 ELSE $4 END, $5
+		RETURNING `+userColumns,
+		email, passwordHash, models.RoleMember, models.RoleAdmin, active,
+	), tenantID)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := events.Record(ctx, tx, models.EventUserRegistered, tenantID, user); err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// UserByID returns a user including their password hash
+func (u *Users) UserByID(ctx context.Context, tenantID, userID int) (*models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1", userID), tenantID)
+}
+
+// UserByEmail returns a user including their password hash
+func (u *Users) UserByEmail(ctx context.Context, tenantID int, email string) (*models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return scanUser(db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = $1", email), tenantID)
+}
+
+// ListUsers returns a page of the tenant's users ordered by ID
+func (u *Users) ListUsers(ctx context.Context, tenantID int, active *bool, limit, offset int) ([]models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + userColumns + " FROM users"
+	args := []interface{}{}
+	if active != nil {
+		args = append(args, *active)
+		query += " WHERE active = $1"
+	}
+	args = append(args, limit, offset)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []models.User{}
+	for rows.Next() {
+		user, err := scanUser(rows, tenantID)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *user)
+	}
+	return users, rows.Err()
+}
+
+// UpdateEmail changes a user's email
+func (u *Users) UpdateEmail(ctx context.Context, tenantID, userID int, email string) (*models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := scanUser(db.QueryRowContext(ctx,
+		"UPDATE users SET email = $1, updated_at = $2 WHERE id = $3 RETURNING "+userColumns,
+		email, time.Now(), userID,
+	), tenantID)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrConflict
+	}
+	return user, err
+}
+
+// UpdatePassword replaces a user's password hash
+func (u *Users) UpdatePassword(ctx context.Context, tenantID, userID int, passwordHash string) error {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "UPDATE users SET password = $1, updated_at = $2 WHERE id = $3", passwordHash, time.Now(), userID)
+	return err
+}
+
+// UpdateUser applies an admin's changes to a user's email, role and active state
+func (u *Users) UpdateUser(ctx context.Context, tenantID, userID int, changes models.UpdateUserRequest) (*models.User, error) {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Demoting or deactivating an admin must leave at least one active admin
+	removesAdmin := (changes.Role != nil && *changes.Role != models.RoleAdmin) || (changes.Active != nil && !*changes.Active)
+	if removesAdmin {
+		if err := ensureOtherAdmin(ctx, tx, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	sets := []string{"updated_at = $1"}
+	args := []interface{}{time.Now()}
+	if changes.Email != nil {
+		args = append(args, *changes.Email)
+		sets = append(sets, fmt.Sprintf("email = $%d", len(args)))
+	}
+	if changes.Role != nil {
+		args = append(args, *changes.Role)
+		sets = append(sets, fmt.Sprintf("role = $%d", len(args)))
+	}
+	if changes.Active != nil {
+		args = append(args, *changes.Active)
+		sets = append(sets, fmt.Sprintf("active = $%d", len(args)))
+	}
+	args = append(args, userID)
+
+	user, err := scanUser(tx.QueryRowContext(ctx,
+		fmt.Sprintf("UPDATE users SET %s WHERE id = $%d RETURNING %s", strings.Join(sets, ", "), len(args), userColumns),
+		args...,
+	), tenantID)
+	if isUniqueViolation(err) {
+		return nil, repository.ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	return user, tx.Commit()
+}
+
+// DeactivateUser deactivates a user
+func (u *Users) DeactivateUser(ctx context.Context, tenantID, userID int) error {
+	return u.removeUser(ctx, tenantID, userID, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.ExecContext(ctx, "UPDATE users SET active = FALSE, updated_at = $1 WHERE id = $2", time.Now(), userID)
+	})
+}
+
+// DeleteUser deletes a user and their posts, appending the post.deleted event
+// of each post to the outbox in the same transaction
+func (u *Users) DeleteUser(ctx context.Context, tenantID, userID int) error {
+	return u.removeUser(ctx, tenantID, userID, func(tx *sql.Tx) (sql.Result, error) {
+		// posts.user_id references users(id), so the user's posts go first
+		rows, err := tx.QueryContext(ctx, "DELETE FROM posts WHERE user_id = $1 RETURNING "+postColumns, userID)
+		if err != nil {
+			return nil, err
+		}
+		var posts []*models.Post
+		for rows.Next() {
+			post, err := scanPost(rows)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			posts = append(posts, post)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, post := range posts {
+			if err := events.Record(ctx, tx, models.EventPostDeleted, tenantID, post); err != nil {
+				return nil, err
+			}
+		}
+		return tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
+	})
+}
+
+// removeUser deactivates or deletes a user with remove in a transaction that
+// first checks the tenant keeps another active admin
+func (u *Users) removeUser(ctx context.Context, tenantID, userID int, remove func(tx *sql.Tx) (sql.Result, error)) error {
+	db, err := u.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := ensureOtherAdmin(ctx, tx, userID); err != nil {
+		return err
+	}
+
+	result, err := remove(tx)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// ensureOtherAdmin returns repository.ErrLastAdmin if userID is the tenant's
+// only active admin. The active admins stay locked until tx ends, so
+// concurrent transactions can't each remove a different one of the last two.
+func ensureOtherAdmin(ctx context.Context, tx *sql.Tx, userID int) error {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM users WHERE role = $1 AND active FOR UPDATE", models.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	isAdmin, others := false, 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		if id == userID {
+			isAdmin = true
+		} else {
+			others++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if isAdmin && others == 0 {
+		return repository.ErrLastAdmin
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// deliveryColumns are the columns read by scanDelivery
+const deliveryColumns = `id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_at,
+	last_status_code, last_error, delivered_at, created_at`
+
+// Webhooks is the Postgres implementation of repository.WebhookRepository,
+// keeping the webhooks and their deliveries in the tenant databases
+type Webhooks struct {
+	tenants repository.TenantStore
+}
+
+// NewWebhooks creates a webhook repository
+func NewWebhooks(tenants repository.TenantStore) *Webhooks {
+	return &Webhooks{tenants: tenants}
+}
+
+func scanDelivery(row rowScanner) (*models.WebhookDelivery, error) {
+	var d models.WebhookDelivery
+	var nextAttemptAt, deliveredAt sql.NullTime
+	var lastStatusCode sql.NullInt64
+	var payload []byte
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &payload, &d.Status, &d.Attempts, &nextAttemptAt,
+		&lastStatusCode, &d.LastError, &deliveredAt, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Payload = payload
+	if nextAttemptAt.Valid {
+		d.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if lastStatusCode.Valid {
+		code := int(lastStatusCode.Int64)
+		d.LastStatusCode = &code
+	}
+	if deliveredAt.Valid {
+		d.DeliveredAt = &deliveredAt.Time
+	}
+	return &d, nil
+}
+
+func scanDeliveries(rows *sql.Rows) ([]models.WebhookDelivery, error) {
+	defer rows.Close()
+
+	deliveries := []models.WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CreateWebhook stores a webhook and fills in its generated fields
+func (w *Webhooks) CreateWebhook(ctx context.Context, tenantID int, webhook *models.Webhook) error {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	return db.QueryRowContext(ctx, `
+		INSERT INTO webhooks (url, secret, event_types)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`,
+		webhook.URL, webhook.Secret, pq.Array(webhook.EventTypes),
+	).Scan(&webhook.ID, &webhook.CreatedAt)
+}
+
+// ListWebhooks returns the tenant's webhooks without their secrets
+func (w *Webhooks) ListWebhooks(ctx context.Context, tenantID int) ([]models.Webhook, error) {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, url, event_types, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []models.Webhook{}
+	for rows.Next() {
+		var webhook models.Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.URL, pq.Array(&webhook.EventTypes), &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// WebhookByID returns a webhook including its secret
+func (w *Webhooks) WebhookByID(ctx context.Context, tenantID, webhookID int) (*models.Webhook, error) {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhook models.Webhook
+	err = db.QueryRowContext(ctx,
+		"SELECT id, url, secret, event_types, created_at FROM webhooks WHERE id = $1", webhookID,
+	).Scan(&webhook.ID, &webhook.URL, &webhook.Secret, pq.Array(&webhook.EventTypes), &webhook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &webhook, nil
+}
+
+// DeleteWebhook deletes a webhook and its deliveries
+func (w *Webhooks) DeleteWebhook(ctx context.Context, tenantID, webhookID int) error {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.ExecContext(ctx, "DELETE FROM webhooks WHERE id = $1", webhookID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ListDeliveries returns a page of a webhook's deliveries, newest first
+func (w *Webhooks) ListDeliveries(ctx context.Context, tenantID, webhookID, limit, offset int) ([]models.WebhookDelivery, error) {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+deliveryColumns+`
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3`,
+		webhookID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// QueueEvent queues a delivery of the event for each of the tenant's webhooks
+// subscribed to it, skipping the webhooks it was queued for before
+func (w *Webhooks) QueueEvent(ctx context.Context, tenantID int, event models.Event) error {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT w.id, $1::VARCHAR, $2::TEXT, $3::JSONB
+		FROM webhooks w
+		WHERE $2::TEXT = ANY(w.event_types)
+			AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.webhook_id = w.id AND d.event_id = $1::VARCHAR)`,
+		event.ID, event.Type, string(payload),
+	)
+	return err
+}
+
+// Redeliver queues the event of a delivery again as a new delivery
+func (w *Webhooks) Redeliver(ctx context.Context, tenantID, webhookID int, deliveryID int64) (*models.WebhookDelivery, error) {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDelivery(db.QueryRowContext(ctx, `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT webhook_id, event_id, event_type, payload
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING `+deliveryColumns,
+		deliveryID, webhookID,
+	))
+}
+
+// ClaimDeliveries returns up to limit pending deliveries that are due,
+// postponing their next attempt by lease. Deliveries claimed by another
+// replica are skipped rather than waited for.
+func (w *Webhooks) ClaimDeliveries(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = CURRENT_TIMESTAMP + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+deliveryColumns,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanDeliveries(rows)
+}
+
+// RecordAttempt stores the outcome of an attempt to send a delivery
+func (w *Webhooks) RecordAttempt(ctx context.Context, tenantID int, deliveryID int64, attempt models.WebhookAttempt) error {
+	db, err := w.tenants.TenantDB(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE webhook_deliveries SET
+			attempts = attempts + 1,
+			status = $2::VARCHAR,
+			last_status_code = NULLIF($3, 0),
+			last_error = $4,
+			next_attempt_at = CASE WHEN $2::VARCHAR = 'pending' THEN CURRENT_TIMESTAMP + make_interval(secs => $5) END,
+			delivered_at = CASE WHEN $2::VARCHAR = 'delivered' THEN CURRENT_TIMESTAMP END
+		WHERE id = $1`,
+		deliveryID, attempt.Status, attempt.StatusCode, attempt.Error, attempt.RetryIn.Seconds(),
+	)
+	return err
+}
@@ -0,0 +1,170 @@
+package domains
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/netguard"
+)
+
+// Verification methods
+const (
+	MethodDNS  = "dns"
+	MethodHTTP = "http"
+)
+
+const (
+	// DNSChallengePrefix is prepended to the domain to form the TXT record name
+	DNSChallengePrefix = "_mt-challenge."
+	// HTTPChallengePath is the path the token must be served under
+	HTTPChallengePath = "/.well-known/mt-challenge/"
+)
+
+// TXTResolver looks up DNS TXT records
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Verifier checks domain ownership challenges
+type Verifier struct {
+	// Resolver is used for DNS-TXT challenges
+	Resolver TXTResolver
+	// HTTPClient is used for HTTP challenges
+	HTTPClient *http.Client
+}
+
+// NewVerifier creates a challenge verifier. A challenge DNS server sends TXT
+// lookups to a specific DNS server and a challenge HTTP address sends HTTP
+// challenges to a fixed address, which lets both be verified against local stubs.
+// Otherwise HTTP challenges are only fetched from public addresses, without
+// following redirects, as tenants choose the domains.
+func NewVerifier(cfg config.DomainsConfig) *Verifier {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: netguard.Control}
+	v := &Verifier{
+		Resolver: net.DefaultResolver,
+		HTTPClient: &http.Client{
+			Timeout:       10 * time.Second,
+			Transport:     &http.Transport{DialContext: dialer.DialContext},
+			CheckRedirect: netguard.NoRedirects,
+		},
+	}
+
+	if server := cfg.ChallengeDNSServer; server != "" {
+		v.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	if addr := cfg.ChallengeHTTPAddr; addr != "" {
+		v.HTTPClient = &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			},
+			CheckRedirect: netguard.NoRedirects,
+		}
+	}
+	return v
+}
+
+// NewToken generates a random verification token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NormalizeDomain lower-cases a domain and strips any port and trailing dot
+func NormalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	return strings.TrimSuffix(domain, ".")
+}
+
+// Challenge describes how to prove ownership of the domain
+func Challenge(d *models.TenantDomain) *models.DomainChallenge {
+	switch d.VerificationMethod {
+	case MethodDNS:
+		return &models.DomainChallenge{
+			Type:  "TXT",
+			Name:  DNSChallengePrefix + d.Domain,
+			Value: d.VerificationToken,
+		}
+	case MethodHTTP:
+		return &models.DomainChallenge{
+			Type:  "HTTP",
+			Name:  "http://" + d.Domain + HTTPChallengePath + d.VerificationToken,
+			Value: d.VerificationToken,
+		}
+	}
+	return nil
+}
+
+// Verify checks that the challenge for the domain has been published
+func (v *Verifier) Verify(ctx context.Context, d *models.TenantDomain) error {
+	switch d.VerificationMethod {
+	case MethodDNS:
+		return v.verifyDNS(ctx, d)
+	case MethodHTTP:
+		return v.verifyHTTP(ctx, d)
+	}
+	return fmt.Errorf("unknown verification method: %s", d.VerificationMethod)
+}
+
+func (v *Verifier) verifyDNS(ctx context.Context, d *models.TenantDomain) error {
+	records, err := v.Resolver.LookupTXT(ctx, DNSChallengePrefix+d.Domain)
+	if err != nil {
+		return fmt.Errorf("TXT lookup failed: %v", err)
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == d.VerificationToken {
+			return nil
+		}
+	}
+	return fmt.Errorf("no TXT record matching the verification token")
+}
+
+func (v *Verifier) verifyHTTP(ctx context.Context, d *models.TenantDomain) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+d.Domain+HTTPChallengePath+d.VerificationToken, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP challenge request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP challenge returned status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != d.VerificationToken {
+		return fmt.Errorf("HTTP challenge response does not match the verification token")
+	}
+	return nil
+}
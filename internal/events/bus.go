@@ -0,0 +1,64 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// Handler reacts to an event. Events are published at least once, handlers
+// must tolerate being called again with an event they already handled.
+type Handler func(ctx context.Context, event models.Event) error
+
+type subscription struct {
+	name    string
+	types   map[string]bool
+	handler Handler
+}
+
+// Bus passes events to the handlers subscribed to them, in process
+type Bus struct {
+	mu            sync.RWMutex
+	subscriptions []subscription
+}
+
+// NewBus creates a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls handler with the events of the given types, or with every
+// event if no type is given. name identifies the subscriber in errors.
+func (b *Bus) Subscribe(name string, handler Handler, eventTypes ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	types := make(map[string]bool, len(eventTypes))
+	for _, t := range eventTypes {
+		types[t] = true
+	}
+	b.subscriptions = append(b.subscriptions, subscription{name: name, types: types, handler: handler})
+}
+
+// Publish calls the handlers subscribed to the event in the order they
+// subscribed. Every handler is called even if some fail; the errors are
+// returned together.
+func (b *Bus) Publish(ctx context.Context, event models.Event) error {
+	b.mu.RLock()
+	subscriptions := b.subscriptions
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range subscriptions {
+		if len(s.types) > 0 && !s.types[event.Type] {
+			continue
+		}
+		if err := s.handler(ctx, event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,59 @@
+// Package events publishes the domain events of the tenants. Changes append
+// their events to the tenant's outbox in their own transaction; the relay
+// publishes them to the subscribers of the in-process bus once committed.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// New creates an event about data with a random ID
+func New(eventType string, tenantID int, data interface{}) (*models.Event, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("encoding %s event: %w", eventType, err)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &models.Event{
+		ID:         "evt_" + hex.EncodeToString(b),
+		Type:       eventType,
+		TenantID:   tenantID,
+		OccurredAt: time.Now().UTC(),
+		Data:       encoded,
+	}, nil
+}
+
+// Append adds the event to the outbox of the tenant database tx belongs to.
+// Called with the transaction making the change, the event is published if
+// and only if the change commits.
+func Append(ctx context.Context, tx *sql.Tx, event *models.Event) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO outbox_events (event_id, type, data, occurred_at)
+		VALUES ($1, $2, $3, $4)`,
+		event.ID, event.Type, string(event.Data), event.OccurredAt,
+	)
+	if err != nil {
+		return fmt.Errorf("appending %s event to the outbox: %w", event.Type, err)
+	}
+	return nil
+}
+
+// Record creates an event about data and appends it to the outbox in tx
+func Record(ctx context.Context, tx *sql.Tx, eventType string, tenantID int, data interface{}) error {
+	event, err := New(eventType, tenantID, data)
+	if err != nil {
+		return err
+	}
+	return Append(ctx, tx, event)
+}
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/repository"
+)
+
+const (
+	// batchSize is the number of events of a tenant claimed at once
+	batchSize = 100
+	// lease postpones the next attempt at claimed events, so that other
+	// replicas skip them; a replica dying mid-batch leaves them to be
+	// published again after it
+	lease = time.Minute
+	// retryBase is the delay before publishing an event again after its
+	// subscribers failed, doubled for each further attempt up to maxRetryDelay
+	retryBase     = 5 * time.Second
+	maxRetryDelay = time.Hour
+	// pruneInterval is how often published events past their retention are deleted
+	pruneInterval = time.Hour
+	// maxErrorLength bounds the error recorded for an event
+	maxErrorLength = 1000
+)
+
+// Relay publishes the events committed to the tenants' outboxes to the bus.
+// Events are published at least once, in the order they were appended unless
+// a subscriber fails, after which the event is retried with backoff.
+type Relay struct {
+	tenants   repository.TenantStore
+	outbox    repository.OutboxRepository
+	bus       *Bus
+	retention time.Duration
+}
+
+// NewRelay creates a relay keeping published events for retention
+func NewRelay(tenants repository.TenantStore, outbox repository.OutboxRepository, bus *Bus, retention time.Duration) *Relay {
+	return &Relay{tenants: tenants, outbox: outbox, bus: bus, retention: retention}
+}
+
+// Relay publishes the due events of every tenant
+func (r *Relay) Relay(ctx context.Context) error {
+	tenantIDs, err := r.tenants.TenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tenantID := range tenantIDs {
+		if err := r.relayTenant(ctx, tenantID); err != nil {
+			logging.FromContext(ctx).Error("Error relaying events", "tenant_id", tenantID, "error", err)
+		}
+	}
+	return nil
+}
+
+// relayTenant publishes a tenant's due events, a batch at a time
+func (r *Relay) relayTenant(ctx context.Context, tenantID int) error {
+	for ctx.Err() == nil {
+		events, err := r.outbox.ClaimEvents(ctx, tenantID, batchSize, lease)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := r.bus.Publish(ctx, event.Event); err != nil {
+				logging.FromContext(ctx).Warn("Error publishing event, retrying later",
+					"tenant_id", tenantID, "event_id", event.ID, "event_type", event.Type, "attempts", event.Attempts+1, "error", err)
+				message := err.Error()
+				if len(message) > maxErrorLength {
+					message = message[:maxErrorLength]
+				}
+				err = r.outbox.RecordPublishFailure(ctx, tenantID, event.Seq, message, backoff(event.Attempts+1))
+			} else {
+				err = r.outbox.MarkPublished(ctx, tenantID, event.Seq)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) < batchSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// backoff returns the delay after the given number of failed attempts
+func backoff(attempts int) time.Duration {
+	delay := retryBase
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// Prune deletes the published events of every tenant past their retention
+func (r *Relay) Prune(ctx context.Context) error {
+	tenantIDs, err := r.tenants.TenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tenantID := range tenantIDs {
+		if err := r.outbox.DeletePublishedEvents(ctx, tenantID, r.retention); err != nil {
+			logging.FromContext(ctx).Error("Error pruning published events", "tenant_id", tenantID, "error", err)
+		}
+	}
+	return nil
+}
+
+// Run relays the due events every interval, and prunes published ones every
+// hour, until ctx is cancelled
+func (r *Relay) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Relay(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error listing tenants to relay events", "error", err)
+			}
+		case <-pruneTicker.C:
+			if err := r.Prune(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error listing tenants to prune events", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package feed streams the post events of the tenants to the clients of this
+// replica. Each tenant with clients connected has one listener on its outbox,
+// so events committed through any replica reach every replica's clients.
+package feed
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+const (
+	// streamBuffer is how many events a stream may fall behind by before it
+	// is closed; its client then reconnects and resumes from the outbox
+	streamBuffer = 64
+	// retryDelay is the delay before listening again after losing a listener
+	retryDelay = 2 * time.Second
+	// pageSize is the number of events read from the outbox at once when
+	// catching up
+	pageSize = 100
+)
+
+// ErrClosed is returned by Subscribe once the hub is closed
+var ErrClosed = errors.New("post feed is shutting down")
+
+// IsPostEvent reports whether an event belongs in the post feed
+func IsPostEvent(eventType string) bool {
+	return strings.HasPrefix(eventType, "post.")
+}
+
+// Stream receives the post events of a tenant. Events is closed when the
+// stream falls behind or the hub closes.
+type Stream struct {
+	Events <-chan models.FeedEvent
+
+	events   chan models.FeedEvent
+	hub      *Hub
+	tenantID int
+}
+
+// Close stops the stream
+func (s *Stream) Close() {
+	s.hub.unsubscribe(s)
+}
+
+// listener fans the events of a tenant out to its streams
+type listener struct {
+	streams map[*Stream]bool
+	cancel  context.CancelFunc
+	// ready is closed once the first attempt to listen is over
+	ready chan struct{}
+}
+
+// Hub keeps a listener per tenant while the tenant has streams open
+type Hub struct {
+	outbox repository.OutboxRepository
+
+	mu        sync.Mutex
+	listeners map[int]*listener
+	closed    bool
+}
+
+// NewHub creates a hub reading the events from outbox
+func NewHub(outbox repository.OutboxRepository) *Hub {
+	return &Hub{outbox: outbox, listeners: make(map[int]*listener)}
+}
+
+// Subscribe opens a stream of the tenant's post events from now on. The
+// tenant's first stream waits for its listener to start.
+func (h *Hub) Subscribe(ctx context.Context, tenantID int) (*Stream, error) {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, ErrClosed
+	}
+
+	events := make(chan models.FeedEvent, streamBuffer)
+	stream := &Stream{Events: events, events: events, hub: h, tenantID: tenantID}
+
+	l, ok := h.listeners[tenantID]
+	if !ok {
+		listenCtx, cancel := context.WithCancel(context.Background())
+		l = &listener{streams: make(map[*Stream]bool), cancel: cancel, ready: make(chan struct{})}
+		h.listeners[tenantID] = l
+		go h.listen(listenCtx, tenantID, l)
+	}
+	l.streams[stream] = true
+	h.mu.Unlock()
+
+	select {
+	case <-l.ready:
+		return stream, nil
+	case <-ctx.Done():
+		stream.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// unsubscribe removes a stream, stopping the tenant's listener with its last stream
+func (h *Hub) unsubscribe(s *Stream) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(s)
+}
+
+// remove closes a stream and removes it. Callers must hold h.mu.
+func (h *Hub) remove(s *Stream) {
+	l, ok := h.listeners[s.tenantID]
+	if !ok || !l.streams[s] {
+		return
+	}
+	delete(l.streams, s)
+	close(s.events)
+	if len(l.streams) == 0 {
+		l.cancel()
+		delete(h.listeners, s.tenantID)
+	}
+}
+
+// Close closes every stream and refuses new ones, so that requests streaming
+// don't hold up the shutdown
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, l := range h.listeners {
+		for s := range l.streams {
+			h.remove(s)
+		}
+	}
+}
+
+// listen sends the tenant's post events to the streams of l until ctx is
+// cancelled, listening again whenever the listener is lost and catching up
+// with the events committed in the meantime
+func (h *Hub) listen(ctx context.Context, tenantID int, l *listener) {
+	log := logging.FromContext(ctx).With("tenant_id", tenantID)
+	ready := sync.OnceFunc(func() { close(l.ready) })
+	defer ready()
+
+	var last int64
+	for ctx.Err() == nil {
+		seqs, err := h.outbox.Listen(ctx, tenantID)
+		ready()
+		if err != nil {
+			log.Error("Error listening to the outbox", "error", err)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		if last > 0 {
+			if last, err = h.catchUp(ctx, tenantID, l, last); err != nil {
+				log.Error("Error catching up with the outbox", "error", err)
+			}
+		}
+
+		for seq := range seqs {
+			event, err := h.outbox.EventBySeq(ctx, tenantID, seq)
+			if err != nil {
+				log.Error("Error reading event from the outbox", "seq", seq, "error", err)
+				continue
+			}
+			h.broadcast(l, *event)
+			last = max(last, seq)
+		}
+	}
+}
+
+// catchUp broadcasts the events following last and returns the last one sent
+func (h *Hub) catchUp(ctx context.Context, tenantID int, l *listener, last int64) (int64, error) {
+	for {
+		events, err := h.outbox.EventsAfter(ctx, tenantID, last, pageSize)
+		if err != nil {
+			return last, err
+		}
+		for _, event := range events {
+			h.broadcast(l, event)
+			last = event.Seq
+		}
+		if len(events) < pageSize {
+			return last, nil
+		}
+	}
+}
+
+// broadcast sends a post event to the streams of l, closing those that fell
+// behind
+func (h *Hub) broadcast(l *listener, event models.OutboxEvent) {
+	if !IsPostEvent(event.Type) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	feedEvent := models.FeedEvent{Seq: event.Seq, Event: event.Event}
+	for s := range l.streams {
+		select {
+		case s.events <- feedEvent:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// Replay sends the tenant's post events following seq, for clients resuming
+// a stream, and returns the sequence numbers sent. Events are only kept in the
+// outbox for its retention.
+func (h *Hub) Replay(ctx context.Context, tenantID int, seq int64, send func(models.FeedEvent) error) (map[int64]bool, error) {
+	sent := make(map[int64]bool)
+	for {
+		events, err := h.outbox.EventsAfter(ctx, tenantID, seq, pageSize)
+		if err != nil {
+			return sent, err
+		}
+		for _, event := range events {
+			seq = event.Seq
+			if !IsPostEvent(event.Type) {
+				continue
+			}
+			if err := send(models.FeedEvent{Seq: event.Seq, Event: event.Event}); err != nil {
+				return sent, err
+			}
+			sent[event.Seq] = true
+		}
+		if len(events) < pageSize {
+			return sent, nil
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Package integration holds end-to-end tests that run the API against a real
+// PostgreSQL server. They are behind the integration build tag:
+//
+//	go test -tags=integration ./internal/integration/
+//
+// The server is started from the local postgres binaries by package pgtest and
+// the tests are skipped when none are installed.
+package integration
@@ -0,0 +1,1456 @@
+//go:build integration
+
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"golang-multi-tenant/internal/api"
+	"golang-multi-tenant/internal/backup"
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/billingtest"
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/database"
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/jobs"
+	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/pgtest"
+	"golang-multi-tenant/internal/ratelimit"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/storage"
+	"golang-multi-tenant/internal/transfer"
+	"golang-multi-tenant/internal/usage"
+	"golang-multi-tenant/internal/webhook"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// Cheap hashes keep the suite fast
+	models.InitPasswordHasher(config.PasswordConfig{HashAlgorithm: models.AlgorithmBcrypt, BcryptCost: bcrypt.MinCost})
+	models.RegisterValidators()
+
+	os.Exit(m.Run())
+}
+
+// env is the API served over HTTP on top of a fresh Postgres server
+type env struct {
+	cfg      *config.Config
+	registry *database.Registry
+	server   *httptest.Server
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+	return newEnvWithConfig(t, nil)
+}
+
+// newEnvWithConfig creates an environment after letting configure change the
+// test configuration
+func newEnvWithConfig(t *testing.T, configure func(cfg *config.Config)) *env {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.Database = pgtest.Start(t)
+	cfg.JWT.SecretKey = "test-secret-key"
+	cfg.Admin.APIKey = "test-admin-key"
+	cfg.Storage.Dir = t.TempDir()
+	if configure != nil {
+		configure(cfg)
+	}
+
+	registry, err := database.Open(cfg.Database)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	server := httptest.NewServer(api.NewServer(cfg, registry.Repositories()).Router())
+	t.Cleanup(func() {
+		server.Close()
+		registry.Close()
+	})
+
+	return &env{cfg: cfg, registry: registry, server: server}
+}
+
+// request sends a request and decodes the JSON response into out, if not nil.
+// headers are given as name, value pairs. It is safe for concurrent use.
+func (e *env) request(method, path string, body, out interface{}, headers ...string) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, e.server.URL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := e.server.Client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// mustRequest is request failing t unless the response has the want status
+func (e *env) mustRequest(t *testing.T, want int, method, path string, body, out interface{}, headers ...string) {
+	t.Helper()
+
+	code, err := e.request(method, path, body, out, headers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != want {
+		t.Fatalf("%s %s: status = %d, want %d", method, path, code, want)
+	}
+}
+
+func (e *env) createTenant(t *testing.T, name, slug string) models.Tenant {
+	t.Helper()
+
+	var tenant models.Tenant
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/tenants", gin.H{"name": name, "slug": slug}, &tenant)
+	return tenant
+}
+
+func (e *env) register(t *testing.T, slug, email string) string {
+	t.Helper()
+
+	var resp struct{ Token string }
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/register",
+		gin.H{"email": email, "password": "password123"}, &resp, middleware.TenantHeader, slug)
+	return resp.Token
+}
+
+func (e *env) tenantDB(t *testing.T, tenantID int) *sql.DB {
+	t.Helper()
+
+	db, err := e.registry.TenantDB(context.Background(), tenantID)
+	if err != nil {
+		t.Fatalf("opening database of tenant %d: %v", tenantID, err)
+	}
+	return db
+}
+
+func count(t *testing.T, db *sql.DB, query string, args ...interface{}) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func bearer(token string) string {
+	return "Bearer " + token
+}
+
+func TestTenantIsolation(t *testing.T) {
+	e := newEnv(t)
+
+	slugs := []string{"acme", "globex", "initech"}
+	tenants := map[string]models.Tenant{}
+	tokens := map[string]string{}
+	for _, slug := range slugs {
+		tenants[slug] = e.createTenant(t, slug, slug)
+		tokens[slug] = e.register(t, slug, "owner@"+slug+".com")
+		for i := 0; i < 2; i++ {
+			body := gin.H{"title": fmt.Sprintf("%s post %d", slug, i), "content": "Only for " + slug}
+			e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", body, nil, "Authorization", bearer(tokens[slug]))
+		}
+	}
+
+	t.Run("each tenant has its own database", func(t *testing.T) {
+		var dbNames []string
+		rows, err := e.registry.MainDB().Query("SELECT db_name FROM tenants ORDER BY id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				t.Fatal(err)
+			}
+			dbNames = append(dbNames, name)
+		}
+		want := []string{"tenant_acme", "tenant_globex", "tenant_initech"}
+		if fmt.Sprint(dbNames) != fmt.Sprint(want) {
+			t.Errorf("databases = %v, want %v", dbNames, want)
+		}
+
+		for _, slug := range slugs {
+			db := e.tenantDB(t, tenants[slug].ID)
+			if n := count(t, db, "SELECT count(*) FROM users"); n != 1 {
+				t.Errorf("%s has %d users, want 1", slug, n)
+			}
+			if n := count(t, db, "SELECT count(*) FROM posts WHERE title NOT LIKE $1", slug+" %"); n != 0 {
+				t.Errorf("%s holds %d posts of other tenants", slug, n)
+			}
+		}
+	})
+
+	t.Run("posts are only listed in their tenant", func(t *testing.T) {
+		for _, slug := range slugs {
+			var posts []models.Post
+			e.mustRequest(t, http.StatusOK, http.MethodGet, "/posts", nil, &posts, "Authorization", bearer(tokens[slug]))
+			if len(posts) != 2 {
+				t.Errorf("%s lists %d posts, want 2", slug, len(posts))
+			}
+			for _, post := range posts {
+				if post.Content != "Only for "+slug {
+					t.Errorf("%s lists post %q", slug, post.Title)
+				}
+			}
+		}
+	})
+
+	t.Run("tokens are rejected by other tenants", func(t *testing.T) {
+		code, err := e.request(http.MethodGet, "/posts", nil, nil,
+			middleware.TenantHeader, "globex", "Authorization", bearer(tokens["acme"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("credentials are scoped to their tenant", func(t *testing.T) {
+		body := gin.H{"email": "owner@acme.com", "password": "password123"}
+		code, err := e.request(http.MethodPost, "/login", body, nil, middleware.TenantHeader, "globex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want %d", code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestMigrations(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	tenant := e.createTenant(t, "Acme", "acme")
+
+	t.Run("databases are at the latest version", func(t *testing.T) {
+		version, err := database.SchemaVersion(ctx, e.registry.MainDB())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != database.ManagementSchemaVersion() {
+			t.Errorf("management version = %d, want %d", version, database.ManagementSchemaVersion())
+		}
+
+		version, err = database.SchemaVersion(ctx, e.tenantDB(t, tenant.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != database.TenantSchemaVersion() {
+			t.Errorf("tenant version = %d, want %d", version, database.TenantSchemaVersion())
+		}
+	})
+
+	t.Run("health reports the schema version", func(t *testing.T) {
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/readyz", nil, nil)
+
+		var health models.TenantHealth
+		e.mustRequest(t, http.StatusOK, http.MethodGet, fmt.Sprintf("/admin/tenants/%d/health", tenant.ID), nil, &health,
+			middleware.AdminKeyHeader, "test-admin-key")
+		if health.SchemaVersion != database.TenantSchemaVersion() || health.SchemaVersion != health.LatestSchemaVersion {
+			t.Errorf("schema version = %d of %d, want %d", health.SchemaVersion, health.LatestSchemaVersion, database.TenantSchemaVersion())
+		}
+		if health.DatabaseSizeBytes == 0 || health.Pool.OpenConnections == 0 {
+			t.Errorf("health = %+v, want the database size and open connections", health)
+		}
+		if _, ok := health.RowCounts["users"]; !ok {
+			t.Errorf("row counts = %v, want the users table", health.RowCounts)
+		}
+	})
+
+	t.Run("reopening is idempotent", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			registry, err := database.Open(e.cfg.Database)
+			if err != nil {
+				t.Fatalf("reopening: %v", err)
+			}
+			db, err := registry.TenantDB(ctx, tenant.ID)
+			if err != nil {
+				t.Fatalf("reopening tenant database: %v", err)
+			}
+			if n := count(t, db, "SELECT count(*) FROM schema_migrations"); n != database.TenantSchemaVersion() {
+				t.Errorf("tenant has %d recorded migrations, want %d", n, database.TenantSchemaVersion())
+			}
+			if n := count(t, registry.MainDB(), "SELECT count(*) FROM schema_migrations"); n != database.ManagementSchemaVersion() {
+				t.Errorf("management has %d recorded migrations, want %d", n, database.ManagementSchemaVersion())
+			}
+			registry.Close()
+		}
+	})
+
+	t.Run("legacy tenant databases are upgraded", func(t *testing.T) {
+		// A tenant created before versioned migrations, with the original schema
+		if _, err := e.registry.MainDB().Exec("CREATE DATABASE tenant_legacy"); err != nil {
+			t.Fatal(err)
+		}
+		legacy, err := sql.Open("postgres", e.cfg.Database.DSN("tenant_legacy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer legacy.Close()
+
+		hash, err := models.HashPassword(ctx, "password123")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = legacy.Exec(`
+			CREATE TABLE users (
+				id SERIAL PRIMARY KEY,
+				email VARCHAR(255) NOT NULL UNIQUE,
+				password VARCHAR(255) NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE posts (
+				id SERIAL PRIMARY KEY,
+				user_id INT NOT NULL REFERENCES users(id),
+				title VARCHAR(255) NOT NULL,
+				content TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			INSERT INTO users (email, password) VALUES ('first@legacy.com', $1), ('second@legacy.com', $1);
+			INSERT INTO posts (user_id, title, content) VALUES (1, 'Old post', 'Written before roles')`,
+			hash,
+		)
+		if err != nil {
+			t.Fatalf("creating legacy schema: %v", err)
+		}
+		_, err = e.registry.MainDB().Exec(
+			"INSERT INTO tenants (name, slug, db_name) VALUES ('Legacy', 'legacy', 'tenant_legacy')",
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Logging in opens and migrates the database; the oldest user is the admin
+		var resp struct{ Token string }
+		e.mustRequest(t, http.StatusOK, http.MethodPost, "/login",
+			gin.H{"email": "first@legacy.com", "password": "password123"}, &resp, middleware.TenantHeader, "legacy")
+
+		var users []models.User
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/users", nil, &users,
+			middleware.TenantHeader, "legacy", "Authorization", bearer(resp.Token))
+		if len(users) != 2 {
+			t.Errorf("legacy tenant lists %d users, want 2", len(users))
+		}
+
+		var posts []models.Post
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/posts", nil, &posts,
+			middleware.TenantHeader, "legacy", "Authorization", bearer(resp.Token))
+		if len(posts) != 1 || posts[0].Title != "Old post" {
+			t.Errorf("legacy posts = %+v, want the old post", posts)
+		}
+
+		version, err := database.SchemaVersion(ctx, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != database.TenantSchemaVersion() {
+			t.Errorf("legacy version = %d, want %d", version, database.TenantSchemaVersion())
+		}
+		if n := count(t, legacy, "SELECT count(*) FROM users WHERE role = $1", models.RoleAdmin); n != 1 {
+			t.Errorf("legacy tenant has %d admins, want 1", n)
+		}
+	})
+}
+
+func TestConcurrency(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+
+	t.Run("tenants are provisioned concurrently", func(t *testing.T) {
+		const n = 8
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				slug := fmt.Sprintf("tenant%d", i)
+				code, err := e.request(http.MethodPost, "/tenants", gin.H{"name": slug, "slug": slug}, nil)
+				if err == nil && code != http.StatusCreated {
+					err = fmt.Errorf("creating %s: status %d", slug, code)
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		if got := count(t, e.registry.MainDB(), "SELECT count(*) FROM tenants"); got != n {
+			t.Errorf("%d tenants registered, want %d", got, n)
+		}
+	})
+
+	t.Run("concurrent registrations create one admin", func(t *testing.T) {
+		tenant := e.createTenant(t, "Rush", "rush")
+
+		const n = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := gin.H{"email": fmt.Sprintf("user%d@rush.com", i), "password": "password123"}
+				code, err := e.request(http.MethodPost, "/register", body, nil, middleware.TenantHeader, "rush")
+				if err == nil && code != http.StatusCreated {
+					err = fmt.Errorf("registering user %d: status %d", i, code)
+				}
+				errs <- err
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		db := e.tenantDB(t, tenant.ID)
+		if got := count(t, db, "SELECT count(*) FROM users"); got != n {
+			t.Errorf("%d users registered, want %d", got, n)
+		}
+		if got := count(t, db, "SELECT count(*) FROM users WHERE role = $1", models.RoleAdmin); got != 1 {
+			t.Errorf("%d admins, want 1", got)
+		}
+	})
+
+	t.Run("concurrent demotions keep an admin", func(t *testing.T) {
+		tenant := e.createTenant(t, "Demote", "demote")
+		tokens := []string{e.register(t, "demote", "first@demote.com"), e.register(t, "demote", "second@demote.com")}
+		e.mustRequest(t, http.StatusOK, http.MethodPatch, "/users/2", gin.H{"role": models.RoleAdmin}, nil,
+			"Authorization", bearer(tokens[0]))
+
+		// Each admin demotes the other, only one of them may succeed
+		codes := make([]int, 2)
+		errs := make([]error, 2)
+		var wg sync.WaitGroup
+		for i := range tokens {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				path := fmt.Sprintf("/users/%d", 2-i)
+				codes[i], errs[i] = e.request(http.MethodPatch, path, gin.H{"role": models.RoleMember}, nil,
+					"Authorization", bearer(tokens[i]))
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := count(t, e.tenantDB(t, tenant.ID), "SELECT count(*) FROM users WHERE role = $1 AND active", models.RoleAdmin); got != 1 {
+			t.Errorf("%d active admins after concurrent demotions (statuses %v), want 1", got, codes)
+		}
+	})
+
+	t.Run("tenant pools are shared", func(t *testing.T) {
+		tenant := e.createTenant(t, "Pool", "pool")
+
+		// A fresh registry has no pools open yet, so every caller races to open it
+		registry, err := database.Open(e.cfg.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer registry.Close()
+
+		const n = 20
+		pools := make([]*sql.DB, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				pools[i], errs[i] = registry.TenantDB(ctx, tenant.ID)
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range pools {
+			if errs[i] != nil {
+				t.Fatalf("opening tenant database: %v", errs[i])
+			}
+			if pools[i] != pools[0] {
+				t.Fatalf("caller %d got a different pool", i)
+			}
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	e := newEnv(t)
+	tenant := e.createTenant(t, "Acme", "acme")
+	token := e.register(t, "acme", "alice@acme.com")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil, admin...)
+
+	t.Run("events are chained in the tenant database", func(t *testing.T) {
+		var events []models.AuditEvent
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/audit", nil, &events, admin...)
+		if len(events) != 2 || events[0].Action != "post.create" || events[1].Action != "user.register" {
+			t.Fatalf("events = %+v, want the post and the registration", events)
+		}
+		if events[0].PrevHash != events[1].Hash {
+			t.Errorf("post event links to %s, want %s", events[0].PrevHash, events[1].Hash)
+		}
+
+		var result models.AuditVerification
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/audit/verify", nil, &result, admin...)
+		if !result.Valid || result.Events != 2 {
+			t.Errorf("verification = %+v, want a valid log of 2 events", result)
+		}
+	})
+
+	t.Run("platform events are kept in the management database", func(t *testing.T) {
+		if n := count(t, e.registry.MainDB(), "SELECT COUNT(*) FROM audit_events WHERE action = 'tenant.create' AND tenant_id = $1", tenant.ID); n != 1 {
+			t.Errorf("%d tenant creation events, want 1", n)
+		}
+	})
+
+	t.Run("events can't be changed or deleted", func(t *testing.T) {
+		db := e.tenantDB(t, tenant.ID)
+		for _, query := range []string{
+			"UPDATE audit_events SET actor_email = 'mallory@acme.com'",
+			"DELETE FROM audit_events",
+		} {
+			if _, err := db.Exec(query); err == nil {
+				t.Errorf("%s: succeeded, want the append-only trigger to reject it", query)
+			}
+		}
+	})
+
+	t.Run("tampering is detected", func(t *testing.T) {
+		db := e.tenantDB(t, tenant.ID)
+		// Only the table owner can bypass the trigger
+		_, err := db.Exec(`
+            ALTER TABLE audit_events DISABLE TRIGGER USER;
+            UPDATE audit_events SET actor_email = 'mallory@acme.com' WHERE action = 'user.register';
+            ALTER TABLE audit_events ENABLE TRIGGER USER;`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result models.AuditVerification
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/audit/verify", nil, &result, admin...)
+		if result.Valid || result.BrokenAt == nil || *result.BrokenAt != 1 {
+			t.Errorf("verification = %+v, want broken at event 1", result)
+		}
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	limit := ratelimit.Limit{PerSecond: 1.0 / 60, Burst: 3}
+
+	t.Run("replicas share buckets", func(t *testing.T) {
+		replicas := []*ratelimit.PostgresStore{
+			ratelimit.NewPostgresStore(e.registry.MainDB()),
+			ratelimit.NewPostgresStore(e.registry.MainDB()),
+		}
+
+		var allowed []bool
+		for i := 0; i < 4; i++ {
+			result, err := replicas[i%2].Take(ctx, "tenant:1", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed = append(allowed, result.Allowed)
+		}
+		if fmt.Sprint(allowed) != "[true true true false]" {
+			t.Errorf("allowed = %v, want the fourth request denied", allowed)
+		}
+	})
+
+	t.Run("concurrent requests take one token each", func(t *testing.T) {
+		store := ratelimit.NewPostgresStore(e.registry.MainDB())
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		granted := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := store.Take(ctx, "tenant:2", limit)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if result.Allowed {
+					mu.Lock()
+					granted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if granted != limit.Burst {
+			t.Errorf("%d requests allowed, want %d", granted, limit.Burst)
+		}
+	})
+}
+
+func TestQuotas(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	tenant := e.createTenant(t, "Acme", "acme")
+
+	e.mustRequest(t, http.StatusOK, http.MethodPut, "/admin/plans/tiny", gin.H{"max_users": 1, "max_posts": 1}, nil, platform...)
+	e.mustRequest(t, http.StatusOK, http.MethodPut, fmt.Sprintf("/admin/tenants/%d/plan", tenant.ID), gin.H{"plan": "tiny"}, nil, platform...)
+	token := e.register(t, "acme", "alice@acme.com")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+
+	t.Run("plans are enforced", func(t *testing.T) {
+		e.mustRequest(t, http.StatusForbidden, http.MethodPost, "/register",
+			gin.H{"email": "bob@acme.com", "password": "password123"}, nil, middleware.TenantHeader, "acme")
+
+		post := gin.H{"title": "Hello", "content": "World"}
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", post, nil, admin...)
+		e.mustRequest(t, http.StatusForbidden, http.MethodPost, "/posts", post, nil, admin...)
+	})
+
+	t.Run("plans in use can't be deleted", func(t *testing.T) {
+		if _, err := e.registry.MainDB().Exec("DELETE FROM plans WHERE name = 'tiny'"); err == nil {
+			t.Error("deleting the plan succeeded, want the tenants foreign key to reject it")
+		}
+	})
+
+	t.Run("replicas add up their requests", func(t *testing.T) {
+		repos := e.registry.Repositories()
+		replicas := []*usage.Meter{usage.NewMeter(repos.Usage, repos.Plans), usage.NewMeter(repos.Usage, repos.Plans)}
+		handler := func(m *usage.Meter) *gin.Engine {
+			r := gin.New()
+			r.Use(func(c *gin.Context) { c.Set("tenant", &tenant) }, m.Middleware())
+			r.GET("/", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+			return r
+		}
+		for i, m := range replicas {
+			for j := 0; j <= i; j++ {
+				handler(m).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		}
+		for _, m := range replicas {
+			m.Flush(ctx)
+		}
+
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		daily, err := repos.Usage.DailyUsage(ctx, tenant.ID, day, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(daily) != 1 || daily[0].Requests != 3 || daily[0].Users != 1 || daily[0].Posts != 1 || daily[0].StorageBytes == 0 {
+			t.Fatalf("daily usage = %+v, want 3 requests, 1 user, 1 post and the database size", daily)
+		}
+		if n := replicas[1].RequestsToday(tenant.ID); n != 3 {
+			t.Errorf("last replica to flush counts %d requests, want 3", n)
+		}
+	})
+}
+
+func TestBilling(t *testing.T) {
+	stripe := billingtest.NewStripe(t)
+	const secret = "whsec_test"
+	e := newEnvWithConfig(t, func(cfg *config.Config) {
+		cfg.Billing.Provider = "stripe"
+		cfg.Billing.APIURL = stripe.URL
+		cfg.Billing.SecretKey = "sk_test"
+		cfg.Billing.WebhookSecret = secret
+		cfg.Billing.Prices = map[string]string{"pro": "price_pro"}
+	})
+	ctx := context.Background()
+	repos := e.registry.Repositories()
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+
+	tenant := e.createTenant(t, "Acme", "acme")
+	token := e.register(t, "acme", "alice@acme.com")
+	auth := []string{middleware.TenantHeader, "acme", "Authorization", bearer(token)}
+	e.mustRequest(t, http.StatusOK, http.MethodPut, "/admin/plans/pro", gin.H{}, nil, platform...)
+	e.mustRequest(t, http.StatusOK, http.MethodPut, fmt.Sprintf("/admin/tenants/%d/plan", tenant.ID), gin.H{"plan": "pro"}, nil, platform...)
+
+	sub, err := repos.Billing.TenantBilling(ctx, tenant.ID)
+	if err != nil || sub.Status != models.SubscriptionActive || sub.SubscriptionItemID == "" {
+		t.Fatalf("billing = %+v, %v, want an active subscription", sub, err)
+	}
+
+	// webhook delivers a signed event about the tenant's subscription; it is
+	// called from several goroutines, so failures don't stop the test
+	webhook := func(id, eventType string) {
+		t.Helper()
+		payload, header := billingtest.Event(secret, id, eventType, map[string]interface{}{
+			"customer":     sub.CustomerID,
+			"subscription": sub.SubscriptionID,
+		})
+		req, _ := http.NewRequest(http.MethodPost, e.server.URL+"/billing/webhook", bytes.NewReader(payload))
+		req.Header.Set(billing.SignatureHeader, header)
+		resp, err := e.server.Client().Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("webhook %s: status = %d, want %d", id, resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	t.Run("payments suspend and resume the tenant", func(t *testing.T) {
+		webhook("evt_failed", "invoice.payment_failed")
+		e.mustRequest(t, http.StatusPaymentRequired, http.MethodGet, "/me", nil, nil, auth...)
+		if n := count(t, e.registry.MainDB(), "SELECT COUNT(*) FROM tenants WHERE id = $1 AND suspended_at IS NOT NULL", tenant.ID); n != 1 {
+			t.Errorf("tenant isn't marked suspended")
+		}
+
+		webhook("evt_paid", "invoice.paid")
+		webhook("evt_failed", "invoice.payment_failed")
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/me", nil, nil, auth...)
+	})
+
+	t.Run("concurrent redeliveries apply once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				webhook("evt_failed_again", "invoice.payment_failed")
+			}()
+		}
+		wg.Wait()
+
+		if n := count(t, e.registry.MainDB(), "SELECT COUNT(*) FROM billing_events WHERE id = 'evt_failed_again'"); n != 1 {
+			t.Errorf("event recorded %d times, want once", n)
+		}
+		var events []models.AuditEvent
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/admin/audit?action=tenant.suspend", nil, &events, platform...)
+		if len(events) != 2 {
+			t.Errorf("%d suspension events, want 2", len(events))
+		}
+
+		webhook("evt_paid_again", "invoice.paid")
+	})
+
+	t.Run("metered requests are reported once", func(t *testing.T) {
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		if _, err := repos.Usage.AddRequests(ctx, tenant.ID, day, 7); err != nil {
+			t.Fatal(err)
+		}
+
+		service := billing.NewService(billing.NewStripe(e.cfg.Billing), repos.Billing)
+		for i := 0; i < 2; i++ {
+			if err := service.ReportUsage(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := stripe.Usage(sub.SubscriptionItemID); got != 7 {
+			t.Errorf("reported usage = %d, want 7", got)
+		}
+		if n := count(t, e.registry.MainDB(), "SELECT billed_requests FROM tenant_usage_daily WHERE tenant_id = $1", tenant.ID); n != 7 {
+			t.Errorf("billed requests = %d, want 7", n)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	e := newEnvWithConfig(t, func(cfg *config.Config) { cfg.Webhooks.AllowPrivateTargets = true })
+	ctx := context.Background()
+	repos := e.registry.Repositories()
+	tenant := e.createTenant(t, "Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "alice@acme.com"))}
+	db := e.tenantDB(t, tenant.ID)
+	bus := events.NewBus()
+	webhook.NewDispatcher(e.cfg.Webhooks, e.registry, repos.Webhooks).Subscribe(bus)
+	relay := events.NewRelay(e.registry, repos.Outbox, bus, time.Hour)
+	// Publish alice's registration before the webhook exists
+	if err := relay.Relay(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	status := http.StatusOK
+	received := map[string]int{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[r.Header.Get(webhook.EventIDHeader)]++
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	var hook models.Webhook
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/webhooks", gin.H{
+		"url":         receiver.URL,
+		"event_types": []string{models.EventPostCreated, models.EventUserRegistered},
+	}, &hook, admin...)
+
+	t.Run("events are appended with the change and queued once relayed", func(t *testing.T) {
+		e.register(t, "acme", "bob@acme.com")
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil, admin...)
+
+		var invitation models.Invitation
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/invitations", gin.H{"email": "carol@acme.com"}, &invitation, admin...)
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/invitations/"+invitation.Token+"/accept",
+			gin.H{"password": "password123"}, nil, middleware.TenantHeader, "acme")
+
+		// A registration that fails appends nothing
+		e.mustRequest(t, http.StatusConflict, http.MethodPost, "/register",
+			gin.H{"email": "bob@acme.com", "password": "password123"}, nil, middleware.TenantHeader, "acme")
+
+		if n := count(t, db, "SELECT COUNT(*) FROM outbox_events WHERE published_at IS NULL"); n != 3 {
+			t.Errorf("%d unpublished events, want 3", n)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries"); n != 0 {
+			t.Errorf("%d deliveries before relaying, want 0", n)
+		}
+
+		if err := relay.Relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM outbox_events WHERE published_at IS NULL"); n != 0 {
+			t.Errorf("%d unpublished events after relaying, want 0", n)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'pending'"); n != 3 {
+			t.Errorf("%d pending deliveries, want 3", n)
+		}
+
+		// Events published again aren't queued twice
+		if _, err := db.Exec("UPDATE outbox_events SET published_at = NULL, next_attempt_at = CURRENT_TIMESTAMP"); err != nil {
+			t.Fatal(err)
+		}
+		if err := relay.Relay(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries"); n != 3 {
+			t.Errorf("%d deliveries after publishing again, want 3", n)
+		}
+	})
+
+	t.Run("replicas deliver each event once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := webhook.NewDispatcher(e.cfg.Webhooks, e.registry, repos.Webhooks).Dispatch(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(received) != 3 {
+			t.Errorf("%d events received, want 3", len(received))
+		}
+		for id, n := range received {
+			if n != 1 {
+				t.Errorf("event %s received %d times", id, n)
+			}
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'delivered' AND delivered_at IS NOT NULL"); n != 3 {
+			t.Errorf("%d deliveries marked delivered, want 3", n)
+		}
+	})
+
+	t.Run("failures are retried after the backoff", func(t *testing.T) {
+		mu.Lock()
+		status = http.StatusServiceUnavailable
+		mu.Unlock()
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Again", "content": "World"}, nil, admin...)
+		relay.Relay(ctx)
+
+		dispatcher := webhook.NewDispatcher(e.cfg.Webhooks, e.registry, repos.Webhooks)
+		dispatcher.Dispatch(ctx)
+		dispatcher.Dispatch(ctx)
+		var attempts, lastStatus int
+		var retryIn float64
+		err := db.QueryRow(`
+			SELECT attempts, last_status_code, EXTRACT(EPOCH FROM next_attempt_at - CURRENT_TIMESTAMP)
+			FROM webhook_deliveries WHERE status = 'pending'`,
+		).Scan(&attempts, &lastStatus, &retryIn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 1 || lastStatus != http.StatusServiceUnavailable || retryIn < 1 {
+			t.Errorf("attempts = %d, last status = %d, retry in %.0fs, want 1 attempt answered 503 and a retry later", attempts, lastStatus, retryIn)
+		}
+
+		mu.Lock()
+		status = http.StatusOK
+		mu.Unlock()
+		if _, err := db.Exec("UPDATE webhook_deliveries SET next_attempt_at = CURRENT_TIMESTAMP WHERE status = 'pending'"); err != nil {
+			t.Fatal(err)
+		}
+		dispatcher.Dispatch(ctx)
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'delivered' AND attempts = 2"); n != 1 {
+			t.Errorf("%d deliveries delivered on the second attempt, want 1", n)
+		}
+	})
+
+	t.Run("deleting a webhook deletes its deliveries", func(t *testing.T) {
+		e.mustRequest(t, http.StatusNoContent, http.MethodDelete, fmt.Sprintf("/webhooks/%d", hook.ID), nil, nil, admin...)
+		if n := count(t, db, "SELECT COUNT(*) FROM webhook_deliveries"); n != 0 {
+			t.Errorf("%d deliveries left, want 0", n)
+		}
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	repos := e.registry.Repositories()
+	tenant := e.createTenant(t, "Acme", "acme")
+	token := e.register(t, "acme", "alice@acme.com")
+	db := e.tenantDB(t, tenant.ID)
+	for i := 0; i < 5; i++ {
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil,
+			middleware.TenantHeader, "acme", "Authorization", bearer(token))
+	}
+
+	var mu sync.Mutex
+	published := map[string]int{}
+	bus := events.NewBus()
+	bus.Subscribe("test", func(ctx context.Context, event models.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published[event.ID]++
+		return nil
+	})
+
+	t.Run("replicas publish each event once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := events.NewRelay(e.registry, repos.Outbox, bus, time.Hour).Relay(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(published) != 6 {
+			t.Errorf("%d events published, want 6", len(published))
+		}
+		for id, n := range published {
+			if n != 1 {
+				t.Errorf("event %s published %d times", id, n)
+			}
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM outbox_events WHERE published_at IS NULL"); n != 0 {
+			t.Errorf("%d unpublished events, want 0", n)
+		}
+	})
+
+	t.Run("published events are pruned after the retention", func(t *testing.T) {
+		if _, err := db.Exec("UPDATE outbox_events SET published_at = published_at - INTERVAL '2 hours' WHERE id <= 2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := events.NewRelay(e.registry, repos.Outbox, bus, time.Hour).Prune(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM outbox_events"); n != 4 {
+			t.Errorf("%d events left, want 4", n)
+		}
+	})
+}
+
+// readSSE reads the next event of a Server-Sent Events stream, skipping
+// comments, as its ID and type
+func readSSE(t *testing.T, r *bufio.Reader) (id, eventType string) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" && id != "" {
+			return id, eventType
+		}
+		if field, value, ok := strings.Cut(line, ": "); ok {
+			switch field {
+			case "id":
+				id = value
+			case "event":
+				eventType = value
+			}
+		}
+	}
+}
+
+func TestPostFeed(t *testing.T) {
+	e := newEnv(t)
+	e.createTenant(t, "Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "alice@acme.com"))}
+	member := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "bob@acme.com"))}
+
+	// A second replica sharing the databases
+	replica := httptest.NewServer(api.NewServer(e.cfg, e.registry.Repositories()).Router())
+	t.Cleanup(replica.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	openStream := func(t *testing.T, server *httptest.Server, lastEventID string) *bufio.Reader {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/posts/stream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(admin[0], admin[1])
+		req.Header.Set(admin[2], admin[3])
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+	expect := func(t *testing.T, r *bufio.Reader, types ...string) []string {
+		t.Helper()
+		var ids []string
+		for _, want := range types {
+			id, eventType := readSSE(t, r)
+			if eventType != want {
+				t.Fatalf("event %s is %s, want %s", id, eventType, want)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	stream := openStream(t, replica, "")
+
+	var post models.Post
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, &post, admin...)
+	path := fmt.Sprintf("/posts/%d", post.ID)
+	e.mustRequest(t, http.StatusOK, http.MethodPut, path, gin.H{"title": "Hello", "content": "Edited"}, nil, admin...)
+	e.mustRequest(t, http.StatusNoContent, http.MethodDelete, path, nil, nil, admin...)
+	ids := expect(t, stream, models.EventPostCreated, models.EventPostUpdated, models.EventPostDeleted)
+
+	t.Run("resumes after Last-Event-ID", func(t *testing.T) {
+		resumed := openStream(t, e.server, ids[0])
+		if replayed := expect(t, resumed, models.EventPostUpdated, models.EventPostDeleted); !slices.Equal(replayed, ids[1:]) {
+			t.Errorf("replayed %v, want %v", replayed, ids[1:])
+		}
+	})
+
+	t.Run("deleting a user deletes their posts", func(t *testing.T) {
+		var bob models.Post
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Bob's", "content": "World"}, &bob, member...)
+		e.mustRequest(t, http.StatusNoContent, http.MethodDelete, fmt.Sprintf("/users/%d?hard=true", bob.UserID), nil, nil, admin...)
+		expect(t, stream, models.EventPostCreated, models.EventPostDeleted)
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	repos := e.registry.Repositories()
+	acme := e.createTenant(t, "Acme", "acme")
+	admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "alice@acme.com"))}
+	member := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "bob@acme.com"))}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	for i := 0; i < 3; i++ {
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil, member...)
+	}
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/invitations", gin.H{"email": "carol@acme.com"}, nil, admin...)
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/webhooks",
+		gin.H{"url": "https://hooks.example.com/acme", "event_types": []string{models.EventPostCreated}}, nil, admin...)
+
+	// The replicas' runners share the server's storage directory
+	archives := storage.NewLocal(e.cfg.Storage.Dir)
+	newRunner := func() *jobs.Runner {
+		runner := jobs.NewRunner(repos.Jobs, archives, time.Hour)
+		transfer.NewService(repos, archives, billing.NewService(billing.NewProvider(e.cfg.Billing), repos.Billing)).Register(runner)
+		return runner
+	}
+	// runReplicas runs the due jobs on several replicas at once
+	runReplicas := func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := newRunner().RunPending(ctx); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	var export models.Job
+	e.mustRequest(t, http.StatusAccepted, http.MethodPost, fmt.Sprintf("/tenants/%d/export", acme.ID), nil, &export, admin...)
+	runReplicas(t)
+	exportPath := fmt.Sprintf("/tenants/%d/exports/%d", acme.ID, export.ID)
+	e.mustRequest(t, http.StatusOK, http.MethodGet, exportPath, nil, &export, admin...)
+	if export.Status != models.JobCompleted || export.Attempts != 1 {
+		t.Fatalf("export = %+v, want completed after 1 attempt", export)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, e.server.URL+exportPath+"/archive", nil)
+	req.Header.Set(middleware.TenantHeader, "acme")
+	req.Header.Set("Authorization", admin[3])
+	resp, err := e.server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: status %d, %v", resp.StatusCode, err)
+	}
+
+	_, data, err := transfer.Read(bytes.NewReader(archive), database.TenantSchemaVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Users) != 2 || len(data.Posts) != 3 || len(data.Invitations) != 1 || len(data.Webhooks) != 1 {
+		t.Fatalf("exported %d users, %d posts, %d invitations, %d webhooks, want 2, 3, 1, 1",
+			len(data.Users), len(data.Posts), len(data.Invitations), len(data.Webhooks))
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("name", "Acme Copy")
+	part, _ := mw.CreateFormFile("archive", "export.tar.gz")
+	part.Write(archive)
+	mw.Close()
+	req, _ = http.NewRequest(http.MethodPost, e.server.URL+"/admin/tenants/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set(middleware.AdminKeyHeader, "test-admin-key")
+	resp, err = e.server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported models.Job
+	json.NewDecoder(resp.Body).Decode(&imported)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("import: status %d", resp.StatusCode)
+	}
+	runReplicas(t)
+	e.mustRequest(t, http.StatusOK, http.MethodGet, fmt.Sprintf("/admin/tenants/imports/%d", imported.ID), nil, &imported, platform...)
+	if imported.Status != models.JobCompleted || imported.Attempts != 1 || imported.TenantID == 0 {
+		t.Fatalf("import = %+v, want completed after 1 attempt with a tenant", imported)
+	}
+
+	t.Run("references are remapped", func(t *testing.T) {
+		db := e.tenantDB(t, imported.TenantID)
+		if n := count(t, db, "SELECT COUNT(*) FROM posts p JOIN users u ON u.id = p.user_id WHERE u.email = 'bob@acme.com'"); n != 3 {
+			t.Errorf("%d posts of bob, want 3", n)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM invitations i JOIN users u ON u.id = i.invited_by WHERE u.email = 'alice@acme.com'"); n != 1 {
+			t.Errorf("%d invitations by alice, want 1", n)
+		}
+		if n := count(t, db, "SELECT COUNT(*) FROM webhooks"); n != 1 {
+			t.Errorf("%d webhooks, want 1", n)
+		}
+	})
+
+	t.Run("users log in and keep writing", func(t *testing.T) {
+		var login struct{ Token string }
+		e.mustRequest(t, http.StatusOK, http.MethodPost, "/login", gin.H{"email": "bob@acme.com", "password": "password123"}, &login,
+			middleware.TenantHeader, "acme-copy")
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Again", "content": "World"}, nil,
+			middleware.TenantHeader, "acme-copy", "Authorization", bearer(login.Token))
+		e.register(t, "acme-copy", "dave@acme.com")
+	})
+
+	t.Run("data is only imported into empty tenants", func(t *testing.T) {
+		err := repos.TenantData.ImportTenantData(ctx, imported.TenantID, data)
+		if !errors.Is(err, repository.ErrConflict) {
+			t.Errorf("error = %v, want %v", err, repository.ErrConflict)
+		}
+	})
+}
+
+func TestSnapshots(t *testing.T) {
+	for _, method := range []string{models.SnapshotLogical, models.SnapshotPGDump} {
+		t.Run(method, func(t *testing.T) {
+			e := newEnvWithConfig(t, func(cfg *config.Config) { cfg.Backup.Method = method })
+			ctx := context.Background()
+			repos := e.registry.Repositories()
+			acme := e.createTenant(t, "Acme", "acme")
+			admin := []string{middleware.TenantHeader, "acme", "Authorization", bearer(e.register(t, "acme", "alice@acme.com"))}
+			platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+			for i := 0; i < 3; i++ {
+				e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Hello", "content": "World"}, nil, admin...)
+			}
+			e.mustRequest(t, http.StatusCreated, http.MethodPost, "/webhooks",
+				gin.H{"url": "https://hooks.example.com/acme", "event_types": []string{models.EventPostCreated}}, nil, admin...)
+
+			// The jobs run on a replica sharing the server's storage directory
+			archives := storage.NewLocal(e.cfg.Storage.Dir)
+			runner := jobs.NewRunner(repos.Jobs, archives, time.Hour)
+			billingService := billing.NewService(billing.NewProvider(e.cfg.Billing), repos.Billing)
+			backup.NewService(e.cfg.Backup, repos, archives, billingService).Register(runner)
+			run := func(t *testing.T, job *models.Job) {
+				t.Helper()
+				if err := runner.RunPending(ctx); err != nil {
+					t.Fatal(err)
+				}
+				e.mustRequest(t, http.StatusOK, http.MethodGet, fmt.Sprintf("/admin/jobs/%d", job.ID), nil, job, platform...)
+				if job.Status != models.JobCompleted {
+					t.Fatalf("job = %+v, want completed", job)
+				}
+			}
+
+			var job models.Job
+			snapshotsPath := fmt.Sprintf("/admin/tenants/%d/snapshots", acme.ID)
+			e.mustRequest(t, http.StatusAccepted, http.MethodPost, snapshotsPath, gin.H{"label": "Three posts"}, &job, platform...)
+			run(t, &job)
+			var snapshots []models.Snapshot
+			e.mustRequest(t, http.StatusOK, http.MethodGet, snapshotsPath, nil, &snapshots, platform...)
+			if len(snapshots) != 1 || snapshots[0].Method != method || snapshots[0].SchemaVersion != database.TenantSchemaVersion() || snapshots[0].Size == 0 {
+				t.Fatalf("snapshots = %+v, want a %s snapshot", snapshots, method)
+			}
+			restorePath := fmt.Sprintf("%s/%d/restore", snapshotsPath, snapshots[0].ID)
+
+			// Changes made after the snapshot are undone by restoring it
+			e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Later", "content": "World"}, nil, admin...)
+			var restore models.Job
+			e.mustRequest(t, http.StatusAccepted, http.MethodPost, restorePath, gin.H{"target": "existing"}, &restore, platform...)
+			run(t, &restore)
+
+			db := e.tenantDB(t, acme.ID)
+			if n := count(t, db, "SELECT COUNT(*) FROM posts"); n != 3 {
+				t.Errorf("%d posts, want the snapshot's 3", n)
+			}
+			if n := count(t, db, "SELECT COUNT(*) FROM webhooks"); n != 1 {
+				t.Errorf("%d webhooks, want 1", n)
+			}
+			if n := count(t, e.registry.MainDB(), "SELECT COUNT(*) FROM memberships WHERE tenant_id = $1", acme.ID); n != 0 {
+				t.Errorf("%d memberships, want them removed", n)
+			}
+			if n := count(t, e.registry.MainDB(), "SELECT COUNT(*) FROM pg_database WHERE datname LIKE $1", "tenant_acme%"); n != 0 {
+				t.Errorf("%d databases left of the replaced one, want 0", n)
+			}
+
+			var login struct{ Token string }
+			e.mustRequest(t, http.StatusOK, http.MethodPost, "/login", gin.H{"email": "alice@acme.com", "password": "password123"}, &login,
+				middleware.TenantHeader, "acme")
+			restored := []string{middleware.TenantHeader, "acme", "Authorization", bearer(login.Token)}
+			e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Again", "content": "World"}, nil, restored...)
+			var verification models.AuditVerification
+			e.mustRequest(t, http.StatusOK, http.MethodGet, "/audit/verify", nil, &verification, restored...)
+			if !verification.Valid {
+				t.Errorf("verification = %+v, want the restored audit log valid", verification)
+			}
+
+			t.Run("restore into a new tenant", func(t *testing.T) {
+				var job models.Job
+				e.mustRequest(t, http.StatusAccepted, http.MethodPost, restorePath, gin.H{"target": "new", "name": "Acme Restored"}, &job, platform...)
+				run(t, &job)
+				if job.TenantID == 0 || job.TenantID == acme.ID {
+					t.Fatalf("job = %+v, want a new tenant", job)
+				}
+				if n := count(t, e.tenantDB(t, job.TenantID), "SELECT COUNT(*) FROM posts"); n != 3 {
+					t.Errorf("%d posts, want the snapshot's 3", n)
+				}
+				e.mustRequest(t, http.StatusOK, http.MethodPost, "/login", gin.H{"email": "alice@acme.com", "password": "password123"}, nil,
+					middleware.TenantHeader, "acme-restored")
+				e.register(t, "acme-restored", "bob@acme.com")
+			})
+		})
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	e := newEnv(t)
+	ctx := context.Background()
+	demo := e.createTenant(t, "Demo", "demo")
+	author := []string{middleware.TenantHeader, "demo", "Authorization", bearer(e.register(t, "demo", "author@demo.com"))}
+	for i := 0; i < 2; i++ {
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Welcome", "content": "Sample content"}, nil, author...)
+	}
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/invitations", gin.H{"email": "carol@demo.com"}, nil, author...)
+	e.mustRequest(t, http.StatusCreated, http.MethodPost, "/webhooks",
+		gin.H{"url": "https://hooks.example.com/demo", "event_types": []string{models.EventPostCreated}}, nil, author...)
+	settings := &models.TenantSettings{RegistrationMode: models.RegistrationDomainRestricted, AllowedEmailDomains: []string{"acme.com"}}
+	if err := e.registry.UpdateTenantSettings(ctx, demo.ID, settings); err != nil {
+		t.Fatal(err)
+	}
+	platform := []string{middleware.AdminKeyHeader, "test-admin-key"}
+	e.mustRequest(t, http.StatusOK, http.MethodPut, fmt.Sprintf("/admin/tenants/%d/template", demo.ID), gin.H{"is_template": true}, nil, platform...)
+
+	// check creates a tenant from the template and checks what it starts with
+	check := func(t *testing.T, name, slug string) {
+		var tenant models.Tenant
+		body := gin.H{"name": name, "slug": slug, "template_id": demo.ID, "copy_settings": true, "seed_data": true}
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/tenants", body, &tenant, platform...)
+
+		db := e.tenantDB(t, tenant.ID)
+		for query, want := range map[string]int{
+			"SELECT COUNT(*) FROM posts":                                2,
+			"SELECT COUNT(*) FROM users WHERE active OR password <> ''": 0,
+			"SELECT COUNT(*) FROM users":                                1,
+			"SELECT COUNT(*) FROM users WHERE email LIKE '%@demo.com'":  0,
+			"SELECT COUNT(*) FROM invitations":                          0,
+			"SELECT COUNT(*) FROM webhooks":                             0,
+			"SELECT COUNT(*) FROM audit_events":                         0,
+			"SELECT COUNT(*) FROM outbox_events":                        0,
+		} {
+			if n := count(t, db, query); n != want {
+				t.Errorf("%s = %d, want %d", query, n, want)
+			}
+		}
+		copied, err := e.registry.TenantSettings(ctx, tenant.ID)
+		if err != nil || copied.RegistrationMode != models.RegistrationDomainRestricted || !slices.Equal(copied.AllowedEmailDomains, []string{"acme.com"}) {
+			t.Errorf("settings = %+v, %v, want the template's", copied, err)
+		}
+
+		// The copied settings keep alice inactive until she verifies her
+		// email, which activates her as done here
+		if token := e.register(t, slug, "alice@acme.com"); token != "" {
+			t.Errorf("registering in a domain-restricted tenant returned a token")
+		}
+		if _, err := db.Exec("UPDATE users SET active = TRUE WHERE email = 'alice@acme.com'"); err != nil {
+			t.Fatal(err)
+		}
+		var login struct{ Token string }
+		e.mustRequest(t, http.StatusOK, http.MethodPost, "/login", gin.H{"email": "alice@acme.com", "password": "password123"}, &login,
+			middleware.TenantHeader, slug)
+		admin := []string{middleware.TenantHeader, slug, "Authorization", bearer(login.Token)}
+		var me models.User
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/me", nil, &me, admin...)
+		if me.Role != models.RoleAdmin {
+			t.Errorf("role of the first user = %q, want %q", me.Role, models.RoleAdmin)
+		}
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "Ours", "content": "Acme"}, nil, admin...)
+		var verification models.AuditVerification
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/audit/verify", nil, &verification, admin...)
+		if !verification.Valid || verification.Events != 3 {
+			t.Errorf("verification = %+v, want a valid log of the new tenant's 3 events", verification)
+		}
+	}
+
+	t.Run("rows are copied", func(t *testing.T) {
+		check(t, "Acme", "acme")
+	})
+
+	t.Run("rows are copied while another session uses the template", func(t *testing.T) {
+		var dbName string
+		if err := e.registry.MainDB().QueryRow("SELECT db_name FROM tenants WHERE id = $1", demo.ID).Scan(&dbName); err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open("postgres", e.cfg.Database.DSN(dbName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		check(t, "Acme Two", "acme-two")
+	})
+
+	t.Run("database is copied while nobody uses the template", func(t *testing.T) {
+		// Nothing connects to a template that was never used
+		blank := e.createTenant(t, "Blank", "blank")
+		e.mustRequest(t, http.StatusOK, http.MethodPut, fmt.Sprintf("/admin/tenants/%d/template", blank.ID), gin.H{"is_template": true}, nil, platform...)
+		var tenant models.Tenant
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/tenants", gin.H{"name": "Initech", "template_id": blank.ID, "seed_data": true}, &tenant, platform...)
+
+		admin := []string{middleware.TenantHeader, "initech", "Authorization", bearer(e.register(t, "initech", "peter@initech.com"))}
+		var me models.User
+		e.mustRequest(t, http.StatusOK, http.MethodGet, "/me", nil, &me, admin...)
+		if me.Role != models.RoleAdmin {
+			t.Errorf("role of the first user = %q, want %q", me.Role, models.RoleAdmin)
+		}
+	})
+
+	t.Run("settings and seed data are opt-in", func(t *testing.T) {
+		var tenant models.Tenant
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/tenants", gin.H{"name": "Globex", "template_id": demo.ID}, &tenant, platform...)
+		db := e.tenantDB(t, tenant.ID)
+		if n := count(t, db, "SELECT COUNT(*) FROM users") + count(t, db, "SELECT COUNT(*) FROM posts"); n != 0 {
+			t.Errorf("%d users and posts, want an empty tenant", n)
+		}
+		settings, err := e.registry.TenantSettings(ctx, tenant.ID)
+		if err != nil || settings.RegistrationMode != models.RegistrationOpen {
+			t.Errorf("settings = %+v, %v, want the defaults", settings, err)
+		}
+	})
+
+	t.Run("template is unchanged", func(t *testing.T) {
+		db := e.tenantDB(t, demo.ID)
+		if n := count(t, db, "SELECT COUNT(*) FROM users WHERE active"); n != 1 {
+			t.Errorf("%d active template users, want 1", n)
+		}
+		e.mustRequest(t, http.StatusCreated, http.MethodPost, "/posts", gin.H{"title": "More", "content": "Samples"}, nil, author...)
+	})
+}
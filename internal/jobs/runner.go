@@ -0,0 +1,210 @@
+// Package jobs runs long operations on tenants, such as exports and imports,
+// in the background. Jobs are stored in the management database, so that any
+// replica can run them and clients can poll them for their outcome.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/storage"
+)
+
+const (
+	// lease postpones the next attempt at a claimed job, so that other
+	// replicas skip it. It is renewed while the job runs, a job is only
+	// claimed again once the replica running it stopped.
+	lease = 5 * time.Minute
+	// maxAttempts bounds how often a job is started again after its replica
+	// stopped, so that a job crashing replicas doesn't keep doing so
+	maxAttempts = 3
+	// pruneInterval is how often finished jobs past their retention are deleted
+	pruneInterval = time.Hour
+	// maxErrorLength bounds the error recorded for a job
+	maxErrorLength = 1000
+)
+
+// Handler runs a job of a type. The error fails the job; its message is only
+// shown to clients if made by Fail.
+type Handler func(ctx context.Context, job *models.Job) error
+
+// failure is an error whose message tells the client why their job failed
+type failure struct {
+	message string
+}
+
+func (f *failure) Error() string {
+	return f.message
+}
+
+// Fail returns an error failing a job with a message for its client
+func Fail(format string, args ...interface{}) error {
+	return &failure{message: fmt.Sprintf(format, args...)}
+}
+
+// Runner claims the due jobs and runs them with the handler of their type
+type Runner struct {
+	repo      repository.JobRepository
+	archives  storage.Storage
+	retention time.Duration
+	handlers  map[string]Handler
+	// wake starts the next run early when a job is enqueued
+	wake chan struct{}
+}
+
+// NewRunner creates a runner keeping finished jobs and their archives for
+// retention
+func NewRunner(repo repository.JobRepository, archives storage.Storage, retention time.Duration) *Runner {
+	return &Runner{
+		repo:      repo,
+		archives:  archives,
+		retention: retention,
+		handlers:  make(map[string]Handler),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Handle sets the handler of a job type. It must be called before the runner runs.
+func (r *Runner) Handle(jobType string, handler Handler) {
+	r.handlers[jobType] = handler
+}
+
+// Enqueue stores a pending job and wakes the runner of this replica
+func (r *Runner) Enqueue(ctx context.Context, job *models.Job) error {
+	if err := r.repo.CreateJob(ctx, job); err != nil {
+		return err
+	}
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RunPending runs the due jobs one at a time until none is left
+func (r *Runner) RunPending(ctx context.Context) error {
+	for ctx.Err() == nil {
+		job, err := r.repo.ClaimJob(ctx, lease)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		r.run(ctx, job)
+	}
+	return ctx.Err()
+}
+
+// run runs a claimed job, renewing its lease meanwhile, and records the outcome
+func (r *Runner) run(ctx context.Context, job *models.Job) {
+	log := logging.FromContext(ctx).With("job_id", job.ID, "job_type", job.Type, "tenant_id", job.TenantID)
+
+	var err error
+	handler, ok := r.handlers[job.Type]
+	switch {
+	case !ok:
+		err = Fail("Unknown job type %q", job.Type)
+	case job.Attempts > maxAttempts:
+		err = Fail("Job was interrupted %d times", job.Attempts-1)
+	default:
+		log.Info("Job started", "attempt", job.Attempts)
+		err = r.runHandler(ctx, handler, job)
+		if ctx.Err() != nil {
+			// Shutting down; another replica takes over once the lease runs out
+			log.Info("Job interrupted")
+			return
+		}
+	}
+
+	status, message := models.JobCompleted, ""
+	if err != nil {
+		log.Error("Job failed", "error", err)
+		status, message = models.JobFailed, "Internal error"
+		var f *failure
+		if errors.As(err, &f) {
+			message = f.message
+		}
+		if len(message) > maxErrorLength {
+			message = message[:maxErrorLength]
+		}
+	} else {
+		log.Info("Job completed")
+	}
+	if err := r.repo.FinishJob(ctx, job.ID, status, message); err != nil {
+		log.Error("Error recording the outcome of a job", "error", err)
+	}
+}
+
+// runHandler calls handler, extending the job's lease until it returns
+func (r *Runner) runHandler(ctx context.Context, handler Handler, job *models.Job) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.repo.ExtendJob(ctx, job.ID, lease); err != nil {
+					logging.FromContext(ctx).Warn("Error extending the lease of a job", "job_id", job.ID, "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return handler(ctx, job)
+}
+
+// Prune deletes the jobs finished longer than the retention ago and their
+// archives
+func (r *Runner) Prune(ctx context.Context) error {
+	jobs, err := r.repo.DeleteFinishedJobs(ctx, r.retention)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		if job.Archive == "" {
+			continue
+		}
+		if err := r.archives.Delete(ctx, job.Archive); err != nil {
+			logging.FromContext(ctx).Error("Error deleting the archive of a job", "job_id", job.ID, "archive", job.Archive, "error", err)
+		}
+	}
+	return nil
+}
+
+// Run runs the due jobs every interval, or as soon as one is enqueued on this
+// replica, and prunes finished ones every hour, until ctx is cancelled
+func (r *Runner) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		case <-pruneTicker.C:
+			if err := r.Prune(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error pruning finished jobs", "error", err)
+			}
+			continue
+		case <-ctx.Done():
+			return
+		}
+
+		if err := r.RunPending(ctx); err != nil && ctx.Err() == nil {
+			logging.FromContext(ctx).Error("Error claiming jobs", "error", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Package logging configures the structured logger and carries request scoped
+// loggers through contexts
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// Output formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Redacted replaces the values of sensitive attributes
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are redacted wherever they appear in an attribute key
+var sensitiveKeys = []string{"password", "secret", "token", "authorization", "cookie", "api_key", "admin-key"}
+
+type loggerKey struct{}
+
+// Setup makes the configured logger the default for slog and the log package
+func Setup(cfg config.LoggingConfig) error {
+	handler, err := NewHandler(os.Stdout, cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// NewHandler creates a handler writing to w in the configured format and level,
+// redacting sensitive attributes
+func NewHandler(w io.Writer, cfg config.LoggingConfig) (slog.Handler, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch cfg.Format {
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	case FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, Redacted)
+		}
+	}
+	return a
+}
+
+// FromContext returns the request scoped logger stored in ctx, or the default logger
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// NewContext returns a copy of ctx carrying logger
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// With adds attributes to the logger of the request, for the handlers and
+// middleware that run after the caller
+func With(c *gin.Context, args ...any) {
+	ctx := c.Request.Context()
+	c.Request = c.Request.WithContext(NewContext(ctx, FromContext(ctx).With(args...)))
+}
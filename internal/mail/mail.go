@@ -0,0 +1,60 @@
+package mail
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// Sender delivers plain-text emails
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// NewSender creates the sender for the mail configuration. Without an SMTP
+// host emails are written to the log instead of being sent.
+func NewSender(cfg config.MailConfig) Sender {
+	if cfg.SMTPHost == "" {
+		slog.Warn("SMTP host not configured, emails will be logged instead of sent")
+		return LogSender{}
+	}
+
+	sender := &SMTPSender{
+		Addr: net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+		From: cfg.From,
+	}
+	if cfg.SMTPUsername != "" {
+		sender.Auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return sender
+}
+
+// SMTPSender sends emails through an SMTP server
+type SMTPSender struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Send sends the email through the SMTP server
+func (s *SMTPSender) Send(to, subject, body string) error {
+	msg := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		s.From, to, subject, strings.ReplaceAll(body, "\n", "\r\n"),
+	)
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{to}, []byte(msg))
+}
+
+// LogSender writes emails to the log, for development
+type LogSender struct{}
+
+// Send logs the email
+func (LogSender) Send(to, subject, body string) error {
+	slog.Info("Email", "to", to, "subject", subject, "body", body)
+	return nil
+}
@@ -0,0 +1,198 @@
+// Package metrics collects the Prometheus metrics of the API
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"golang-multi-tenant/internal/models"
+)
+
+const namespace = "multitenant"
+
+// OtherLabel replaces tenant label values beyond the cardinality limit
+const OtherLabel = "other"
+
+// Reasons JWT validation fails in AuthMiddleware
+const (
+	JWTMissing        = "missing"
+	JWTInvalid        = "invalid"
+	JWTTenantMismatch = "tenant_mismatch"
+	JWTUserInactive   = "user_inactive"
+)
+
+// PoolStatsSource reports the statistics of the open database pools by database name
+type PoolStatsSource interface {
+	PoolStats() map[string]models.PoolStats
+}
+
+// Metrics holds the collectors of one API server in their own registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests         *prometheus.CounterVec
+	httpDuration         *prometheus.HistogramVec
+	tenantRequests       *prometheus.CounterVec
+	provisioningDuration prometheus.Histogram
+	provisioningFailures prometheus.Counter
+	logins               *prometheus.CounterVec
+	jwtErrors            *prometheus.CounterVec
+	rateLimited          *prometheus.CounterVec
+
+	tenantLabels *labelGuard
+}
+
+// New creates the collectors. At most maxTenantLabels tenants get their own
+// label value, later ones are counted as "other".
+func New(pools PoolStatsSource, maxTenantLabels int) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route and status.",
+		}, []string{"method", "route", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by method and route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		tenantRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tenant_requests_total",
+			Help:      "HTTP requests by tenant slug.",
+		}, []string{"tenant"}),
+		provisioningDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "tenant_provisioning_duration_seconds",
+			Help:      "Time taken to create a tenant and its database.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}),
+		provisioningFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tenant_provisioning_failures_total",
+			Help:      "Tenants that could not be created.",
+		}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "logins_total",
+			Help:      "Login attempts by result.",
+		}, []string{"result"}),
+		jwtErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jwt_validation_errors_total",
+			Help:      "Requests rejected by the authentication middleware by reason.",
+		}, []string{"reason"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_requests_total",
+			Help:      "Requests rejected by the rate limiter by scope.",
+		}, []string{"scope"}),
+		tenantLabels: newLabelGuard(maxTenantLabels),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.tenantRequests,
+		m.provisioningDuration,
+		m.provisioningFailures,
+		m.logins,
+		m.jwtErrors,
+		m.rateLimited,
+		newPoolCollector(pools, newLabelGuard(maxTenantLabels)),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware records the count and latency of requests, and the tenant they
+// were resolved to
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Unmatched paths would give every scanner probe its own series
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		m.httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		m.httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+
+		if value, ok := c.Get("tenant"); ok {
+			if tenant, ok := value.(*models.Tenant); ok {
+				m.tenantRequests.WithLabelValues(m.tenantLabels.label(tenant.Slug)).Inc()
+			}
+		}
+	}
+}
+
+// TenantProvisioned records a tenant creation attempt that took d
+func (m *Metrics) TenantProvisioned(d time.Duration, err error) {
+	m.provisioningDuration.Observe(d.Seconds())
+	if err != nil {
+		m.provisioningFailures.Inc()
+	}
+}
+
+// Login records a login attempt
+func (m *Metrics) Login(success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.logins.WithLabelValues(result).Inc()
+}
+
+// JWTError records a request rejected by the authentication middleware
+func (m *Metrics) JWTError(reason string) {
+	m.jwtErrors.WithLabelValues(reason).Inc()
+}
+
+// RateLimited records a request rejected by the rate limiter
+func (m *Metrics) RateLimited(scope string) {
+	m.rateLimited.WithLabelValues(scope).Inc()
+}
+
+// labelGuard bounds the number of distinct values of a label
+type labelGuard struct {
+	mu    sync.Mutex
+	max   int
+	known map[string]bool
+}
+
+func newLabelGuard(max int) *labelGuard {
+	return &labelGuard{max: max, known: make(map[string]bool)}
+}
+
+// label returns value if it has been seen before or there is room for it,
+// and OtherLabel otherwise
+func (g *labelGuard) label(value string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.known[value] {
+		return value
+	}
+	if len(g.known) >= g.max {
+		return OtherLabel
+	}
+	g.known[value] = true
+	return value
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// poolCollector reports the statistics of the database pools at scrape time
+type poolCollector struct {
+	pools  PoolStatsSource
+	labels *labelGuard
+
+	open         *prometheus.Desc
+	inUse        *prometheus.Desc
+	idle         *prometheus.Desc
+	waitCount    *prometheus.Desc
+	waitDuration *prometheus.Desc
+}
+
+func newPoolCollector(pools PoolStatsSource, labels *labelGuard) *poolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, []string{"database"}, nil)
+	}
+	return &poolCollector{
+		pools:        pools,
+		labels:       labels,
+		open:         desc("open_connections", "Open connections of the database pool."),
+		inUse:        desc("in_use_connections", "Connections of the database pool in use."),
+		idle:         desc("idle_connections", "Idle connections of the database pool."),
+		waitCount:    desc("wait_count_total", "Connections waited for."),
+		waitDuration: desc("wait_duration_seconds_total", "Time spent waiting for connections."),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- p.open
+	ch <- p.inUse
+	ch <- p.idle
+	ch <- p.waitCount
+	ch <- p.waitDuration
+}
+
+// Collect implements prometheus.Collector. Pools beyond the label limit are
+// summed up as "other".
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	totals := make(map[string]models.PoolStats)
+	for database, stats := range p.pools.PoolStats() {
+		label := p.labels.label(database)
+		total := totals[label]
+		total.OpenConnections += stats.OpenConnections
+		total.InUse += stats.InUse
+		total.Idle += stats.Idle
+		total.WaitCount += stats.WaitCount
+		total.WaitDurationMillis += stats.WaitDurationMillis
+		totals[label] = total
+	}
+
+	for label, stats := range totals {
+		ch <- prometheus.MustNewConstMetric(p.open, prometheus.GaugeValue, float64(stats.OpenConnections), label)
+		ch <- prometheus.MustNewConstMetric(p.inUse, prometheus.GaugeValue, float64(stats.InUse), label)
+		ch <- prometheus.MustNewConstMetric(p.idle, prometheus.GaugeValue, float64(stats.Idle), label)
+		ch <- prometheus.MustNewConstMetric(p.waitCount, prometheus.CounterValue, float64(stats.WaitCount), label)
+		ch <- prometheus.MustNewConstMetric(p.waitDuration, prometheus.CounterValue, float64(stats.WaitDurationMillis)/1000, label)
+	}
+}
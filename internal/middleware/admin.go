@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminKeyHeader carries the platform admin API key
+const AdminKeyHeader = "X-Admin-Key"
+
+// RequireAdminKey restricts platform administration routes to requests with
+// the admin API key. The routes are disabled when no key is configured.
+func RequireAdminKey(key string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin API is disabled"})
+			c.Abort()
+			return
+		}
+
+		if !HasAdminKey(c, key) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin key"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// HasAdminKey reports whether the request carries the admin API key, for
+// routes that allow more to platform admins. It is false when no key is
+// configured.
+func HasAdminKey(c *gin.Context, key string) bool {
+	return key != "" && subtle.ConstantTimeCompare([]byte(c.GetHeader(AdminKeyHeader)), []byte(key)) == 1
+}
@@ -1,13 +1,19 @@
 package middleware
 
 import (
+	"database/sql"
+	"errors"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/metrics"
+	"golang-multi-tenant/internal/repository"
 )
 
 // Claims represents the JWT claims structure
@@ -18,28 +24,58 @@ type Claims struct {
     jwt.RegisteredClaims
 }
 
+// TokenService issues and verifies JWT tokens
+type TokenService struct {
+    // secret signs and verifies tokens
+    secret []byte
+    // ttl is how long issued tokens are valid
+    ttl time.Duration
+}
+
+// NewTokenService creates a token service from the JWT configuration
+func NewTokenService(cfg config.JWTConfig) *TokenService {
+    return &TokenService{
+        secret: []byte(cfg.SecretKey),
+        ttl:    time.Duration(cfg.ExpirationHours) * time.Hour,
+    }
+}
+
 // GenerateToken generates a new JWT token
-func GenerateToken(userID, tenantID int, email string) (string, error) {
+func (s *TokenService) GenerateToken(userID, tenantID int, email string) (string, error) {
     // Create claims with multiple fields
     claims := &Claims{
         UserID:   userID,
         TenantID: tenantID,
         Email:    email,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
+            ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.ttl)),
             IssuedAt:  jwt.NewNumericDate(time.Now()),
         },
     }
 
     token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+    return token.SignedString(s.secret)
+}
+
+// ParseToken verifies a token and returns its claims
+func (s *TokenService) ParseToken(tokenString string) (*Claims, error) {
+    claims := &Claims{}
+    _, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+        return s.secret, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return claims, nil
 }
 
-// AuthMiddleware verifies the JWT token in the Authorization header
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware verifies the JWT token in the Authorization header and loads
+// the user's current role. Rejected requests are counted in m by reason.
+func AuthMiddleware(tokens *TokenService, users repository.UserRepository, m *metrics.Metrics) gin.HandlerFunc {
     return func(c *gin.Context) {
         authHeader := c.GetHeader("Authorization")
         if authHeader == "" {
+            m.JWTError(metrics.JWTMissing)
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is required"})
             c.Abort()
             return
@@ -49,20 +85,31 @@ func AuthMiddleware() gin.HandlerFunc {
         tokenString := strings.TrimPrefix(authHeader, "Bearer ")
         tokenString = strings.TrimSpace(tokenString)
 
-        claims := &Claims{}
-
-        token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-            return []byte(os.Getenv("JWT_SECRET_KEY")), nil
-        })
-
+        claims, err := tokens.ParseToken(tokenString)
         if err != nil {
+            m.JWTError(metrics.JWTInvalid)
             c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
             c.Abort()
             return
         }
 
-        if !token.Valid {
-            c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+        // Reject tokens issued for a different tenant than the one addressed
+        if tenant, ok := ResolvedTenant(c); ok && tenant.ID != claims.TenantID {
+            m.JWTError(metrics.JWTTenantMismatch)
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "Token does not belong to this tenant"})
+            c.Abort()
+            return
+        }
+
+        // Load the current role and reject deactivated or deleted users
+        user, err := users.UserByID(c.Request.Context(), claims.TenantID, claims.UserID)
+        if errors.Is(err, sql.ErrNoRows) || (err == nil && !user.Active) {
+            m.JWTError(metrics.JWTUserInactive)
+            c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found or deactivated"})
+            c.Abort()
+            return
+        } else if err != nil {
+            c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
             c.Abort()
             return
         }
@@ -71,7 +118,44 @@ func AuthMiddleware() gin.HandlerFunc {
         c.Set("user_id", claims.UserID)
         c.Set("tenant_id", claims.TenantID)
         c.Set("email", claims.Email)
+        c.Set("role", user.Role)
+
+        // Add the user, and the tenant if it wasn't resolved before, to the logs
+        if _, resolved := ResolvedTenant(c); resolved {
+            logging.With(c, "user_id", claims.UserID)
+        } else {
+            logging.With(c, "tenant_id", claims.TenantID, "user_id", claims.UserID)
+        }
+
+        c.Next()
+    }
+}
+
+// RequireRole allows the request only if the authenticated user has one of the given roles.
+// It must run after AuthMiddleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        role := c.GetString("role")
+        for _, allowed := range roles {
+            if role == allowed {
+                c.Next()
+                return
+            }
+        }
+
+        c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+        c.Abort()
+    }
+}
 
+// QueryToken accepts the token in the access_token query parameter, for
+// clients like EventSource that can't send headers. The Authorization header
+// takes precedence; request logs leave out the query string.
+func QueryToken() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+            c.Request.Header.Set("Authorization", "Bearer "+token)
+        }
         c.Next()
     }
-} 
\ No newline at end of file
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/logging"
+)
+
+// RequestIDHeader carries the ID correlating the logs of a request
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID takes the request ID from the X-Request-ID header, or generates one
+// if it is missing or malformed, echoes it in the response and adds it to the
+// request's logger
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+
+		c.Set("request_id", id)
+		c.Header(RequestIDHeader, id)
+		logging.With(c, "request_id", id)
+
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs every request once it has been handled, with the fields
+// added to the request's logger by the middleware and handlers
+func AccessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("path", redactedPath(c)),
+			slog.String("route", c.FullPath()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+
+		ctx := c.Request.Context()
+		logging.FromContext(ctx).LogAttrs(ctx, level, "Request handled", attrs...)
+	}
+}
+
+// redactedPath returns the request path with secret path parameters, like
+// invitation tokens, replaced
+func redactedPath(c *gin.Context) string {
+	path := c.Request.URL.Path
+	for _, param := range c.Params {
+		if strings.Contains(param.Key, "token") && param.Value != "" {
+			path = strings.ReplaceAll(path, param.Value, logging.Redacted)
+		}
+	}
+	return path
+}
+
+// Recovery turns panics into 500 responses and logs them with their stack
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				logging.FromContext(c.Request.Context()).Error("Panic handling request",
+					"error", err,
+					"stack", string(debug.Stack()),
+				)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			}
+		}()
+		c.Next()
+	}
+}
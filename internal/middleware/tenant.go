@@ -0,0 +1,212 @@
+package middleware
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/tracing"
+)
+
+// Tenant resolution strategies
+const (
+	TenantStrategyDomain    = "domain"
+	TenantStrategySubdomain = "subdomain"
+	TenantStrategyHeader    = "header"
+	TenantStrategyPath      = "path"
+)
+
+// TenantHeader is the header carrying the tenant slug for the header strategy
+const TenantHeader = "X-Tenant"
+
+// TenantResolver resolves the tenant a request addresses
+type TenantResolver struct {
+	tenants repository.TenantStore
+	// strategies are tried in order until one yields a slug
+	strategies []string
+	// baseDomain is the domain tenant subdomains live under, e.g. example.com
+	baseDomain string
+}
+
+// NewTenantResolver creates a tenant resolver looking tenants up in the store
+func NewTenantResolver(cfg config.TenantConfig, tenants repository.TenantStore) *TenantResolver {
+	r := &TenantResolver{
+		tenants:    tenants,
+		strategies: make([]string, len(cfg.ResolutionStrategies)),
+		baseDomain: strings.ToLower(strings.TrimPrefix(cfg.BaseDomain, ".")),
+	}
+	for i, strategy := range cfg.ResolutionStrategies {
+		r.strategies[i] = strings.ToLower(strategy)
+	}
+	return r
+}
+
+// StrategyEnabled reports whether the given resolution strategy is configured
+func (r *TenantResolver) StrategyEnabled(strategy string) bool {
+	for _, s := range r.strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// BaseDomain returns the domain tenant subdomains live under
+func (r *TenantResolver) BaseDomain() string {
+	return r.baseDomain
+}
+
+// Middleware resolves the tenant from a verified custom domain, the host
+// subdomain, the X-Tenant header or the /t/:slug path prefix and stores it in
+// the context. Requests that don't identify a tenant pass through unchanged.
+func (r *TenantResolver) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, err := r.resolve(c)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+			c.Abort()
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			c.Abort()
+			return
+		}
+
+		if tenant != nil {
+			c.Set("tenant", tenant)
+			c.Set("tenant_id", tenant.ID)
+			logging.With(c, "tenant_id", tenant.ID)
+			trace.SpanFromContext(c.Request.Context()).SetAttributes(
+				tracing.TenantIDKey.Int(tenant.ID),
+				attribute.String("tenant.slug", tenant.Slug),
+			)
+		}
+
+		c.Next()
+	}
+}
+
+// ResolvedTenant returns the tenant resolved by TenantResolver.Middleware, if any
+func ResolvedTenant(c *gin.Context) (*models.Tenant, bool) {
+	value, exists := c.Get("tenant")
+	if !exists {
+		return nil, false
+	}
+	tenant, ok := value.(*models.Tenant)
+	return tenant, ok
+}
+
+// tokenTenantKey is the context key of the tenant of the token, stored by
+// RequireActiveTenant for authenticated requests that didn't resolve one
+const tokenTenantKey = "token_tenant"
+
+// RequestTenant returns the tenant the request acts in: the resolved tenant or,
+// once RequireActiveTenant has run, the tenant of the token
+func RequestTenant(c *gin.Context) (*models.Tenant, bool) {
+	if tenant, ok := ResolvedTenant(c); ok {
+		return tenant, true
+	}
+	value, exists := c.Get(tokenTenantKey)
+	if !exists {
+		return nil, false
+	}
+	tenant, ok := value.(*models.Tenant)
+	return tenant, ok
+}
+
+// RequireActiveTenant rejects the requests of tenants suspended for
+// non-payment. It checks the resolved tenant or, for authenticated requests
+// that didn't resolve one, the tenant of the token.
+func (r *TenantResolver) RequireActiveTenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, ok := ResolvedTenant(c)
+		if !ok {
+			tenantID, authenticated := c.Get("tenant_id")
+			if !authenticated {
+				c.Next()
+				return
+			}
+			var err error
+			if tenant, err = r.tenants.TenantByID(c.Request.Context(), tenantID.(int)); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				c.Abort()
+				return
+			}
+			c.Set(tokenTenantKey, tenant)
+		}
+
+		if tenant.SuspendedAt != nil {
+			c.JSON(http.StatusPaymentRequired, gin.H{"error": "Tenant is suspended for non-payment"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// resolve returns the tenant found by the first matching strategy, or nil if
+// no strategy identifies a tenant
+func (r *TenantResolver) resolve(c *gin.Context) (*models.Tenant, error) {
+	for _, strategy := range r.strategies {
+		var slug string
+		switch strategy {
+		case TenantStrategyDomain:
+			tenant, err := r.tenantByCustomDomain(c, c.Request.Host)
+			if err != sql.ErrNoRows {
+				return tenant, err
+			}
+		case TenantStrategyHeader:
+			slug = c.GetHeader(TenantHeader)
+		case TenantStrategySubdomain:
+			slug = r.subdomain(c.Request.Host)
+		case TenantStrategyPath:
+			slug = c.Param("slug")
+		}
+		if slug = strings.ToLower(strings.TrimSpace(slug)); slug != "" {
+			return r.tenants.TenantBySlug(c.Request.Context(), slug)
+		}
+	}
+	return nil, nil
+}
+
+// tenantByCustomDomain looks up the tenant mapped to host. Hosts under the
+// base domain are never custom domains and skip the lookup.
+func (r *TenantResolver) tenantByCustomDomain(c *gin.Context, host string) (*models.Tenant, error) {
+	host = hostname(host)
+	if host == "" || net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return nil, sql.ErrNoRows
+	}
+	if r.baseDomain != "" && (host == r.baseDomain || strings.HasSuffix(host, "."+r.baseDomain)) {
+		return nil, sql.ErrNoRows
+	}
+	return r.tenants.TenantByDomain(c.Request.Context(), host)
+}
+
+// hostname strips the port from a Host header and lower-cases it
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// subdomain extracts the tenant label from hosts like acme.example.com
+func (r *TenantResolver) subdomain(host string) string {
+	if r.baseDomain == "" {
+		return ""
+	}
+	label, found := strings.CutSuffix(hostname(host), "."+r.baseDomain)
+	if !found || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEvent records a change made through the API. Events form a hash chain:
+// each hash covers the event and the hash of the event before it.
+type AuditEvent struct {
+	ID         int64     `json:"id"`
+	OccurredAt time.Time `json:"occurred_at"`
+	// TenantID is the tenant the event concerns; platform events without a
+	// tenant have none
+	TenantID    *int            `json:"tenant_id,omitempty"`
+	ActorUserID *int            `json:"actor_user_id,omitempty"`
+	ActorEmail  string          `json:"actor_email,omitempty"`
+	Action      string          `json:"action"`
+	TargetType  string          `json:"target_type,omitempty"`
+	TargetID    string          `json:"target_id,omitempty"`
+	IP          string          `json:"ip"`
+	RequestID   string          `json:"request_id,omitempty"`
+	Status      int             `json:"status"`
+	Before      json.RawMessage `json:"before,omitempty" swaggertype:"object"`
+	After       json.RawMessage `json:"after,omitempty" swaggertype:"object"`
+	PrevHash    string          `json:"prev_hash"`
+	Hash        string          `json:"hash"`
+}
+
+// AuditFilter selects audit events. Zero values don't filter.
+type AuditFilter struct {
+	ActorUserID int
+	Action      string
+	TargetType  string
+	TargetID    string
+	From        time.Time
+	To          time.Time
+	// Limit of 0 returns every matching event
+	Limit  int
+	Offset int
+	// Ascending orders events oldest first, the order of the hash chain
+	Ascending bool
+}
+
+// AuditVerification is the result of checking an audit log's hash chain
+type AuditVerification struct {
+	Valid  bool `json:"valid"`
+	Events int  `json:"events"`
+	// BrokenAt is the first event whose hash doesn't match
+	BrokenAt *int64 `json:"broken_at,omitempty"`
+}
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Subscription states, following Stripe's subscription statuses. Tenants on
+// plans that aren't billed have no subscription.
+const (
+	SubscriptionNone              = "none"
+	SubscriptionActive            = "active"
+	SubscriptionTrialing          = "trialing"
+	SubscriptionIncomplete        = "incomplete"
+	SubscriptionIncompleteExpired = "incomplete_expired"
+	SubscriptionPastDue           = "past_due"
+	SubscriptionUnpaid            = "unpaid"
+	SubscriptionCanceled          = "canceled"
+)
+
+// SubscriptionSuspends reports whether tenants whose subscription is in a
+// state are suspended
+func SubscriptionSuspends(status string) bool {
+	switch status {
+	case SubscriptionPastDue, SubscriptionUnpaid, SubscriptionCanceled, SubscriptionIncompleteExpired:
+		return true
+	}
+	return false
+}
+
+// TenantBilling links a tenant to its customer and subscription at the
+// billing provider
+type TenantBilling struct {
+	TenantID           int    `json:"tenant_id"`
+	CustomerID         string `json:"customer_id"`
+	SubscriptionID     string `json:"subscription_id"`
+	SubscriptionItemID string `json:"subscription_item_id"`
+	Status             string `json:"status"`
+	// SuspendedAt is set while the tenant is suspended for non-payment
+	SuspendedAt *time.Time `json:"suspended_at"`
+	// Subscriptions counts the subscriptions created for the tenant,
+	// numbering the attempts to subscribe it
+	Subscriptions int `json:"subscriptions"`
+}
+
+// UnbilledUsage is a day of a subscribed tenant's requests with some not yet
+// reported to the billing provider
+type UnbilledUsage struct {
+	TenantID           int
+	SubscriptionItemID string
+	Day                time.Time
+	Requests           int64
+	// BilledRequests have been reported before
+	BilledRequests int64
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// TenantDomain represents a custom domain mapped to a tenant
+type TenantDomain struct {
+	ID                 int              `json:"id"`
+	TenantID           int              `json:"tenant_id"`
+	Domain             string           `json:"domain"`
+	VerificationMethod string           `json:"verification_method"`
+	VerificationToken  string           `json:"-"`
+	Verified           bool             `json:"verified"`
+	VerifiedAt         *time.Time       `json:"verified_at,omitempty"`
+	CreatedAt          time.Time        `json:"created_at"`
+	Challenge          *DomainChallenge `json:"challenge,omitempty"`
+}
+
+// DomainChallenge describes the record or resource proving domain ownership
+type DomainChallenge struct {
+	Type  string `json:"type" example:"TXT"`
+	Name  string `json:"name" example:"_mt-challenge.api.example.org"`
+	Value string `json:"value"`
+}
+
+// CreateDomainRequest represents the add domain request body
+type CreateDomainRequest struct {
+	Domain             string `json:"domain" binding:"required,fqdn" example:"api.example.org"`
+	VerificationMethod string `json:"verification_method" binding:"required,oneof=dns http" example:"dns"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event types. Webhooks can subscribe to each of them.
+const (
+	EventPostCreated    = "post.created"
+	EventPostUpdated    = "post.updated"
+	EventPostDeleted    = "post.deleted"
+	EventUserRegistered = "user.registered"
+)
+
+// Event is a domain event: something that happened in a tenant, published to
+// the subsystems reacting to it after the change is committed. Its ID stays
+// the same when it is published again.
+type Event struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	TenantID   int             `json:"tenant_id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Data       json.RawMessage `json:"data" swaggertype:"object"`
+}
+
+// OutboxEvent is an event waiting in a tenant's outbox to be published
+type OutboxEvent struct {
+	Event
+	// Seq orders the events of the tenant's outbox
+	Seq int64
+	// Attempts counts the failed attempts to publish the event
+	Attempts int
+}
+
+// FeedEvent is an event sent to the post feed streams. Seq orders the events
+// of a tenant; clients resume after the last one they received.
+type FeedEvent struct {
+	Seq int64 `json:"seq"`
+	Event
+}
@@ -0,0 +1,26 @@
+package models
+
+// TenantHealth describes the state of a tenant's database
+type TenantHealth struct {
+	TenantID            int   `json:"tenant_id"`
+	PingMillis          int64 `json:"ping_ms"`
+	SchemaVersion       int   `json:"schema_version"`
+	LatestSchemaVersion int   `json:"latest_schema_version"`
+	DatabaseSizeBytes   int64 `json:"database_size_bytes"`
+	// RowCounts are the estimated live rows of each table
+	RowCounts map[string]int64 `json:"row_counts"`
+	Pool      PoolStats        `json:"pool"`
+}
+
+// PoolStats are the statistics of a database connection pool
+type PoolStats struct {
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMillis int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
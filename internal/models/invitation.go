@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// Invitation represents an invitation to join a tenant
+type Invitation struct {
+	ID         int        `json:"id"`
+	Email      string     `json:"email"`
+	Role       string     `json:"role"`
+	InvitedBy  *int       `json:"invited_by,omitempty"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Token is only returned when the invitation is created
+	Token string `json:"token,omitempty"`
+}
+
+// CreateInvitationRequest represents the create invitation request body
+type CreateInvitationRequest struct {
+	Email          string `json:"email" binding:"required,email" example:"user@example.com"`
+	Role           string `json:"role" binding:"omitempty,oneof=admin member" example:"member"`
+	ExpiresInHours int    `json:"expires_in_hours" binding:"omitempty,min=1,max=720" example:"72"`
+}
+
+// AcceptInvitationRequest represents the accept invitation request body
+type AcceptInvitationRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// Registration modes
+const (
+	RegistrationOpen             = "open"
+	RegistrationInviteOnly       = "invite_only"
+	RegistrationDomainRestricted = "domain_restricted"
+)
+
+// TenantSettings represents the settings of a tenant
+type TenantSettings struct {
+	RegistrationMode    string   `json:"registration_mode" example:"open"`
+	AllowedEmailDomains []string `json:"allowed_email_domains" example:"acme.com"`
+}
+
+// UpdateTenantSettingsRequest represents the update tenant settings request body
+type UpdateTenantSettingsRequest struct {
+	RegistrationMode    *string  `json:"registration_mode" binding:"omitempty,oneof=open invite_only domain_restricted" example:"domain_restricted"`
+	AllowedEmailDomains []string `json:"allowed_email_domains" binding:"omitempty,dive,fqdn" example:"acme.com"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Job types
+const (
+	JobExport   = "tenant.export"
+	JobImport   = "tenant.import"
+	JobSnapshot = "tenant.snapshot"
+	JobRestore  = "tenant.restore"
+)
+
+// Job states. Running jobs whose replica stopped are started again.
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Job is a long operation on a tenant, run in the background by whichever
+// replica claims it first
+type Job struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+	// TenantID is the tenant the job operates on; imports and restores into
+	// a new tenant set it once they have created their tenant
+	TenantID int    `json:"tenant_id,omitempty"`
+	Status   string `json:"status"`
+	// Params holds the parameters of the job's type
+	Params json.RawMessage `json:"params,omitempty" swaggertype:"object"`
+	// Archive is the storage key of the archive the job reads or writes
+	Archive string `json:"-"`
+	// Error tells why the job failed
+	Error       string     `json:"error,omitempty"`
+	Attempts    int        `json:"attempts"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// ImportTenantRequest names the tenant an archive is imported into. The slug
+// is derived from the name if empty.
+type ImportTenantRequest struct {
+	Name string `form:"name" json:"name" binding:"required" example:"Example Company"`
+	Slug string `form:"slug" json:"slug,omitempty" binding:"omitempty,max=63,slug" example:"example-company"`
+}
@@ -0,0 +1,49 @@
+package models
+
+import "time"
+
+// Identity is a global account in the management database. Its password is
+// shared by the tenant users it is linked to through memberships, one per tenant.
+type Identity struct {
+	ID       int    `json:"id"`
+	Email    string `json:"email"`
+	Password string `json:"-"`
+}
+
+// TenantMembership represents a tenant a global identity belongs to
+type TenantMembership struct {
+	TenantID int    `json:"tenant_id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	UserID   int    `json:"user_id"`
+	Current  bool   `json:"current"`
+}
+
+// EmailVerification proves that a tenant user owns their email before the
+// user is linked to the identity with that email, or that a linked user owns
+// the email they change to
+type EmailVerification struct {
+	TenantID  int
+	UserID    int
+	Email     string
+	ExpiresAt time.Time
+	// Activate activates the user once verified, for users who registered in
+	// a domain-restricted tenant
+	Activate bool
+	// EmailChange changes the email of a user linked to an identity to Email
+	// once verified
+	EmailChange bool
+}
+
+// VerifyEmailRequest represents the verify email request body
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+	// Password is the password of the global account with the email, if
+	// there is one already
+	Password string `json:"password"`
+}
+
+// SwitchTenantRequest represents the switch tenant request body
+type SwitchTenantRequest struct {
+	Tenant string `json:"tenant" binding:"required,slug" example:"example-company"`
+}
@@ -0,0 +1,214 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// Supported password hashing algorithms
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+// ErrUnsupportedHash is returned when a stored hash was produced by an unknown algorithm
+var ErrUnsupportedHash = errors.New("unsupported password hash format")
+
+// PasswordHasher hashes and verifies passwords
+type PasswordHasher interface {
+	// Hash returns the encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash was produced with
+	// a different algorithm or different parameters than the hasher's
+	NeedsRehash(encoded string) bool
+}
+
+// BcryptHasher hashes passwords with bcrypt using the standard $2a$ encoding
+type BcryptHasher struct {
+	Cost int
+}
+
+// Argon2idHasher hashes passwords with argon2id using the PHC string format:
+// $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultHasher is the hasher used by HashPassword and CheckPassword
+var DefaultHasher PasswordHasher = NewArgon2idHasher()
+
+// NewBcryptHasher creates a bcrypt hasher with the default cost
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+// NewArgon2idHasher creates an argon2id hasher with the OWASP recommended parameters
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Memory:      19 * 1024,
+		Iterations:  2,
+		Parallelism: 1,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+// InitPasswordHasher configures DefaultHasher
+func InitPasswordHasher(cfg config.PasswordConfig) {
+	switch cfg.HashAlgorithm {
+	case AlgorithmArgon2id:
+		h := NewArgon2idHasher()
+		h.Memory = uint32(cfg.Argon2MemoryKiB)
+		h.Iterations = uint32(cfg.Argon2Iterations)
+		h.Parallelism = uint8(cfg.Argon2Parallelism)
+		DefaultHasher = h
+	case AlgorithmBcrypt:
+		DefaultHasher = &BcryptHasher{Cost: cfg.BcryptCost}
+	default:
+		log.Fatalf("Unsupported password hash algorithm: %s", cfg.HashAlgorithm)
+	}
+}
+
+// Hash hashes the password using bcrypt
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(bytes), err
+}
+
+// Verify checks a password against a bcrypt or argon2id hash
+func (h *BcryptHasher) Verify(password, encoded string) (bool, error) {
+	return verifyPassword(password, encoded)
+}
+
+// NeedsRehash reports whether the hash is not bcrypt at the configured cost
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcryptHash(encoded) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Hash hashes the password using argon2id
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks a password against a bcrypt or argon2id hash
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, error) {
+	return verifyPassword(password, encoded)
+}
+
+// NeedsRehash reports whether the hash is not argon2id with the configured parameters
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Memory != h.Memory ||
+		params.Iterations != h.Iterations ||
+		params.Parallelism != h.Parallelism ||
+		uint32(len(salt)) != h.SaltLength ||
+		uint32(len(key)) != h.KeyLength
+}
+
+// verifyPassword verifies a password against any supported hash format, so
+// that hashes produced before an algorithm change keep working
+func verifyPassword(password, encoded string) (bool, error) {
+	switch {
+	case isBcryptHash(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	default:
+		return false, ErrUnsupportedHash
+	}
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") ||
+		strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// minArgon2KeyLength is the shortest argon2id key accepted in stored hashes
+const minArgon2KeyLength = 16
+
+// decodeArgon2id parses a PHC formatted argon2id hash
+func decodeArgon2id(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id version: %v", err)
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("incompatible argon2id version: %d", version)
+	}
+
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	// Stored hashes may come from imported archives: parameters the
+	// configuration wouldn't allow could panic or exhaust memory on login
+	if params.Memory < 1 || params.Memory > config.MaxArgon2MemoryKiB ||
+		params.Iterations < 1 || params.Iterations > config.MaxArgon2Iterations ||
+		params.Parallelism < 1 || params.Parallelism > config.MaxArgon2Parallelism {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash: %v", err)
+	}
+	// An empty key would match every password
+	if len(key) < minArgon2KeyLength {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// PasswordPolicy describes the requirements a new password must satisfy
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	MinCharClasses int
+	// breached holds upper-case hex SHA-1 digests of known breached passwords
+	breached map[string]struct{}
+}
+
+// DefaultPasswordPolicy is the policy enforced on new passwords
+var DefaultPasswordPolicy = &PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      72,
+	MinCharClasses: 2,
+}
+
+// InitPasswordPolicy configures DefaultPasswordPolicy
+func InitPasswordPolicy(cfg config.PasswordConfig) {
+	policy := &PasswordPolicy{
+		MinLength:      cfg.MinLength,
+		MaxLength:      cfg.MaxLength,
+		MinCharClasses: cfg.MinCharClasses,
+	}
+
+	if cfg.BreachedList != "" {
+		if err := policy.LoadBreachedList(cfg.BreachedList); err != nil {
+			log.Fatal("Error loading breached password list:", err)
+		}
+	}
+
+	DefaultPasswordPolicy = policy
+}
+
+// LoadBreachedList loads a local list of breached passwords. Each line holds
+// either a plain-text password or a SHA-1 digest in the "HASH[:COUNT]" format
+// used by the Have I Been Pwned downloads.
+func (p *PasswordPolicy) LoadBreachedList(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	p.breached = make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if digest, _, _ := strings.Cut(line, ":"); isSHA1Hex(digest) {
+			p.breached[strings.ToUpper(digest)] = struct{}{}
+			continue
+		}
+		p.breached[sha1Hex(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// Check returns an error describing the first requirement the password fails
+func (p *PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Errorf("password must be at most %d bytes long", p.MaxLength)
+	}
+	if charClasses(password) < p.MinCharClasses {
+		return fmt.Errorf("password must mix at least %d of lower case, upper case, digits and symbols", p.MinCharClasses)
+	}
+	if _, found := p.breached[sha1Hex(password)]; found {
+		return errors.New("password appears in a list of breached passwords")
+	}
+	return nil
+}
+
+// charClasses counts the character classes (lower, upper, digit, other) used in s
+func charClasses(s string) int {
+	var lower, upper, digit, other int
+	for _, r := range s {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
@@ -0,0 +1,172 @@
+package models
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters keep the tests fast
+func testArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		AlgorithmBcrypt:   &BcryptHasher{Cost: bcrypt.MinCost},
+		AlgorithmArgon2id: testArgon2idHasher(),
+	}
+
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := hasher.Verify("correct horse", encoded); !ok || err != nil {
+				t.Errorf("Verify(right password) = %v, %v, want true", ok, err)
+			}
+			if ok, err := hasher.Verify("wrong horse", encoded); ok || err != nil {
+				t.Errorf("Verify(wrong password) = %v, %v, want false", ok, err)
+			}
+			if hasher.NeedsRehash(encoded) {
+				t.Errorf("NeedsRehash(%q) = true for the hasher's own hash", encoded)
+			}
+
+			// Hashes of the other algorithm keep verifying but are rehashed
+			for other, otherHasher := range hashers {
+				if other == name {
+					continue
+				}
+				otherEncoded, err := otherHasher.Hash("correct horse")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok, err := hasher.Verify("correct horse", otherEncoded); !ok || err != nil {
+					t.Errorf("Verify(%s hash) = %v, %v, want true", other, ok, err)
+				}
+				if !hasher.NeedsRehash(otherEncoded) {
+					t.Errorf("NeedsRehash(%s hash) = false, want true", other)
+				}
+			}
+		})
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	hasher := testArgon2idHasher()
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("hash = %q, want the PHC format with the hasher's parameters", encoded)
+	}
+
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Memory != 64 || params.Iterations != 1 || params.Parallelism != 1 || len(salt) != 16 || len(key) != 32 {
+		t.Errorf("decoded %+v with %d byte salt and %d byte key", params, len(salt), len(key))
+	}
+
+	for _, changed := range []*Argon2idHasher{
+		{Memory: 128, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		{Memory: 64, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32},
+		{Memory: 64, Iterations: 1, Parallelism: 2, SaltLength: 16, KeyLength: 32},
+		{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 32},
+		{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 16},
+	} {
+		if !changed.NeedsRehash(encoded) {
+			t.Errorf("NeedsRehash with %+v = false, want true", changed)
+		}
+	}
+
+	for _, invalid := range []string{
+		"",
+		"plain text",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		// Parameters out of bounds, which could panic or exhaust memory
+		"$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=64,t=1000,p=1$c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5",
+		// A key that would match any password
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		if ok, err := verifyPassword("correct horse", invalid); ok || err == nil {
+			t.Errorf("verifyPassword(%q) = %v, %v, want an error", invalid, ok, err)
+		}
+		if !hasher.NeedsRehash(invalid) {
+			t.Errorf("NeedsRehash(%q) = false, want true", invalid)
+		}
+	}
+	if _, err := verifyPassword("correct horse", "plain text"); !errors.Is(err, ErrUnsupportedHash) {
+		t.Errorf("error = %v, want %v", err, ErrUnsupportedHash)
+	}
+}
+
+func TestBcryptCost(t *testing.T) {
+	encoded, err := (&BcryptHasher{Cost: bcrypt.MinCost}).Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(&BcryptHasher{Cost: bcrypt.MinCost + 1}).NeedsRehash(encoded) {
+		t.Error("NeedsRehash with another cost = false, want true")
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "breached.txt")
+	// A plain-text entry and the SHA-1 digest of "Password1", with a count
+	content := "Summer2024\n\n70CCD9007338D6D81DD3B6271621B9CF9A97EA00:123\n"
+	if err := os.WriteFile(list, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policy := &PasswordPolicy{MinLength: 8, MaxLength: 20, MinCharClasses: 3}
+	if err := policy.LoadBreachedList(list); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		password string
+		want     string
+	}{
+		{"Ab1", "at least 8 characters"},
+		{"Äb1äöüßé", ""},
+		{"Abcdefgh1Abcdefgh1Abc", "at most 20 bytes"},
+		{"abcdefgh1", "at least 3 of"},
+		{"ABCDEFGH!", "at least 3 of"},
+		{"abcdEFGH", "at least 3 of"},
+		{"abcdEF1!", ""},
+		{"Summer2024", "breached"},
+		{"Password1", "breached"},
+		{"Password2", ""},
+	} {
+		err := policy.Check(tc.password)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("Check(%q) = %v, want nil", tc.password, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("Check(%q) = %v, want an error about %q", tc.password, err, tc.want)
+		}
+	}
+
+	if err := (&PasswordPolicy{MinLength: 1}).Check(strings.Repeat("a", 1000)); err != nil {
+		t.Errorf("Check without a maximum length = %v, want nil", err)
+	}
+	if err := policy.LoadBreachedList(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("LoadBreachedList of a missing file succeeded")
+	}
+}
@@ -0,0 +1,107 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Quotas a plan can set
+const (
+	QuotaUsers          = "users"
+	QuotaPosts          = "posts"
+	QuotaStorageBytes   = "storage_bytes"
+	QuotaRequestsPerDay = "requests_per_day"
+)
+
+// Plan sets the resource quotas of the tenants on it. Quotas without a value
+// are unlimited.
+type Plan struct {
+	Name              string `json:"name" example:"starter"`
+	MaxUsers          *int   `json:"max_users" example:"10"`
+	MaxPosts          *int   `json:"max_posts" example:"1000"`
+	MaxStorageBytes   *int64 `json:"max_storage_bytes" example:"104857600"`
+	MaxRequestsPerDay *int64 `json:"max_requests_per_day" example:"10000"`
+}
+
+// UpdatePlanRequest is the request body for creating or replacing a plan
+type UpdatePlanRequest struct {
+	MaxUsers          *int   `json:"max_users" binding:"omitempty,min=0" example:"10"`
+	MaxPosts          *int   `json:"max_posts" binding:"omitempty,min=0" example:"1000"`
+	MaxStorageBytes   *int64 `json:"max_storage_bytes" binding:"omitempty,min=0" example:"104857600"`
+	MaxRequestsPerDay *int64 `json:"max_requests_per_day" binding:"omitempty,min=0" example:"10000"`
+}
+
+// AssignPlanRequest is the request body for moving a tenant to another plan
+type AssignPlanRequest struct {
+	Plan string `json:"plan" binding:"required" example:"starter"`
+}
+
+// ResourceUsage is the amount of a tenant's resources in use
+type ResourceUsage struct {
+	Users        int   `json:"users"`
+	Posts        int   `json:"posts"`
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// DailyUsage is a tenant's metered usage on one day (UTC). Resources are as
+// of the last time they were metered that day.
+type DailyUsage struct {
+	Day      time.Time `json:"day"`
+	Requests int64     `json:"requests"`
+	ResourceUsage
+}
+
+// TenantUsage reports a tenant's usage against the quotas of its plan
+type TenantUsage struct {
+	TenantID      int           `json:"tenant_id"`
+	Plan          Plan          `json:"plan"`
+	Current       ResourceUsage `json:"current"`
+	RequestsToday int64         `json:"requests_today"`
+	Daily         []DailyUsage  `json:"daily"`
+}
+
+// QuotaError reports a quota a request would exceed
+type QuotaError struct {
+	Quota string
+	Limit int64
+}
+
+func (e *QuotaError) Error() string {
+	units := map[string]string{
+		QuotaUsers:          "users",
+		QuotaPosts:          "posts",
+		QuotaStorageBytes:   "bytes of storage",
+		QuotaRequestsPerDay: "requests per day",
+	}
+	return fmt.Sprintf("Quota exceeded: the plan allows at most %d %s", e.Limit, units[e.Quota])
+}
+
+// Limit returns the plan's limit for a quota, nil if it is unlimited
+func (p *Plan) Limit(quota string) *int64 {
+	var limit *int64
+	switch quota {
+	case QuotaUsers:
+		if p.MaxUsers != nil {
+			n := int64(*p.MaxUsers)
+			limit = &n
+		}
+	case QuotaPosts:
+		if p.MaxPosts != nil {
+			n := int64(*p.MaxPosts)
+			limit = &n
+		}
+	case QuotaStorageBytes:
+		limit = p.MaxStorageBytes
+	case QuotaRequestsPerDay:
+		limit = p.MaxRequestsPerDay
+	}
+	return limit
+}
+
+// Allow returns a QuotaError if the plan doesn't allow adding to used of a quota
+func (p *Plan) Allow(quota string, used int64) error {
+	if limit := p.Limit(quota); limit != nil && used >= *limit {
+		return &QuotaError{Quota: quota, Limit: *limit}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// Snapshot methods
+const (
+	// SnapshotLogical copies the rows of every table of the tenant database
+	SnapshotLogical = "logical"
+	// SnapshotPGDump runs pg_dump on the tenant database
+	SnapshotPGDump = "pg_dump"
+)
+
+// Restore targets
+const (
+	// RestoreExisting replaces the database of the snapshot's tenant
+	RestoreExisting = "existing"
+	// RestoreNew provisions a new tenant from the snapshot
+	RestoreNew = "new"
+)
+
+// Snapshot is a copy of a tenant database taken at a point in time
+type Snapshot struct {
+	ID       int64 `json:"id"`
+	TenantID int   `json:"tenant_id"`
+	// JobID is the job that took the snapshot
+	JobID  int64  `json:"job_id"`
+	Label  string `json:"label,omitempty"`
+	Method string `json:"method"`
+	// SchemaVersion is the tenant schema version the snapshot was taken at
+	SchemaVersion int   `json:"schema_version"`
+	Size          int64 `json:"size"`
+	// Key is the storage key of the snapshot's archive
+	Key string `json:"-"`
+	// CreatedAt is when the snapshot was started; it holds the data
+	// committed by then
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateSnapshotRequest labels a snapshot
+type CreateSnapshotRequest struct {
+	Label string `json:"label,omitempty" binding:"max=255" example:"Before the migration"`
+}
+
+// RestoreSnapshotRequest chooses where a snapshot is restored. A new tenant
+// is named like one created with POST /tenants.
+type RestoreSnapshotRequest struct {
+	Target string `json:"target" binding:"required,oneof=existing new" example:"existing"`
+	Name   string `json:"name,omitempty" binding:"required_if=Target new" example:"Example Company"`
+	Slug   string `json:"slug,omitempty" binding:"omitempty,max=63,slug" example:"example-company"`
+}
@@ -1,15 +1,77 @@
 package models
 
-import "time"
+import (
+    "regexp"
+    "strings"
+    "time"
+)
 
 // Tenant represents the tenant model
 type Tenant struct {
-    ID        int       `json:"id"`
-    Name      string    `json:"name"`
-    CreatedAt time.Time `json:"created_at"`
+    ID                 int        `json:"id"`
+    Name               string     `json:"name"`
+    Slug               string     `json:"slug"`
+    // Plan selects the tenant's quotas and rate limits
+    Plan               string     `json:"plan"`
+    // SubscriptionStatus is the state of the tenant's subscription at the billing provider
+    SubscriptionStatus string     `json:"subscription_status"`
+    // SuspendedAt is set while the tenant is suspended for non-payment
+    SuspendedAt        *time.Time `json:"suspended_at,omitempty"`
+    // IsTemplate allows creating tenants from this one's data and settings
+    IsTemplate         bool       `json:"is_template"`
+    CreatedAt          time.Time  `json:"created_at"`
 }
 
+// DefaultPlan is the plan of new tenants
+const DefaultPlan = "free"
+
 // CreateTenantRequest represents the create tenant request body
 type CreateTenantRequest struct {
     Name string `json:"name" binding:"required" example:"Example Company"`
+    // Slug identifies the tenant in subdomains, the X-Tenant header and /t/:slug paths.
+    // It is derived from the name when omitted.
+    Slug string `json:"slug" binding:"omitempty,max=63,slug" example:"example-company"`
+    // TemplateID names a template tenant the tenant is created from. Only
+    // platform admins can use templates.
+    TemplateID int `json:"template_id,omitempty" binding:"omitempty,min=1" example:"1"`
+    // CopySettings starts the tenant with the template's registration settings
+    CopySettings bool `json:"copy_settings,omitempty" example:"true"`
+    // SeedData starts the tenant with the template's posts, attributed to an
+    // anonymous deactivated author
+    SeedData bool `json:"seed_data,omitempty" example:"true"`
+}
+
+// TemplateOptions choose what a tenant created from a template copies from it.
+// The template's users and their personal data are never copied.
+type TemplateOptions struct {
+    Settings bool
+    SeedData bool
+}
+
+// SeedAuthorEmail is the email of the anonymous deactivated user the seed
+// posts of a tenant created from a template are attributed to
+const SeedAuthorEmail = "seed-author@template.invalid"
+
+// SetTemplateRequest marks a tenant as a template or unmarks it
+type SetTemplateRequest struct {
+    IsTemplate *bool `json:"is_template" binding:"required" example:"true"`
+}
+
+var (
+    slugPattern     = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+    slugReplacement = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// Slugify derives a tenant slug from a display name
+func Slugify(name string) string {
+    slug := strings.Trim(slugReplacement.ReplaceAllString(strings.ToLower(name), "-"), "-")
+    if len(slug) > 63 {
+        slug = strings.TrimRight(slug[:63], "-")
+    }
+    return slug
+}
+
+// IsValidSlug reports whether s can be used as a tenant slug
+func IsValidSlug(s string) bool {
+    return len(s) <= 63 && slugPattern.MatchString(s)
 } 
\ No newline at end of file
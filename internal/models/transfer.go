@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// TenantData is the content of a tenant's database that is exported and
+// imported. IDs are those of the exporting database; imports assign new ones
+// and remap the references to them.
+type TenantData struct {
+	Users       []UserRecord
+	Posts       []Post
+	Invitations []InvitationRecord
+	Webhooks    []Webhook
+}
+
+// UserRecord is a user as exported, including the password hash stored in the
+// tenant so that they can log in after an import. The hashes of global
+// identities are never exported.
+type UserRecord struct {
+	ID           int       `json:"id"`
+	Email        string    `json:"email"`
+	PasswordHash string    `json:"password_hash"`
+	Role         string    `json:"role"`
+	Active       bool      `json:"active"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// InvitationRecord is an invitation as exported, including the digest of its
+// token so that it can still be accepted after an import
+type InvitationRecord struct {
+	Invitation
+	TokenHash string `json:"token_hash"`
+}
@@ -1,9 +1,16 @@
 package models
 
 import (
-	"time"
+    "context"
+    "time"
 
-	"golang.org/x/crypto/bcrypt"
+    "golang-multi-tenant/internal/tracing"
+)
+
+// User roles
+const (
+    RoleAdmin  = "admin"
+    RoleMember = "member"
 )
 
 // User represents the user model
@@ -12,31 +19,64 @@ type User struct {
     TenantID  int       `json:"tenant_id"`
     Email     string    `json:"email"`
     Password  string    `json:"-"` // "-" means this field won't be included in JSON
+    Role      string    `json:"role"`
+    Active    bool      `json:"active"`
     CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
 }
 
 // RegisterRequest represents the registration request body
 type RegisterRequest struct {
-    TenantID int    `json:"tenant_id" binding:"required"`
+    // Deprecated: identify the tenant with the X-Tenant header, its subdomain or the /t/:slug path prefix
+    TenantID int    `json:"tenant_id,omitempty"`
     Email    string `json:"email" binding:"required,email"`
-    Password string `json:"password" binding:"required,min=6"`
+    Password string `json:"password" binding:"required"`
 }
 
 // LoginRequest represents the login request body
 type LoginRequest struct {
-    TenantID int    `json:"tenant_id" binding:"required"`
+    // Deprecated: identify the tenant with the X-Tenant header, its subdomain or the /t/:slug path prefix
+    TenantID int    `json:"tenant_id,omitempty"`
     Email    string `json:"email" binding:"required,email"`
     Password string `json:"password" binding:"required"`
 }
 
-// HashPassword hashes the password using bcrypt
-func HashPassword(password string) (string, error) {
-    bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-    return string(bytes), err
+// UpdateUserRequest represents the admin update user request body
+type UpdateUserRequest struct {
+    Email  *string `json:"email" binding:"omitempty,email" example:"user@example.com"`
+    Role   *string `json:"role" binding:"omitempty,oneof=admin member" example:"member"`
+    Active *bool   `json:"active" example:"true"`
+}
+
+// UpdateMeRequest represents the update current user request body
+type UpdateMeRequest struct {
+    Email *string `json:"email" binding:"omitempty,email" example:"user@example.com"`
+}
+
+// ChangePasswordRequest represents the change password request body
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password" binding:"required"`
+    NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// HashPassword hashes the password using the configured PasswordHasher
+func HashPassword(ctx context.Context, password string) (string, error) {
+    _, span := tracing.Start(ctx, "HashPassword")
+    defer span.End()
+
+    return DefaultHasher.Hash(password)
 }
 
 // CheckPassword checks if the provided password matches the hash
-func CheckPassword(password, hash string) bool {
-    err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-    return err == nil
+func CheckPassword(ctx context.Context, password, hash string) bool {
+    _, span := tracing.Start(ctx, "CheckPassword")
+    defer span.End()
+
+    ok, err := DefaultHasher.Verify(password, hash)
+    return err == nil && ok
+}
+
+// PasswordNeedsRehash reports whether the hash should be upgraded to the configured algorithm and parameters
+func PasswordNeedsRehash(hash string) bool {
+    return DefaultHasher.NeedsRehash(hash)
 } 
\ No newline at end of file
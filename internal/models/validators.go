@@ -0,0 +1,24 @@
+package models
+
+import (
+	"log"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// RegisterValidators registers the custom validation tags used by the request models
+func RegisterValidators() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		log.Fatal("Unexpected validator engine")
+	}
+	if err := v.RegisterValidation("slug", validateSlug); err != nil {
+		log.Fatal("Error registering slug validator:", err)
+	}
+}
+
+// validateSlug implements the "slug" validation tag
+func validateSlug(fl validator.FieldLevel) bool {
+	return IsValidSlug(fl.Field().String())
+}
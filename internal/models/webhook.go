@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook delivery states. Pending deliveries are retried with backoff until
+// delivered or failed for good.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook subscribes a URL of the tenant to some of its events
+type Webhook struct {
+	ID  int    `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the deliveries; it is only returned when the webhook is created
+	Secret     string    `json:"secret,omitempty"`
+	EventTypes []string  `json:"event_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateWebhookRequest is the request body for creating a webhook
+type CreateWebhookRequest struct {
+	URL        string   `json:"url" binding:"required,url,max=2048"`
+	EventTypes []string `json:"event_types" binding:"required,min=1,dive,oneof=post.created post.updated post.deleted user.registered"`
+}
+
+// WebhookDelivery is an event queued for, or sent to, a webhook. Deliveries
+// are kept as the webhook's delivery log.
+type WebhookDelivery struct {
+	ID        int64  `json:"id"`
+	WebhookID int    `json:"webhook_id"`
+	EventID   string `json:"event_id"`
+	EventType string `json:"event_type"`
+	// Payload is the body sent to the webhook
+	Payload        json.RawMessage `json:"payload" swaggertype:"object"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// WebhookAttempt is the outcome of an attempt to send a delivery
+type WebhookAttempt struct {
+	// StatusCode is the webhook's response status, 0 if there was no response
+	StatusCode int
+	Error      string
+	// Status is the delivery's state after the attempt
+	Status string
+	// RetryIn is the delay before the next attempt of a pending delivery
+	RetryIn time.Duration
+}
@@ -0,0 +1,74 @@
+// Package netguard keeps requests to hosts chosen by tenants away from
+// addresses that aren't publicly routable, which could reach services behind
+// the platform.
+package netguard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+)
+
+// ErrPrivateAddress is returned for connections to addresses that aren't
+// publicly routable
+var ErrPrivateAddress = errors.New("target is not a public address")
+
+// Control refuses connections to addresses that aren't publicly routable. Set
+// as the Control of a net.Dialer it checks the resolved address, so DNS can't
+// point around it.
+func Control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicIP(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// NoRedirects is an http.Client CheckRedirect that doesn't follow redirects,
+// which would skip the address check of the original host
+func NoRedirects(req *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// nonPublicBlocks are the blocks that aren't publicly routable but aren't
+// covered by the net.IP predicates, or that embed IPv4 addresses which could
+// be translated into private ones
+var nonPublicBlocks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this network"
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT, used by some cloud metadata endpoints
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and the limited broadcast address
+	netip.MustParsePrefix("::/96"),          // IPv4-compatible IPv6
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001::/32"),      // Teredo
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+}
+
+// PublicIP reports whether ip is publicly routable. IPv4-mapped IPv6
+// addresses are checked as the IPv4 addresses they carry.
+func PublicIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	ip = net.IP(addr.AsSlice())
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, block := range nonPublicBlocks {
+		if block.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package netguard
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"100.63.255.255", true},
+		{"100.128.0.0", true},
+		{"198.20.0.0", true},
+
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"224.0.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.100.100.200", false},
+		{"100.127.255.255", false},
+		{"192.0.0.8", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"::ffff:100.64.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::10.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b:1::a00:1", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"2002:a00:1::1", false},
+		{"fc00::1", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := PublicIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("PublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestControl(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr error
+	}{
+		{"93.184.216.34:443", nil},
+		{"127.0.0.1:80", ErrPrivateAddress},
+		{"100.100.100.200:80", ErrPrivateAddress},
+		{"[::1]:443", ErrPrivateAddress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if err := Control("tcp", tt.address, nil); err != tt.wantErr {
+				t.Errorf("Control(%s) = %v, want %v", tt.address, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Package pgtest starts a throwaway PostgreSQL server for tests, using the
+// postgres binaries installed on the machine.
+package pgtest
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	// Registers the postgres driver
+	_ "github.com/lib/pq"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// binDirs are searched for initdb and postgres when they aren't on the PATH
+var binDirs = []string{
+	"/usr/lib/postgresql/*/bin",
+	"/usr/local/pgsql/bin",
+	"/usr/local/opt/postgresql*/bin",
+	"/opt/homebrew/opt/postgresql*/bin",
+}
+
+// Start initializes a database cluster in a temporary directory, starts a
+// server on a free local port and returns the configuration to connect to it.
+// The server is stopped and its data removed when the test finishes. The test
+// is skipped when the binaries can't be found; set PG_BIN to their directory
+// to pick a specific version.
+func Start(t testing.TB) config.DatabaseConfig {
+	t.Helper()
+
+	if os.Geteuid() == 0 {
+		t.Skip("postgres refuses to run as root")
+	}
+	initdb, postgres, err := findBinaries()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	logFile := filepath.Join(dir, "postgres.log")
+
+	out, err := exec.Command(initdb,
+		"-D", dataDir,
+		"-U", "postgres",
+		"-A", "trust",
+		"-E", "UTF8",
+		"--locale=C",
+		"--no-sync",
+	).CombinedOutput()
+	if err != nil {
+		t.Fatalf("initdb failed: %v\n%s", err, out)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatalf("finding a free port: %v", err)
+	}
+
+	logs, err := os.Create(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+
+	// Durability is of no use for a throwaway cluster
+	cmd := exec.Command(postgres,
+		"-D", dataDir,
+		"-h", "127.0.0.1",
+		"-p", strconv.Itoa(port),
+		"-k", dir,
+		"-c", "fsync=off",
+		"-c", "synchronous_commit=off",
+		"-c", "full_page_writes=off",
+		"-c", "max_connections=200",
+	)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	t.Cleanup(func() { stop(t, cmd) })
+
+	cfg := config.Default().Database
+	cfg.Host = "127.0.0.1"
+	cfg.Port = port
+	cfg.User = "postgres"
+	cfg.Password = ""
+	cfg.AdminDB = "postgres"
+	cfg.ManagementDB = "tenant_management"
+	cfg.SSLMode = "disable"
+	// pg_dump and pg_restore come with the server
+	cfg.BinDir = filepath.Dir(initdb)
+
+	if err := waitReady(cfg, 30*time.Second); err != nil {
+		log, _ := os.ReadFile(logFile)
+		t.Fatalf("postgres did not become ready: %v\n%s", err, log)
+	}
+	return cfg
+}
+
+func findBinaries() (initdb, postgres string, err error) {
+	dirs := []string{}
+	if dir := os.Getenv("PG_BIN"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if path, err := exec.LookPath("initdb"); err == nil {
+		dirs = append(dirs, filepath.Dir(path))
+	}
+	for _, pattern := range binDirs {
+		matches, _ := filepath.Glob(pattern)
+		dirs = append(dirs, matches...)
+	}
+
+	for _, dir := range dirs {
+		initdb = filepath.Join(dir, "initdb")
+		postgres = filepath.Join(dir, "postgres")
+		if isExecutable(initdb) && isExecutable(postgres) {
+			return initdb, postgres, nil
+		}
+	}
+	return "", "", fmt.Errorf("postgres binaries not found, set PG_BIN to the directory containing initdb")
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitReady(cfg config.DatabaseConfig, timeout time.Duration) error {
+	db, err := sql.Open("postgres", cfg.DSN(cfg.AdminDB))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stop asks postgres for a fast shutdown and kills it if that takes too long
+func stop(t testing.TB, cmd *exec.Cmd) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
+		t.Logf("stopping postgres: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Logf("postgres did not shut down, killing it")
+		cmd.Process.Kill()
+		<-done
+	}
+}
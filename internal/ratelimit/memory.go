@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often buckets that have refilled are dropped
+const pruneInterval = time.Minute
+
+// MemoryStore keeps the buckets in the process, limiting each replica separately
+type MemoryStore struct {
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// NewMemoryStore creates an empty in-process store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Take implements Store
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.prune(now)
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = b
+	}
+	b.limit = limit
+
+	var result Result
+	b.tokens, result = take(refill(b.tokens, now.Sub(b.updated), limit), limit)
+	b.updated = now
+	return result, nil
+}
+
+// prune drops the buckets that are full again, they are recreated full when
+// needed. Callers must hold s.mu.
+func (s *MemoryStore) prune(now time.Time) {
+	if now.Sub(s.lastPruned) < pruneInterval {
+		return
+	}
+	s.lastPruned = now
+
+	for key, b := range s.buckets {
+		if refill(b.tokens, now.Sub(b.updated), b.limit) >= float64(b.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
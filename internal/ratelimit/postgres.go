@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"golang-multi-tenant/internal/logging"
+)
+
+// idleBucketTTL is how long unused buckets are kept in Postgres. Buckets
+// refill within minutes, so older ones are full and can be recreated.
+const idleBucketTTL = time.Hour
+
+// PostgresStore keeps the buckets in the management database's
+// rate_limit_buckets table, sharing the limits between API replicas. Times
+// come from the database so that replica clocks don't matter.
+type PostgresStore struct {
+	db *sql.DB
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// NewPostgresStore creates a store using the given management database
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Take implements Store
+func (s *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	s.prune(ctx)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limit_buckets (key, tokens, updated_at)
+		VALUES ($1, $2, LOCALTIMESTAMP)
+		ON CONFLICT (key) DO NOTHING`,
+		key, limit.Burst,
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// The row lock serializes requests to the same bucket across replicas
+	var tokens float64
+	var updated, now time.Time
+	err = tx.QueryRowContext(ctx,
+		"SELECT tokens, updated_at, LOCALTIMESTAMP FROM rate_limit_buckets WHERE key = $1 FOR UPDATE", key,
+	).Scan(&tokens, &updated, &now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	tokens, result := take(refill(tokens, now.Sub(updated), limit), limit)
+	_, err = tx.ExecContext(ctx,
+		"UPDATE rate_limit_buckets SET tokens = $1, updated_at = $2 WHERE key = $3", tokens, now, key,
+	)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return result, tx.Commit()
+}
+
+// prune deletes idle buckets, at most once per pruneInterval per replica
+func (s *PostgresStore) prune(ctx context.Context) {
+	s.mu.Lock()
+	due := time.Since(s.lastPruned) >= pruneInterval
+	if due {
+		s.lastPruned = time.Now()
+	}
+	s.mu.Unlock()
+	if !due {
+		return
+	}
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM rate_limit_buckets WHERE updated_at < LOCALTIMESTAMP - make_interval(secs => $1)",
+		idleBucketTTL.Seconds())
+	if err != nil {
+		logging.FromContext(ctx).Error("Error pruning rate limit buckets", "error", err)
+	}
+}
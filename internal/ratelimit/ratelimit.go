@@ -0,0 +1,206 @@
+// Package ratelimit throttles requests with token buckets per tenant, user and
+// API key, sized by the tenant's plan
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/metrics"
+	"golang-multi-tenant/internal/middleware"
+)
+
+// Scopes requests are limited in
+const (
+	ScopeTenant = "tenant"
+	ScopeUser   = "user"
+	ScopeAPIKey = "api_key"
+)
+
+// Response headers, following the IETF RateLimit header fields draft
+const (
+	LimitHeader      = "RateLimit-Limit"
+	RemainingHeader  = "RateLimit-Remaining"
+	ResetHeader      = "RateLimit-Reset"
+	RetryAfterHeader = "Retry-After"
+)
+
+// resultKey is the Gin context key of the most restrictive result so far
+const resultKey = "rate_limit"
+
+// tenantLimitedKey marks requests already counted against their tenant's limit
+const tenantLimitedKey = "rate_limit_tenant"
+
+// Limit is a token bucket holding up to Burst tokens, refilled at PerSecond
+type Limit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Result is the state of a bucket after taking a token from it
+type Result struct {
+	Allowed bool
+	Limit   int
+	// Remaining is the number of whole tokens left
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token, for denied requests
+	RetryAfter time.Duration
+}
+
+// Store holds the token buckets
+type Store interface {
+	// Take takes a token from the bucket with the given key, creating a full
+	// bucket if there is none
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// take takes a token from a bucket holding tokens, returning the tokens left
+func take(tokens float64, limit Limit) (float64, Result) {
+	result := Result{Limit: limit.Burst}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - tokens) / limit.PerSecond)
+	}
+	result.Remaining = int(math.Floor(tokens))
+	result.Reset = seconds((float64(limit.Burst) - tokens) / limit.PerSecond)
+	return tokens, result
+}
+
+// refill adds the tokens accumulated over elapsed, up to the burst size
+func refill(tokens float64, elapsed time.Duration, limit Limit) float64 {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.PerSecond)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Limiter applies the plans' limits to requests
+type Limiter struct {
+	store   Store
+	plans   map[string]config.RateLimitPlan
+	metrics *metrics.Metrics
+}
+
+// New creates a limiter keeping its buckets in store. A nil store disables
+// rate limiting.
+func New(cfg config.RateLimitConfig, store Store, m *metrics.Metrics) *Limiter {
+	return &Limiter{store: store, plans: cfg.Plans, metrics: m}
+}
+
+// plan returns the limits of the named plan
+func (l *Limiter) plan(name string) config.RateLimitPlan {
+	if plan, ok := l.plans[name]; ok {
+		return plan
+	}
+	return l.plans[config.DefaultRateLimitPlan]
+}
+
+// tenantPlan returns the limits of the plan of the request's tenant, resolved
+// or taken from the token
+func (l *Limiter) tenantPlan(c *gin.Context) config.RateLimitPlan {
+	if tenant, ok := middleware.RequestTenant(c); ok {
+		return l.plan(tenant.Plan)
+	}
+	return l.plan(config.DefaultRateLimitPlan)
+}
+
+// perMinute converts a plan's per minute rate and burst into a limit
+func perMinute(rate, burst int) Limit {
+	if burst == 0 {
+		burst = rate
+	}
+	return Limit{PerSecond: float64(rate) / 60, Burst: burst}
+}
+
+// Tenant limits the requests of each tenant. Requests that only identify their
+// tenant by token pass through until it runs again after the authentication
+// middleware; each request is counted once.
+func (l *Limiter) Tenant() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenantID, ok := c.Get("tenant_id")
+		if !ok || c.GetBool(tenantLimitedKey) {
+			c.Next()
+			return
+		}
+		c.Set(tenantLimitedKey, true)
+		plan := l.tenantPlan(c)
+		l.limit(c, ScopeTenant, fmt.Sprintf("tenant:%d", tenantID), plan.TenantPerMinute, plan.TenantBurst)
+	}
+}
+
+// User limits the requests of each authenticated user. It must run after the
+// authentication middleware.
+func (l *Limiter) User() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plan := l.tenantPlan(c)
+		key := fmt.Sprintf("user:%d:%d", c.GetInt("tenant_id"), c.GetInt("user_id"))
+		l.limit(c, ScopeUser, key, plan.UserPerMinute, plan.UserBurst)
+	}
+}
+
+// APIKey limits the requests made with each key sent in header. It must run
+// after the key has been checked.
+func (l *Limiter) APIKey(header string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Keys are secrets, the buckets are named after a hash
+		sum := sha256.Sum256([]byte(c.GetHeader(header)))
+		plan := l.plan(config.DefaultRateLimitPlan)
+		l.limit(c, ScopeAPIKey, "api_key:"+hex.EncodeToString(sum[:8]), plan.APIKeyPerMinute, plan.APIKeyBurst)
+	}
+}
+
+// limit takes a token from the bucket with the given key, rejecting the
+// request when it is empty
+func (l *Limiter) limit(c *gin.Context, scope, key string, rate, burst int) {
+	if l.store == nil || rate == 0 {
+		c.Next()
+		return
+	}
+
+	ctx := c.Request.Context()
+	result, err := l.store.Take(ctx, key, perMinute(rate, burst))
+	if err != nil {
+		// An unavailable store shouldn't take the API down with it
+		logging.FromContext(ctx).Error("Error checking rate limit", "scope", scope, "error", err)
+		c.Next()
+		return
+	}
+
+	// Report the bucket closest to running out
+	if previous, ok := c.Get(resultKey); !ok || result.Remaining < previous.(Result).Remaining || !result.Allowed {
+		c.Set(resultKey, result)
+		c.Header(LimitHeader, strconv.Itoa(result.Limit))
+		c.Header(RemainingHeader, strconv.Itoa(result.Remaining))
+		c.Header(ResetHeader, strconv.Itoa(ceilSeconds(result.Reset)))
+	}
+
+	if !result.Allowed {
+		l.metrics.RateLimited(scope)
+		c.Header(RetryAfterHeader, strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		return
+	}
+	c.Next()
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
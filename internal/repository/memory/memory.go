@@ -0,0 +1,2390 @@
+// Package memory implements the repositories in memory, for tests and for
+// running the handlers without Postgres
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"golang-multi-tenant/internal/audit"
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// errNoSQL is returned by TenantDB, the memory store has no databases to
+// query directly
+var errNoSQL = errors.New("the memory store has no SQL databases")
+
+// Store implements every repository interface in memory. Each tenant keeps
+// its own users and posts with their own ID sequences, like the per-tenant
+// Postgres databases.
+type Store struct {
+	mu          sync.Mutex
+	tenants     []*tenant
+	identities  []*models.Identity
+	memberships []membership
+	// verifications are the pending email verifications by token digest
+	verifications map[string]models.EmailVerification
+	// domains are the custom domains of every tenant
+	domains      []*models.TenantDomain
+	nextDomainID int
+	// audit is the platform audit log
+	audit []models.AuditEvent
+	plans map[string]models.Plan
+	// billingEvents are the IDs of the payment events recorded
+	billingEvents map[string]bool
+	jobs          []*jobEntry
+	nextJobID     int64
+	// snapshots are kept in the order they were taken
+	snapshots      []models.Snapshot
+	nextSnapshotID int64
+}
+
+type tenant struct {
+	models.Tenant
+	settings models.TenantSettings
+	users    []*models.User
+	posts    []*models.Post
+	audit    []models.AuditEvent
+	usage    map[string]*models.DailyUsage
+	billing  models.TenantBilling
+	// billed are the requests reported for billing by day
+	billed     map[string]int64
+	webhooks   []*models.Webhook
+	deliveries []*models.WebhookDelivery
+	// invitations are kept with the digests of their tokens
+	invitations      []models.InvitationRecord
+	outbox           []*outboxEntry
+	listeners        []chan int64
+	nextUserID       int
+	nextPostID       int
+	nextWebhookID    int
+	nextInvitationID int
+	nextDeliveryID   int64
+	nextSeq          int64
+}
+
+// outboxEntry is an event in a tenant's outbox with its publishing state
+type outboxEntry struct {
+	models.OutboxEvent
+	nextAttemptAt time.Time
+	publishedAt   *time.Time
+	lastError     string
+}
+
+// jobEntry is a background job with the time it is due again
+type jobEntry struct {
+	models.Job
+	nextAttemptAt time.Time
+}
+
+type membership struct {
+	identityID int
+	tenantID   int
+	userID     int
+}
+
+// New creates an empty store
+func New() *Store {
+	return &Store{
+		plans:         map[string]models.Plan{models.DefaultPlan: {Name: models.DefaultPlan}},
+		billingEvents: make(map[string]bool),
+		verifications: make(map[string]models.EmailVerification),
+	}
+}
+
+// Repositories returns the store as the repositories the API server depends on
+func (s *Store) Repositories() repository.Repositories {
+	return repository.Repositories{
+		Tenants:     s,
+		Users:       s,
+		Invitations: s,
+		Domains:     s,
+		Posts:       s,
+		Identities:  s,
+		Audit:       s,
+		Plans:       s,
+		Usage:       s,
+		Billing:     s,
+		Webhooks:    s,
+		Outbox:      s,
+		Jobs:        s,
+		TenantData:  s,
+		Snapshots:   s,
+	}
+}
+
+// tenant returns the tenant with the given ID. Callers must hold s.mu.
+func (s *Store) tenant(tenantID int) (*tenant, error) {
+	for _, t := range s.tenants {
+		if t.ID == tenantID {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("tenant not found: %w", sql.ErrNoRows)
+}
+
+// MainDB returns nil, the memory store has no management database
+func (s *Store) MainDB() *sql.DB {
+	return nil
+}
+
+// TenantDB always fails, the memory store has no tenant databases
+func (s *Store) TenantDB(ctx context.Context, tenantID int) (*sql.DB, error) {
+	return nil, errNoSQL
+}
+
+// TenantByID looks up a tenant by its ID
+func (s *Store) TenantByID(ctx context.Context, tenantID int) (*models.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	tenant := t.Tenant
+	return &tenant, nil
+}
+
+// TenantBySlug looks up a tenant by its slug
+func (s *Store) TenantBySlug(ctx context.Context, slug string) (*models.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tenants {
+		if t.Slug == slug {
+			tenant := t.Tenant
+			return &tenant, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// TenantByDomain looks up the tenant a verified custom domain is mapped to
+func (s *Store) TenantByDomain(ctx context.Context, domain string) (*models.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.domains {
+		if d.Domain == domain && d.VerifiedAt != nil {
+			t, err := s.tenant(d.TenantID)
+			if err != nil {
+				return nil, sql.ErrNoRows
+			}
+			tenant := t.Tenant
+			return &tenant, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// CreateTenant registers a tenant
+func (s *Store) CreateTenant(ctx context.Context, name, slug string) (*models.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.createTenant(name, slug)
+	if err != nil {
+		return nil, err
+	}
+	tenant := t.Tenant
+	return &tenant, nil
+}
+
+// createTenant adds a tenant, the caller holds s.mu
+func (s *Store) createTenant(name, slug string) (*tenant, error) {
+	for _, t := range s.tenants {
+		if t.Name == name || t.Slug == slug {
+			return nil, repository.ErrConflict
+		}
+	}
+
+	t := &tenant{
+		Tenant: models.Tenant{
+			ID:                 len(s.tenants) + 1,
+			Name:               name,
+			Slug:               slug,
+			Plan:               models.DefaultPlan,
+			SubscriptionStatus: models.SubscriptionNone,
+			CreatedAt:          time.Now(),
+		},
+		usage:  make(map[string]*models.DailyUsage),
+		billed: make(map[string]int64),
+		settings: models.TenantSettings{
+			RegistrationMode:    models.RegistrationOpen,
+			AllowedEmailDomains: []string{},
+		},
+	}
+	s.tenants = append(s.tenants, t)
+	return t, nil
+}
+
+// CreateTenantFromTemplate provisions a tenant from a template, copying its
+// settings and posts as opts choose. The posts keep their IDs and are
+// attributed to an anonymous deactivated user.
+func (s *Store) CreateTenantFromTemplate(ctx context.Context, name, slug string, templateID int, opts models.TemplateOptions) (*models.Tenant, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template, err := s.tenant(templateID)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.createTenant(name, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Settings {
+		t.settings = template.settings
+		t.settings.AllowedEmailDomains = slices.Clone(template.settings.AllowedEmailDomains)
+	}
+	if opts.SeedData && len(template.posts) > 0 {
+		now := time.Now()
+		author := &models.User{ID: 1, TenantID: t.ID, Email: models.SeedAuthorEmail, Role: models.RoleMember, CreatedAt: now, UpdatedAt: now}
+		t.users = append(t.users, author)
+		for _, p := range template.posts {
+			post := *p
+			post.UserID = author.ID
+			t.posts = append(t.posts, &post)
+		}
+		t.nextUserID, t.nextPostID = author.ID, template.nextPostID
+	}
+
+	tenant := t.Tenant
+	return &tenant, nil
+}
+
+// SetTenantTemplate marks a tenant as a template or unmarks it
+func (s *Store) SetTenantTemplate(ctx context.Context, tenantID int, isTemplate bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	t.IsTemplate = isTemplate
+	return nil
+}
+
+// TenantIDs lists the IDs of every tenant
+func (s *Store) TenantIDs(ctx context.Context) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int, 0, len(s.tenants))
+	for _, t := range s.tenants {
+		ids = append(ids, t.ID)
+	}
+	return ids, nil
+}
+
+// TenantSettings returns the registration settings of a tenant
+func (s *Store) TenantSettings(ctx context.Context, tenantID int) (*models.TenantSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	settings := t.settings
+	settings.AllowedEmailDomains = append([]string{}, t.settings.AllowedEmailDomains...)
+	return &settings, nil
+}
+
+// UpdateTenantSettings stores the registration settings of a tenant
+func (s *Store) UpdateTenantSettings(ctx context.Context, tenantID int, settings *models.TenantSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	t.settings = *settings
+	t.settings.AllowedEmailDomains = append([]string{}, settings.AllowedEmailDomains...)
+	return nil
+}
+
+// Ready always succeeds, the memory store has nothing to connect to
+func (s *Store) Ready(ctx context.Context) error {
+	return nil
+}
+
+// PoolStats returns nil, the memory store has no connection pools
+func (s *Store) PoolStats() map[string]models.PoolStats {
+	return nil
+}
+
+// TenantHealth reports the tenant's row counts; there is no database or pool
+func (s *Store) TenantHealth(ctx context.Context, tenantID int) (*models.TenantHealth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &models.TenantHealth{
+		TenantID: tenantID,
+		RowCounts: map[string]int64{
+			"users": int64(len(t.users)),
+			"posts": int64(len(t.posts)),
+		},
+	}, nil
+}
+
+// CreateUser creates a user and queues the user.registered event; the first
+// user of a tenant without active users becomes its admin
+func (s *Store) CreateUser(ctx context.Context, tenantID int, email, passwordHash string, active bool) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range t.users {
+		if u.Email == email {
+			return nil, repository.ErrConflict
+		}
+	}
+
+	role := models.RoleAdmin
+	for _, u := range t.users {
+		if u.Active {
+			role = models.RoleMember
+			break
+		}
+	}
+	t.nextUserID++
+	now := time.Now()
+	user := &models.User{
+		ID:        t.nextUserID,
+		TenantID:  tenantID,
+		Email:     email,
+		Password:  passwordHash,
+		Role:      role,
+		Active:    active,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	created := *user
+	if err := t.appendEvent(models.EventUserRegistered, &created); err != nil {
+		return nil, err
+	}
+	t.users = append(t.users, user)
+
+	return &created, nil
+}
+
+// user returns the user matching the predicate. Callers must hold s.mu.
+func (s *Store) user(tenantID int, match func(*models.User) bool) (*models.User, error) {
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range t.users {
+		if match(u) {
+			return u, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// UserByID returns a user including their password hash
+func (s *Store) UserByID(ctx context.Context, tenantID, userID int) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return nil, err
+	}
+	user := *u
+	return &user, nil
+}
+
+// UserByEmail returns a user including their password hash
+func (s *Store) UserByEmail(ctx context.Context, tenantID int, email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.Email == email })
+	if err != nil {
+		return nil, err
+	}
+	user := *u
+	return &user, nil
+}
+
+// ListUsers returns a page of the tenant's users ordered by ID
+func (s *Store) ListUsers(ctx context.Context, tenantID int, active *bool, limit, offset int) ([]models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []models.User{}
+	for _, u := range t.users {
+		if active != nil && u.Active != *active {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(users) == limit {
+			break
+		}
+		users = append(users, *u)
+	}
+	return users, nil
+}
+
+// UpdateEmail changes a user's email
+func (s *Store) UpdateEmail(ctx context.Context, tenantID, userID int, email string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.user(tenantID, func(u *models.User) bool { return u.Email == email && u.ID != userID }); err == nil {
+		return nil, repository.ErrConflict
+	}
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return nil, err
+	}
+	u.Email = email
+	u.UpdatedAt = time.Now()
+
+	user := *u
+	return &user, nil
+}
+
+// UpdatePassword replaces a user's password hash
+func (s *Store) UpdatePassword(ctx context.Context, tenantID, userID int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return err
+	}
+	u.Password = passwordHash
+	u.UpdatedAt = time.Now()
+	return nil
+}
+
+// UpdateUser applies an admin's changes to a user's email, role and active state
+func (s *Store) UpdateUser(ctx context.Context, tenantID, userID int, changes models.UpdateUserRequest) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return nil, err
+	}
+	removesAdmin := (changes.Role != nil && *changes.Role != models.RoleAdmin) || (changes.Active != nil && !*changes.Active)
+	if removesAdmin {
+		if err := s.ensureOtherAdmin(tenantID, u); err != nil {
+			return nil, err
+		}
+	}
+	if changes.Email != nil {
+		if _, err := s.user(tenantID, func(o *models.User) bool { return o.Email == *changes.Email && o.ID != userID }); err == nil {
+			return nil, repository.ErrConflict
+		}
+		u.Email = *changes.Email
+	}
+	if changes.Role != nil {
+		u.Role = *changes.Role
+	}
+	if changes.Active != nil {
+		u.Active = *changes.Active
+	}
+	u.UpdatedAt = time.Now()
+
+	user := *u
+	return &user, nil
+}
+
+// DeactivateUser deactivates a user
+func (s *Store) DeactivateUser(ctx context.Context, tenantID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return err
+	}
+	if err := s.ensureOtherAdmin(tenantID, u); err != nil {
+		return err
+	}
+	u.Active = false
+	u.UpdatedAt = time.Now()
+	return nil
+}
+
+// DeleteUser deletes a user and their posts, appending the post.deleted event
+// of each post to the outbox
+func (s *Store) DeleteUser(ctx context.Context, tenantID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return err
+	}
+	if err := s.ensureOtherAdmin(tenantID, u); err != nil {
+		return err
+	}
+
+	t, _ := s.tenant(tenantID)
+	for _, p := range t.posts {
+		if p.UserID != userID {
+			continue
+		}
+		if err := t.appendEvent(models.EventPostDeleted, p); err != nil {
+			return err
+		}
+	}
+	t.posts = slices.DeleteFunc(t.posts, func(p *models.Post) bool { return p.UserID == userID })
+	t.users = slices.DeleteFunc(t.users, func(u *models.User) bool { return u.ID == userID })
+	return nil
+}
+
+// ensureOtherAdmin returns repository.ErrLastAdmin if u is the tenant's only
+// active admin. Callers must hold s.mu.
+func (s *Store) ensureOtherAdmin(tenantID int, u *models.User) error {
+	if u.Role != models.RoleAdmin || !u.Active {
+		return nil
+	}
+	if _, err := s.user(tenantID, func(o *models.User) bool {
+		return o.ID != u.ID && o.Role == models.RoleAdmin && o.Active
+	}); err == nil {
+		return nil
+	}
+	return repository.ErrLastAdmin
+}
+
+// SetUserActive activates or deactivates a user, for tests that need a user
+// deactivated without the checks of DeactivateUser
+func (s *Store) SetUserActive(tenantID, userID int, active bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.user(tenantID, func(u *models.User) bool { return u.ID == userID })
+	if err != nil {
+		return err
+	}
+	u.Active = active
+	return nil
+}
+
+// CreateInvitation stores an invitation with the digest of its token and fills
+// in its generated fields
+func (s *Store) CreateInvitation(ctx context.Context, tenantID int, invitation *models.Invitation, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	t.nextInvitationID++
+	invitation.ID = t.nextInvitationID
+	invitation.CreatedAt = time.Now()
+	t.invitations = append(t.invitations, models.InvitationRecord{Invitation: *invitation, TokenHash: tokenHash})
+	return nil
+}
+
+// pending reports whether an invitation is neither accepted nor expired
+func pending(inv *models.InvitationRecord) bool {
+	return inv.AcceptedAt == nil && inv.ExpiresAt.After(time.Now())
+}
+
+// PendingInvitations lists the invitations neither accepted nor expired, newest first
+func (s *Store) PendingInvitations(ctx context.Context, tenantID int) ([]models.Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	invitations := []models.Invitation{}
+	for i := len(t.invitations) - 1; i >= 0; i-- {
+		if pending(&t.invitations[i]) {
+			invitations = append(invitations, t.invitations[i].Invitation)
+		}
+	}
+	return invitations, nil
+}
+
+// PendingInvitation returns the invitation with the token digest if it is
+// neither accepted nor expired
+func (s *Store) PendingInvitation(ctx context.Context, tenantID int, tokenHash string) (*models.Invitation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range t.invitations {
+		if inv := &t.invitations[i]; inv.TokenHash == tokenHash && pending(inv) {
+			invitation := inv.Invitation
+			return &invitation, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// DeleteInvitation deletes an invitation that wasn't accepted
+func (s *Store) DeleteInvitation(ctx context.Context, tenantID, invitationID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for i, inv := range t.invitations {
+		if inv.ID == invitationID && inv.AcceptedAt == nil {
+			t.invitations = slices.Delete(t.invitations, i, i+1)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// AcceptInvitation marks a pending invitation accepted and creates the invited
+// user, appending the user.registered event to the outbox
+func (s *Store) AcceptInvitation(ctx context.Context, tenantID, invitationID int, passwordHash string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	var inv *models.InvitationRecord
+	for i := range t.invitations {
+		if t.invitations[i].ID == invitationID && pending(&t.invitations[i]) {
+			inv = &t.invitations[i]
+		}
+	}
+	if inv == nil {
+		return nil, sql.ErrNoRows
+	}
+	for _, u := range t.users {
+		if u.Email == inv.Email {
+			return nil, repository.ErrConflict
+		}
+	}
+
+	t.nextUserID++
+	now := time.Now()
+	user := &models.User{
+		ID:        t.nextUserID,
+		TenantID:  tenantID,
+		Email:     inv.Email,
+		Password:  passwordHash,
+		Role:      inv.Role,
+		Active:    true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	created := *user
+	if err := t.appendEvent(models.EventUserRegistered, &created); err != nil {
+		return nil, err
+	}
+	t.users = append(t.users, user)
+	inv.AcceptedAt = &now
+
+	return &created, nil
+}
+
+// ExpireInvitation moves an invitation's expiry into the past, for tests of
+// expired invitations
+func (s *Store) ExpireInvitation(tenantID, invitationID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for i := range t.invitations {
+		if t.invitations[i].ID == invitationID {
+			t.invitations[i].ExpiresAt = time.Now().Add(-time.Minute)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// CreateDomain stores a domain and fills in its generated fields
+func (s *Store) CreateDomain(ctx context.Context, domain *models.TenantDomain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.domains {
+		if d.TenantID == domain.TenantID && d.Domain == domain.Domain {
+			return repository.ErrConflict
+		}
+	}
+	s.nextDomainID++
+	domain.ID = s.nextDomainID
+	domain.CreatedAt = time.Now()
+	stored := *domain
+	stored.Challenge = nil
+	s.domains = append(s.domains, &stored)
+	return nil
+}
+
+// ListDomains returns the tenant's domains ordered by name
+func (s *Store) ListDomains(ctx context.Context, tenantID int) ([]models.TenantDomain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	domains := []models.TenantDomain{}
+	for _, d := range s.domains {
+		if d.TenantID == tenantID {
+			domains = append(domains, *d)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+	return domains, nil
+}
+
+// DomainByID returns a domain of the tenant
+func (s *Store) DomainByID(ctx context.Context, tenantID, domainID int) (*models.TenantDomain, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.domains {
+		if d.ID == domainID && d.TenantID == tenantID {
+			domain := *d
+			return &domain, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// MarkDomainVerified records that the domain's challenge was satisfied,
+// unless another tenant verified the domain first
+func (s *Store) MarkDomainVerified(ctx context.Context, domain *models.TenantDomain) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored *models.TenantDomain
+	for _, d := range s.domains {
+		if d.ID == domain.ID && d.TenantID == domain.TenantID {
+			stored = d
+		} else if d.Domain == domain.Domain && d.VerifiedAt != nil {
+			return repository.ErrConflict
+		}
+	}
+	if stored == nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	stored.VerifiedAt, stored.Verified = &now, true
+	domain.VerifiedAt, domain.Verified = &now, true
+	return nil
+}
+
+// DeleteDomain removes a domain of the tenant
+func (s *Store) DeleteDomain(ctx context.Context, tenantID, domainID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, d := range s.domains {
+		if d.ID == domainID && d.TenantID == tenantID {
+			s.domains = slices.Delete(s.domains, i, i+1)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// CreatePost stores the post, filling in its generated fields, and queues the
+// post.created event
+func (s *Store) CreatePost(ctx context.Context, tenantID int, post *models.Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	t.nextPostID++
+	post.ID = t.nextPostID
+	post.CreatedAt = time.Now()
+	post.UpdatedAt = post.CreatedAt
+
+	stored := *post
+	if err := t.appendEvent(models.EventPostCreated, &stored); err != nil {
+		return err
+	}
+	t.posts = append(t.posts, &stored)
+	return nil
+}
+
+// ListPosts returns the tenant's posts, newest first
+func (s *Store) ListPosts(ctx context.Context, tenantID int) ([]models.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var posts []models.Post
+	for i := len(t.posts) - 1; i >= 0; i-- {
+		posts = append(posts, *t.posts[i])
+	}
+	return posts, nil
+}
+
+// PostByID returns a post of the tenant
+func (s *Store) PostByID(ctx context.Context, tenantID, postID int) (*models.Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range t.posts {
+		if p.ID == postID {
+			post := *p
+			return &post, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// UpdatePost updates the post's title and content and fills in the rest of
+// it, appending the post.updated event to the outbox
+func (s *Store) UpdatePost(ctx context.Context, tenantID int, post *models.Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for _, p := range t.posts {
+		if p.ID != post.ID {
+			continue
+		}
+		updated := *p
+		updated.Title = post.Title
+		updated.Content = post.Content
+		updated.UpdatedAt = time.Now()
+		if err := t.appendEvent(models.EventPostUpdated, &updated); err != nil {
+			return err
+		}
+		*p = updated
+		*post = updated
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// DeletePost deletes a post, appending the post.deleted event to the outbox
+func (s *Store) DeletePost(ctx context.Context, tenantID, postID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for i, p := range t.posts {
+		if p.ID != postID {
+			continue
+		}
+		if err := t.appendEvent(models.EventPostDeleted, p); err != nil {
+			return err
+		}
+		t.posts = append(t.posts[:i], t.posts[i+1:]...)
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// identity returns the identity matching the predicate. Callers must hold s.mu.
+func (s *Store) identity(match func(*models.Identity) bool) (*models.Identity, error) {
+	for _, i := range s.identities {
+		if match(i) {
+			return i, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// IdentityByEmail returns the identity with the given email
+func (s *Store) IdentityByEmail(ctx context.Context, email string) (*models.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, err := s.identity(func(i *models.Identity) bool { return i.Email == email })
+	if err != nil {
+		return nil, err
+	}
+	ident := *i
+	return &ident, nil
+}
+
+// IdentityByUser returns the identity a tenant user is linked to
+func (s *Store) IdentityByUser(ctx context.Context, tenantID, userID int) (*models.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.memberships {
+		if m.tenantID == tenantID && m.userID == userID {
+			i, err := s.identity(func(i *models.Identity) bool { return i.ID == m.identityID })
+			if err != nil {
+				return nil, err
+			}
+			ident := *i
+			return &ident, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// MemberUserID returns the ID of the identity's user in a tenant
+func (s *Store) MemberUserID(ctx context.Context, identityID, tenantID int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.memberships {
+		if m.identityID == identityID && m.tenantID == tenantID {
+			return m.userID, nil
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+// Memberships lists the tenants of the identity a tenant user is linked to
+func (s *Store) Memberships(ctx context.Context, tenantID, userID int) ([]models.TenantMembership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identityID := 0
+	for _, m := range s.memberships {
+		if m.tenantID == tenantID && m.userID == userID {
+			identityID = m.identityID
+		}
+	}
+
+	memberships := []models.TenantMembership{}
+	for _, m := range s.memberships {
+		if identityID == 0 || m.identityID != identityID {
+			continue
+		}
+		t, err := s.tenant(m.tenantID)
+		if err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, models.TenantMembership{
+			TenantID: t.ID,
+			Name:     t.Name,
+			Slug:     t.Slug,
+			UserID:   m.userID,
+			Current:  t.ID == tenantID,
+		})
+	}
+	sort.Slice(memberships, func(a, b int) bool {
+		return memberships[a].Name < memberships[b].Name
+	})
+	return memberships, nil
+}
+
+// CreateIdentity creates an identity with the email and passwordHash and
+// links a tenant user to it, returning ErrConflict if the email already has
+// an identity. Callers must have verified the email.
+func (s *Store) CreateIdentity(ctx context.Context, tenantID, userID int, email, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.identity(func(i *models.Identity) bool { return i.Email == email }); err == nil {
+		return repository.ErrConflict
+	}
+	i := &models.Identity{ID: len(s.identities) + 1, Email: email, Password: passwordHash}
+	s.identities = append(s.identities, i)
+	s.addMembership(i.ID, tenantID, userID)
+	return nil
+}
+
+// LinkIdentity links a tenant user to an existing identity. Callers must have
+// verified the identity's password.
+func (s *Store) LinkIdentity(ctx context.Context, identityID, tenantID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addMembership(identityID, tenantID, userID)
+	return nil
+}
+
+// addMembership links a tenant user to an identity unless either is already
+// linked in the tenant
+func (s *Store) addMembership(identityID, tenantID, userID int) {
+	for _, m := range s.memberships {
+		if (m.identityID == identityID && m.tenantID == tenantID) || (m.tenantID == tenantID && m.userID == userID) {
+			return
+		}
+	}
+	s.memberships = append(s.memberships, membership{identityID: identityID, tenantID: tenantID, userID: userID})
+}
+
+// UnlinkIdentity removes a tenant user's membership
+func (s *Store) UnlinkIdentity(ctx context.Context, tenantID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for n, m := range s.memberships {
+		if m.tenantID == tenantID && m.userID == userID {
+			s.memberships = append(s.memberships[:n], s.memberships[n+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// CreateEmailVerification stores a verification by the digest of its token,
+// replacing the pending one of the same user
+func (s *Store) CreateEmailVerification(ctx context.Context, v *models.EmailVerification, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replaced := *v
+	maps.DeleteFunc(s.verifications, func(_ string, o models.EmailVerification) bool {
+		if o.TenantID != v.TenantID || o.UserID != v.UserID {
+			return false
+		}
+		replaced.Activate = replaced.Activate || o.Activate
+		return true
+	})
+	s.verifications[tokenHash] = replaced
+	return nil
+}
+
+// ConsumeEmailVerification deletes and returns the tenant's unexpired
+// verification with the token digest, so that each token is used once
+func (s *Store) ConsumeEmailVerification(ctx context.Context, tenantID int, tokenHash string) (*models.EmailVerification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.verifications[tokenHash]
+	if !ok || v.TenantID != tenantID || !v.ExpiresAt.After(time.Now()) {
+		return nil, sql.ErrNoRows
+	}
+	delete(s.verifications, tokenHash)
+	return &v, nil
+}
+
+// DeleteEmailVerification deletes the pending verification of a tenant user
+func (s *Store) DeleteEmailVerification(ctx context.Context, tenantID, userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maps.DeleteFunc(s.verifications, func(_ string, v models.EmailVerification) bool {
+		return v.TenantID == tenantID && v.UserID == userID
+	})
+	return nil
+}
+
+// UpdateIdentityEmail changes an identity's email
+func (s *Store) UpdateIdentityEmail(ctx context.Context, identityID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.identity(func(i *models.Identity) bool { return i.Email == email && i.ID != identityID }); err == nil {
+		return repository.ErrConflict
+	}
+	if i, err := s.identity(func(i *models.Identity) bool { return i.ID == identityID }); err == nil {
+		i.Email = email
+	}
+	return nil
+}
+
+// UpdateIdentityPassword replaces an identity's password hash
+func (s *Store) UpdateIdentityPassword(ctx context.Context, identityID int, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, err := s.identity(func(i *models.Identity) bool { return i.ID == identityID }); err == nil {
+		i.Password = passwordHash
+	}
+	return nil
+}
+
+// auditLog returns the tenant's audit log, or the platform log for tenant 0.
+// Callers must hold s.mu.
+func (s *Store) auditLog(tenantID int) (*[]models.AuditEvent, error) {
+	if tenantID == 0 {
+		return &s.audit, nil
+	}
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return &t.audit, nil
+}
+
+// AppendAuditEvent seals the event onto the end of the tenant's log, or of the
+// platform log when tenantID is 0
+func (s *Store) AppendAuditEvent(ctx context.Context, tenantID int, event *models.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log, err := s.auditLog(tenantID)
+	if err != nil {
+		return err
+	}
+
+	prevHash := audit.GenesisHash
+	if n := len(*log); n > 0 {
+		prevHash = (*log)[n-1].Hash
+	}
+	if tenantID != 0 {
+		event.TenantID = &tenantID
+	}
+	audit.Seal(prevHash, event)
+	event.ID = int64(len(*log) + 1)
+
+	*log = append(*log, *event)
+	return nil
+}
+
+// ListAuditEvents returns the events of the tenant's log, or of the platform
+// log when tenantID is 0, matching the filter
+func (s *Store) ListAuditEvents(ctx context.Context, tenantID int, filter models.AuditFilter) ([]models.AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log, err := s.auditLog(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := func(e models.AuditEvent) bool {
+		switch {
+		case filter.ActorUserID != 0 && (e.ActorUserID == nil || *e.ActorUserID != filter.ActorUserID),
+			filter.Action != "" && e.Action != filter.Action,
+			filter.TargetType != "" && e.TargetType != filter.TargetType,
+			filter.TargetID != "" && e.TargetID != filter.TargetID,
+			!filter.From.IsZero() && e.OccurredAt.Before(filter.From),
+			!filter.To.IsZero() && !e.OccurredAt.Before(filter.To):
+			return false
+		}
+		return true
+	}
+
+	events := []models.AuditEvent{}
+	offset := filter.Offset
+	for i := range *log {
+		e := (*log)[i]
+		if !filter.Ascending {
+			e = (*log)[len(*log)-1-i]
+		}
+		if !matches(e) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if filter.Limit > 0 && len(events) == filter.Limit {
+			break
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// TamperAuditEvent changes a stored audit event without resealing it, for
+// tests of the hash chain verification
+func (s *Store) TamperAuditEvent(tenantID int, eventID int64, change func(*models.AuditEvent)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log, err := s.auditLog(tenantID)
+	if err != nil {
+		return err
+	}
+	for i := range *log {
+		if (*log)[i].ID == eventID {
+			change(&(*log)[i])
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+// Plans lists the plans by name
+func (s *Store) Plans(ctx context.Context) ([]models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plans := []models.Plan{}
+	for _, p := range s.plans {
+		plans = append(plans, p)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Name < plans[j].Name })
+	return plans, nil
+}
+
+// PlanByName returns the named plan
+func (s *Store) PlanByName(ctx context.Context, name string) (*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan, ok := s.plans[name]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &plan, nil
+}
+
+// SavePlan creates or replaces a plan
+func (s *Store) SavePlan(ctx context.Context, plan *models.Plan) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.plans[plan.Name] = *plan
+	return nil
+}
+
+// AssignPlan moves a tenant to a plan
+func (s *Store) AssignPlan(ctx context.Context, tenantID int, plan string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return sql.ErrNoRows
+	}
+	if _, ok := s.plans[plan]; !ok {
+		return sql.ErrNoRows
+	}
+	t.Plan = plan
+	return nil
+}
+
+// ResourceUsage counts a tenant's active users and posts, with the bytes of
+// their fields standing in for the database size
+func (s *Store) ResourceUsage(ctx context.Context, tenantID int) (*models.ResourceUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &models.ResourceUsage{Posts: len(t.posts)}
+	for _, u := range t.users {
+		if u.Active {
+			usage.Users++
+		}
+		usage.StorageBytes += int64(len(u.Email) + len(u.Password))
+	}
+	for _, p := range t.posts {
+		usage.StorageBytes += int64(len(p.Title) + len(p.Content))
+	}
+	return usage, nil
+}
+
+// dailyUsage returns the tenant's usage record of a day, creating it if
+// needed. Callers must hold s.mu.
+func (s *Store) dailyUsage(tenantID int, day time.Time) (*models.DailyUsage, error) {
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	key := day.Format(time.DateOnly)
+	if t.usage[key] == nil {
+		date, _ := time.Parse(time.DateOnly, key)
+		t.usage[key] = &models.DailyUsage{Day: date}
+	}
+	return t.usage[key], nil
+}
+
+// AddRequests adds n to a tenant's requests on a day, returning the day's total
+func (s *Store) AddRequests(ctx context.Context, tenantID int, day time.Time, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.dailyUsage(tenantID, day)
+	if err != nil {
+		return 0, err
+	}
+	d.Requests += n
+	return d.Requests, nil
+}
+
+// RecordResources stores the resources a tenant used on a day
+func (s *Store) RecordResources(ctx context.Context, tenantID int, day time.Time, usage *models.ResourceUsage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.dailyUsage(tenantID, day)
+	if err != nil {
+		return err
+	}
+	d.ResourceUsage = *usage
+	return nil
+}
+
+// DailyUsage returns a tenant's usage on the days from from to to, oldest first
+func (s *Store) DailyUsage(ctx context.Context, tenantID int, from, to time.Time) ([]models.DailyUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := from.Format(time.DateOnly), to.Format(time.DateOnly)
+	days := []models.DailyUsage{}
+	for key, d := range t.usage {
+		if key >= first && key <= last {
+			days = append(days, *d)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day.Before(days[j].Day) })
+	return days, nil
+}
+
+// TenantBilling returns the billing state of a tenant
+func (s *Store) TenantBilling(ctx context.Context, tenantID int) (*models.TenantBilling, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return t.tenantBilling(), nil
+}
+
+// tenantBilling returns a copy of the tenant's billing state. Callers must
+// hold s.mu.
+func (t *tenant) tenantBilling() *models.TenantBilling {
+	b := t.billing
+	b.TenantID = t.ID
+	b.Status = t.SubscriptionStatus
+	b.SuspendedAt = t.SuspendedAt
+	return &b
+}
+
+// TenantBillingByCustomer finds the tenant with a customer ID at the provider
+func (s *Store) TenantBillingByCustomer(ctx context.Context, customerID string) (*models.TenantBilling, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.tenants {
+		if customerID != "" && t.billing.CustomerID == customerID {
+			return t.tenantBilling(), nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// SaveTenantBilling stores a tenant's customer, subscription and status
+func (s *Store) SaveTenantBilling(ctx context.Context, b *models.TenantBilling) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(b.TenantID)
+	if err != nil {
+		return sql.ErrNoRows
+	}
+	t.setBilling(b)
+	return nil
+}
+
+// setBilling stores the tenant's billing state. Callers must hold s.mu.
+func (t *tenant) setBilling(b *models.TenantBilling) {
+	t.billing = *b
+	t.SubscriptionStatus = b.Status
+	t.SuspendedAt = b.SuspendedAt
+}
+
+// ApplyBillingEvent records a payment event and passes the billing of the
+// customer's tenant to apply, saving it if apply returns true. Events
+// recorded before are skipped without calling apply.
+func (s *Store) ApplyBillingEvent(ctx context.Context, eventID, eventType, customerID string, apply func(b *models.TenantBilling) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.billingEvents[eventID] {
+		return nil
+	}
+	s.billingEvents[eventID] = true
+
+	for _, t := range s.tenants {
+		if customerID != "" && t.billing.CustomerID == customerID {
+			if b := t.tenantBilling(); apply(b) {
+				t.setBilling(b)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// UnbilledUsage lists the days since since on which subscribed tenants made
+// requests that weren't reported yet
+func (s *Store) UnbilledUsage(ctx context.Context, since time.Time) ([]models.UnbilledUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	first := since.Format(time.DateOnly)
+	var usage []models.UnbilledUsage
+	for _, t := range s.tenants {
+		if t.billing.SubscriptionItemID == "" {
+			continue
+		}
+		for key, d := range t.usage {
+			if key >= first && d.Requests > t.billed[key] {
+				usage = append(usage, models.UnbilledUsage{
+					TenantID:           t.ID,
+					SubscriptionItemID: t.billing.SubscriptionItemID,
+					Day:                d.Day,
+					Requests:           d.Requests,
+					BilledRequests:     t.billed[key],
+				})
+			}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if !usage[i].Day.Equal(usage[j].Day) {
+			return usage[i].Day.Before(usage[j].Day)
+		}
+		return usage[i].TenantID < usage[j].TenantID
+	})
+	return usage, nil
+}
+
+// MarkBilled records that a tenant's requests on a day were reported
+func (s *Store) MarkBilled(ctx context.Context, tenantID int, day time.Time, requests int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	key := day.Format(time.DateOnly)
+	if requests > t.billed[key] {
+		t.billed[key] = requests
+	}
+	return nil
+}
+
+// appendEvent adds an event about data to the tenant's outbox. Callers must
+// hold s.mu.
+func (t *tenant) appendEvent(eventType string, data interface{}) error {
+	event, err := events.New(eventType, t.ID, data)
+	if err != nil {
+		return err
+	}
+
+	t.nextSeq++
+	t.outbox = append(t.outbox, &outboxEntry{
+		OutboxEvent:   models.OutboxEvent{Event: *event, Seq: t.nextSeq},
+		nextAttemptAt: time.Now(),
+	})
+
+	listeners := t.listeners[:0]
+	for _, l := range t.listeners {
+		select {
+		case l <- t.nextSeq:
+			listeners = append(listeners, l)
+		default:
+			// Fallen behind; the listener catches up from the outbox
+			close(l)
+		}
+	}
+	t.listeners = listeners
+	return nil
+}
+
+// Listen sends the sequence number of each event appended to the tenant's
+// outbox from now on, until ctx is done or the listener falls behind
+func (s *Store) Listen(ctx context.Context, tenantID int) (<-chan int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	seqs := make(chan int64, 256)
+	t.listeners = append(t.listeners, seqs)
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, l := range t.listeners {
+			if l == seqs {
+				t.listeners = append(t.listeners[:i], t.listeners[i+1:]...)
+				close(seqs)
+				return
+			}
+		}
+	}()
+	return seqs, nil
+}
+
+// EventBySeq returns an event of the tenant's outbox, published or not
+func (s *Store) EventBySeq(ctx context.Context, tenantID int, seq int64) (*models.OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	e, err := t.outboxEntry(seq)
+	if err != nil {
+		return nil, err
+	}
+	event := e.OutboxEvent
+	return &event, nil
+}
+
+// EventsAfter returns up to limit events of the tenant's outbox following seq,
+// in order
+func (s *Store) EventsAfter(ctx context.Context, tenantID int, seq int64, limit int) ([]models.OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	events := []models.OutboxEvent{}
+	for _, e := range t.outbox {
+		if len(events) == limit {
+			break
+		}
+		if e.Seq > seq {
+			events = append(events, e.OutboxEvent)
+		}
+	}
+	return events, nil
+}
+
+// ClaimEvents returns up to limit unpublished events that are due, oldest
+// first, postponing their next attempt by lease
+func (s *Store) ClaimEvents(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claimed := []models.OutboxEvent{}
+	for _, e := range t.outbox {
+		if len(claimed) == limit {
+			break
+		}
+		if e.publishedAt != nil || e.nextAttemptAt.After(now) {
+			continue
+		}
+		e.nextAttemptAt = now.Add(lease)
+		claimed = append(claimed, e.OutboxEvent)
+	}
+	return claimed, nil
+}
+
+// outboxEntry returns the entry of the tenant's outbox with the given
+// sequence number. Callers must hold s.mu.
+func (t *tenant) outboxEntry(seq int64) (*outboxEntry, error) {
+	for _, e := range t.outbox {
+		if e.Seq == seq {
+			return e, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// MarkPublished records that an event was published
+func (s *Store) MarkPublished(ctx context.Context, tenantID int, seq int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	e, err := t.outboxEntry(seq)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e.publishedAt = &now
+	return nil
+}
+
+// RecordPublishFailure stores why an event couldn't be published and
+// postpones its next attempt by retryIn
+func (s *Store) RecordPublishFailure(ctx context.Context, tenantID int, seq int64, message string, retryIn time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	e, err := t.outboxEntry(seq)
+	if err != nil {
+		return err
+	}
+	e.Attempts++
+	e.lastError = message
+	e.nextAttemptAt = time.Now().Add(retryIn)
+	return nil
+}
+
+// DeletePublishedEvents deletes the events published longer than olderThan ago
+func (s *Store) DeletePublishedEvents(ctx context.Context, tenantID int, olderThan time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-olderThan)
+	kept := t.outbox[:0]
+	for _, e := range t.outbox {
+		if e.publishedAt == nil || !e.publishedAt.Before(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	t.outbox = kept
+	return nil
+}
+
+// ExpediteOutboxEvents makes the tenant's unpublished events due now, for
+// tests of retries that would otherwise wait for the backoff
+func (s *Store) ExpediteOutboxEvents(tenantID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, e := range t.outbox {
+		if e.publishedAt == nil {
+			e.nextAttemptAt = now
+		}
+	}
+	return nil
+}
+
+// OutboxEvents returns the tenant's events that are yet to be published, for
+// tests
+func (s *Store) OutboxEvents(tenantID int) ([]models.OutboxEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	pending := []models.OutboxEvent{}
+	for _, e := range t.outbox {
+		if e.publishedAt == nil {
+			pending = append(pending, e.OutboxEvent)
+		}
+	}
+	return pending, nil
+}
+
+// CreateWebhook stores a webhook and fills in its generated fields
+func (s *Store) CreateWebhook(ctx context.Context, tenantID int, webhook *models.Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+
+	t.nextWebhookID++
+	webhook.ID = t.nextWebhookID
+	webhook.CreatedAt = time.Now()
+
+	stored := *webhook
+	stored.EventTypes = append([]string(nil), webhook.EventTypes...)
+	t.webhooks = append(t.webhooks, &stored)
+	return nil
+}
+
+// ListWebhooks returns the tenant's webhooks without their secrets
+func (s *Store) ListWebhooks(ctx context.Context, tenantID int) ([]models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []models.Webhook{}
+	for _, w := range t.webhooks {
+		webhook := *w
+		webhook.Secret = ""
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// WebhookByID returns a webhook including its secret
+func (s *Store) WebhookByID(ctx context.Context, tenantID, webhookID int) (*models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range t.webhooks {
+		if w.ID == webhookID {
+			webhook := *w
+			return &webhook, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// DeleteWebhook deletes a webhook and its deliveries
+func (s *Store) DeleteWebhook(ctx context.Context, tenantID, webhookID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for i, w := range t.webhooks {
+		if w.ID != webhookID {
+			continue
+		}
+		t.webhooks = append(t.webhooks[:i], t.webhooks[i+1:]...)
+
+		deliveries := t.deliveries[:0]
+		for _, d := range t.deliveries {
+			if d.WebhookID != webhookID {
+				deliveries = append(deliveries, d)
+			}
+		}
+		t.deliveries = deliveries
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// ListDeliveries returns a page of a webhook's deliveries, newest first
+func (s *Store) ListDeliveries(ctx context.Context, tenantID, webhookID, limit, offset int) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []models.WebhookDelivery{}
+	for i := len(t.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		if d := t.deliveries[i]; d.WebhookID == webhookID {
+			if offset > 0 {
+				offset--
+				continue
+			}
+			deliveries = append(deliveries, *d)
+		}
+	}
+	return deliveries, nil
+}
+
+// QueueEvent queues a delivery of the event for each of the tenant's webhooks
+// subscribed to it, skipping the webhooks it was queued for before
+func (s *Store) QueueEvent(ctx context.Context, tenantID int, event models.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	queued := make(map[int]bool)
+	for _, d := range t.deliveries {
+		if d.EventID == event.ID {
+			queued[d.WebhookID] = true
+		}
+	}
+
+	now := time.Now()
+	for _, w := range t.webhooks {
+		if queued[w.ID] || !slices.Contains(w.EventTypes, event.Type) {
+			continue
+		}
+		t.nextDeliveryID++
+		t.deliveries = append(t.deliveries, &models.WebhookDelivery{
+			ID:            t.nextDeliveryID,
+			WebhookID:     w.ID,
+			EventID:       event.ID,
+			EventType:     event.Type,
+			Payload:       payload,
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		})
+	}
+	return nil
+}
+
+// Redeliver queues the event of a delivery again as a new delivery
+func (s *Store) Redeliver(ctx context.Context, tenantID, webhookID int, deliveryID int64) (*models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range t.deliveries {
+		if d.ID != deliveryID || d.WebhookID != webhookID {
+			continue
+		}
+		now := time.Now()
+		t.nextDeliveryID++
+		redelivery := &models.WebhookDelivery{
+			ID:            t.nextDeliveryID,
+			WebhookID:     webhookID,
+			EventID:       d.EventID,
+			EventType:     d.EventType,
+			Payload:       d.Payload,
+			Status:        models.DeliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+		}
+		t.deliveries = append(t.deliveries, redelivery)
+
+		created := *redelivery
+		return &created, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ClaimDeliveries returns up to limit pending deliveries that are due,
+// postponing their next attempt by lease
+func (s *Store) ClaimDeliveries(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	until := now.Add(lease)
+	deliveries := []models.WebhookDelivery{}
+	for _, d := range t.deliveries {
+		if len(deliveries) == limit {
+			break
+		}
+		if d.Status != models.DeliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.NextAttemptAt = &until
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, nil
+}
+
+// RecordAttempt stores the outcome of an attempt to send a delivery
+func (s *Store) RecordAttempt(ctx context.Context, tenantID int, deliveryID int64, attempt models.WebhookAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	for _, d := range t.deliveries {
+		if d.ID != deliveryID {
+			continue
+		}
+		now := time.Now()
+		d.Attempts++
+		d.Status = attempt.Status
+		d.LastStatusCode = nil
+		if attempt.StatusCode != 0 {
+			code := attempt.StatusCode
+			d.LastStatusCode = &code
+		}
+		d.LastError = attempt.Error
+		d.NextAttemptAt = nil
+		if attempt.Status == models.DeliveryPending {
+			next := now.Add(attempt.RetryIn)
+			d.NextAttemptAt = &next
+		}
+		if attempt.Status == models.DeliveryDelivered {
+			d.DeliveredAt = &now
+		}
+		return nil
+	}
+	return sql.ErrNoRows
+}
+
+// ExpediteWebhookDeliveries makes the tenant's pending deliveries due now, for
+// tests of retries that would otherwise wait for the backoff
+func (s *Store) ExpediteWebhookDeliveries(tenantID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, d := range t.deliveries {
+		if d.Status == models.DeliveryPending {
+			d.NextAttemptAt = &now
+		}
+	}
+	return nil
+}
+
+// CreateJob stores a pending job and fills in its generated fields
+func (s *Store) CreateJob(ctx context.Context, job *models.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextJobID++
+	job.ID = s.nextJobID
+	job.Status = models.JobPending
+	job.CreatedAt = time.Now()
+	s.jobs = append(s.jobs, &jobEntry{Job: *job, nextAttemptAt: job.CreatedAt})
+	return nil
+}
+
+// job returns the job with the given ID. Callers must hold s.mu.
+func (s *Store) job(jobID int64) (*jobEntry, error) {
+	for _, j := range s.jobs {
+		if j.ID == jobID {
+			return j, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// JobByID looks up a job
+func (s *Store) JobByID(ctx context.Context, jobID int64) (*models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.job(jobID)
+	if err != nil {
+		return nil, err
+	}
+	job := j.Job
+	return &job, nil
+}
+
+// ClaimJob marks the oldest due job running and returns it, postponing its
+// next attempt by lease
+func (s *Store) ClaimJob(ctx context.Context, lease time.Duration) (*models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, j := range s.jobs {
+		if (j.Status != models.JobPending && j.Status != models.JobRunning) || j.nextAttemptAt.After(now) {
+			continue
+		}
+		j.Status = models.JobRunning
+		j.Attempts++
+		j.StartedAt = &now
+		j.nextAttemptAt = now.Add(lease)
+		job := j.Job
+		return &job, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// ExtendJob postpones the next attempt of a running job by lease
+func (s *Store) ExtendJob(ctx context.Context, jobID int64, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.job(jobID)
+	if err != nil {
+		return err
+	}
+	if j.Status == models.JobRunning {
+		j.nextAttemptAt = time.Now().Add(lease)
+	}
+	return nil
+}
+
+// SetJobTenant records the tenant a job created
+func (s *Store) SetJobTenant(ctx context.Context, jobID int64, tenantID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.job(jobID)
+	if err != nil {
+		return err
+	}
+	j.TenantID = tenantID
+	return nil
+}
+
+// FinishJob records that a job completed or failed with the message
+func (s *Store) FinishJob(ctx context.Context, jobID int64, status, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.job(jobID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	j.Status = status
+	j.Error = message
+	j.CompletedAt = &now
+	return nil
+}
+
+// DeleteFinishedJobs deletes the jobs finished longer than olderThan ago and
+// returns them
+func (s *Store) DeleteFinishedJobs(ctx context.Context, olderThan time.Duration) ([]models.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-olderThan)
+	deleted := []models.Job{}
+	kept := s.jobs[:0]
+	for _, j := range s.jobs {
+		if j.CompletedAt != nil && j.CompletedAt.Before(cutoff) {
+			deleted = append(deleted, j.Job)
+			continue
+		}
+		kept = append(kept, j)
+	}
+	s.jobs = kept
+	return deleted, nil
+}
+
+// ExpireJobLeases makes the running jobs due again, for tests of jobs whose
+// replica stopped
+func (s *Store) ExpireJobLeases() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, j := range s.jobs {
+		if j.Status == models.JobRunning {
+			j.nextAttemptAt = time.Now()
+		}
+	}
+}
+
+// schemaVersion is the latest Postgres tenant migration, whose tables the
+// records of the memory store correspond to
+const schemaVersion = 7
+
+// TenantSchemaVersion returns the version the memory store's records correspond to
+func (s *Store) TenantSchemaVersion() int {
+	return schemaVersion
+}
+
+// ExportTenantData copies the tenant's users, posts, invitations and webhooks
+func (s *Store) ExportTenantData(ctx context.Context, tenantID int) (*models.TenantData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	return exportData(t), nil
+}
+
+// exportData copies the tenant's users, posts, invitations and webhooks.
+// Callers must hold s.mu.
+func exportData(t *tenant) *models.TenantData {
+	data := &models.TenantData{
+		Users:       []models.UserRecord{},
+		Posts:       []models.Post{},
+		Invitations: append([]models.InvitationRecord{}, t.invitations...),
+		Webhooks:    []models.Webhook{},
+	}
+	for _, u := range t.users {
+		data.Users = append(data.Users, models.UserRecord{
+			ID:           u.ID,
+			Email:        u.Email,
+			PasswordHash: u.Password,
+			Role:         u.Role,
+			Active:       u.Active,
+			CreatedAt:    u.CreatedAt,
+			UpdatedAt:    u.UpdatedAt,
+		})
+	}
+	for _, p := range t.posts {
+		data.Posts = append(data.Posts, *p)
+	}
+	for _, w := range t.webhooks {
+		webhook := *w
+		webhook.EventTypes = append([]string(nil), w.EventTypes...)
+		data.Webhooks = append(data.Webhooks, webhook)
+	}
+	return data
+}
+
+// ImportTenantData stores data into a tenant without users, giving the
+// records new IDs and remapping the references to them
+func (s *Store) ImportTenantData(ctx context.Context, tenantID int, data *models.TenantData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	if len(t.users) > 0 {
+		return repository.ErrConflict
+	}
+
+	// Check the posts first, so that nothing is stored if the import fails
+	userIDs := make(map[int]int, len(data.Users))
+	for i, u := range data.Users {
+		userIDs[u.ID] = t.nextUserID + i + 1
+	}
+	for _, p := range data.Posts {
+		if _, ok := userIDs[p.UserID]; !ok {
+			return fmt.Errorf("post %d belongs to user %d, who isn't imported", p.ID, p.UserID)
+		}
+	}
+
+	for _, u := range data.Users {
+		t.nextUserID++
+		t.users = append(t.users, &models.User{
+			ID:        t.nextUserID,
+			TenantID:  tenantID,
+			Email:     u.Email,
+			Password:  u.PasswordHash,
+			Role:      u.Role,
+			Active:    u.Active,
+			CreatedAt: u.CreatedAt,
+			UpdatedAt: u.UpdatedAt,
+		})
+	}
+	for _, p := range data.Posts {
+		t.nextPostID++
+		post := p
+		post.ID = t.nextPostID
+		post.UserID = userIDs[p.UserID]
+		t.posts = append(t.posts, &post)
+	}
+	for _, inv := range data.Invitations {
+		t.nextInvitationID++
+		inv.ID = t.nextInvitationID
+		if inv.InvitedBy != nil {
+			if id, ok := userIDs[*inv.InvitedBy]; ok {
+				inv.InvitedBy = &id
+			} else {
+				inv.InvitedBy = nil
+			}
+		}
+		t.invitations = append(t.invitations, inv)
+	}
+	for _, w := range data.Webhooks {
+		t.nextWebhookID++
+		webhook := w
+		webhook.ID = t.nextWebhookID
+		webhook.EventTypes = append([]string(nil), w.EventTypes...)
+		t.webhooks = append(t.webhooks, &webhook)
+	}
+	return nil
+}
+
+// DumpTenant writes the tenant's users, posts, invitations and webhooks as
+// JSON, whatever the method
+func (s *Store) DumpTenant(ctx context.Context, tenantID int, method string, w io.Writer) (int, error) {
+	s.mu.Lock()
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	data := exportData(t)
+	s.mu.Unlock()
+
+	return schemaVersion, json.NewEncoder(w).Encode(data)
+}
+
+// RestoreTenant replaces the tenant's users, posts, invitations and webhooks
+// with the ones of a snapshot, keeping their IDs. Webhook deliveries and
+// outbox events are dropped.
+func (s *Store) RestoreTenant(ctx context.Context, tenantID int, method string, version int, r io.Reader) error {
+	if version < 1 || version > schemaVersion {
+		return fmt.Errorf("can't restore a snapshot at schema version %d", version)
+	}
+	var data models.TenantData
+	if err := json.NewDecoder(r).Decode(&data); err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, err := s.tenant(tenantID)
+	if err != nil {
+		return err
+	}
+	t.users, t.posts, t.webhooks = nil, nil, nil
+	t.nextUserID, t.nextPostID, t.nextWebhookID = 0, 0, 0
+	for _, u := range data.Users {
+		t.users = append(t.users, &models.User{
+			ID:        u.ID,
+			TenantID:  tenantID,
+			Email:     u.Email,
+			Password:  u.PasswordHash,
+			Role:      u.Role,
+			Active:    u.Active,
+			CreatedAt: u.CreatedAt,
+			UpdatedAt: u.UpdatedAt,
+		})
+		t.nextUserID = max(t.nextUserID, u.ID)
+	}
+	for _, p := range data.Posts {
+		post := p
+		t.posts = append(t.posts, &post)
+		t.nextPostID = max(t.nextPostID, p.ID)
+	}
+	for _, w := range data.Webhooks {
+		webhook := w
+		t.webhooks = append(t.webhooks, &webhook)
+		t.nextWebhookID = max(t.nextWebhookID, w.ID)
+	}
+	t.invitations, t.nextInvitationID = data.Invitations, 0
+	for _, inv := range data.Invitations {
+		t.nextInvitationID = max(t.nextInvitationID, inv.ID)
+	}
+	t.deliveries = nil
+	t.outbox = nil
+
+	s.memberships = slices.DeleteFunc(s.memberships, func(m membership) bool { return m.tenantID == tenantID })
+	maps.DeleteFunc(s.verifications, func(_ string, v models.EmailVerification) bool { return v.TenantID == tenantID })
+	return nil
+}
+
+// CreateSnapshot records a snapshot
+func (s *Store) CreateSnapshot(ctx context.Context, snapshot *models.Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.snapshots {
+		if existing.JobID == snapshot.JobID {
+			return repository.ErrConflict
+		}
+	}
+	s.nextSnapshotID++
+	snapshot.ID = s.nextSnapshotID
+	s.snapshots = append(s.snapshots, *snapshot)
+	return nil
+}
+
+// Snapshots lists the tenant's snapshots, newest first
+func (s *Store) Snapshots(ctx context.Context, tenantID int) ([]models.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots := []models.Snapshot{}
+	for i := len(s.snapshots) - 1; i >= 0; i-- {
+		if s.snapshots[i].TenantID == tenantID {
+			snapshots = append(snapshots, s.snapshots[i])
+		}
+	}
+	return snapshots, nil
+}
+
+// SnapshotByID looks up a snapshot
+func (s *Store) SnapshotByID(ctx context.Context, snapshotID int64) (*models.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, snapshot := range s.snapshots {
+		if snapshot.ID == snapshotID {
+			return &snapshot, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// DeleteSnapshot deletes the record of a snapshot
+func (s *Store) DeleteSnapshot(ctx context.Context, snapshotID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots = slices.DeleteFunc(s.snapshots, func(snapshot models.Snapshot) bool { return snapshot.ID == snapshotID })
+	return nil
+}
+
+// AgeSnapshots moves the creation of the tenant's snapshots back by d, for
+// tests of their retention
+func (s *Store) AgeSnapshots(tenantID int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.snapshots {
+		if s.snapshots[i].TenantID == tenantID {
+			s.snapshots[i].CreatedAt = s.snapshots[i].CreatedAt.Add(-d)
+		}
+	}
+}
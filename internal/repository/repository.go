@@ -0,0 +1,340 @@
+// Package repository defines the storage interfaces the handlers and
+// middleware depend on. Lookups that find nothing return sql.ErrNoRows.
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+// ErrConflict is returned when a record would violate a uniqueness constraint
+var ErrConflict = errors.New("record already exists")
+
+// ErrLastAdmin is returned when a change would leave a tenant without an
+// active admin
+var ErrLastAdmin = errors.New("the tenant must keep at least one active admin")
+
+// TenantStore looks up and creates tenants and hands out their databases
+type TenantStore interface {
+	// MainDB returns the tenant management database
+	MainDB() *sql.DB
+	// TenantDB returns the connection pool of a tenant's database
+	TenantDB(ctx context.Context, tenantID int) (*sql.DB, error)
+
+	TenantByID(ctx context.Context, tenantID int) (*models.Tenant, error)
+	TenantBySlug(ctx context.Context, slug string) (*models.Tenant, error)
+	// TenantByDomain looks up the tenant a verified custom domain is mapped to
+	TenantByDomain(ctx context.Context, domain string) (*models.Tenant, error)
+	// CreateTenant provisions a tenant, returning ErrConflict if the name or slug is taken
+	CreateTenant(ctx context.Context, name, slug string) (*models.Tenant, error)
+	// CreateTenantFromTemplate provisions a tenant from a template tenant,
+	// copying its settings and posts as opts choose, and returns ErrConflict if
+	// the name or slug is taken. The template's users, audit log, outbox,
+	// invitations and webhooks aren't copied; seeded posts are attributed to
+	// an anonymous deactivated author.
+	CreateTenantFromTemplate(ctx context.Context, name, slug string, templateID int, opts models.TemplateOptions) (*models.Tenant, error)
+	// SetTenantTemplate marks a tenant as a template or unmarks it
+	SetTenantTemplate(ctx context.Context, tenantID int, isTemplate bool) error
+	// TenantIDs lists the IDs of every tenant, for workers that visit each tenant
+	TenantIDs(ctx context.Context) ([]int, error)
+
+	TenantSettings(ctx context.Context, tenantID int) (*models.TenantSettings, error)
+	UpdateTenantSettings(ctx context.Context, tenantID int, settings *models.TenantSettings) error
+
+	// Ready checks that the management database is reachable and migrated
+	Ready(ctx context.Context) error
+	// TenantHealth checks a tenant's database and collects statistics about it
+	TenantHealth(ctx context.Context, tenantID int) (*models.TenantHealth, error)
+	// PoolStats reports the statistics of the open connection pools by database name
+	PoolStats() map[string]models.PoolStats
+}
+
+// UserRepository stores the users of each tenant
+type UserRepository interface {
+	// CreateUser creates a user, active or awaiting activation, returning
+	// ErrConflict if the email is taken, and appends the user.registered event
+	// to the outbox. The first user of a tenant without active users becomes
+	// its admin.
+	CreateUser(ctx context.Context, tenantID int, email, passwordHash string, active bool) (*models.User, error)
+	// UserByID returns a user including their password hash
+	UserByID(ctx context.Context, tenantID, userID int) (*models.User, error)
+	// UserByEmail returns a user including their password hash
+	UserByEmail(ctx context.Context, tenantID int, email string) (*models.User, error)
+	// ListUsers returns a page of the tenant's users ordered by ID, optionally
+	// filtered by their active state
+	ListUsers(ctx context.Context, tenantID int, active *bool, limit, offset int) ([]models.User, error)
+	// UpdateEmail changes a user's email, returning ErrConflict if it is taken
+	UpdateEmail(ctx context.Context, tenantID, userID int, email string) (*models.User, error)
+	UpdatePassword(ctx context.Context, tenantID, userID int, passwordHash string) error
+	// UpdateUser applies an admin's changes to a user's email, role and active
+	// state, returning ErrConflict if the email is taken and ErrLastAdmin if
+	// the tenant would be left without an active admin
+	UpdateUser(ctx context.Context, tenantID, userID int, changes models.UpdateUserRequest) (*models.User, error)
+	// DeactivateUser deactivates a user, returning ErrLastAdmin if the tenant
+	// would be left without an active admin
+	DeactivateUser(ctx context.Context, tenantID, userID int) error
+	// DeleteUser deletes a user and their posts, appending the post.deleted
+	// event of each post to the outbox, and returns ErrLastAdmin if the tenant
+	// would be left without an active admin
+	DeleteUser(ctx context.Context, tenantID, userID int) error
+}
+
+// InvitationRepository stores the invitations into each tenant. Only a digest
+// of an invitation's token is stored.
+type InvitationRepository interface {
+	// CreateInvitation stores an invitation with the digest of its token and
+	// fills in its generated fields
+	CreateInvitation(ctx context.Context, tenantID int, invitation *models.Invitation, tokenHash string) error
+	// PendingInvitations lists the invitations neither accepted nor expired, newest first
+	PendingInvitations(ctx context.Context, tenantID int) ([]models.Invitation, error)
+	// PendingInvitation returns the invitation with the token digest if it is
+	// neither accepted nor expired
+	PendingInvitation(ctx context.Context, tenantID int, tokenHash string) (*models.Invitation, error)
+	// DeleteInvitation deletes an invitation that wasn't accepted
+	DeleteInvitation(ctx context.Context, tenantID, invitationID int) error
+	// AcceptInvitation marks a pending invitation accepted and creates the
+	// invited user with its email and role in one transaction, appending the
+	// user.registered event to the outbox. It returns sql.ErrNoRows if the
+	// invitation was accepted or expired meanwhile and ErrConflict if the
+	// email is taken.
+	AcceptInvitation(ctx context.Context, tenantID, invitationID int, passwordHash string) (*models.User, error)
+}
+
+// DomainRepository stores the custom domains of the tenants
+type DomainRepository interface {
+	// CreateDomain stores a domain and fills in its generated fields,
+	// returning ErrConflict if the tenant already added it
+	CreateDomain(ctx context.Context, domain *models.TenantDomain) error
+	// ListDomains returns the tenant's domains ordered by name
+	ListDomains(ctx context.Context, tenantID int) ([]models.TenantDomain, error)
+	DomainByID(ctx context.Context, tenantID, domainID int) (*models.TenantDomain, error)
+	// MarkDomainVerified records that the domain's challenge was satisfied and
+	// fills in its verification time, returning ErrConflict if another tenant
+	// verified the domain first
+	MarkDomainVerified(ctx context.Context, domain *models.TenantDomain) error
+	DeleteDomain(ctx context.Context, tenantID, domainID int) error
+}
+
+// IdentityRepository stores the global identities and their memberships
+type IdentityRepository interface {
+	IdentityByEmail(ctx context.Context, email string) (*models.Identity, error)
+	// IdentityByUser returns the identity a tenant user is linked to
+	IdentityByUser(ctx context.Context, tenantID, userID int) (*models.Identity, error)
+	// MemberUserID returns the ID of the identity's user in a tenant
+	MemberUserID(ctx context.Context, identityID, tenantID int) (int, error)
+	// Memberships lists the tenants of the identity a tenant user is linked to
+	Memberships(ctx context.Context, tenantID, userID int) ([]models.TenantMembership, error)
+	// CreateIdentity creates an identity with the email and passwordHash and
+	// links a tenant user to it, returning ErrConflict if the email already
+	// has an identity. The user must have proven the email is theirs.
+	CreateIdentity(ctx context.Context, tenantID, userID int, email, passwordHash string) error
+	// LinkIdentity links a tenant user to an existing identity. The user must
+	// have known the identity's password.
+	LinkIdentity(ctx context.Context, identityID, tenantID, userID int) error
+	UnlinkIdentity(ctx context.Context, tenantID, userID int) error
+	// UpdateIdentityEmail changes an identity's email, returning ErrConflict if it is taken
+	UpdateIdentityEmail(ctx context.Context, identityID int, email string) error
+	UpdateIdentityPassword(ctx context.Context, identityID int, passwordHash string) error
+	// CreateEmailVerification stores a verification by the digest of its
+	// token, replacing the pending one of the same user
+	CreateEmailVerification(ctx context.Context, v *models.EmailVerification, tokenHash string) error
+	// ConsumeEmailVerification deletes and returns the tenant's unexpired
+	// verification with the token digest, sql.ErrNoRows if there is none
+	ConsumeEmailVerification(ctx context.Context, tenantID int, tokenHash string) (*models.EmailVerification, error)
+	// DeleteEmailVerification deletes the pending verification of a tenant user
+	DeleteEmailVerification(ctx context.Context, tenantID, userID int) error
+}
+
+// PostRepository stores the posts of each tenant
+type PostRepository interface {
+	// CreatePost stores a post and appends the post.created event to the outbox
+	CreatePost(ctx context.Context, tenantID int, post *models.Post) error
+	// ListPosts returns the tenant's posts, newest first
+	ListPosts(ctx context.Context, tenantID int) ([]models.Post, error)
+	PostByID(ctx context.Context, tenantID, postID int) (*models.Post, error)
+	// UpdatePost updates the post's title and content and appends the
+	// post.updated event to the outbox
+	UpdatePost(ctx context.Context, tenantID int, post *models.Post) error
+	// DeletePost deletes a post and appends the post.deleted event to the outbox
+	DeletePost(ctx context.Context, tenantID, postID int) error
+}
+
+// AuditRepository stores the hash-chained audit logs, one per tenant plus the
+// platform log for events without a tenant
+type AuditRepository interface {
+	// AppendAuditEvent seals the event onto the end of the tenant's log, or of
+	// the platform log when tenantID is 0
+	AppendAuditEvent(ctx context.Context, tenantID int, event *models.AuditEvent) error
+	ListAuditEvents(ctx context.Context, tenantID int, filter models.AuditFilter) ([]models.AuditEvent, error)
+}
+
+// PlanRepository stores the plans and the tenants' assignment to them
+type PlanRepository interface {
+	Plans(ctx context.Context) ([]models.Plan, error)
+	PlanByName(ctx context.Context, name string) (*models.Plan, error)
+	// SavePlan creates or replaces a plan
+	SavePlan(ctx context.Context, plan *models.Plan) error
+	// AssignPlan moves a tenant to a plan, returning sql.ErrNoRows if either doesn't exist
+	AssignPlan(ctx context.Context, tenantID int, plan string) error
+}
+
+// UsageRepository meters the usage of each tenant
+type UsageRepository interface {
+	// ResourceUsage measures the resources a tenant currently uses
+	ResourceUsage(ctx context.Context, tenantID int) (*models.ResourceUsage, error)
+	// AddRequests adds n to a tenant's requests on a day, returning the day's total
+	AddRequests(ctx context.Context, tenantID int, day time.Time, n int64) (int64, error)
+	// RecordResources stores the resources a tenant used on a day
+	RecordResources(ctx context.Context, tenantID int, day time.Time, usage *models.ResourceUsage) error
+	// DailyUsage returns a tenant's usage on the days from from to to, oldest first
+	DailyUsage(ctx context.Context, tenantID int, from, to time.Time) ([]models.DailyUsage, error)
+}
+
+// BillingRepository stores the tenants' subscriptions at the billing provider
+// and the payment events received from it
+type BillingRepository interface {
+	TenantBilling(ctx context.Context, tenantID int) (*models.TenantBilling, error)
+	// TenantBillingByCustomer finds the tenant with a customer ID at the provider
+	TenantBillingByCustomer(ctx context.Context, customerID string) (*models.TenantBilling, error)
+	// SaveTenantBilling stores a tenant's customer, subscription and status
+	SaveTenantBilling(ctx context.Context, billing *models.TenantBilling) error
+	// ApplyBillingEvent records a payment event and passes the billing of the
+	// customer's tenant to apply, saving it if apply returns true, atomically.
+	// Events recorded before are skipped without calling apply.
+	ApplyBillingEvent(ctx context.Context, eventID, eventType, customerID string, apply func(b *models.TenantBilling) bool) error
+	// UnbilledUsage lists the days since since on which subscribed tenants made
+	// requests that weren't reported yet
+	UnbilledUsage(ctx context.Context, since time.Time) ([]models.UnbilledUsage, error)
+	// MarkBilled records that a tenant's requests on a day were reported
+	MarkBilled(ctx context.Context, tenantID int, day time.Time, requests int64) error
+}
+
+// WebhookRepository stores the tenants' webhooks and their deliveries
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, tenantID int, webhook *models.Webhook) error
+	// ListWebhooks returns the tenant's webhooks without their secrets
+	ListWebhooks(ctx context.Context, tenantID int) ([]models.Webhook, error)
+	// WebhookByID returns a webhook including its secret
+	WebhookByID(ctx context.Context, tenantID, webhookID int) (*models.Webhook, error)
+	// DeleteWebhook deletes a webhook and its deliveries
+	DeleteWebhook(ctx context.Context, tenantID, webhookID int) error
+	// ListDeliveries returns a page of a webhook's deliveries, newest first
+	ListDeliveries(ctx context.Context, tenantID, webhookID, limit, offset int) ([]models.WebhookDelivery, error)
+	// QueueEvent queues a delivery of the event for each of the tenant's
+	// webhooks subscribed to it, once per webhook however often it is called
+	QueueEvent(ctx context.Context, tenantID int, event models.Event) error
+	// Redeliver queues the event of a delivery again as a new delivery
+	Redeliver(ctx context.Context, tenantID, webhookID int, deliveryID int64) (*models.WebhookDelivery, error)
+	// ClaimDeliveries returns up to limit pending deliveries that are due,
+	// postponing their next attempt by lease so that other replicas skip them
+	ClaimDeliveries(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.WebhookDelivery, error)
+	// RecordAttempt stores the outcome of an attempt to send a delivery
+	RecordAttempt(ctx context.Context, tenantID int, deliveryID int64, attempt models.WebhookAttempt) error
+}
+
+// OutboxRepository reads the tenants' outboxes, to which the repositories
+// making changes append their events
+type OutboxRepository interface {
+	// ClaimEvents returns up to limit unpublished events that are due, oldest
+	// first, postponing their next attempt by lease so that other replicas skip them
+	ClaimEvents(ctx context.Context, tenantID, limit int, lease time.Duration) ([]models.OutboxEvent, error)
+	MarkPublished(ctx context.Context, tenantID int, seq int64) error
+	// RecordPublishFailure stores why an event couldn't be published and
+	// postpones its next attempt by retryIn
+	RecordPublishFailure(ctx context.Context, tenantID int, seq int64, message string, retryIn time.Duration) error
+	// DeletePublishedEvents deletes the events published longer than olderThan ago
+	DeletePublishedEvents(ctx context.Context, tenantID int, olderThan time.Duration) error
+
+	// Listen sends the sequence number of each event committed to the tenant's
+	// outbox from now on. The channel is closed once ctx is done or the
+	// listener falls behind or loses its connection, after which events may
+	// have been missed.
+	Listen(ctx context.Context, tenantID int) (<-chan int64, error)
+	// EventBySeq returns a committed event, published or not
+	EventBySeq(ctx context.Context, tenantID int, seq int64) (*models.OutboxEvent, error)
+	// EventsAfter returns up to limit committed events following seq, in order
+	EventsAfter(ctx context.Context, tenantID int, seq int64, limit int) ([]models.OutboxEvent, error)
+}
+
+// JobRepository stores the background jobs run on tenants, in the management
+// database so that any replica can run them
+type JobRepository interface {
+	// CreateJob stores a pending job and fills in its generated fields
+	CreateJob(ctx context.Context, job *models.Job) error
+	JobByID(ctx context.Context, jobID int64) (*models.Job, error)
+	// ClaimJob marks the oldest due job running and returns it, postponing
+	// its next attempt by lease so that other replicas skip it. Running jobs
+	// are due again once their lease runs out. It returns sql.ErrNoRows if no
+	// job is due.
+	ClaimJob(ctx context.Context, lease time.Duration) (*models.Job, error)
+	// ExtendJob postpones the next attempt of a running job by lease
+	ExtendJob(ctx context.Context, jobID int64, lease time.Duration) error
+	// SetJobTenant records the tenant a job created
+	SetJobTenant(ctx context.Context, jobID int64, tenantID int) error
+	// FinishJob records that a job completed or failed with the message
+	FinishJob(ctx context.Context, jobID int64, status, message string) error
+	// DeleteFinishedJobs deletes the jobs finished longer than olderThan ago
+	// and returns them
+	DeleteFinishedJobs(ctx context.Context, olderThan time.Duration) ([]models.Job, error)
+}
+
+// TenantDataRepository reads and writes the data of whole tenants, for
+// exports and imports
+type TenantDataRepository interface {
+	// TenantSchemaVersion is the version of the tenant schema the data is
+	// read and written in
+	TenantSchemaVersion() int
+	// ExportTenantData reads the tenant's users, posts, invitations and
+	// webhooks as of a single point in time
+	ExportTenantData(ctx context.Context, tenantID int) (*models.TenantData, error)
+	// ImportTenantData stores data into a tenant without users in one
+	// transaction, giving the records new IDs and remapping the references
+	// to them. No events are appended to the outbox. It returns ErrConflict
+	// if the tenant already has users.
+	ImportTenantData(ctx context.Context, tenantID int, data *models.TenantData) error
+}
+
+// SnapshotRepository takes and restores snapshots of tenant databases and
+// keeps the records of the snapshots taken
+type SnapshotRepository interface {
+	// DumpTenant writes a snapshot of the tenant database taken with method
+	// to w and returns the tenant schema version it was taken at
+	DumpTenant(ctx context.Context, tenantID int, method string, w io.Writer) (int, error)
+	// RestoreTenant replaces the tenant database with a snapshot read from
+	// r, taken with method at schemaVersion, and migrates it to the latest
+	// version. The tenant's users are unlinked from their identities, they
+	// are linked again when they log in.
+	RestoreTenant(ctx context.Context, tenantID int, method string, schemaVersion int, r io.Reader) error
+
+	// CreateSnapshot records a snapshot, returning ErrConflict if its job
+	// already recorded one
+	CreateSnapshot(ctx context.Context, snapshot *models.Snapshot) error
+	// Snapshots lists the tenant's snapshots, newest first
+	Snapshots(ctx context.Context, tenantID int) ([]models.Snapshot, error)
+	SnapshotByID(ctx context.Context, snapshotID int64) (*models.Snapshot, error)
+	DeleteSnapshot(ctx context.Context, snapshotID int64) error
+}
+
+// Repositories bundles the storage the API server depends on
+type Repositories struct {
+	Tenants     TenantStore
+	Users       UserRepository
+	Invitations InvitationRepository
+	Domains     DomainRepository
+	Posts       PostRepository
+	Identities  IdentityRepository
+	Audit       AuditRepository
+	Plans       PlanRepository
+	Usage       UsageRepository
+	Billing     BillingRepository
+	Webhooks    WebhookRepository
+	Outbox      OutboxRepository
+	Jobs        JobRepository
+	TenantData  TenantDataRepository
+	Snapshots   SnapshotRepository
+}
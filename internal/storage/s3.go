@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// S3 stores blobs as objects of a bucket of an S3 compatible service,
+// authenticating requests with AWS Signature Version 4
+type S3 struct {
+	endpoint        string
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	client          *http.Client
+}
+
+// NewS3 creates a storage in the configured bucket
+func NewS3(cfg config.StorageConfig) *S3 {
+	return &S3{
+		endpoint:        strings.TrimRight(cfg.S3Endpoint, "/"),
+		region:          cfg.S3Region,
+		bucket:          cfg.S3Bucket,
+		accessKeyID:     cfg.S3AccessKeyID,
+		secretAccessKey: cfg.S3SecretAccessKey,
+		client:          &http.Client{Timeout: 30 * time.Minute},
+	}
+}
+
+// Put uploads r. It is spooled to a temporary file first, as the request
+// needs the length and hash of the body.
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) error {
+	f, err := os.CreateTemp("", "s3-upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(ctx, http.MethodPut, key, io.NopCloser(f), hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s.errorFor(resp, key)
+	}
+	return nil
+}
+
+// Get downloads the object of a key
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, emptyHash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s.errorFor(resp, key)
+	}
+	return resp.Body, nil
+}
+
+// Delete deletes the object of a key
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return s.errorFor(resp, key)
+}
+
+// errorFor describes an unsuccessful response, wrapping fs.ErrNotExist for
+// missing objects
+func (s *S3) errorFor(resp *http.Response, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("object %s: %w", key, fs.ErrNotExist)
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s %s: status %d: %s", resp.Request.Method, key, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// emptyHash is the SHA-256 of an empty body
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// newRequest creates a signed path-style request for the object of a key
+func (s *S3) newRequest(ctx context.Context, method, key string, body io.ReadCloser, payloadHash string) (*http.Request, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return nil, fmt.Errorf("invalid storage key %q", key)
+	}
+	u, err := url.Parse(s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = escapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to req
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// escapePath escapes each segment of a path as S3 expects: everything but
+// unreserved characters is percent-encoded
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+				b.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, "/")
+}
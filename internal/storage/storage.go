@@ -0,0 +1,99 @@
+// Package storage keeps archives, such as tenant exports and snapshots,
+// outside the databases.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang-multi-tenant/internal/config"
+)
+
+// Storage stores blobs by key. Keys are slash-separated relative paths.
+type Storage interface {
+	// Put stores the contents of r under key, replacing any blob stored there
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get opens the blob stored under key. The error wraps fs.ErrNotExist if
+	// there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete deletes the blob stored under key; a missing blob isn't an error
+	Delete(ctx context.Context, key string) error
+}
+
+// Local stores blobs as files in a directory
+type Local struct {
+	dir string
+}
+
+// NewLocal creates a storage in dir, which is created when first written to
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// path returns the file of a key, refusing keys that would leave the directory
+func (l *Local) path(key string) (string, error) {
+	if !fs.ValidPath(key) || key == "." {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(l.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r to a temporary file that is renamed to the key's file once
+// complete, so that readers never see a partial blob
+func (l *Local) Put(ctx context.Context, key string, r io.Reader) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Get opens the file of a key
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Delete removes the file of a key
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// New creates the configured storage backend
+func New(cfg config.StorageConfig) Storage {
+	if cfg.Backend == "s3" {
+		return NewS3(cfg)
+	}
+	return NewLocal(cfg.Dir)
+}
@@ -0,0 +1,303 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang-multi-tenant/internal/models"
+)
+
+const (
+	// FormatVersion is the version of the archive layout; archives of other
+	// versions can't be read
+	FormatVersion = 1
+	// MinSchemaVersion is the oldest tenant schema whose archives can be
+	// imported, the schema exports were introduced with
+	MinSchemaVersion = 7
+	// manifestFile is the first file of an archive
+	manifestFile = "manifest.json"
+)
+
+// ErrInvalidArchive is wrapped by the errors of archives that can't be imported
+var ErrInvalidArchive = errors.New("invalid archive")
+
+// Manifest describes an archive
+type Manifest struct {
+	FormatVersion int `json:"format_version"`
+	// SchemaVersion is the tenant schema version the data was exported from
+	SchemaVersion int                   `json:"schema_version"`
+	ExportedAt    time.Time             `json:"exported_at"`
+	Tenant        ManifestTenant        `json:"tenant"`
+	Settings      models.TenantSettings `json:"settings"`
+	Tables        []Table               `json:"tables"`
+}
+
+// ManifestTenant is the exported tenant. Imports name their tenant themselves
+// and start on the default plan.
+type ManifestTenant struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+	Plan string `json:"plan"`
+}
+
+// Table is a JSON Lines file of an archive with a record per line
+type Table struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Rows int    `json:"rows"`
+}
+
+// table reads and writes a table of the tenant data
+type table struct {
+	name   string
+	encode func(w io.Writer, data *models.TenantData) (int, error)
+	decode func(r io.Reader, data *models.TenantData) (int, error)
+}
+
+// tables are written in this order, after the manifest. Rows refer to rows
+// of earlier tables only.
+var tables = []table{
+	{
+		name:   "users",
+		encode: func(w io.Writer, data *models.TenantData) (int, error) { return encodeRows(w, data.Users) },
+		decode: func(r io.Reader, data *models.TenantData) (int, error) { return decodeRows(r, &data.Users) },
+	},
+	{
+		name:   "posts",
+		encode: func(w io.Writer, data *models.TenantData) (int, error) { return encodeRows(w, data.Posts) },
+		decode: func(r io.Reader, data *models.TenantData) (int, error) { return decodeRows(r, &data.Posts) },
+	},
+	{
+		name:   "invitations",
+		encode: func(w io.Writer, data *models.TenantData) (int, error) { return encodeRows(w, data.Invitations) },
+		decode: func(r io.Reader, data *models.TenantData) (int, error) { return decodeRows(r, &data.Invitations) },
+	},
+	{
+		name:   "webhooks",
+		encode: func(w io.Writer, data *models.TenantData) (int, error) { return encodeRows(w, data.Webhooks) },
+		decode: func(r io.Reader, data *models.TenantData) (int, error) { return decodeRows(r, &data.Webhooks) },
+	},
+}
+
+func encodeRows[T any](w io.Writer, rows []T) (int, error) {
+	enc := json.NewEncoder(w)
+	for _, row := range rows {
+		if err := enc.Encode(row); err != nil {
+			return 0, err
+		}
+	}
+	return len(rows), nil
+}
+
+func decodeRows[T any](r io.Reader, rows *[]T) (int, error) {
+	dec := json.NewDecoder(r)
+	n := 0
+	for {
+		var row T
+		if err := dec.Decode(&row); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		*rows = append(*rows, row)
+		n++
+	}
+}
+
+// Write writes data as a gzipped tar archive to w, with the manifest first
+// and then a file per table. The tables of the manifest are filled in.
+func Write(w io.Writer, manifest *Manifest, data *models.TenantData) error {
+	files := make([][]byte, len(tables))
+	manifest.FormatVersion = FormatVersion
+	manifest.Tables = make([]Table, len(tables))
+	for i, t := range tables {
+		var buf bytes.Buffer
+		rows, err := t.encode(&buf, data)
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %v", t.name, err)
+		}
+		files[i] = buf.Bytes()
+		manifest.Tables[i] = Table{Name: t.name, File: t.name + ".jsonl", Rows: rows}
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := writeFile(tw, manifestFile, manifestData, manifest.ExportedAt); err != nil {
+		return err
+	}
+	for i, t := range manifest.Tables {
+		if err := writeFile(tw, t.File, files[i], manifest.ExportedAt); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func writeFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0o644,
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// ReadManifest reads the manifest of an archive and checks that a server at
+// schemaVersion can import it
+func ReadManifest(r io.Reader, schemaVersion int) (*Manifest, error) {
+	manifest, _, err := readManifest(r, schemaVersion)
+	return manifest, err
+}
+
+// readManifest reads and checks the manifest, returning the tar reader
+// positioned after it
+func readManifest(r io.Reader, schemaVersion int) (*Manifest, *tar.Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: not a gzip file: %v", ErrInvalidArchive, err)
+	}
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: not a tar file: %v", ErrInvalidArchive, err)
+	}
+	if header.Name != manifestFile {
+		return nil, nil, fmt.Errorf("%w: the first file is %s, not %s", ErrInvalidArchive, header.Name, manifestFile)
+	}
+	var manifest Manifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: decoding %s: %v", ErrInvalidArchive, manifestFile, err)
+	}
+
+	switch {
+	case manifest.FormatVersion != FormatVersion:
+		return nil, nil, fmt.Errorf("%w: format version %d isn't supported, only %d is", ErrInvalidArchive, manifest.FormatVersion, FormatVersion)
+	case manifest.SchemaVersion > schemaVersion:
+		return nil, nil, fmt.Errorf("%w: exported at schema version %d, newer than this server's %d; upgrade the server first",
+			ErrInvalidArchive, manifest.SchemaVersion, schemaVersion)
+	case manifest.SchemaVersion < MinSchemaVersion:
+		return nil, nil, fmt.Errorf("%w: exported at schema version %d, older than the oldest supported %d",
+			ErrInvalidArchive, manifest.SchemaVersion, MinSchemaVersion)
+	}
+	return &manifest, tr, nil
+}
+
+// Read reads an archive and checks that a server at schemaVersion can import
+// it and that its records are consistent
+func Read(r io.Reader, schemaVersion int) (*Manifest, *models.TenantData, error) {
+	manifest, tr, err := readManifest(r, schemaVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	files := make(map[string]Table, len(manifest.Tables))
+	for _, t := range manifest.Tables {
+		files[t.File] = t
+	}
+	read := make(map[string]bool, len(tables))
+	data := &models.TenantData{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%w: reading tar file: %v", ErrInvalidArchive, err)
+		}
+
+		entry, ok := files[header.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: %s isn't listed in the manifest", ErrInvalidArchive, header.Name)
+		}
+		t, ok := tableByName(entry.Name)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: unknown table %s", ErrInvalidArchive, entry.Name)
+		}
+		if read[t.name] {
+			return nil, nil, fmt.Errorf("%w: %s appears twice", ErrInvalidArchive, header.Name)
+		}
+		read[t.name] = true
+
+		rows, err := t.decode(tr, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: decoding %s: %v", ErrInvalidArchive, header.Name, err)
+		}
+		if rows != entry.Rows {
+			return nil, nil, fmt.Errorf("%w: %s has %d rows, the manifest lists %d", ErrInvalidArchive, header.Name, rows, entry.Rows)
+		}
+	}
+	for _, t := range manifest.Tables {
+		if !read[t.Name] {
+			return nil, nil, fmt.Errorf("%w: %s is missing", ErrInvalidArchive, t.File)
+		}
+	}
+
+	if err := check(manifest, data); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return manifest, data, nil
+}
+
+func tableByName(name string) (table, bool) {
+	for _, t := range tables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return table{}, false
+}
+
+// check validates the settings and records that the tenant database would
+// otherwise reject or misinterpret
+func check(manifest *Manifest, data *models.TenantData) error {
+	switch manifest.Settings.RegistrationMode {
+	case models.RegistrationOpen, models.RegistrationInviteOnly, models.RegistrationDomainRestricted:
+	default:
+		return fmt.Errorf("unknown registration mode %q", manifest.Settings.RegistrationMode)
+	}
+	if manifest.Settings.AllowedEmailDomains == nil {
+		manifest.Settings.AllowedEmailDomains = []string{}
+	}
+
+	userIDs := make(map[int]bool, len(data.Users))
+	emails := make(map[string]bool, len(data.Users))
+	for _, u := range data.Users {
+		switch {
+		case userIDs[u.ID]:
+			return fmt.Errorf("user ID %d appears twice", u.ID)
+		case u.Email == "" || emails[u.Email]:
+			return fmt.Errorf("user %d has an empty or duplicate email", u.ID)
+		case u.Role != models.RoleAdmin && u.Role != models.RoleMember:
+			return fmt.Errorf("user %d has unknown role %q", u.ID, u.Role)
+		}
+		userIDs[u.ID] = true
+		emails[u.Email] = true
+	}
+	for _, p := range data.Posts {
+		if !userIDs[p.UserID] {
+			return fmt.Errorf("post %d belongs to unknown user %d", p.ID, p.UserID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Package transfer exports the data of tenants to archives and imports
+// archives into new tenants, to hand tenants a copy of their data and to move
+// them between environments. Exports and imports run as background jobs.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"golang-multi-tenant/internal/billing"
+	"golang-multi-tenant/internal/jobs"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+	"golang-multi-tenant/internal/storage"
+)
+
+// Service runs the export and import jobs
+type Service struct {
+	tenants  repository.TenantStore
+	data     repository.TenantDataRepository
+	jobs     repository.JobRepository
+	archives storage.Storage
+	billing  *billing.Service
+}
+
+// NewService creates a service keeping the archives in archives
+func NewService(repos repository.Repositories, archives storage.Storage, billingService *billing.Service) *Service {
+	return &Service{
+		tenants:  repos.Tenants,
+		data:     repos.TenantData,
+		jobs:     repos.Jobs,
+		archives: archives,
+		billing:  billingService,
+	}
+}
+
+// Register sets the service as the handler of the export and import jobs
+func (s *Service) Register(runner *jobs.Runner) {
+	runner.Handle(models.JobExport, s.Export)
+	runner.Handle(models.JobImport, s.Import)
+}
+
+// ArchiveKey returns a new storage key for an archive of the given kind,
+// exports or imports
+func ArchiveKey(kind string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s.tar.gz", kind, hex.EncodeToString(b)), nil
+}
+
+// CheckArchive reads the manifest of an archive and checks that it can be
+// imported, so that uploads of incompatible archives are refused right away
+func (s *Service) CheckArchive(r io.Reader) (*Manifest, error) {
+	return ReadManifest(r, s.data.TenantSchemaVersion())
+}
+
+// Export writes the archive of the job's tenant under the job's archive key
+func (s *Service) Export(ctx context.Context, job *models.Job) error {
+	tenant, err := s.tenants.TenantByID(ctx, job.TenantID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return jobs.Fail("Tenant not found")
+	} else if err != nil {
+		return err
+	}
+	settings, err := s.tenants.TenantSettings(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+	data, err := s.data.ExportTenantData(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+
+	manifest := &Manifest{
+		SchemaVersion: s.data.TenantSchemaVersion(),
+		ExportedAt:    time.Now().UTC(),
+		Tenant:        ManifestTenant{ID: tenant.ID, Name: tenant.Name, Slug: tenant.Slug, Plan: tenant.Plan},
+		Settings:      *settings,
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, manifest, data); err != nil {
+		return err
+	}
+	return s.archives.Put(ctx, job.Archive, &buf)
+}
+
+// Import provisions the tenant named by the job's parameters and imports the
+// job's archive into it. A job started again after its replica stopped
+// continues with the tenant it created.
+func (s *Service) Import(ctx context.Context, job *models.Job) error {
+	var req models.ImportTenantRequest
+	if err := json.Unmarshal(job.Params, &req); err != nil {
+		return fmt.Errorf("error decoding import parameters: %v", err)
+	}
+
+	r, err := s.archives.Get(ctx, job.Archive)
+	if errors.Is(err, fs.ErrNotExist) {
+		return jobs.Fail("Archive not found")
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	manifest, data, err := Read(r, s.data.TenantSchemaVersion())
+	if errors.Is(err, ErrInvalidArchive) {
+		return jobs.Fail("%v", err)
+	} else if err != nil {
+		return err
+	}
+
+	resumed := job.TenantID != 0
+	if !resumed {
+		tenant, err := s.tenants.CreateTenant(ctx, req.Name, req.Slug)
+		if errors.Is(err, repository.ErrConflict) {
+			return jobs.Fail("Tenant with this name or slug already exists")
+		} else if err != nil {
+			return err
+		}
+		if err := s.jobs.SetJobTenant(ctx, job.ID, tenant.ID); err != nil {
+			return err
+		}
+		job.TenantID = tenant.ID
+
+		// A failed subscription is retried by assigning the plan again
+		if err := s.billing.SyncPlan(ctx, tenant, tenant.Plan); err != nil {
+			logging.FromContext(ctx).Error("Error subscribing tenant", "tenant_id", tenant.ID, "error", err)
+		}
+	}
+
+	if err := s.tenants.UpdateTenantSettings(ctx, job.TenantID, &manifest.Settings); err != nil {
+		return err
+	}
+	err = s.data.ImportTenantData(ctx, job.TenantID, data)
+	if errors.Is(err, repository.ErrConflict) && resumed {
+		// The data was committed by the attempt that was interrupted
+		return nil
+	}
+	return err
+}
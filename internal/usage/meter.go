@@ -0,0 +1,208 @@
+// Package usage meters the requests of each tenant and enforces the daily
+// request quotas of their plans
+package usage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/repository"
+)
+
+// planCacheTTL is how long plans are cached, other replicas see plan changes
+// after at most this long
+const planCacheTTL = time.Minute
+
+// meteredKey marks requests already counted against their tenant's usage
+const meteredKey = "usage_metered"
+
+// dayKey identifies a tenant's usage on a day (UTC)
+type dayKey struct {
+	tenantID int
+	day      string
+}
+
+// Meter counts requests in memory and periodically adds them to the daily
+// usage in the management database, recording the tenants' resources with them
+type Meter struct {
+	usage repository.UsageRepository
+	plans repository.PlanRepository
+	now   func() time.Time
+
+	mu sync.Mutex
+	// pending are the requests counted since the last flush
+	pending map[dayKey]int64
+	// recorded are the day's totals of every replica as of the last flush
+	recorded    map[dayKey]int64
+	planCache   map[string]models.Plan
+	plansLoaded time.Time
+}
+
+// NewMeter creates a meter
+func NewMeter(usage repository.UsageRepository, plans repository.PlanRepository) *Meter {
+	return &Meter{
+		usage:    usage,
+		plans:    plans,
+		now:      time.Now,
+		pending:  make(map[dayKey]int64),
+		recorded: make(map[dayKey]int64),
+	}
+}
+
+func (m *Meter) today(tenantID int) dayKey {
+	return dayKey{tenantID: tenantID, day: m.now().UTC().Format(time.DateOnly)}
+}
+
+// Middleware counts the requests of each tenant, rejecting them once their
+// plan's daily request quota is used up. Requests that only identify their
+// tenant by token pass through until it runs again after the authentication
+// middleware; each request is counted once.
+func (m *Meter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenant, ok := middleware.RequestTenant(c)
+		if !ok || c.GetBool(meteredKey) {
+			c.Next()
+			return
+		}
+		c.Set(meteredKey, true)
+
+		plan := m.plan(c.Request.Context(), tenant.Plan)
+		key := m.today(tenant.ID)
+
+		m.mu.Lock()
+		if plan != nil {
+			if err := plan.Allow(models.QuotaRequestsPerDay, m.recorded[key]+m.pending[key]); err != nil {
+				m.mu.Unlock()
+				var quotaErr *models.QuotaError
+				errors.As(err, &quotaErr)
+				c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "quota": quotaErr.Quota, "limit": quotaErr.Limit})
+				return
+			}
+		}
+		m.pending[key]++
+		m.mu.Unlock()
+
+		c.Next()
+	}
+}
+
+// plan returns the named plan from the cache, reloading the plans when they
+// are stale. It returns nil if the plan can't be found.
+func (m *Meter) plan(ctx context.Context, name string) *models.Plan {
+	m.mu.Lock()
+	plan, ok := m.planCache[name]
+	fresh := m.now().Sub(m.plansLoaded) < planCacheTTL
+	m.mu.Unlock()
+	if ok && fresh {
+		return &plan
+	}
+
+	plans, err := m.plans.Plans(ctx)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error loading plans", "error", err)
+		return nil
+	}
+
+	cache := make(map[string]models.Plan, len(plans))
+	for _, p := range plans {
+		cache[p.Name] = p
+	}
+	m.mu.Lock()
+	m.planCache = cache
+	m.plansLoaded = m.now()
+	m.mu.Unlock()
+
+	if plan, ok := cache[name]; ok {
+		return &plan
+	}
+	return nil
+}
+
+// InvalidatePlans makes the next request reload the plans
+func (m *Meter) InvalidatePlans() {
+	m.mu.Lock()
+	m.plansLoaded = time.Time{}
+	m.mu.Unlock()
+}
+
+// RequestsToday returns the tenant's requests today as far as this replica knows
+func (m *Meter) RequestsToday(tenantID int) int64 {
+	key := m.today(tenantID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recorded[key] + m.pending[key]
+}
+
+// Flush adds the pending request counts to the daily usage and records the
+// current resources of the tenants that made them
+func (m *Meter) Flush(ctx context.Context) {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = make(map[dayKey]int64)
+	m.mu.Unlock()
+
+	log := logging.FromContext(ctx)
+	for key, n := range pending {
+		day, _ := time.Parse(time.DateOnly, key.day)
+		total, err := m.usage.AddRequests(ctx, key.tenantID, day, n)
+
+		m.mu.Lock()
+		if err != nil {
+			// Counted again with the next flush
+			m.pending[key] += n
+		} else {
+			m.recorded[key] = total
+		}
+		m.mu.Unlock()
+		if err != nil {
+			log.Error("Error metering requests", "tenant_id", key.tenantID, "error", err)
+			continue
+		}
+
+		resources, err := m.usage.ResourceUsage(ctx, key.tenantID)
+		if err == nil {
+			err = m.usage.RecordResources(ctx, key.tenantID, day, resources)
+		}
+		if err != nil {
+			log.Error("Error metering resources", "tenant_id", key.tenantID, "error", err)
+		}
+	}
+
+	// Yesterday's totals no longer count towards any quota
+	today := m.now().UTC().Format(time.DateOnly)
+	m.mu.Lock()
+	for key := range m.recorded {
+		if key.day != today {
+			delete(m.recorded, key)
+		}
+	}
+	m.mu.Unlock()
+}
+
+// Run flushes the meter every interval until ctx is cancelled, then one last time
+func (m *Meter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.Flush(ctx)
+		case <-ctx.Done():
+			// ctx is done, the last flush gets a little time of its own
+			flushCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			m.Flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
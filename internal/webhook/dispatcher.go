@@ -0,0 +1,227 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang-multi-tenant/internal/config"
+	"golang-multi-tenant/internal/events"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/netguard"
+	"golang-multi-tenant/internal/repository"
+)
+
+const (
+	// batchSize is the number of deliveries of a tenant claimed and sent at once
+	batchSize = 20
+	// leaseMargin is added to the request timeout to lease claimed deliveries;
+	// a replica that dies mid-batch leaves them to be retried after the lease
+	leaseMargin = 30 * time.Second
+	// maxRetryDelay caps the exponential backoff between attempts
+	maxRetryDelay = time.Hour
+	// maxErrorLength bounds the error recorded in the delivery log
+	maxErrorLength = 1000
+)
+
+// CheckURL checks that a webhook URL is an absolute HTTP(S) URL
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook URL must use http or https")
+	}
+	if u.Hostname() == "" {
+		return errors.New("webhook URL must have a host")
+	}
+	return nil
+}
+
+// Dispatcher sends the deliveries queued in the tenant databases, retrying
+// failed ones with exponential backoff
+type Dispatcher struct {
+	tenants     repository.TenantStore
+	repo        repository.WebhookRepository
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	retryBase   time.Duration
+	now         func() time.Time
+}
+
+// NewDispatcher creates a dispatcher
+func NewDispatcher(cfg config.WebhooksConfig, tenants repository.TenantStore, repo repository.WebhookRepository) *Dispatcher {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+	if !cfg.AllowPrivateTargets {
+		dialer.Control = netguard.Control
+	}
+
+	return &Dispatcher{
+		tenants: tenants,
+		repo:    repo,
+		client: &http.Client{
+			Timeout:       timeout,
+			Transport:     &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: timeout},
+			CheckRedirect: netguard.NoRedirects,
+		},
+		timeout:     timeout,
+		maxAttempts: cfg.MaxAttempts,
+		retryBase:   time.Duration(cfg.RetryBaseSeconds) * time.Second,
+		now:         time.Now,
+	}
+}
+
+// Subscribe queues deliveries of the events webhooks can subscribe to as the
+// bus publishes them
+func (d *Dispatcher) Subscribe(bus *events.Bus) {
+	bus.Subscribe("webhooks", d.queue, models.EventPostCreated, models.EventPostUpdated, models.EventPostDeleted, models.EventUserRegistered)
+}
+
+// queue queues a delivery of an event for the tenant's webhooks subscribed to
+// it. Queueing is idempotent, an event published again isn't delivered twice.
+func (d *Dispatcher) queue(ctx context.Context, event models.Event) error {
+	return d.repo.QueueEvent(ctx, event.TenantID, event)
+}
+
+// Dispatch sends the due deliveries of every tenant
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	tenantIDs, err := d.tenants.TenantIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, tenantID := range tenantIDs {
+		if err := d.dispatchTenant(ctx, tenantID); err != nil {
+			logging.FromContext(ctx).Error("Error dispatching webhooks", "tenant_id", tenantID, "error", err)
+		}
+	}
+	return nil
+}
+
+// dispatchTenant sends a tenant's due deliveries, a batch at a time
+func (d *Dispatcher) dispatchTenant(ctx context.Context, tenantID int) error {
+	for ctx.Err() == nil {
+		deliveries, err := d.repo.ClaimDeliveries(ctx, tenantID, batchSize, d.timeout+leaseMargin)
+		if err != nil {
+			return err
+		}
+
+		webhooks := make(map[int]*models.Webhook)
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			w, ok := webhooks[delivery.WebhookID]
+			if !ok {
+				w, err = d.repo.WebhookByID(ctx, tenantID, delivery.WebhookID)
+				if errors.Is(err, sql.ErrNoRows) {
+					// Deleted meanwhile, along with its deliveries
+					continue
+				} else if err != nil {
+					return err
+				}
+				webhooks[delivery.WebhookID] = w
+			}
+
+			wg.Add(1)
+			go func(delivery models.WebhookDelivery) {
+				defer wg.Done()
+				attempt := d.attempt(ctx, w, &delivery)
+				if err := d.repo.RecordAttempt(ctx, tenantID, delivery.ID, attempt); err != nil {
+					logging.FromContext(ctx).Error("Error recording webhook delivery attempt",
+						"tenant_id", tenantID, "delivery_id", delivery.ID, "error", err)
+				}
+			}(delivery)
+		}
+		wg.Wait()
+
+		if len(deliveries) < batchSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// attempt sends a delivery and decides what becomes of it
+func (d *Dispatcher) attempt(ctx context.Context, w *models.Webhook, delivery *models.WebhookDelivery) models.WebhookAttempt {
+	statusCode, err := d.send(ctx, w, delivery)
+	if err == nil {
+		return models.WebhookAttempt{StatusCode: statusCode, Status: models.DeliveryDelivered}
+	}
+
+	message := err.Error()
+	if len(message) > maxErrorLength {
+		message = message[:maxErrorLength]
+	}
+	attempt := models.WebhookAttempt{StatusCode: statusCode, Error: message, Status: models.DeliveryFailed}
+	if attempts := delivery.Attempts + 1; attempts < d.maxAttempts {
+		attempt.Status = models.DeliveryPending
+		attempt.RetryIn = d.backoff(attempts)
+	}
+	return attempt
+}
+
+// backoff returns the delay after the given number of failed attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.retryBase
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// send posts a delivery's payload to the webhook, signed with its secret. It
+// returns the response status and an error unless the status is 2xx.
+func (d *Dispatcher) send(ctx context.Context, w *models.Webhook, delivery *models.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	t := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "golang-multi-tenant-webhooks")
+	req.Header.Set(EventIDHeader, delivery.EventID)
+	req.Header.Set(EventTypeHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set(SignatureHeader, fmt.Sprintf("t=%d,v1=%s", t, Sign(w.Secret, t, delivery.Payload)))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Run dispatches the due deliveries every interval until ctx is cancelled
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.Dispatch(ctx); err != nil {
+				logging.FromContext(ctx).Error("Error listing tenants to dispatch webhooks", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
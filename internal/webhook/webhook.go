@@ -0,0 +1,38 @@
+// Package webhook delivers the tenants' events to their webhooks, signed and
+// with retries
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Headers sent with every delivery
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventIDHeader   = "X-Webhook-ID"
+	EventTypeHeader = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// NewSecret generates a webhook signing secret
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the v1 signature of a payload sent at unix time t: the hex
+// HMAC-SHA256 of "<t>.<payload>" keyed with the webhook's secret. Deliveries
+// carry it in the X-Webhook-Signature header as t=<t>,v1=<signature>.
+func Sign(secret string, t int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", t)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,51 @@
+// Package worker runs the application's background workers and stops them on
+// shutdown.
+package worker
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Group runs background workers sharing a context that is cancelled by Stop
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewGroup creates an empty worker group
+func NewGroup() *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{ctx: ctx, cancel: cancel}
+}
+
+// Go starts fn in a goroutine. fn must return once ctx is cancelled.
+func (g *Group) Go(name string, fn func(ctx context.Context)) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		slog.Info("Worker started", "worker", name)
+		fn(g.ctx)
+		slog.Info("Worker stopped", "worker", name)
+	}()
+}
+
+// Stop cancels the workers and waits for them to return, or for ctx to be done
+func (g *Group) Stop(ctx context.Context) error {
+	g.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
-
-	"github.com/gin-contrib/cors"
-	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
-	swaggerFiles "github.com/swaggo/files"
-	ginSwagger "github.com/swaggo/gin-swagger"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "golang-multi-tenant/docs" // This will be generated
 	"golang-multi-tenant/internal/api"
+	"golang-multi-tenant/internal/config"
 	"golang-multi-tenant/internal/database"
-	"golang-multi-tenant/internal/middleware"
+	"golang-multi-tenant/internal/logging"
+	"golang-multi-tenant/internal/models"
+	"golang-multi-tenant/internal/tracing"
+	"golang-multi-tenant/internal/worker"
 )
 
 // @title           Multi-Tenant API
@@ -24,61 +30,112 @@ import (
 // @in header
 // @name Authorization
 // @description Enter your JWT token directly without Bearer prefix
+// @securityDefinitions.apikey AdminKey
+// @in header
+// @name X-Admin-Key
+// @description Platform admin API key
 // @Security BearerAuth[]
 func main() {
-	// Load environment variables
-	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: .env file not found")
+	// Load configuration from the config file, .env and environment variables
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal("Error loading configuration: ", err)
+	}
+
+	// Log as structured JSON or text from here on
+	if err := logging.Setup(cfg.Logging); err != nil {
+		log.Fatal("Error configuring logging: ", err)
+	}
+
+	// Configure password hashing and policy
+	models.InitPasswordHasher(cfg.Password)
+	models.InitPasswordPolicy(cfg.Password)
+	models.RegisterValidators()
+
+	// Configure tracing before anything opens database connections
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Error configuring tracing", err)
 	}
 
 	// Initialize database
-	database.InitDB()
-	defer func() {
-		if err := database.MainDB.Close(); err != nil {
-			log.Printf("Error closing main database connection: %v", err)
-		}
-		// Close all tenant database connections
-		for dbName, db := range database.TenantDBs {
-			if err := db.Close(); err != nil {
-				log.Printf("Error closing tenant database connection %s: %v", dbName, err)
-			}
-		}
-	}()
+	registry, err := database.Open(cfg.Database)
+	if err != nil {
+		fatal("Error initializing database", err)
+	}
 
-	// Initialize Gin router
-	r := gin.Default()
-
-	// Configure CORS
-	config := cors.DefaultConfig()
-	config.AllowOrigins = []string{"*"} // Allow all origins not recommended for production
-	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	config.AllowCredentials = true
-	r.Use(cors.New(config))
-
-	// Swagger endpoint
-	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-
-	// Public routes
-	r.POST("/register", api.Register)
-	r.POST("/login", api.Login)
-	r.POST("/tenants", api.CreateTenant)
-
-	// Protected routes
-	protected := r.Group("/")
-	protected.Use(middleware.AuthMiddleware())
-	{
-		protected.GET("/me", api.Me)
-		
-		// Post routes
-		protected.POST("/posts", api.CreatePost)
-		protected.GET("/posts", api.GetPosts)
-		protected.GET("/posts/:id", api.GetPost)
+	server := api.NewServer(cfg, registry.Repositories())
+	workers := worker.NewGroup()
+	server.StartWorkers(workers)
+
+	httpServer := &http.Server{
+		Addr:              cfg.Server.Addr,
+		Handler:           server.Router(),
+		ReadTimeout:       seconds(cfg.Server.ReadTimeoutSeconds),
+		ReadHeaderTimeout: seconds(cfg.Server.ReadTimeoutSeconds),
+		WriteTimeout:      seconds(cfg.Server.WriteTimeoutSeconds),
+		IdleTimeout:       seconds(cfg.Server.IdleTimeoutSeconds),
 	}
+	// Streaming requests would otherwise hold up the shutdown until it times out
+	httpServer.RegisterOnShutdown(server.CloseStreams)
 
 	// Start server
-	log.Println("Server starting on 0.0.0.0:8080")
-	if err := r.Run("0.0.0.0:8080"); err != nil {
-		log.Fatal("Error starting server:", err)
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Server starting", "addr", cfg.Server.Addr)
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	// Wait for a shutdown signal or the server failing
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	failed := false
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down")
+	case err := <-serveErr:
+		slog.Error("Error starting server", "error", err)
+		failed = true
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), seconds(cfg.Server.ShutdownTimeoutSeconds))
+	defer cancel()
+
+	// Stop accepting connections and drain in-flight requests
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error draining requests, closing remaining connections", "error", err)
+		httpServer.Close()
 	}
-} 
\ No newline at end of file
+
+	if err := workers.Stop(shutdownCtx); err != nil {
+		slog.Error("Error stopping background workers", "error", err)
+	}
+
+	// Close the management database and every tenant pool
+	if err := registry.Close(); err != nil {
+		slog.Error("Error closing database connections", "error", err)
+	}
+	// Flush the remaining spans
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
+	slog.Info("Server stopped")
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}